@@ -27,10 +27,19 @@
 // 2. WithStack produces an error with exactly one stack trace.  If the
 // wrapped error already contains a stack trace, this function returns it
 // unmodified.
+//
+// 3. WrapSensitive produces an error whose text omits the wrapped error, and
+// whose Cause() does not reveal it.  Use it when the underlying error may
+// contain secret data, such as key material.
+//
+// 4. Every wrapping error implements `Unwrap() error`, so the standard
+// library's errors.Is and errors.As (also exported here as Is and As) can
+// traverse the chain.
 
 package errors
 
 import (
+	stderrors "errors"
 	"fmt"
 
 	pkgerrors "github.com/pkg/errors"
@@ -40,11 +49,80 @@ type stackTracer interface {
 	StackTrace() pkgerrors.StackTrace
 }
 
+// unwrapper adapts an error produced by pkg/errors so that it exposes its
+// cause via Unwrap().  Text and formatting are delegated to the pkg/errors
+// value.
+type unwrapper struct {
+	err   error
+	cause error
+}
+
+func (u *unwrapper) Error() string {
+	return u.err.Error()
+}
+
+func (u *unwrapper) Cause() error {
+	return u.cause
+}
+
+func (u *unwrapper) Unwrap() error {
+	return u.cause
+}
+
+func (u *unwrapper) Format(s fmt.State, verb rune) {
+	u.err.(fmt.Formatter).Format(s, verb)
+}
+
+// stackUnwrapper is an unwrapper whose pkg/errors value carries a stack
+// trace.
+type stackUnwrapper struct {
+	*unwrapper
+}
+
+func (u *stackUnwrapper) StackTrace() pkgerrors.StackTrace {
+	return u.err.(stackTracer).StackTrace()
+}
+
+// withUnwrap makes the pkg/errors value err, which wraps cause, unwrappable.
+func withUnwrap(err error, cause error) error {
+	if err == nil {
+		return nil
+	}
+
+	u := &unwrapper{
+		err:   err,
+		cause: cause,
+	}
+	if _, ok := err.(stackTracer); ok {
+		return &stackUnwrapper{u}
+	}
+
+	return u
+}
+
 // Cause retrieves the underlying cause of an error
 func Cause(err error) error {
 	return pkgerrors.Cause(err)
 }
 
+// Is reports whether any error in err's chain matches target.  It is
+// equivalent to the standard library's errors.Is.
+func Is(err, target error) bool {
+	return stderrors.Is(err, target)
+}
+
+// As finds the first error in err's chain that matches target, and if so,
+// sets target to that error value and returns true.  It is equivalent to the
+// standard library's errors.As.
+func As(err error, target interface{}) bool {
+	return stderrors.As(err, target)
+}
+
+// Unwrap returns the next error in err's chain, or nil if there is none.
+func Unwrap(err error) error {
+	return stderrors.Unwrap(err)
+}
+
 // Errorf formats according to a format specifier and returns the string
 // as a value that satisfies error.
 // Errorf also records the stack trace at the point it was called.
@@ -62,10 +140,10 @@ func New(message string) error {
 // called, and the supplied message.  If err is nil, Wrap returns nil.
 func Wrap(err error, message string) error {
 	if _, ok := err.(stackTracer); !ok {
-		return pkgerrors.Wrap(err, message)
+		return withUnwrap(pkgerrors.Wrap(err, message), err)
 	} else {
 		msg := err.Error() + ": " + message
-		return pkgerrors.WithMessage(err, msg)
+		return withUnwrap(pkgerrors.WithMessage(err, msg), err)
 	}
 }
 
@@ -79,7 +157,7 @@ func Wrapf(err error, format string, args ...interface{}) error {
 // If err is nil, WithStack returns nil.
 func WithStack(err error) error {
 	if _, ok := err.(stackTracer); !ok {
-		return pkgerrors.WithStack(err)
+		return withUnwrap(pkgerrors.WithStack(err), err)
 	} else {
 		return err
 	}
@@ -90,3 +168,37 @@ func HasStackTrace(err error) bool {
 	_, ok := err.(stackTracer)
 	return ok
 }
+
+// sensitiveError hides the text of its cause.  It deliberately lacks a
+// Cause() method, so Cause() stops at this error rather than returning the
+// unredacted one.  The cause remains reachable via Unwrap() (and therefore
+// errors.Is and errors.As) for callers that explicitly want it.
+type sensitiveError struct {
+	msg   string
+	cause error
+}
+
+func (e *sensitiveError) Error() string {
+	return e.msg
+}
+
+func (e *sensitiveError) Unwrap() error {
+	return e.cause
+}
+
+// WrapSensitive returns an error annotating err with a stack trace at the
+// point WrapSensitive is called, and the supplied message.  Unlike Wrap, the
+// text of err is not included in the resulting error's message, including
+// when formatted with "%+v", and Cause() returns the redacted error rather
+// than err.  If err is nil, WrapSensitive returns nil.
+func WrapSensitive(err error, message string) error {
+	if err == nil {
+		return nil
+	}
+
+	se := &sensitiveError{
+		msg:   message + ": <redacted>",
+		cause: err,
+	}
+	return withUnwrap(pkgerrors.WithStack(se), se)
+}
@@ -0,0 +1,129 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package errors
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+type testError struct {
+	code int
+}
+
+func (e *testError) Error() string {
+	return fmt.Sprintf("test error %d", e.code)
+}
+
+func TestIsAs(t *testing.T) {
+	base := &testError{code: 7}
+
+	chains := map[string]error{
+		"Wrap":          Wrap(base, "outer"),
+		"Wrapf":         Wrapf(base, "outer %d", 1),
+		"WithStack":     WithStack(base),
+		"WrapSensitive": WrapSensitive(base, "outer"),
+		"Wrap(Wrap)":    Wrap(Wrap(base, "inner"), "outer"),
+	}
+
+	for name, err := range chains {
+		if !Is(err, base) {
+			t.Errorf("%s: Is failed", name)
+		}
+
+		var te *testError
+		if !As(err, &te) || te != base {
+			t.Errorf("%s: As failed", name)
+		}
+
+		// A sensitive error's cause is redacted.
+		if name == "WrapSensitive" {
+			continue
+		}
+		if Cause(err) != base {
+			t.Errorf("%s: wrong cause: %v", name, Cause(err))
+		}
+	}
+
+	if !Is(Wrap(WithStack(os.ErrNotExist), "outer"), os.ErrNotExist) {
+		t.Errorf("sentinel not found in chain")
+	}
+}
+
+func TestFormatPreserved(t *testing.T) {
+	base := fmt.Errorf("base")
+
+	have := Wrap(base, "outer")
+	want := pkgerrors.Wrap(base, "outer")
+	if have.Error() != want.Error() {
+		t.Fatalf("wrong text: have=%q want=%q", have.Error(), want.Error())
+	}
+	if !HasStackTrace(have) {
+		t.Fatalf("wrapped error lacks a stack trace")
+	}
+
+	s := fmt.Sprintf("%+v", have)
+	if !strings.HasPrefix(s, "base\nouter\n") {
+		t.Fatalf("wrong verbose text: %q", s)
+	}
+}
+
+func TestWrapSensitive(t *testing.T) {
+	if WrapSensitive(nil, "outer") != nil {
+		t.Fatalf("WrapSensitive(nil) returned non-nil")
+	}
+
+	secret := fmt.Errorf("secret")
+	sens := WrapSensitive(secret, "outer")
+	if !HasStackTrace(sens) {
+		t.Fatalf("sensitive error lacks a stack trace")
+	}
+
+	errs := map[string]error{
+		"WrapSensitive":            sens,
+		"Wrap(WrapSensitive)":      Wrap(sens, "wrapper"),
+		"WithStack(WrapSensitive)": WithStack(sens),
+	}
+	for name, err := range errs {
+		for _, verb := range []string{"%s", "%v", "%+v", "%q"} {
+			s := fmt.Sprintf(verb, err)
+			if strings.Contains(s, "secret") {
+				t.Errorf("%s: %s leaked cause: %q", name, verb, s)
+			}
+			if !strings.Contains(s, "outer: <redacted>") {
+				t.Errorf("%s: %s lacks message: %q", name, verb, s)
+			}
+		}
+
+		cause := Cause(err)
+		if cause == secret || strings.Contains(cause.Error(), "secret") {
+			t.Errorf("%s: Cause() leaked cause: %v", name, cause)
+		}
+
+		// The cause is still available to explicit inspection.
+		if !Is(err, secret) {
+			t.Errorf("%s: Is failed", name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package flash
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Maximum number of text rows inside a single box.  The largest segment of a
+// diagram gets this many rows; smaller segments are scaled down, but never
+// below one row.
+const DIAGRAM_MAX_ROWS = 8
+
+// Minimum total width of a diagram box, including its borders.
+const DIAGRAM_MIN_WIDTH = 8
+
+// diagramSeg is one box in a memory-map diagram: either a flash area or an
+// unallocated gap between areas.
+type diagramSeg struct {
+	offset int
+	size   int
+	label  string // Empty for a gap.
+}
+
+func sizeString(size int) string {
+	if size != 0 && size%1024 == 0 {
+		return fmt.Sprintf("%d KB", size/1024)
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+// Diagram renders a boxed ASCII memory map of the areas on the specified
+// flash device.  Each area is drawn as a labeled box whose height is scaled
+// by its size; the offset of each boundary is printed to the left.
+// Unallocated gaps between areas are drawn as hatched boxes.  width is the
+// total width of each box, including its borders.  An error is returned if
+// any areas on the device overlap.
+func Diagram(areas []FlashArea, device int, width int) (string, error) {
+	if width < DIAGRAM_MIN_WIDTH {
+		width = DIAGRAM_MIN_WIDTH
+	}
+	inner := width - 2
+
+	var segs []diagramSeg
+	cur := 0
+	for _, area := range SortFlashAreasByDevOff(areas) {
+		if area.Device != device {
+			continue
+		}
+
+		if area.Offset < 0 || area.Size < 0 {
+			return "", errors.Errorf(
+				"flash area %s has invalid extent: offset=%d size=%d",
+				area.Name, area.Offset, area.Size)
+		}
+		if area.Offset < cur {
+			return "", errors.Errorf(
+				"flash area %s overlaps preceding area at 0x%08x",
+				area.Name, area.Offset)
+		}
+
+		if area.Offset > cur {
+			segs = append(segs, diagramSeg{
+				offset: cur,
+				size:   area.Offset - cur,
+			})
+		}
+		segs = append(segs, diagramSeg{
+			offset: area.Offset,
+			size:   area.Size,
+			label: fmt.Sprintf("%s (%s)",
+				area.Name, sizeString(area.Size)),
+		})
+
+		cur = area.Offset + area.Size
+	}
+
+	if len(segs) == 0 {
+		return "", nil
+	}
+
+	largest := 0
+	for _, seg := range segs {
+		if seg.size > largest {
+			largest = seg.size
+		}
+	}
+
+	margin := strings.Repeat(" ", len(fmt.Sprintf("0x%08x ", 0)))
+	border := "+" + strings.Repeat("-", inner) + "+\n"
+
+	var sb strings.Builder
+	for _, seg := range segs {
+		fmt.Fprintf(&sb, "0x%08x %s", seg.offset, border)
+
+		rows := 1
+		if largest > 0 {
+			rows = (seg.size*DIAGRAM_MAX_ROWS + largest - 1) / largest
+			if rows < 1 {
+				rows = 1
+			}
+		}
+
+		for i := 0; i < rows; i++ {
+			var body string
+			if seg.label == "" {
+				body = strings.Repeat("/", inner)
+			} else if i == 0 {
+				label := seg.label
+				if len(label) > inner-2 {
+					label = label[:inner-2]
+				}
+				body = " " + label + strings.Repeat(" ", inner-1-len(label))
+			} else {
+				body = strings.Repeat(" ", inner)
+			}
+			fmt.Fprintf(&sb, "%s|%s|\n", margin, body)
+		}
+	}
+	fmt.Fprintf(&sb, "0x%08x %s", cur, border)
+
+	return sb.String(), nil
+}
@@ -45,6 +45,13 @@ type FlashArea struct {
 	Size   int    `json:"size"`
 }
 
+// FlashRegion is a contiguous range of bytes within a flash device.
+type FlashRegion struct {
+	Device int
+	Offset int
+	Size   int
+}
+
 type areaOffSorter struct {
 	areas []FlashArea
 }
@@ -140,6 +147,128 @@ func DetectErrors(areas []FlashArea) ([][]FlashArea, [][]FlashArea) {
 	return overlaps, conflicts
 }
 
+// FreeRegions calculates the unallocated byte ranges of the specified flash
+// device, given the device's total size.
+//
+// @return free-regions, areas-exceeding-device.
+func FreeRegions(areas []FlashArea, device int,
+	totalSize int) ([]FlashRegion, []FlashArea) {
+
+	var devAreas []FlashArea
+	for _, area := range areas {
+		if area.Device == device {
+			devAreas = append(devAreas, area)
+		}
+	}
+	devAreas = SortFlashAreasByDevOff(devAreas)
+
+	var free []FlashRegion
+	var oob []FlashArea
+
+	addFree := func(start int, end int) {
+		if end > totalSize {
+			end = totalSize
+		}
+		if start < end {
+			free = append(free, FlashRegion{
+				Device: device,
+				Offset: start,
+				Size:   end - start,
+			})
+		}
+	}
+
+	cur := 0
+	for _, area := range devAreas {
+		end := area.Offset + area.Size
+		if area.Offset < 0 || end > totalSize {
+			oob = append(oob, area)
+		}
+
+		addFree(cur, area.Offset)
+		if end > cur {
+			cur = end
+		}
+	}
+	addFree(cur, totalSize)
+
+	return free, oob
+}
+
+// Warning is an advisory finding about a set of flash areas.
+type Warning struct {
+	Areas []FlashArea
+	Text  string
+}
+
+func (w Warning) String() string {
+	return w.Text
+}
+
+// ValidateAlignment flags areas whose start or end offset is not a multiple
+// of the specified erase sector size.  The results are advisory; some devices
+// have non-uniform sectors.
+func ValidateAlignment(areas []FlashArea, sectorSize int) []Warning {
+	var warnings []Warning
+
+	if sectorSize <= 0 {
+		return nil
+	}
+
+	for _, area := range SortFlashAreasByDevOff(areas) {
+		end := area.Offset + area.Size
+
+		if area.Offset%sectorSize != 0 {
+			warnings = append(warnings, Warning{
+				Areas: []FlashArea{area},
+				Text: fmt.Sprintf(
+					"flash area %s starts mid-sector: "+
+						"offset=0x%x sector-size=0x%x",
+					area.Name, area.Offset, sectorSize),
+			})
+		}
+
+		if end%sectorSize != 0 {
+			warnings = append(warnings, Warning{
+				Areas: []FlashArea{area},
+				Text: fmt.Sprintf(
+					"flash area %s ends mid-sector: "+
+						"end=0x%x sector-size=0x%x",
+					area.Name, end, sectorSize),
+			})
+		}
+	}
+
+	return warnings
+}
+
+// Lint collects all findings for a set of flash areas: ID conflicts,
+// overlaps, and misaligned areas.  A sectorSize of 0 disables the alignment
+// check.
+func Lint(areas []FlashArea, sectorSize int) []Warning {
+	var warnings []Warning
+
+	overlaps, conflicts := DetectErrors(areas)
+
+	for _, pair := range conflicts {
+		warnings = append(warnings, Warning{
+			Areas: pair,
+			Text: fmt.Sprintf("conflicting flash area IDs: (%d) %s =/= %s",
+				pair[0].Id, pair[0].Name, pair[1].Name),
+		})
+	}
+
+	for _, pair := range overlaps {
+		warnings = append(warnings, Warning{
+			Areas: pair,
+			Text: fmt.Sprintf("overlapping flash areas: %s =/= %s",
+				pair[0].Name, pair[1].Name),
+		})
+	}
+
+	return append(warnings, ValidateAlignment(areas, sectorSize)...)
+}
+
 func ErrorText(overlaps [][]FlashArea, conflicts [][]FlashArea) string {
 	str := ""
 
@@ -0,0 +1,140 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package flash
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFreeRegions(t *testing.T) {
+	areas := []FlashArea{
+		FlashArea{Name: "a", Id: 0, Device: 0, Offset: 0x4000, Size: 0x4000},
+		FlashArea{Name: "b", Id: 1, Device: 0, Offset: 0x0000, Size: 0x2000},
+		FlashArea{Name: "c", Id: 2, Device: 0, Offset: 0xc000, Size: 0x8000},
+		FlashArea{Name: "d", Id: 3, Device: 1, Offset: 0x2000, Size: 0x1000},
+	}
+
+	free, oob := FreeRegions(areas, 0, 0x10000)
+
+	wantFree := []FlashRegion{
+		FlashRegion{Device: 0, Offset: 0x2000, Size: 0x2000},
+		FlashRegion{Device: 0, Offset: 0x8000, Size: 0x4000},
+	}
+	if !reflect.DeepEqual(free, wantFree) {
+		t.Fatalf("wrong free regions: have=%+v want=%+v", free, wantFree)
+	}
+
+	if len(oob) != 1 || oob[0].Name != "c" {
+		t.Fatalf("wrong out-of-bounds areas: have=%+v", oob)
+	}
+
+	free, oob = FreeRegions(areas, 1, 0x4000)
+	wantFree = []FlashRegion{
+		FlashRegion{Device: 1, Offset: 0x0000, Size: 0x2000},
+		FlashRegion{Device: 1, Offset: 0x3000, Size: 0x1000},
+	}
+	if !reflect.DeepEqual(free, wantFree) || len(oob) != 0 {
+		t.Fatalf("wrong free regions: have=%+v want=%+v", free, wantFree)
+	}
+}
+
+func TestLint(t *testing.T) {
+	areas := []FlashArea{
+		FlashArea{Name: "a", Id: 0, Device: 0, Offset: 0x0000, Size: 0x4000},
+		FlashArea{Name: "b", Id: 1, Device: 0, Offset: 0x4000, Size: 0x3800},
+		FlashArea{Name: "c", Id: 2, Device: 0, Offset: 0x7800, Size: 0x0800},
+		FlashArea{Name: "d", Id: 2, Device: 0, Offset: 0x7000, Size: 0x1000},
+	}
+
+	align := ValidateAlignment(areas, 0x1000)
+	var names []string
+	for _, w := range align {
+		names = append(names, w.Areas[0].Name)
+	}
+	// "b" ends mid-sector; "c" starts mid-sector.
+	if !reflect.DeepEqual(names, []string{"b", "c"}) {
+		t.Fatalf("wrong alignment warnings: %v", align)
+	}
+
+	// One ID conflict, two overlaps ("b"/"d", "c"/"d"), two misalignments.
+	warnings := Lint(areas, 0x1000)
+	if len(warnings) != 5 {
+		t.Fatalf("wrong lint warning count: have=%d want=5: %v",
+			len(warnings), warnings)
+	}
+
+	if w := Lint(areas[:2], 0); len(w) != 0 {
+		t.Fatalf("unexpected lint warnings: %v", w)
+	}
+}
+
+func TestDiagram(t *testing.T) {
+	areas := []FlashArea{
+		FlashArea{Name: "a", Id: 0, Device: 0, Offset: 0x4000, Size: 0x4000},
+		FlashArea{Name: "b", Id: 1, Device: 0, Offset: 0x0000, Size: 0x2000},
+		FlashArea{Name: "d", Id: 3, Device: 1, Offset: 0x2000, Size: 0x1000},
+	}
+
+	want := "" +
+		"0x00000000 +------------------+\n" +
+		"           | b (8 KB)         |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"0x00002000 +------------------+\n" +
+		"           |//////////////////|\n" +
+		"           |//////////////////|\n" +
+		"           |//////////////////|\n" +
+		"           |//////////////////|\n" +
+		"0x00004000 +------------------+\n" +
+		"           | a (16 KB)        |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"           |                  |\n" +
+		"0x00008000 +------------------+\n"
+
+	have, err := Diagram(areas, 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have != want {
+		t.Fatalf("wrong diagram:\nhave:\n%s\nwant:\n%s", have, want)
+	}
+
+	have, err = Diagram(areas, 2, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have != "" {
+		t.Fatalf("diagram of empty device not empty:\n%s", have)
+	}
+
+	// Overlapping areas.
+	areas = append(areas,
+		FlashArea{Name: "c", Id: 2, Device: 0, Offset: 0x1000, Size: 0x2000})
+	if _, err := Diagram(areas, 0, 20); err == nil {
+		t.Fatalf("diagram of overlapping areas succeeded")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/apache/mynewt-artifact
 
-go 1.12
+go 1.13
 
 require (
 	github.com/NickBall/go-aes-key-wrap v0.0.0-20170929221519-1c3aa3e4dfc5
@@ -0,0 +1,133 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"context"
+	"sync"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// BatchResult is the outcome of verifying a single image file with
+// VerifyBatch.
+type BatchResult struct {
+	Path string
+
+	// Index of the ring key that validated a signature, or -1 if signatures
+	// were not checked.
+	KeyIdx int
+
+	// Nil if the image passed verification.
+	Err error
+}
+
+// Ok indicates whether the image passed verification.
+func (r *BatchResult) Ok() bool {
+	return r.Err == nil
+}
+
+// verifyFile parses and verifies a single image file.  The image's structure
+// and hash are always checked.  If the ring is non-empty, the image must also
+// be signed by one of its keys.
+func verifyFile(path string, ring []sec.PubSignKey) BatchResult {
+	res := BatchResult{
+		Path:   path,
+		KeyIdx: -1,
+	}
+
+	img, err := ReadImage(path)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	if err := img.VerifyStructure(); err != nil {
+		res.Err = err
+		return res
+	}
+
+	if _, err := img.VerifyHash(nil); err != nil {
+		res.Err = err
+		return res
+	}
+
+	if len(ring) > 0 {
+		res.KeyIdx, res.Err = img.VerifyWithRing(ring)
+	}
+
+	return res
+}
+
+// VerifyBatch verifies a set of image files concurrently using the specified
+// number of workers (at least one is used).  Each file is parsed and its
+// structure, hash, and (if ring is non-empty) signatures are checked; see
+// verifyFile.  Encrypted images cannot be verified this way.
+//
+// The keyring is shared read-only among the workers.  The returned slice has
+// one entry per path, in the same order as paths.  If ctx is canceled, files
+// that have not yet been verified are reported with the context's error.
+func VerifyBatch(ctx context.Context, paths []string, ring []sec.PubSignKey,
+	workers int) []BatchResult {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]BatchResult, len(paths))
+	idxs := make(chan int)
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idxs {
+				results[i] = verifyFile(paths[i], ring)
+			}
+		}()
+	}
+
+	// Index of the first path not handed to a worker.
+	next := 0
+
+dispatch:
+	for next < len(paths) && ctx.Err() == nil {
+		select {
+		case idxs <- next:
+			next++
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(idxs)
+	wg.Wait()
+
+	for ; next < len(paths); next++ {
+		results[next] = BatchResult{
+			Path:   paths[next],
+			KeyIdx: -1,
+			Err:    errors.Wrapf(ctx.Err(), "image verification canceled"),
+		}
+	}
+
+	return results
+}
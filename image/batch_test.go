@@ -0,0 +1,70 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+func TestVerifyBatch(t *testing.T) {
+	var paths []string
+	for i := 0; i < 10; i++ {
+		paths = append(paths,
+			fmt.Sprintf("%s/good-unsigned-unencrypted.img", testdataPath),
+			fmt.Sprintf("%s/bad-hash.img", testdataPath))
+	}
+
+	results := VerifyBatch(context.Background(), paths, nil, 4)
+	if len(results) != len(paths) {
+		t.Fatalf("wrong result count: have=%d want=%d",
+			len(results), len(paths))
+	}
+	for i, r := range results {
+		if r.Path != paths[i] {
+			t.Fatalf("result %d out of order: %s", i, r.Path)
+		}
+		if r.Ok() != (i%2 == 0) {
+			t.Fatalf("wrong result for %s: %v", r.Path, r.Err)
+		}
+	}
+
+	// Signed image against its key.
+	signed := []string{
+		fmt.Sprintf("%s/good-signed-unencrypted.img", testdataPath),
+	}
+	ring := []sec.PubSignKey{readPubSignKey()}
+	results = VerifyBatch(context.Background(), signed, ring, 1)
+	if !results[0].Ok() || results[0].KeyIdx != 0 {
+		t.Fatalf("signed image failed batch verification: %v", results[0].Err)
+	}
+
+	// A canceled context verifies nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range VerifyBatch(ctx, paths, nil, 4) {
+		if r.Ok() {
+			t.Fatalf("image verified after cancellation: %s", r.Path)
+		}
+	}
+}
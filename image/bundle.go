@@ -0,0 +1,358 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// Bundle is the content of a release artifact bundle: a manifest and the
+// images it references.
+type Bundle struct {
+	Manifest manifest.Manifest
+	Image    Image
+	Loader   *Image // Nil if the manifest does not name a loader.
+}
+
+// ErrBundleMissingFile indicates that an artifact bundle lacks a file that
+// is required or that its manifest references.
+type ErrBundleMissingFile struct {
+	Name string // Path within the archive.
+}
+
+func (e *ErrBundleMissingFile) Error() string {
+	return fmt.Sprintf("artifact bundle does not contain \"%s\"", e.Name)
+}
+
+// Limits on the files read from an artifact bundle.  They bound the memory
+// used by a malformed or malicious archive, e.g., one containing a
+// decompression bomb.
+const (
+	BUNDLE_MAX_FILE_SZ  = 16 * 1024 * 1024
+	BUNDLE_MAX_TOTAL_SZ = 64 * 1024 * 1024
+)
+
+// bundleFiles accumulates the files read from an archive.  Until the
+// manifest has been seen, any image (.img) file is a candidate for inclusion;
+// afterwards, only the files the manifest references are retained.
+type bundleFiles struct {
+	files   map[string][]byte
+	total   int
+	manName string
+	man     *manifest.Manifest
+}
+
+func newBundleFiles() *bundleFiles {
+	return &bundleFiles{
+		files: map[string][]byte{},
+	}
+}
+
+func isBundleManifest(name string) bool {
+	return path.Base(name) == manifest.MANIFEST_FILENAME
+}
+
+// bundleRefPaths returns the paths within an archive where a file referenced
+// by a manifest may be found, in order of preference.  Manifests written by
+// newt often record absolute build paths; these are located by file name in
+// the manifest's directory.
+func bundleRefPaths(manName string, ref string) []string {
+	dir := path.Dir(manName)
+	byName := path.Join(dir, path.Base(ref))
+	if path.IsAbs(ref) {
+		return []string{byName}
+	}
+
+	return []string{path.Join(dir, ref), byName}
+}
+
+// referenced indicates whether the manifest references a file in the archive.
+func (bf *bundleFiles) referenced(name string) bool {
+	for _, ref := range []string{bf.man.Image, bf.man.Loader} {
+		if ref == "" {
+			continue
+		}
+		for _, p := range bundleRefPaths(bf.manName, ref) {
+			if p == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// wants indicates whether a file in an archive should be read.
+func (bf *bundleFiles) wants(name string) bool {
+	if isBundleManifest(name) {
+		return true
+	}
+	if bf.man == nil {
+		return strings.HasSuffix(name, ".img")
+	}
+
+	return bf.referenced(name)
+}
+
+// add reads a file from an archive, enforcing the size limits.
+func (bf *bundleFiles) add(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, BUNDLE_MAX_FILE_SZ+1))
+	if err != nil {
+		return errors.Wrapf(err,
+			"failed to read \"%s\" from artifact bundle", name)
+	}
+	if len(data) > BUNDLE_MAX_FILE_SZ {
+		return errors.Errorf(
+			"artifact bundle file \"%s\" too large: max=%d",
+			name, BUNDLE_MAX_FILE_SZ)
+	}
+
+	bf.total += len(data)
+	if bf.total > BUNDLE_MAX_TOTAL_SZ {
+		return errors.Errorf(
+			"artifact bundle contents too large: max=%d",
+			BUNDLE_MAX_TOTAL_SZ)
+	}
+
+	if !isBundleManifest(name) {
+		bf.files[name] = data
+		return nil
+	}
+
+	if bf.man != nil {
+		return errors.Errorf(
+			"artifact bundle contains multiple manifests: \"%s\", \"%s\"",
+			bf.manName, name)
+	}
+
+	man, err := manifest.ParseManifest(data)
+	if err != nil {
+		return err
+	}
+	bf.manName = name
+	bf.man = &man
+
+	// Discard any images read before the manifest that it doesn't reference.
+	for n, _ := range bf.files {
+		if !bf.referenced(n) {
+			delete(bf.files, n)
+		}
+	}
+
+	return nil
+}
+
+// readTarFiles collects the bundle files from a tar stream.  Files appear in
+// the stream in arbitrary order, so images are retained until the manifest
+// has been seen.
+func readTarFiles(r io.Reader) (*bundleFiles, error) {
+	bf := newBundleFiles()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read tar archive")
+		}
+
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if !bf.wants(name) {
+			continue
+		}
+
+		if err := bf.add(name, tr); err != nil {
+			return nil, err
+		}
+	}
+
+	return bf, nil
+}
+
+// readZipFiles collects the bundle files from a zip archive.  The manifest is
+// read first, so only the files it references are read.
+func readZipFiles(r io.ReaderAt, size int64) (*bundleFiles, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read zip archive")
+	}
+
+	bf := newBundleFiles()
+
+	readFile := func(f *zip.File, name string) error {
+		rc, err := f.Open()
+		if err != nil {
+			return errors.Wrapf(err,
+				"failed to open \"%s\" in zip archive", f.Name)
+		}
+		defer rc.Close()
+
+		return bf.add(name, rc)
+	}
+
+	// Manifests first, then the files they reference.
+	for _, manifests := range []bool{true, false} {
+		for _, f := range zr.File {
+			name := path.Clean(f.Name)
+			if f.FileInfo().IsDir() || isBundleManifest(name) != manifests ||
+				!bf.wants(name) {
+
+				continue
+			}
+
+			if err := readFile(f, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return bf, nil
+}
+
+// bundleFromFiles assembles a bundle from the files in an archive.  The
+// archive must contain exactly one manifest; the files it references are
+// resolved relative to the manifest's directory within the archive, falling
+// back to a file with the same name in that directory.
+func bundleFromFiles(bf *bundleFiles) (Bundle, error) {
+	b := Bundle{}
+
+	if bf.man == nil {
+		return b, errors.WithStack(
+			&ErrBundleMissingFile{Name: manifest.MANIFEST_FILENAME})
+	}
+	b.Manifest = *bf.man
+
+	readImg := func(ref string) (Image, error) {
+		paths := bundleRefPaths(bf.manName, ref)
+
+		name := paths[len(paths)-1]
+		for _, p := range paths {
+			if bf.files[p] != nil {
+				name = p
+				break
+			}
+		}
+
+		data, ok := bf.files[name]
+		if !ok {
+			return Image{}, errors.WithStack(
+				&ErrBundleMissingFile{Name: name})
+		}
+
+		img, err := ParseImage(data)
+		if err != nil {
+			return img, errors.Wrapf(err,
+				"failed to parse \"%s\" from artifact bundle", name)
+		}
+		return img, nil
+	}
+
+	if b.Manifest.Image == "" {
+		return b, errors.Errorf("artifact bundle manifest names no image")
+	}
+
+	var err error
+	b.Image, err = readImg(b.Manifest.Image)
+	if err != nil {
+		return b, err
+	}
+
+	if b.Manifest.Loader != "" {
+		loader, err := readImg(b.Manifest.Loader)
+		if err != nil {
+			return b, err
+		}
+		b.Loader = &loader
+	}
+
+	return b, nil
+}
+
+// ReadBundle reads a release artifact bundle: a tar archive (optionally
+// gzip-compressed) or a zip archive containing a manifest (see
+// manifest.MANIFEST_FILENAME) and the image files it references.  The format
+// is detected from the file's contents rather than its extension.  Tar
+// archives are streamed; only the manifest and the files it references are
+// retained in memory, and the size of each file read and of their total are
+// limited (see BUNDLE_MAX_FILE_SZ and BUNDLE_MAX_TOTAL_SZ).  An
+// ErrBundleMissingFile error is returned if the manifest, or a file it
+// references, is absent.
+func ReadBundle(filename string) (Bundle, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return Bundle{}, errors.Wrapf(err, "failed to open artifact bundle")
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+
+	var files *bundleFiles
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		info, err := f.Stat()
+		if err != nil {
+			return Bundle{}, errors.Wrapf(err,
+				"failed to read artifact bundle")
+		}
+		files, err = readZipFiles(f, info.Size())
+		if err != nil {
+			return Bundle{}, err
+		}
+
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return Bundle{}, errors.Wrapf(err,
+				"failed to decompress artifact bundle")
+		}
+		files, err = readTarFiles(zr)
+		if err != nil {
+			return Bundle{}, err
+		}
+
+	default:
+		files, err = readTarFiles(br)
+		if err != nil {
+			return Bundle{}, err
+		}
+	}
+
+	return bundleFromFiles(files)
+}
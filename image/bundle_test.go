@@ -0,0 +1,195 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+func writeTarGz(t *testing.T, w io.Writer, files []bundleFile) {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name: f.name,
+			Mode: 0644,
+			Size: int64(len(f.data)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeZip(t *testing.T, w io.Writer, files []bundleFile) {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basename := "good-signed-unencrypted"
+	man, err := ioutil.ReadFile(testdataPath + "/" + basename + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgData := readImageData(basename)
+
+	// The manifest's image path is absolute; the image is found by name.
+	full := []bundleFile{
+		{"rel/blinky.img", imgData},
+		{"rel/manifest.json", man},
+	}
+	noImg := full[1:]
+
+	writers := map[string]func(*testing.T, io.Writer, []bundleFile){
+		"tar.gz": writeTarGz,
+		"zip":    writeZip,
+	}
+	for ext, write := range writers {
+		for _, files := range [][]bundleFile{full, noImg} {
+			path := filepath.Join(dir, "bundle."+ext)
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			write(t, f, files)
+			f.Close()
+
+			b, err := ReadBundle(path)
+			if len(files) == len(noImg) {
+				var missing *ErrBundleMissingFile
+				if !errors.As(err, &missing) ||
+					missing.Name != "rel/blinky.img" {
+
+					t.Fatalf("%s: wrong error for missing image: %v",
+						ext, err)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%s: %s", ext, err.Error())
+			}
+			if b.Manifest.Name != readManifest(basename).Name {
+				t.Fatalf("%s: wrong manifest", ext)
+			}
+			if b.Loader != nil || b.Image.Header.ImgSz == 0 {
+				t.Fatalf("%s: wrong images", ext)
+			}
+			if _, err := b.Image.VerifyHash(nil); err != nil {
+				t.Fatalf("%s: %s", ext, err.Error())
+			}
+		}
+	}
+}
+
+func TestReadBundleLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basename := "good-signed-unencrypted"
+	man, err := ioutil.ReadFile(testdataPath + "/" + basename + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgData := readImageData(basename)
+	big := make([]byte, BUNDLE_MAX_FILE_SZ+1)
+
+	writers := map[string]func(*testing.T, io.Writer, []bundleFile){
+		"tar.gz": writeTarGz,
+		"zip":    writeZip,
+	}
+	for ext, write := range writers {
+		path := filepath.Join(dir, "bundle."+ext)
+		create := func(files []bundleFile) {
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			write(t, f, files)
+			f.Close()
+		}
+
+		// Files the manifest doesn't reference are never read.
+		create([]bundleFile{
+			{"rel/manifest.json", man},
+			{"rel/other.img", big},
+			{"rel/blinky.img", imgData},
+			{"rel/notes.txt", big},
+		})
+		if _, err := ReadBundle(path); err != nil {
+			t.Fatalf("%s: %s", ext, err.Error())
+		}
+
+		// A referenced file that exceeds the limit is rejected.
+		create([]bundleFile{
+			{"rel/manifest.json", man},
+			{"rel/blinky.img", big},
+		})
+		_, err := ReadBundle(path)
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Fatalf("%s: oversized image accepted: %v", ext, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"crypto"
+)
+
+// HashInfo describes an image hash algorithm.
+type HashInfo struct {
+	Name    string // E.g., "SHA256".
+	TlvType uint8  // Type of the TLV that holds the hash.
+	Hash    crypto.Hash
+	Size    int // Size of a full digest, in bytes.
+}
+
+// supportedHashes lists the image hash algorithms this package implements.
+var supportedHashes = []HashInfo{
+	{"SHA256", IMAGE_TLV_SHA256, crypto.SHA256, IMAGE_HASH_SZ},
+}
+
+// supportedSignAlgos lists the signature algorithms this package implements.
+// It is the single source of truth for the signature TLV types; see
+// ImageTlvTypeIsSig and sigTlvAlgo.
+var supportedSignAlgos = []SignAlgo{
+	SIGN_ALGO_RSA2048,
+	SIGN_ALGO_RSA3072,
+	SIGN_ALGO_ECDSA224,
+	SIGN_ALGO_ECDSA256,
+	SIGN_ALGO_ED25519,
+}
+
+// SupportedHashes returns the image hash algorithms supported by this build
+// of the package.
+func SupportedHashes() []HashInfo {
+	return append([]HashInfo(nil), supportedHashes...)
+}
+
+// SupportedSignAlgos returns the signature algorithms supported by this build
+// of the package, for both signing and verification.
+func SupportedSignAlgos() []SignAlgo {
+	return append([]SignAlgo(nil), supportedSignAlgos...)
+}
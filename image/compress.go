@@ -0,0 +1,318 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/internal/lzma"
+)
+
+// The compressed-image layout follows MCUboot and imgtool.  The header's
+// compression flags identify the algorithm, and the body consists of a
+// 2-byte header (LZMA2 dictionary size byte, LZMA properties byte) followed
+// by the raw compressed stream.  The image hash and signatures cover the
+// body as stored.  The protected DECOMP_SIZE and DECOMP_SHA TLVs describe
+// the image that results from decompression: its header has the compression
+// flags cleared, ImgSz set to the decompressed size, and a protected region
+// without the DECOMP_[...] TLVs.
+
+const compFlagsMask = IMAGE_F_COMPRESSED_LZMA1 | IMAGE_F_COMPRESSED_LZMA2 |
+	IMAGE_F_COMPRESSED_ARM_THUMB_FLT
+
+// Size of the header that precedes a compressed stream.
+const compHdrSz = 2
+
+// IMAGE_DECOMP_MAX_SZ is the largest decompressed body this package will
+// produce.  The DECOMP_SIZE TLV is only trusted up to this bound, so that a
+// small crafted image cannot make a verifier inflate gigabytes of data.  It
+// comfortably exceeds the flash slots MCUboot images are written to.
+const IMAGE_DECOMP_MAX_SZ = 16 * 1024 * 1024
+
+// CompInfo describes how an image body is compressed.
+type CompInfo struct {
+	// Compression flags from the image header (IMAGE_F_COMPRESSED_[...]).
+	Flags uint32
+
+	// Size of the decompressed body; -1 if the image has no DECOMP_SIZE TLV.
+	Size int
+}
+
+// ImageCompTypeName returns a human-readable name for a set of compression
+// flags.
+func ImageCompTypeName(flags uint32) string {
+	switch flags & compFlagsMask {
+	case IMAGE_F_COMPRESSED_LZMA1:
+		return "lzma1"
+	case IMAGE_F_COMPRESSED_LZMA2:
+		return "lzma2"
+	case IMAGE_F_COMPRESSED_LZMA2 | IMAGE_F_COMPRESSED_ARM_THUMB_FLT:
+		return "lzma2armthumb"
+	default:
+		return "???"
+	}
+}
+
+func imageTlvTypeIsDecomp(tlvType uint8) bool {
+	return tlvType == IMAGE_TLV_DECOMP_SIZE ||
+		tlvType == IMAGE_TLV_DECOMP_SHA ||
+		tlvType == IMAGE_TLV_DECOMP_SIGNATURE
+}
+
+// findDecompTlv retrieves one of an image's DECOMP_[...] TLVs.  These TLVs
+// must reside in the protected region.
+func (img *Image) findDecompTlv(tlvType uint8) (*ImageTlv, error) {
+	tlv, prot, err := img.FindUniqueTlvAnyRegion(tlvType)
+	if err != nil {
+		return nil, err
+	}
+	if tlv != nil && !prot {
+		return nil, errors.Errorf(
+			"image contains unprotected %s TLV", ImageTlvTypeName(tlvType))
+	}
+
+	return tlv, nil
+}
+
+// compInfo decodes an image's compression flags and TLVs.  The returned bool
+// is false if the image is not compressed.  An error is returned if the
+// image's compression flags or TLVs are malformed.
+func (img *Image) compInfo() (CompInfo, bool, error) {
+	ci := CompInfo{
+		Flags: img.Header.Flags & compFlagsMask,
+		Size:  -1,
+	}
+
+	sizeTlv, err := img.findDecompTlv(IMAGE_TLV_DECOMP_SIZE)
+	if err != nil {
+		return ci, false, err
+	}
+	shaTlv, err := img.findDecompTlv(IMAGE_TLV_DECOMP_SHA)
+	if err != nil {
+		return ci, false, err
+	}
+
+	if ci.Flags == 0 {
+		if sizeTlv != nil || shaTlv != nil {
+			return ci, false, errors.Errorf(
+				"image contains decompression TLVs, but compression flags " +
+					"unset in image header")
+		}
+		return ci, false, nil
+	}
+
+	switch ci.Flags {
+	case IMAGE_F_COMPRESSED_LZMA1, IMAGE_F_COMPRESSED_LZMA2,
+		IMAGE_F_COMPRESSED_LZMA2 | IMAGE_F_COMPRESSED_ARM_THUMB_FLT:
+	default:
+		return ci, false, errors.Errorf(
+			"image header contains invalid compression flags: 0x%x",
+			ci.Flags)
+	}
+
+	if sizeTlv != nil {
+		if len(sizeTlv.Data) != 4 {
+			return ci, false, errors.Errorf(
+				"image contains DECOMP_SIZE TLV with invalid length: %d",
+				len(sizeTlv.Data))
+		}
+		ci.Size = int(binary.LittleEndian.Uint32(sizeTlv.Data))
+	}
+
+	return ci, true, nil
+}
+
+// CompressionInfo reports an image's compression algorithm and decompressed
+// size.  It does not decompress the body.  The returned bool is false if the
+// image is not compressed or if its compression flags or TLVs are malformed;
+// VerifyStructure reports the latter.
+func (img *Image) CompressionInfo() (CompInfo, bool) {
+	ci, ok, err := img.compInfo()
+	if err != nil {
+		return CompInfo{}, false
+	}
+
+	return ci, ok
+}
+
+// IsCompressed indicates whether an image's header contains any compression
+// flags.
+func (img *Image) IsCompressed() bool {
+	return img.Header.Flags&compFlagsMask != 0
+}
+
+// decompress inflates a compressed body.  Decompression fails if the result
+// would exceed limit bytes.
+func decompress(flags uint32, body []byte, limit int) ([]byte, error) {
+	if flags&IMAGE_F_COMPRESSED_LZMA2 == 0 {
+		return nil, errors.Errorf("unsupported image compression: %s",
+			ImageCompTypeName(flags))
+	}
+
+	if len(body) < compHdrSz {
+		return nil, errors.Errorf(
+			"compressed image body too short: %d", len(body))
+	}
+
+	dictSize, err := lzma.DictSize(body[0])
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := lzma.DecodeLzma2(body[compHdrSz:], dictSize, limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress image body")
+	}
+
+	if flags&IMAGE_F_COMPRESSED_ARM_THUMB_FLT != 0 {
+		lzma.DecodeArmThumb(plain)
+	}
+
+	return plain, nil
+}
+
+// DecompressBody returns the decompressed contents of an image's body.  The
+// body must already be decrypted.  If the image is not compressed, the body
+// is returned unchanged.
+func (img *Image) DecompressBody() ([]byte, error) {
+	ci, ok, err := img.compInfo()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return img.Body, nil
+	}
+
+	if ci.Size < 0 {
+		return nil, errors.Errorf(
+			"compressed image lacks DECOMP_SIZE TLV")
+	}
+	if ci.Size > IMAGE_DECOMP_MAX_SZ {
+		return nil, errors.Errorf(
+			"compressed image DECOMP_SIZE too large: have=%d max=%d",
+			ci.Size, IMAGE_DECOMP_MAX_SZ)
+	}
+
+	body, err := decompress(ci.Flags, img.Body, ci.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	if ci.Size != len(body) {
+		return nil, errors.Errorf(
+			"decompressed image body has wrong size: have=%d want=%d",
+			len(body), ci.Size)
+	}
+
+	return body, nil
+}
+
+// calcDecompHash calculates the expected contents of a compressed image's
+// DECOMP_SHA TLV from its header and decompressed body.
+func calcDecompHash(hdr ImageHdr, pad []byte, plainBody []byte,
+	protTlvs []ImageTlv) ([]byte, error) {
+
+	var tlvs []ImageTlv
+	for _, tlv := range protTlvs {
+		if !imageTlvTypeIsDecomp(tlv.Header.Type) {
+			tlvs = append(tlvs, tlv)
+		}
+	}
+
+	hdr.Flags &^= compFlagsMask
+	hdr.ImgSz = uint32(len(plainBody))
+	hdr.SetProtSz((&Image{ProtTlvs: tlvs}).ProtSize())
+
+	return calcHash(nil, hdr, pad, plainBody, tlvs)
+}
+
+// verifyDecompHash checks a decrypted image's DECOMP_SHA TLV against its
+// decompressed contents.  It is a no-op for uncompressed images.
+func (img *Image) verifyDecompHash() error {
+	if !img.IsCompressed() {
+		return nil
+	}
+
+	shaTlv, err := img.findDecompTlv(IMAGE_TLV_DECOMP_SHA)
+	if err != nil {
+		return err
+	}
+	if shaTlv == nil {
+		return errors.Errorf("compressed image lacks DECOMP_SHA TLV")
+	}
+
+	body, err := img.DecompressBody()
+	if err != nil {
+		return err
+	}
+
+	hash, err := calcDecompHash(img.Header, img.Pad, body, img.ProtTlvs)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(shaTlv.Data, hash) {
+		return errors.Errorf(
+			"image contains incorrect decompressed hash: have=%x want=%x",
+			shaTlv.Data, hash)
+	}
+
+	return nil
+}
+
+// buildDecompTlvs decompresses a creator's body and generates the
+// DECOMP_SIZE and DECOMP_SHA TLVs for the resulting image.  The header must
+// already contain the compression flags, and protTlvs must be the image's
+// other protected TLVs.
+func buildDecompTlvs(hdr ImageHdr, pad []byte, body []byte,
+	protTlvs []ImageTlv) ([]ImageTlv, error) {
+
+	plain, err := decompress(hdr.Flags&compFlagsMask, body, IMAGE_DECOMP_MAX_SZ)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := calcDecompHash(hdr, pad, plain, protTlvs)
+	if err != nil {
+		return nil, err
+	}
+
+	sizeData := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sizeData, uint32(len(plain)))
+
+	return []ImageTlv{
+		ImageTlv{
+			Header: ImageTlvHdr{
+				Type: IMAGE_TLV_DECOMP_SIZE,
+				Len:  uint16(len(sizeData)),
+			},
+			Data: sizeData,
+		},
+		ImageTlv{
+			Header: ImageTlvHdr{
+				Type: IMAGE_TLV_DECOMP_SHA,
+				Len:  uint16(len(hash)),
+			},
+			Data: hash,
+		},
+	}, nil
+}
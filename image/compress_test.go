@@ -0,0 +1,277 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Compressed bodies in imgtool's format: a dictionary size byte (0 = 4 KiB),
+// the LZMA properties byte (lc=3 lp=0 pb=2), and a raw LZMA2 stream produced
+// by Python's lzma module with format=FORMAT_RAW.
+
+func compTestPlain() []byte {
+	plain := make([]byte, 1024)
+	for i := range plain {
+		plain[i] = byte((i%7)*3 + i/64)
+	}
+	return plain
+}
+
+func compTestBody() []byte {
+	b, _ := hex.DecodeString("005d" +
+		"e003ff00565d000000ea84e203fb23d824b87a51ab34bcf291f10086650f19" +
+		"9fe74cf34128a3bc6147c34b962122fb94d7be69d377106108d35e9684ae65" +
+		"9d6d9580669633c7ddfc504e740fc28b73ad21d75567c7da243d17dc40bceb" +
+		"00")
+	return b
+}
+
+// compProtTlv returns the first protected TLV of the specified type.
+func compProtTlv(img *Image, tlvType uint8) *ImageTlv {
+	for i := range img.ProtTlvs {
+		if img.ProtTlvs[i].Header.Type == tlvType {
+			return &img.ProtTlvs[i]
+		}
+	}
+	return nil
+}
+
+func TestCompressedHash(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x11}, ed25519.SeedSize)
+	edKey := ed25519.NewKeyFromSeed(seed)
+	key := sec.PrivSignKey{Ed25519: &edKey}
+
+	ic := NewImageCreator()
+	ic.Version = ImageVersion{1, 0, 0, 0}
+	ic.Body = compTestBody()
+	ic.Compression = IMAGE_F_COMPRESSED_LZMA2
+	ic.SigKeys = []sec.PrivSignKey{key}
+	ic.ProtTlvs = []ImageTlv{
+		ImageTlv{
+			Header: ImageTlvHdr{Type: IMAGE_TLV_SEC_CNT, Len: 4},
+			Data:   []byte{0x01, 0x00, 0x00, 0x00},
+		},
+	}
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hash and the signing digest both cover the stored body.
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+	digest, _, err := img.SigningDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, hash) {
+		t.Fatalf("signing digest differs from hash: digest=%x hash=%x",
+			digest, hash)
+	}
+	if _, err := img.VerifySigs([]sec.PubSignKey{key.PubKey()}); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := img.DecompressBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, compTestPlain()) {
+		t.Fatalf("wrong decompressed body")
+	}
+
+	// DECOMP_SHA describes the image that results from decompression.
+	plainIc := NewImageCreator()
+	plainIc.Version = ic.Version
+	plainIc.Body = compTestPlain()
+	plainIc.ProtTlvs = ic.ProtTlvs
+	plainImg, err := plainIc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainHash, err := plainImg.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shaTlv := compProtTlv(&img, IMAGE_TLV_DECOMP_SHA)
+	if !bytes.Equal(shaTlv.Data, plainHash) {
+		t.Fatalf("wrong DECOMP_SHA: have=%x want=%x", shaTlv.Data, plainHash)
+	}
+
+	// A corrupt DECOMP_SHA is detected even though the stored hash is
+	// intact.
+	bad := img.Clone()
+	compProtTlv(&bad, IMAGE_TLV_DECOMP_SHA).Data[0] ^= 0xff
+	if _, err := bad.VerifyHash(nil); err == nil {
+		t.Fatalf("corrupt DECOMP_SHA accepted")
+	}
+
+	// A corrupt body is detected.
+	bad = img.Clone()
+	bad.Body[len(bad.Body)-4] ^= 0xff
+	if _, err := bad.VerifyHash(nil); err == nil {
+		t.Fatalf("corrupt compressed body accepted")
+	}
+
+	// Decompression TLVs must be protected.
+	bad = img.Clone()
+	sizeTlv := compProtTlv(&bad, IMAGE_TLV_DECOMP_SIZE)
+	bad.Tlvs = append(bad.Tlvs, sizeTlv.Clone())
+	if _, err := bad.DecompressBody(); err == nil {
+		t.Fatalf("unprotected DECOMP_SIZE TLV accepted")
+	}
+
+	// An oversized DECOMP_SIZE is rejected before decompression, even in an
+	// image whose hash has been recalculated to match.
+	bad = img.Clone()
+	binary.LittleEndian.PutUint32(
+		compProtTlv(&bad, IMAGE_TLV_DECOMP_SIZE).Data, 0xffffffff)
+	badHash, err := bad.CalcHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range bad.Tlvs {
+		if bad.Tlvs[i].Header.Type == IMAGE_TLV_SHA256 {
+			bad.Tlvs[i].Data = badHash
+		}
+	}
+	_, err = bad.VerifyHash(nil)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("oversized DECOMP_SIZE accepted: %v", err)
+	}
+}
+
+func TestCompressedArmThumb(t *testing.T) {
+	var plain []byte
+	for i := 0; i < 64; i++ {
+		plain = append(plain, 0x00, 0xf0, 0x10, 0xf8, 0x00, 0xbf, 0x00, 0xbf)
+	}
+
+	body, _ := hex.DecodeString("005d" +
+		"e001ff00665d00003c2148f2e1878deb62a5cb6f909ea859296503025dcab4" +
+		"44bc1e61ed9c02ef2a518bbd5d005430f922e0d443ceffeedc49b3129f72fa" +
+		"62059ab41c5577cba355cf2f4a5ff81d5d391917b6a853e2565279a8d86fc8" +
+		"25d7e3c08c1a57751c8b6268e6261b0000")
+
+	ic := NewImageCreator()
+	ic.Body = body
+	ic.Compression = IMAGE_F_COMPRESSED_LZMA2 |
+		IMAGE_F_COMPRESSED_ARM_THUMB_FLT
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := img.DecompressBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Fatalf("wrong decompressed body: %x", out[:16])
+	}
+
+	// LZMA1 is recognized but cannot be decompressed.
+	ic.Compression = IMAGE_F_COMPRESSED_LZMA1
+	if _, err := ic.Create(); err == nil {
+		t.Fatalf("LZMA1 image created")
+	}
+}
+
+func TestCompressionInfo(t *testing.T) {
+	ic := NewImageCreator()
+	ic.Version = ImageVersion{1, 0, 0, 0}
+	ic.Body = make([]byte, 64)
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.CompressionInfo(); ok {
+		t.Fatalf("uncompressed image reported as compressed")
+	}
+
+	ic.Body = compTestBody()
+	ic.Compression = IMAGE_F_COMPRESSED_LZMA2
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The decompression TLVs are accounted for in the size estimate.
+	if sz, err := ic.EstimateSize(); err != nil || sz != img.TotalSize() {
+		t.Fatalf("wrong size estimate: have=%d want=%d err=%v",
+			sz, img.TotalSize(), err)
+	}
+
+	if err := img.VerifyStructure(); err != nil {
+		t.Fatal(err)
+	}
+	ci, ok := img.CompressionInfo()
+	if !ok || ci.Flags != IMAGE_F_COMPRESSED_LZMA2 || ci.Size != 1024 {
+		t.Fatalf("wrong compression info: ok=%v %+v", ok, ci)
+	}
+	if ImageCompTypeName(ci.Flags) != "lzma2" {
+		t.Fatalf("wrong compression name: %s", ImageCompTypeName(ci.Flags))
+	}
+
+	// Invalid flag combinations are rejected.
+	img.Header.Flags |= IMAGE_F_COMPRESSED_LZMA1
+	if _, ok := img.CompressionInfo(); ok {
+		t.Fatalf("image with invalid compression flags reported as " +
+			"compressed")
+	}
+	if err := img.VerifyStructure(); err == nil {
+		t.Fatalf("invalid compression flags accepted")
+	}
+	img.Header.Flags &^= IMAGE_F_COMPRESSED_LZMA1
+
+	// Decompression TLVs without a compression flag are rejected.
+	img.Header.Flags &^= IMAGE_F_COMPRESSED_LZMA2
+	if _, ok := img.CompressionInfo(); ok {
+		t.Fatalf("image without compression flag reported as compressed")
+	}
+	if err := img.VerifyStructure(); err == nil {
+		t.Fatalf("decompression TLVs without compression flag accepted")
+	}
+
+	// Callers cannot supply decompression TLVs themselves.
+	ic.ProtTlvs = []ImageTlv{*compProtTlv(&img, IMAGE_TLV_DECOMP_SIZE)}
+	if _, err := ic.Create(); err == nil {
+		t.Fatalf("caller-supplied DECOMP_SIZE TLV accepted")
+	}
+}
@@ -0,0 +1,110 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/binary"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// The CRC16 TLV provides corruption detection for devices that do not verify
+// image hashes or signatures.  It is NOT a security feature: anyone who can
+// modify an image can recompute its CRC.
+//
+// The CRC is CRC16-CCITT (polynomial 0x1021, initial value 0, no reflection),
+// as implemented by Mynewt's `crc16_ccitt()`.  It covers the image header,
+// header padding, and body as they appear in the image (i.e., the ciphertext
+// body if the image is encrypted).
+
+const crc16CcittPoly = 0x1021
+
+func crc16Ccitt(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ crc16CcittPoly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// CalcCrc calculates the CRC16 of an image's header, header padding, and
+// body.
+func (img *Image) CalcCrc() uint16 {
+	crc := crc16Ccitt(0, img.HeaderBytes())
+	crc = crc16Ccitt(crc, img.Pad)
+
+	// Account for header padding not represented in the Pad field.
+	extra := int(img.Header.HdrSz) - IMAGE_HEADER_SIZE - len(img.Pad)
+	if extra > 0 {
+		crc = crc16Ccitt(crc, make([]byte, extra))
+	}
+
+	return crc16Ccitt(crc, img.Body)
+}
+
+// BuildCrcTlv constructs a CRC16 TLV containing the specified value.
+func BuildCrcTlv(crc uint16) ImageTlv {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, crc)
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_CRC16,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}
+}
+
+// VerifyCrc checks an image's CRC16 TLV against its contents.  An error is
+// returned if the image has no CRC16 TLV or if the CRC is incorrect.  A
+// passing CRC only indicates the absence of accidental corruption; it says
+// nothing about the image's authenticity.
+func (img *Image) VerifyCrc() error {
+	tlv, err := img.FindUniqueTlv(IMAGE_TLV_CRC16)
+	if err != nil {
+		return err
+	}
+	if tlv == nil {
+		return errors.Errorf("image does not contain a CRC16 TLV")
+	}
+	if len(tlv.Data) != 2 {
+		return errors.Errorf(
+			"image contains CRC16 TLV with invalid length: %d", len(tlv.Data))
+	}
+
+	have := binary.LittleEndian.Uint16(tlv.Data)
+	want := img.CalcCrc()
+	if have != want {
+		return errors.Errorf(
+			"image contains incorrect CRC16: have=0x%04x want=0x%04x",
+			have, want)
+	}
+
+	return nil
+}
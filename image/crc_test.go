@@ -0,0 +1,72 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCrc16(t *testing.T) {
+	// Standard check value for CRC16-CCITT with a zero seed (XMODEM).
+	if crc := crc16Ccitt(0, []byte("123456789")); crc != 0x31c3 {
+		t.Fatalf("wrong CRC16: have=0x%04x want=0x31c3", crc)
+	}
+
+	ic := NewImageCreator()
+	ic.Version = ImageVersion{1, 0, 0, 0}
+	ic.HeaderSize = 64
+	ic.Body = []byte("123456789")
+	ic.Crc16 = true
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.VerifyCrc(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := img.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	img2, err := ParseImage(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img2.VerifyCrc(); err != nil {
+		t.Fatal(err)
+	}
+
+	img2.Body[0] ^= 0x01
+	if err := img2.VerifyCrc(); err == nil {
+		t.Fatalf("corrupt image passed CRC check")
+	}
+
+	ic.Crc16 = false
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.VerifyCrc(); err == nil {
+		t.Fatalf("image without CRC16 TLV passed CRC check")
+	}
+}
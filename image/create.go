@@ -22,29 +22,97 @@ package image
 import (
 	"bytes"
 	"crypto"
-	"crypto/ecdsa"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/asn1"
 	"encoding/binary"
 	"io/ioutil"
-	"math/big"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/sec"
-	"golang.org/x/crypto/ed25519"
 )
 
+// SignAlgo identifies a signature algorithm (see sec.SignAlgo).  Its values
+// are the corresponding image signature TLV types.
+type SignAlgo = sec.SignAlgo
+
+const (
+	SIGN_ALGO_RSA2048  = sec.SIGN_ALGO_RSA2048
+	SIGN_ALGO_ECDSA224 = sec.SIGN_ALGO_ECDSA224
+	SIGN_ALGO_ECDSA256 = sec.SIGN_ALGO_ECDSA256
+	SIGN_ALGO_RSA3072  = sec.SIGN_ALGO_RSA3072
+	SIGN_ALGO_ED25519  = sec.SIGN_ALGO_ED25519
+)
+
+// SignFunc produces a raw signature over an image digest.  It is called with
+// the 4-byte hash of the signing key and the digest to sign (see
+// Image.SigningDigest).
+type SignFunc func(keyHash []byte, digest []byte) ([]byte, SignAlgo, error)
+
+// ExtSigner signs an image via a callback rather than a local private key.
+// The public key is required to generate the image's keyhash TLV.
+type ExtSigner struct {
+	PubKey sec.PubSignKey
+	Sign   SignFunc
+}
+
 type ImageCreator struct {
 	Body         []byte
 	Version      ImageVersion
 	SigKeys      []sec.PrivSignKey
+	ExtSigners   []ExtSigner
 	PlainSecret  []byte
 	CipherSecret []byte
 	HeaderSize   int
 	InitialHash  []byte
 	Bootable     bool
+
+	// Load address to record in the header (see ImageHdr.LoadAddr).  For an
+	// execute-in-place image, this is the base of the flash area the image
+	// runs from.
+	LoadAddr uint32
+
+	// Whether the image is copied to LoadAddr before it runs, rather than
+	// executing in place.
+	RamLoad bool
+
+	// Whether to emit a CRC16 TLV (see CalcCrc).
+	Crc16 bool
+
+	// Compression flags (IMAGE_F_COMPRESSED_[...]) describing Body.  If
+	// nonzero, Body must contain a compressed payload in imgtool's format,
+	// and the protected DECOMP_SIZE and DECOMP_SHA TLVs are generated from
+	// its decompressed contents.
+	Compression uint32
+
+	// Serialization of ECDSA signatures.  The default is DER, padded to a
+	// fixed length.
+	EcdsaSigEncoding sec.EcdsaSigEncoding
+
+	// Whether to normalize ECDSA signatures to low-S form (see
+	// sec.EcdsaSignOpts).
+	EcdsaLowS bool
+
+	// TLVs to place in the protected region (e.g., security counter,
+	// dependencies).  These are covered by the image hash and signatures.
+	ProtTlvs []ImageTlv
+
+	// If nonzero, the hash TLV contains only this many leading bytes of the
+	// SHA256, for boot loaders that store a truncated hash.  Signatures still
+	// cover the full digest.  Must be in [IMAGE_HASH_MIN_SZ, IMAGE_HASH_SZ].
+	HashLen int
+
+	// If greater than 1, the header is padded so that the body starts at a
+	// multiple of this many bytes, for boot loaders that expect a particular
+	// alignment.  The padding is applied on top of HeaderSize and is covered
+	// by the image hash.
+	BodyAlign int
+
+	// Flash write size and maximum sector count of the slots the image is
+	// destined for, as given to imgtool's --align and --max-sectors options.
+	// These determine the size of the MCUboot trailer (see
+	// SlotTrailerSize).  NewImageCreator sets imgtool's defaults.
+	SlotWriteSize  int
+	SlotMaxSectors int
 }
 
 type ImageCreateOpts struct {
@@ -53,45 +121,49 @@ type ImageCreateOpts struct {
 	Version           ImageVersion
 	SigKeys           []sec.PrivSignKey
 	LoaderHash        []byte
-}
 
-type ECDSASig struct {
-	R *big.Int
-	S *big.Int
+	// Content-encryption key used to encrypt the body.  If nil, a random key
+	// is generated.  Only used if SrcEncKeyFilename is specified.  Because
+	// the AES-CTR nonce is fixed (see sec.AesCtrNonce), supplying this key
+	// makes the encrypted body deterministic.
+	//
+	// WARNING: with a fixed nonce, every body encrypted under the same key
+	// shares one keystream.  XORing two such ciphertexts yields the XOR of
+	// their plaintexts, so a key supplied here must never be used for more
+	// than one distinct body.  Reproducing an image from identical inputs is
+	// safe; reusing a key across builds, versions, or products is not.
+	PlainSecret []byte
+
+	// If true, an AES key-encryption key wraps the content key with AES-GCM
+	// rather than AES-KW.
+	EncKeyGcm bool
 }
 
+type ECDSASig = sec.ECDSASig
+
 func NewImageCreator() ImageCreator {
 	return ImageCreator{
-		HeaderSize: IMAGE_HEADER_SIZE,
-		Bootable:   true,
+		HeaderSize:     IMAGE_HEADER_SIZE,
+		Bootable:       true,
+		SlotWriteSize:  1,
+		SlotMaxSectors: 128,
 	}
 }
 
 func sigTlvType(key sec.PrivSignKey) uint8 {
-	key.AssertValid()
+	return uint8(key.Type())
+}
 
-	if key.Rsa != nil {
-		pubk := key.Rsa.Public().(*rsa.PublicKey)
-		switch pubk.Size() {
-		case 256:
-			return IMAGE_TLV_RSA2048
-		case 384:
-			return IMAGE_TLV_RSA3072
-		default:
-			return 0
-		}
-	} else if key.Ec != nil {
-		switch key.Ec.Curve.Params().Name {
-		case "P-224":
-			return IMAGE_TLV_ECDSA224
-		case "P-256":
-			return IMAGE_TLV_ECDSA256
-		default:
-			return 0
+// sigTlvAlgo returns the signature algorithm of TLVs with the specified type,
+// or sec.SIGN_ALGO_UNKNOWN if tlvType is not a supported signature type.
+func sigTlvAlgo(tlvType uint8) SignAlgo {
+	for _, algo := range supportedSignAlgos {
+		if uint8(algo) == tlvType {
+			return algo
 		}
-	} else {
-		return IMAGE_TLV_ED25519
 	}
+
+	return sec.SIGN_ALGO_UNKNOWN
 }
 
 func GenerateEncTlv(cipherSecret []byte) (ImageTlv, error) {
@@ -99,7 +171,14 @@ func GenerateEncTlv(cipherSecret []byte) (ImageTlv, error) {
 
 	if len(cipherSecret) == 256 {
 		encType = IMAGE_TLV_ENC_RSA
-	} else if len(cipherSecret) == 24 {
+	} else if len(cipherSecret) == sec.ECIES_P256_TOTAL_SZ {
+		encType = IMAGE_TLV_ENC_EC256
+	} else if sec.IsGcmWrappedSize(len(cipherSecret)) {
+		// AES-GCM-wrapped secret: nonce, ciphertext, and tag.
+		encType = IMAGE_TLV_ENC_GCM
+	} else if len(cipherSecret) >= 16 && len(cipherSecret)%8 == 0 {
+		// AES key-wrapped secret; RFC 5649 padding allows wrapped lengths
+		// other than 24 when the content key is not 16 bytes.
 		encType = IMAGE_TLV_ENC_KEK
 	} else {
 		return ImageTlv{}, errors.Errorf("invalid enc TLV size: %d", len(cipherSecret))
@@ -116,34 +195,28 @@ func GenerateEncTlv(cipherSecret []byte) (ImageTlv, error) {
 }
 
 func GenerateSigRsa(key sec.PrivSignKey, hash []byte) ([]byte, error) {
-	opts := rsa.PSSOptions{
-		SaltLength: rsa.PSSSaltLengthEqualsHash,
-	}
-	signature, err := rsa.SignPSS(
-		rand.Reader, key.Rsa, crypto.SHA256, hash, &opts)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to compute signature")
-	}
-
-	return signature, nil
+	return key.SignDigest(hash, crypto.SHA256)
 }
 
 func GenerateSigEc(key sec.PrivSignKey, hash []byte) ([]byte, error) {
-	r, s, err := ecdsa.Sign(rand.Reader, key.Ec, hash)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to compute signature")
-	}
+	return generateSigEc(key, hash, sec.EcdsaSignOpts{})
+}
 
-	ECDSA := ECDSASig{
-		R: r,
-		S: s,
-	}
+func generateSigEc(key sec.PrivSignKey, hash []byte,
+	opts sec.EcdsaSignOpts) ([]byte, error) {
 
-	signature, err := asn1.Marshal(ECDSA)
+	signature, err := key.SignDigestOpts(hash, crypto.SHA256, opts)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to construct signature")
+		return nil, err
+	}
+
+	// Raw signatures are inherently fixed-length.
+	if opts.Encoding == sec.ECDSA_SIG_ENC_RAW {
+		return signature, nil
 	}
 
+	// The image format requires ECDSA signatures to be padded out to a
+	// fixed length.
 	sigLen := key.SigLen()
 	if len(signature) > int(sigLen) {
 		return nil, errors.Errorf("signature truncated")
@@ -156,24 +229,22 @@ func GenerateSigEc(key sec.PrivSignKey, hash []byte) ([]byte, error) {
 }
 
 func GenerateSigEd25519(key sec.PrivSignKey, hash []byte) ([]byte, error) {
-	sig := ed25519.Sign(*key.Ed25519, hash)
-
-	if len(sig) != ed25519.SignatureSize {
-		return nil, errors.Errorf(
-			"ed25519 signature has wrong length: have=%d want=%d",
-			len(sig), ed25519.SignatureSize)
-	}
-
-	return sig, nil
+	return key.SignDigest(hash, crypto.SHA256)
 }
 
 func GenerateSig(key sec.PrivSignKey, hash []byte) ([]byte, error) {
+	return generateSig(key, hash, sec.EcdsaSignOpts{})
+}
+
+func generateSig(key sec.PrivSignKey, hash []byte,
+	opts sec.EcdsaSignOpts) ([]byte, error) {
+
 	key.AssertValid()
 
 	if key.Rsa != nil {
 		return GenerateSigRsa(key, hash)
 	} else if key.Ec != nil {
-		return GenerateSigEc(key, hash)
+		return generateSigEc(key, hash, opts)
 	} else {
 		return GenerateSigEd25519(key, hash)
 	}
@@ -192,6 +263,12 @@ func BuildKeyHashTlv(keyBytes []byte) ImageTlv {
 }
 
 func BuildSigTlvs(keys []sec.PrivSignKey, hash []byte) ([]ImageTlv, error) {
+	return buildSigTlvs(keys, hash, sec.EcdsaSignOpts{})
+}
+
+func buildSigTlvs(keys []sec.PrivSignKey, hash []byte,
+	opts sec.EcdsaSignOpts) ([]ImageTlv, error) {
+
 	var tlvs []ImageTlv
 
 	for _, key := range keys {
@@ -206,7 +283,7 @@ func BuildSigTlvs(keys []sec.PrivSignKey, hash []byte) ([]ImageTlv, error) {
 		tlvs = append(tlvs, tlv)
 
 		// Signature TLV.
-		sig, err := GenerateSig(key, hash)
+		sig, err := generateSig(key, hash, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -223,6 +300,46 @@ func BuildSigTlvs(keys []sec.PrivSignKey, hash []byte) ([]ImageTlv, error) {
 	return tlvs, nil
 }
 
+// BuildExtSigTlvs produces keyhash and signature TLVs by calling out to the
+// provided external signers.
+func BuildExtSigTlvs(signers []ExtSigner, hash []byte) ([]ImageTlv, error) {
+	var tlvs []ImageTlv
+
+	for _, signer := range signers {
+		if signer.Sign == nil {
+			return nil, errors.Errorf("external signer has no signing function")
+		}
+
+		// Key hash TLV.
+		pubKey, err := signer.PubKey.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		tlv := BuildKeyHashTlv(pubKey)
+		tlvs = append(tlvs, tlv)
+
+		// Signature TLV.
+		sig, algo, err := signer.Sign(tlv.Data, hash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "external signer failed")
+		}
+		if !ImageTlvTypeIsSig(uint8(algo)) {
+			return nil, errors.Errorf(
+				"external signer returned invalid algorithm: %d", algo)
+		}
+		tlv = ImageTlv{
+			Header: ImageTlvHdr{
+				Type: uint8(algo),
+				Len:  uint16(len(sig)),
+			},
+			Data: sig,
+		}
+		tlvs = append(tlvs, tlv)
+	}
+
+	return tlvs, nil
+}
+
 func GeneratePlainSecret() ([]byte, error) {
 	plainSecret := make([]byte, 16)
 	if _, err := rand.Read(plainSecret); err != nil {
@@ -252,9 +369,12 @@ func GenerateImage(opts ImageCreateOpts) (Image, error) {
 	}
 
 	if opts.SrcEncKeyFilename != "" {
-		plainSecret, err := GeneratePlainSecret()
-		if err != nil {
-			return Image{}, err
+		plainSecret := opts.PlainSecret
+		if plainSecret == nil {
+			plainSecret, err = GeneratePlainSecret()
+			if err != nil {
+				return Image{}, err
+			}
 		}
 
 		pubKeBytes, err := ioutil.ReadFile(opts.SrcEncKeyFilename)
@@ -266,6 +386,7 @@ func GenerateImage(opts ImageCreateOpts) (Image, error) {
 		if err != nil {
 			return Image{}, err
 		}
+		pubKe.AesGcm = opts.EncKeyGcm
 
 		cipherSecret, err := pubKe.Encrypt(plainSecret)
 		if err != nil {
@@ -285,7 +406,7 @@ func GenerateImage(opts ImageCreateOpts) (Image, error) {
 }
 
 func calcHash(initialHash []byte, hdr ImageHdr, pad []byte,
-	plainBody []byte) ([]byte, error) {
+	plainBody []byte, protTlvs []ImageTlv) ([]byte, error) {
 
 	hash := sha256.New()
 
@@ -315,7 +436,8 @@ func calcHash(initialHash []byte, hdr ImageHdr, pad []byte,
 		return nil, err
 	}
 
-	extra := hdr.HdrSz - IMAGE_HEADER_SIZE
+	// Account for header padding not represented in the pad slice.
+	extra := int(hdr.HdrSz) - IMAGE_HEADER_SIZE - len(pad)
 	if extra > 0 {
 		b := make([]byte, extra)
 		if err := add(b); err != nil {
@@ -327,16 +449,154 @@ func calcHash(initialHash []byte, hdr ImageHdr, pad []byte,
 		return nil, err
 	}
 
+	// The protected region is covered by the hash only if the header
+	// indicates that one is present.
+	if hdr.ProtSz() > 0 {
+		trailer := (&Image{ProtTlvs: protTlvs}).ProtTrailer()
+		if err := add(trailer); err != nil {
+			return nil, err
+		}
+
+		for _, tlv := range protTlvs {
+			if err := add(tlv.Header); err != nil {
+				return nil, err
+			}
+			if err := add(tlv.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return hash.Sum(nil), nil
 }
 
+// BuildOpts specifies the optional parts of an image created with Build.
+type BuildOpts struct {
+	// Keys to sign the image with.  If empty, the image is unsigned.
+	SigKeys []sec.PrivSignKey
+
+	// Key to encrypt the image's content key with.  If nil, the image is not
+	// encrypted.
+	EncKey *sec.PubEncKey
+
+	// Content-encryption key.  If nil, a random key is generated.  Only
+	// valid if EncKey is specified.
+	PlainSecret []byte
+
+	// Image hash algorithm.  Only "sha256" is supported; the empty string
+	// selects it by default.
+	HashAlgo string
+
+	// If nonzero, the number of leading hash bytes to store in the hash TLV
+	// (see ImageCreator.HashLen).
+	HashLen int
+
+	// TLVs to place in the protected region.
+	ProtTlvs []ImageTlv
+}
+
+// validate checks a set of build options for unsupported or conflicting
+// settings.
+func (opts *BuildOpts) validate() error {
+	switch opts.HashAlgo {
+	case "", "sha256":
+	default:
+		return errors.Errorf(
+			"unsupported image hash algorithm: \"%s\"", opts.HashAlgo)
+	}
+
+	if opts.HashLen != 0 &&
+		(opts.HashLen < IMAGE_HASH_MIN_SZ || opts.HashLen > IMAGE_HASH_SZ) {
+
+		return errors.Errorf(
+			"hash length %d conflicts with algorithm sha256: min=%d max=%d",
+			opts.HashLen, IMAGE_HASH_MIN_SZ, IMAGE_HASH_SZ)
+	}
+
+	if opts.PlainSecret != nil && opts.EncKey == nil {
+		return errors.Errorf(
+			"content-encryption key specified without an encryption key")
+	}
+
+	for _, tlv := range opts.ProtTlvs {
+		if tlv.Header.Type == IMAGE_TLV_SHA256 {
+			return errors.Errorf(
+				"protected TLVs conflict with generated hash TLV")
+		}
+	}
+
+	return nil
+}
+
+// Build creates a complete image from a body in a single call: the image is
+// hashed, signed with each of the supplied keys, and, if an encryption key
+// is given, encrypted.  All options are validated before any work is done.
+// Use ImageCreator directly for settings not covered by BuildOpts.
+func Build(body []byte, version ImageVersion, opts BuildOpts) (Image, error) {
+	if err := opts.validate(); err != nil {
+		return Image{}, err
+	}
+
+	ic := NewImageCreator()
+	ic.Body = body
+	ic.Version = version
+	ic.SigKeys = opts.SigKeys
+	ic.HashLen = opts.HashLen
+	ic.ProtTlvs = opts.ProtTlvs
+
+	if opts.EncKey != nil {
+		plainSecret := opts.PlainSecret
+		if plainSecret == nil {
+			var err error
+			plainSecret, err = GeneratePlainSecret()
+			if err != nil {
+				return Image{}, err
+			}
+		}
+
+		cipherSecret, err := opts.EncKey.Encrypt(plainSecret)
+		if err != nil {
+			return Image{}, err
+		}
+
+		ic.PlainSecret = plainSecret
+		ic.CipherSecret = cipherSecret
+	}
+
+	return ic.Create()
+}
+
+// headerSize calculates the size of the header that Create produces,
+// including any padding required by HeaderSize and BodyAlign.
+func (ic *ImageCreator) headerSize() (int, error) {
+	size := IMAGE_HEADER_SIZE
+	if ic.HeaderSize != 0 {
+		if ic.HeaderSize < IMAGE_HEADER_SIZE {
+			return 0, errors.Errorf(
+				"image header must be at least %d bytes", IMAGE_HEADER_SIZE)
+		}
+		size = ic.HeaderSize
+	}
+
+	if ic.BodyAlign > 1 {
+		size = (size + ic.BodyAlign - 1) / ic.BodyAlign * ic.BodyAlign
+	}
+
+	if size > 0xffff {
+		return 0, errors.Errorf(
+			"image header too large: have=%d max=%d", size, 0xffff)
+	}
+
+	return size, nil
+}
+
 func (ic *ImageCreator) Create() (Image, error) {
 	img := Image{}
 
 	// First the header
 	img.Header = ImageHdr{
 		Magic: IMAGE_MAGIC,
-		Pad1:  0,
+		Pad1:  ic.LoadAddr,
 		HdrSz: IMAGE_HEADER_SIZE,
 		Pad2:  0,
 		ImgSz: uint32(len(ic.Body)),
@@ -349,30 +609,78 @@ func (ic *ImageCreator) Create() (Image, error) {
 		img.Header.Flags |= IMAGE_F_NON_BOOTABLE
 	}
 
+	if ic.RamLoad {
+		img.Header.Flags |= IMAGE_F_RAM_LOAD
+	}
+
 	if ic.CipherSecret != nil {
 		img.Header.Flags |= IMAGE_F_ENCRYPTED
 	}
 
-	if ic.HeaderSize != 0 {
+	if ic.Compression&^compFlagsMask != 0 {
+		return img, errors.Errorf(
+			"invalid compression flags: 0x%x", ic.Compression)
+	}
+	img.Header.Flags |= ic.Compression
+
+	hdrSz, err := ic.headerSize()
+	if err != nil {
+		return img, err
+	}
+	if hdrSz != IMAGE_HEADER_SIZE || ic.HeaderSize != 0 {
 		// Pad the header out to the given size.  There will just be zeros
 		// between the header and the start of the image when it is padded.
-		extra := ic.HeaderSize - IMAGE_HEADER_SIZE
-		if extra < 0 {
+		img.Header.HdrSz = uint16(hdrSz)
+		img.Pad = make([]byte, hdrSz-IMAGE_HEADER_SIZE)
+	}
+
+	// Protected TLVs follow the body and precede the unprotected trailer
+	// (and the hash TLV it contains).  The header records their total size
+	// so that the hash covers them.
+	for _, tlv := range ic.ProtTlvs {
+		if tlv.Header.Type == IMAGE_TLV_SHA256 ||
+			ImageTlvTypeIsSig(tlv.Header.Type) ||
+			ImageTlvTypeIsSecret(tlv.Header.Type) ||
+			imageTlvTypeIsDecomp(tlv.Header.Type) {
+
 			return img, errors.Errorf(
-				"image header must be at least %d bytes", IMAGE_HEADER_SIZE)
+				"TLV type %s cannot be placed in protected region",
+				ImageTlvTypeName(tlv.Header.Type))
+		}
+		if int(tlv.Header.Len) != len(tlv.Data) {
+			return img, errors.Errorf(
+				"protected TLV has inconsistent length: hdr=%d data=%d",
+				tlv.Header.Len, len(tlv.Data))
 		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv.Clone())
+	}
 
-		img.Header.HdrSz = uint16(ic.HeaderSize)
-		img.Pad = make([]byte, extra)
+	if ic.Compression != 0 {
+		tlvs, err := buildDecompTlvs(img.Header, img.Pad, ic.Body,
+			img.ProtTlvs)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlvs...)
 	}
+	img.Header.SetProtSz(img.ProtSize())
 
-	hashBytes, err := calcHash(ic.InitialHash, img.Header, img.Pad, ic.Body)
+	hashBytes, err := calcHash(ic.InitialHash, img.Header, img.Pad, ic.Body,
+		img.ProtTlvs)
 	if err != nil {
 		return img, err
 	}
 
 	// Followed by data.
 	if ic.CipherSecret != nil {
+		switch len(ic.PlainSecret) {
+		case 16, 24, 32:
+		default:
+			return img, errors.Errorf(
+				"invalid content-encryption key length: %d",
+				len(ic.PlainSecret))
+		}
+
 		encBody, err := sec.EncryptAES(ic.Body, ic.PlainSecret)
 		if err != nil {
 			return img, err
@@ -383,17 +691,39 @@ func (ic *ImageCreator) Create() (Image, error) {
 	}
 
 	// Hash TLV.
+	tlvHash := hashBytes
+	if ic.HashLen != 0 {
+		if ic.HashLen < IMAGE_HASH_MIN_SZ || ic.HashLen > len(hashBytes) {
+			return img, errors.Errorf(
+				"invalid hash length: have=%d min=%d max=%d",
+				ic.HashLen, IMAGE_HASH_MIN_SZ, len(hashBytes))
+		}
+		tlvHash = hashBytes[:ic.HashLen]
+	}
 	tlv := ImageTlv{
 		Header: ImageTlvHdr{
 			Type: IMAGE_TLV_SHA256,
 			Pad:  0,
-			Len:  uint16(len(hashBytes)),
+			Len:  uint16(len(tlvHash)),
 		},
-		Data: hashBytes,
+		Data: tlvHash,
 	}
 	img.Tlvs = append(img.Tlvs, tlv)
 
-	tlvs, err := BuildSigTlvs(ic.SigKeys, hashBytes)
+	if ic.Crc16 {
+		img.Tlvs = append(img.Tlvs, BuildCrcTlv(img.CalcCrc()))
+	}
+
+	tlvs, err := buildSigTlvs(ic.SigKeys, hashBytes, sec.EcdsaSignOpts{
+		Encoding: ic.EcdsaSigEncoding,
+		LowS:     ic.EcdsaLowS,
+	})
+	if err != nil {
+		return img, err
+	}
+	img.Tlvs = append(img.Tlvs, tlvs...)
+
+	tlvs, err = BuildExtSigTlvs(ic.ExtSigners, hashBytes)
 	if err != nil {
 		return img, err
 	}
@@ -409,3 +739,82 @@ func (ic *ImageCreator) Create() (Image, error) {
 
 	return img, nil
 }
+
+// EstimateSize calculates the TotalSize of the image that Create would
+// produce, without hashing, signing, or encrypting anything.  The result is
+// exact: it is the size of an image laid out with placeholder TLVs of the
+// lengths Create generates.  Images with external signers cannot be estimated
+// because their signature lengths are not known in advance.
+func (ic *ImageCreator) EstimateSize() (int, error) {
+	if len(ic.ExtSigners) > 0 {
+		return 0, errors.Errorf(
+			"cannot estimate size of image with external signers")
+	}
+
+	hdrSz, err := ic.headerSize()
+	if err != nil {
+		return 0, err
+	}
+
+	placeholder := func(tlvType uint8, dataLen int) ImageTlv {
+		return ImageTlv{
+			Header: ImageTlvHdr{Type: tlvType, Len: uint16(dataLen)},
+			Data:   make([]byte, dataLen),
+		}
+	}
+
+	// Encryption does not change the body length.
+	img := Image{
+		Pad:  make([]byte, hdrSz-IMAGE_HEADER_SIZE),
+		Body: ic.Body,
+	}
+
+	img.ProtTlvs = append(img.ProtTlvs, ic.ProtTlvs...)
+	if ic.Compression != 0 {
+		img.ProtTlvs = append(img.ProtTlvs,
+			placeholder(IMAGE_TLV_DECOMP_SIZE, 4),
+			placeholder(IMAGE_TLV_DECOMP_SHA, IMAGE_HASH_SZ))
+	}
+
+	hashLen := IMAGE_HASH_SZ
+	if ic.HashLen != 0 {
+		if ic.HashLen < IMAGE_HASH_MIN_SZ || ic.HashLen > IMAGE_HASH_SZ {
+			return 0, errors.Errorf(
+				"invalid hash length: have=%d min=%d max=%d",
+				ic.HashLen, IMAGE_HASH_MIN_SZ, IMAGE_HASH_SZ)
+		}
+		hashLen = ic.HashLen
+	}
+	img.Tlvs = append(img.Tlvs, placeholder(IMAGE_TLV_SHA256, hashLen))
+
+	if ic.Crc16 {
+		img.Tlvs = append(img.Tlvs, placeholder(IMAGE_TLV_CRC16, 2))
+	}
+
+	opts := sec.EcdsaSignOpts{
+		Encoding: ic.EcdsaSigEncoding,
+		LowS:     ic.EcdsaLowS,
+	}
+	for _, key := range ic.SigKeys {
+		key.AssertValid()
+
+		sigLen := int(key.SigLenOpts(opts))
+		if sigLen == 0 {
+			return 0, errors.Errorf("unsupported signing key")
+		}
+
+		img.Tlvs = append(img.Tlvs,
+			placeholder(IMAGE_TLV_KEYHASH, len(sec.RawKeyHash(nil))),
+			placeholder(sigTlvType(key), sigLen))
+	}
+
+	if ic.CipherSecret != nil {
+		tlv, err := GenerateEncTlv(ic.CipherSecret)
+		if err != nil {
+			return 0, err
+		}
+		img.Tlvs = append(img.Tlvs, tlv)
+	}
+
+	return img.TotalSize(), nil
+}
@@ -0,0 +1,185 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// EqualOpts specifies which parts of an image are disregarded when comparing
+// two images.
+type EqualOpts struct {
+	// Ignore signature TLVs.
+	IgnoreSigs bool
+
+	// Ignore KEYHASH TLVs.
+	IgnoreKeyHash bool
+
+	// Ignore the build number in the image header's version.  The SHA256 TLV
+	// covers the header, so it is ignored as well.
+	IgnoreBuildNum bool
+}
+
+// ignoreTlv indicates whether a TLV is excluded from comparison.
+func (opts *EqualOpts) ignoreTlv(tlv ImageTlv) bool {
+	switch {
+	case opts.IgnoreSigs && ImageTlvTypeIsSig(tlv.Header.Type):
+		return true
+	case opts.IgnoreKeyHash && tlv.Header.Type == IMAGE_TLV_KEYHASH:
+		return true
+	case opts.IgnoreBuildNum && tlv.Header.Type == IMAGE_TLV_SHA256:
+		return true
+	default:
+		return false
+	}
+}
+
+func (opts *EqualOpts) filterTlvs(tlvs []ImageTlv) []ImageTlv {
+	var filtered []ImageTlv
+	for _, tlv := range tlvs {
+		if !opts.ignoreTlv(tlv) {
+			filtered = append(filtered, tlv)
+		}
+	}
+
+	return filtered
+}
+
+// diffTlvs describes the differences between two TLV lists.  The region name
+// is used in the descriptions.
+func diffTlvs(region string, a []ImageTlv, b []ImageTlv) []string {
+	var diffs []string
+
+	if len(a) != len(b) {
+		return append(diffs, fmt.Sprintf(
+			"%s TLV count differs: %d != %d", region, len(a), len(b)))
+	}
+
+	for i, _ := range a {
+		if a[i].Header != b[i].Header {
+			diffs = append(diffs, fmt.Sprintf(
+				"%s TLV %d header differs: %+v != %+v",
+				region, i, a[i].Header, b[i].Header))
+		} else if !bytes.Equal(a[i].Data, b[i].Data) {
+			diffs = append(diffs, fmt.Sprintf(
+				"%s TLV %d (%s) data differs",
+				region, i, ImageTlvTypeName(a[i].Header.Type)))
+		}
+	}
+
+	return diffs
+}
+
+// Diff describes the differences between two images, disregarding the parts
+// specified by opts.  It returns one human-readable string per difference, or
+// nil if the images are equivalent.
+//
+// Ignored TLVs are removed before comparison, so TLV indices in the
+// descriptions refer to the filtered lists.  Trailer lengths are not compared
+// directly; they follow from the TLVs.
+func (img *Image) Diff(other Image, opts EqualOpts) []string {
+	var diffs []string
+
+	ha := img.Header
+	hb := other.Header
+	if opts.IgnoreBuildNum {
+		ha.Vers.BuildNum = 0
+		hb.Vers.BuildNum = 0
+	}
+	if ha != hb {
+		diffs = append(diffs, fmt.Sprintf(
+			"header differs: %+v != %+v", ha, hb))
+	}
+
+	if !bytes.Equal(img.Pad, other.Pad) {
+		diffs = append(diffs, "header padding differs")
+	}
+
+	if !bytes.Equal(img.Body, other.Body) {
+		diffs = append(diffs, fmt.Sprintf(
+			"body differs: len=%d len=%d", len(img.Body), len(other.Body)))
+	}
+
+	diffs = append(diffs, diffTlvs("protected",
+		opts.filterTlvs(img.ProtTlvs), opts.filterTlvs(other.ProtTlvs))...)
+	diffs = append(diffs, diffTlvs("unprotected",
+		opts.filterTlvs(img.Tlvs), opts.filterTlvs(other.Tlvs))...)
+
+	return diffs
+}
+
+// EqualIgnoring indicates whether two images are equivalent, disregarding the
+// parts specified by ignore.
+func (img *Image) EqualIgnoring(other Image, ignore EqualOpts) bool {
+	return len(img.Diff(other, ignore)) == 0
+}
+
+// contentIdOpts specifies the TLVs that do not contribute to an image's
+// content ID.
+var contentIdOpts = EqualOpts{
+	IgnoreSigs:     true,
+	IgnoreKeyHash:  true,
+	IgnoreBuildNum: true,
+}
+
+// ContentID returns a stable identifier for an image's content: the hex
+// SHA256 of a canonical form that omits fields which vary between otherwise
+// identical builds.  The canonical form is the image as serialized by Write
+// after the following changes:
+//  1. The build number field of the header's version is zeroed.  Other
+//     header fields (including HdrSz, and thus the amount of header padding)
+//     are retained.
+//  2. The header padding is zero-filled.
+//  3. SHA256, KEYHASH, signature, and CRC16 TLVs are removed from the
+//     unprotected TLVs; the unprotected trailer's length is adjusted to
+//     match.  Protected TLVs are retained.
+//
+// The body is retained as stored (i.e., ciphertext if the image is
+// encrypted).  Two images with the same content ID are equal according to
+// EqualIgnoring with IgnoreSigs, IgnoreKeyHash, and IgnoreBuildNum set, apart
+// from header padding and CRC16 TLVs.
+//
+// Serialization fails only if a TLV region exceeds the 64 KiB limit imposed
+// by the trailer's length field, which no parsed image does.  Such an image
+// has no content ID; the empty string is returned.
+func (img *Image) ContentID() string {
+	canon := img.Clone()
+	canon.Header.Vers.BuildNum = 0
+
+	// Write zero-fills any header padding the Pad field doesn't represent.
+	canon.Pad = nil
+
+	canon.Tlvs = nil
+	for _, tlv := range contentIdOpts.filterTlvs(img.Tlvs) {
+		if tlv.Header.Type != IMAGE_TLV_CRC16 {
+			canon.Tlvs = append(canon.Tlvs, tlv)
+		}
+	}
+
+	hash := sha256.New()
+	if _, err := canon.Write(hash); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,114 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEqualIgnoring(t *testing.T) {
+	unsigned, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !unsigned.EqualIgnoring(unsigned.Clone(), EqualOpts{}) {
+		t.Fatalf("image not equal to its clone")
+	}
+
+	if unsigned.EqualIgnoring(signed, EqualOpts{}) {
+		t.Fatalf("signed and unsigned images compared equal")
+	}
+	sigOpts := EqualOpts{IgnoreSigs: true, IgnoreKeyHash: true}
+	if diffs := unsigned.Diff(signed, sigOpts); len(diffs) != 0 {
+		t.Fatalf("images differ in more than signatures: %v", diffs)
+	}
+
+	rebuilt := unsigned.Clone()
+	rebuilt.Header.Vers.BuildNum++
+	if unsigned.EqualIgnoring(rebuilt, sigOpts) {
+		t.Fatalf("images with different build numbers compared equal")
+	}
+	if !unsigned.EqualIgnoring(rebuilt, EqualOpts{IgnoreBuildNum: true}) {
+		t.Fatalf("build number not ignored")
+	}
+
+	rebuilt.Body[0] ^= 0xff
+	if unsigned.EqualIgnoring(rebuilt, EqualOpts{IgnoreBuildNum: true}) {
+		t.Fatalf("images with different bodies compared equal")
+	}
+}
+
+func TestContentID(t *testing.T) {
+	unsigned, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := unsigned.ContentID()
+	if len(id) != 64 {
+		t.Fatalf("wrong content ID length: %s", id)
+	}
+	if signed.ContentID() != id {
+		t.Fatalf("signatures affect content ID")
+	}
+
+	rebuilt := unsigned.Clone()
+	rebuilt.Header.Vers.BuildNum++
+	rebuilt.Tlvs = append(rebuilt.Tlvs, BuildCrcTlv(rebuilt.CalcCrc()))
+	if rebuilt.ContentID() != id {
+		t.Fatalf("build number or CRC affects content ID")
+	}
+
+	// Padding contents are normalized; its size is not.
+	padded := unsigned.Clone()
+	padded.Pad = bytes.Repeat([]byte{0xff},
+		int(padded.Header.HdrSz)-IMAGE_HEADER_SIZE)
+	if padded.ContentID() != id {
+		t.Fatalf("header padding contents affect content ID")
+	}
+	padded.Header.HdrSz += 8
+	if padded.ContentID() == id {
+		t.Fatalf("header size does not affect content ID")
+	}
+
+	rebuilt.Body[0] ^= 0xff
+	if rebuilt.ContentID() == id {
+		t.Fatalf("body change does not affect content ID")
+	}
+
+	// An image that cannot be serialized has no content ID.
+	rebuilt.ProtTlvs = append(rebuilt.ProtTlvs, ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_BUILD_INFO},
+		Data:   make([]byte, 0x10000),
+	})
+	if id := rebuilt.ContentID(); id != "" {
+		t.Fatalf("unserializable image has content ID: %s", id)
+	}
+}
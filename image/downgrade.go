@@ -0,0 +1,158 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// ErrDowngrade indicates that a candidate image would roll back the firmware
+// installed on a device.
+type ErrDowngrade struct {
+	// True if the images were compared by security counter; false if they
+	// were compared by version.
+	BySecCnt bool
+
+	// True if the installed image has a security counter but the candidate
+	// does not.
+	CandidateNoSecCnt bool
+
+	CandidateSecCnt  uint32
+	InstalledSecCnt  uint32
+	CandidateVersion ImageVersion
+	InstalledVersion ImageVersion
+}
+
+func (e *ErrDowngrade) Error() string {
+	if e.CandidateNoSecCnt {
+		return fmt.Sprintf(
+			"image downgrade: no security counter; installed has %d",
+			e.InstalledSecCnt)
+	} else if e.BySecCnt {
+		return fmt.Sprintf(
+			"image downgrade: security counter %d less than installed %d",
+			e.CandidateSecCnt, e.InstalledSecCnt)
+	} else {
+		return fmt.Sprintf(
+			"image downgrade: version %s less than installed %s",
+			e.CandidateVersion.String(), e.InstalledVersion.String())
+	}
+}
+
+// SecurityCounter retrieves the value of an image's SEC_CNT TLV.  The counter
+// is only trusted if it is covered by the image hash, so an error is returned
+// if the TLV is in the unprotected region.  The bool return value is false if
+// the image has no SEC_CNT TLV.
+func (img *Image) SecurityCounter() (uint32, bool, error) {
+	tlv, prot, err := img.FindUniqueTlvAnyRegion(IMAGE_TLV_SEC_CNT)
+	if err != nil {
+		return 0, false, err
+	}
+	if tlv == nil {
+		return 0, false, nil
+	}
+	if !prot {
+		return 0, false, errors.Errorf(
+			"image contains unprotected SEC_CNT TLV")
+	}
+
+	if len(tlv.Data) != 4 {
+		return 0, false, errors.Errorf(
+			"image contains invalid SEC_CNT TLV: have=%d bytes want=4",
+			len(tlv.Data))
+	}
+
+	return binary.LittleEndian.Uint32(tlv.Data), true, nil
+}
+
+// compareVersions returns -1, 0, or 1 if a is less than, equal to, or greater
+// than b, respectively.
+func compareVersions(a ImageVersion, b ImageVersion) int {
+	cmp := func(x uint64, y uint64) int {
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		} else {
+			return 0
+		}
+	}
+
+	if c := cmp(uint64(a.Major), uint64(b.Major)); c != 0 {
+		return c
+	}
+	if c := cmp(uint64(a.Minor), uint64(b.Minor)); c != 0 {
+		return c
+	}
+	if c := cmp(uint64(a.Rev), uint64(b.Rev)); c != 0 {
+		return c
+	}
+	return cmp(uint64(a.BuildNum), uint64(b.BuildNum))
+}
+
+// CheckDowngrade determines whether installing the candidate image would roll
+// back the installed one.  If both images contain a SEC_CNT TLV, the security
+// counters are compared.  A candidate without a counter is rejected if the
+// installed image has one.  Otherwise, the header versions are compared.  An
+// *ErrDowngrade is returned if the candidate is older.
+func CheckDowngrade(candidate Image, installed Image) error {
+	candCnt, candOk, err := candidate.SecurityCounter()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read candidate security counter")
+	}
+	instCnt, instOk, err := installed.SecurityCounter()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read installed security counter")
+	}
+
+	if candOk && instOk {
+		if candCnt < instCnt {
+			return errors.WithStack(&ErrDowngrade{
+				BySecCnt:         true,
+				CandidateSecCnt:  candCnt,
+				InstalledSecCnt:  instCnt,
+				CandidateVersion: candidate.Header.Vers,
+				InstalledVersion: installed.Header.Vers,
+			})
+		}
+		return nil
+	}
+
+	if instOk {
+		return errors.WithStack(&ErrDowngrade{
+			CandidateNoSecCnt: true,
+			InstalledSecCnt:   instCnt,
+			CandidateVersion:  candidate.Header.Vers,
+			InstalledVersion:  installed.Header.Vers,
+		})
+	}
+
+	if compareVersions(candidate.Header.Vers, installed.Header.Vers) < 0 {
+		return errors.WithStack(&ErrDowngrade{
+			CandidateVersion: candidate.Header.Vers,
+			InstalledVersion: installed.Header.Vers,
+		})
+	}
+
+	return nil
+}
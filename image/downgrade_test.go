@@ -0,0 +1,196 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+func secCntImage(vers ImageVersion, secCnt int) Image {
+	img := Image{Header: ImageHdr{Vers: vers}}
+	if secCnt >= 0 {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, uint32(secCnt))
+		img.ProtTlvs = []ImageTlv{{
+			Header: ImageTlvHdr{Type: IMAGE_TLV_SEC_CNT, Len: 4},
+			Data:   data,
+		}}
+	}
+	return img
+}
+
+func TestCheckDowngrade(t *testing.T) {
+	v1 := ImageVersion{Major: 1}
+	v2 := ImageVersion{Major: 2}
+
+	type entry struct {
+		cand      Image
+		inst      Image
+		downgrade bool
+	}
+	entries := []entry{
+		// Security counters take precedence over versions.
+		{secCntImage(v1, 5), secCntImage(v2, 4), false},
+		{secCntImage(v2, 4), secCntImage(v1, 5), true},
+		{secCntImage(v1, 5), secCntImage(v1, 5), false},
+
+		// A candidate cannot drop the installed image's counter.
+		{secCntImage(v2, -1), secCntImage(v1, 5), true},
+
+		// Fall back to versions if the installed counter is absent.
+		{secCntImage(v1, 5), secCntImage(v2, -1), true},
+		{secCntImage(v2, 5), secCntImage(v1, -1), false},
+		{secCntImage(v1, -1), secCntImage(v1, -1), false},
+	}
+
+	for i, e := range entries {
+		err := CheckDowngrade(e.cand, e.inst)
+		if !e.downgrade {
+			if err != nil {
+				t.Fatalf("entry %d: unexpected error: %s", i, err.Error())
+			}
+			continue
+		}
+
+		if _, ok := errors.Cause(err).(*ErrDowngrade); !ok {
+			t.Fatalf("entry %d: expected ErrDowngrade, got %v", i, err)
+		}
+	}
+
+	// An unprotected security counter is not trusted.
+	unprot := secCntImage(v2, 9)
+	unprot.Tlvs, unprot.ProtTlvs = unprot.ProtTlvs, nil
+	if _, _, err := unprot.SecurityCounter(); err == nil {
+		t.Fatalf("unprotected SEC_CNT TLV accepted")
+	}
+	if err := CheckDowngrade(unprot, secCntImage(v1, 5)); err == nil {
+		t.Fatalf("image with unprotected SEC_CNT TLV accepted")
+	}
+}
+
+func TestSwapCompatible(t *testing.T) {
+	signKey, err := sec.ReadPrivSignKey(testdataPath + "/sign-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := sec.ReadPrivSignKey(testdataPath + "/rsa3072-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaEnc, err := sec.ReadPubEncKey(testdataPath + "/enc-key-pub.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesEnc := &sec.PubEncKey{Aes: kek}
+
+	keys := []sec.PubSignKey{signKey.PubKey()}
+
+	signed := func(vers ImageVersion, key sec.PrivSignKey,
+		enc *sec.PubEncKey) Image {
+
+		img, err := Build(make([]byte, 256), vers, BuildOpts{
+			SigKeys: []sec.PrivSignKey{key},
+			EncKey:  enc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	installed := signed(ImageVersion{1, 2, 0, 0}, signKey, aesEnc)
+
+	reason := func(err error) SwapIncompatReason {
+		var e *ErrSwapIncompatible
+		if !errors.As(err, &e) {
+			t.Fatalf("wrong error type: %v", err)
+		}
+		return e.Reason
+	}
+
+	cand := signed(ImageVersion{1, 3, 0, 0}, signKey, aesEnc)
+	if err := SwapCompatible(installed, cand, 64*1024, keys); err != nil {
+		t.Fatalf("compatible images rejected: %s", err.Error())
+	}
+
+	r := reason(SwapCompatible(installed, cand, 128, keys))
+	if r != SWAP_INCOMPAT_SIZE {
+		t.Fatalf("wrong reason: have=%s want=%s", r, SWAP_INCOMPAT_SIZE)
+	}
+
+	cand = signed(ImageVersion{1, 3, 0, 0}, otherKey, aesEnc)
+	r = reason(SwapCompatible(installed, cand, 64*1024, keys))
+	if r != SWAP_INCOMPAT_SIGNER {
+		t.Fatalf("wrong reason: have=%s want=%s", r, SWAP_INCOMPAT_SIGNER)
+	}
+
+	// A keyhash copied from a trusted image does not make a signature
+	// trusted.
+	for i, tlv := range installed.Tlvs {
+		if tlv.Header.Type == IMAGE_TLV_KEYHASH {
+			cand.Tlvs[i] = tlv
+		}
+	}
+	r = reason(SwapCompatible(installed, cand, 64*1024, keys))
+	if r != SWAP_INCOMPAT_SIGNER {
+		t.Fatalf("forged keyhash accepted: reason=%s", r)
+	}
+
+	cand = signed(ImageVersion{1, 3, 0, 0}, signKey, &rsaEnc)
+	r = reason(SwapCompatible(installed, cand, 64*1024, keys))
+	if r != SWAP_INCOMPAT_ENC {
+		t.Fatalf("wrong reason: have=%s want=%s", r, SWAP_INCOMPAT_ENC)
+	}
+
+	// Encryption must be used by both images or by neither.
+	cand = signed(ImageVersion{1, 3, 0, 0}, signKey, nil)
+	r = reason(SwapCompatible(installed, cand, 64*1024, keys))
+	if r != SWAP_INCOMPAT_ENC {
+		t.Fatalf("wrong reason: have=%s want=%s", r, SWAP_INCOMPAT_ENC)
+	}
+
+	// A decrypted installed image's scheme cannot be determined.
+	decrypted, err := Decrypt(installed, sec.PrivEncKey{Aes: kek})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cand = signed(ImageVersion{1, 3, 0, 0}, signKey, aesEnc)
+	r = reason(SwapCompatible(decrypted, cand, 64*1024, keys))
+	if r != SWAP_INCOMPAT_ENC_UNKNOWN {
+		t.Fatalf("wrong reason: have=%s want=%s",
+			r, SWAP_INCOMPAT_ENC_UNKNOWN)
+	}
+
+	cand = signed(ImageVersion{1, 1, 0, 0}, signKey, aesEnc)
+	var dg *ErrDowngrade
+	err = SwapCompatible(installed, cand, 64*1024, keys)
+	if !errors.As(err, &dg) {
+		t.Fatalf("downgrade not detected: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Intel HEX record types.
+const (
+	IHEX_REC_DATA         = 0x00
+	IHEX_REC_EOF          = 0x01
+	IHEX_REC_EXT_SEG      = 0x02
+	IHEX_REC_START_SEG    = 0x03
+	IHEX_REC_EXT_LINEAR   = 0x04
+	IHEX_REC_START_LINEAR = 0x05
+)
+
+// Number of data bytes emitted per Intel HEX data record.
+const IHEX_REC_DATA_LEN = 16
+
+// IHEX_MAX_SPAN is the largest address range, from the lowest data byte to
+// the highest, that an Intel HEX image may cover.  This bounds the buffer
+// allocated for a sparse stream.
+const IHEX_MAX_SPAN = 16 * 1024 * 1024
+
+// writeHexRecord writes a single Intel HEX record, including its checksum.
+func writeHexRecord(w io.Writer, recType uint8, addr uint16,
+	data []byte) error {
+
+	sum := uint8(len(data)) + uint8(addr>>8) + uint8(addr) + recType
+	for _, b := range data {
+		sum += b
+	}
+
+	// The checksum is the two's complement of the sum of all other bytes.
+	s := fmt.Sprintf(":%02X%04X%02X%X%02X\n",
+		len(data), addr, recType, data, ^sum+1)
+
+	if _, err := io.WriteString(w, s); err != nil {
+		return errors.Wrapf(err, "failed to write Intel HEX record")
+	}
+
+	return nil
+}
+
+// WriteHex writes an image to the given writer in Intel HEX format.  The
+// image is placed at the specified base address.  Extended linear address
+// records are emitted as needed, and the output is terminated with an EOF
+// record.
+func (i *Image) WriteHex(w io.Writer, baseAddr uint32) error {
+	b := &bytes.Buffer{}
+	if _, err := i.Write(b); err != nil {
+		return err
+	}
+	bin := b.Bytes()
+
+	if uint64(baseAddr)+uint64(len(bin)) > 1<<32 {
+		return errors.Errorf(
+			"image does not fit in 32-bit address space: "+
+				"base=0x%08x size=%d", baseAddr, len(bin))
+	}
+
+	var upper uint32
+	haveUpper := false
+
+	for off := 0; off < len(bin); {
+		addr := baseAddr + uint32(off)
+
+		if !haveUpper || addr>>16 != upper {
+			upper = addr >> 16
+			haveUpper = true
+			ext := []byte{byte(upper >> 8), byte(upper)}
+			if err := writeHexRecord(w, IHEX_REC_EXT_LINEAR, 0,
+				ext); err != nil {
+
+				return err
+			}
+		}
+
+		// Don't let a record cross a 64KB boundary.
+		n := IHEX_REC_DATA_LEN
+		if rem := 0x10000 - int(addr&0xffff); n > rem {
+			n = rem
+		}
+		if rem := len(bin) - off; n > rem {
+			n = rem
+		}
+
+		if err := writeHexRecord(w, IHEX_REC_DATA, uint16(addr),
+			bin[off:off+n]); err != nil {
+
+			return err
+		}
+
+		off += n
+	}
+
+	return writeHexRecord(w, IHEX_REC_EOF, 0, nil)
+}
+
+// hexChunk is a contiguous run of data decoded from Intel HEX records.
+type hexChunk struct {
+	addr uint32
+	data []byte
+}
+
+// decodeHex decodes Intel HEX text into a contiguous byte slice.  It returns
+// the address of the first byte and the data.  Gaps between records are
+// filled with 0xff.  An error is returned if any records overlap or if the
+// data spans more than IHEX_MAX_SPAN bytes.
+func decodeHex(r io.Reader) (uint32, []byte, error) {
+	var chunks []hexChunk
+	var base uint32
+	eof := false
+
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if eof {
+			return 0, nil, errors.Errorf(
+				"Intel HEX line %d: record follows EOF record", lineNum)
+		}
+
+		if !strings.HasPrefix(line, ":") {
+			return 0, nil, errors.Errorf(
+				"Intel HEX line %d: missing start code", lineNum)
+		}
+		rec, err := hex.DecodeString(line[1:])
+		if err != nil {
+			return 0, nil, errors.Wrapf(err,
+				"Intel HEX line %d: invalid hex", lineNum)
+		}
+		if len(rec) < 5 || int(rec[0]) != len(rec)-5 {
+			return 0, nil, errors.Errorf(
+				"Intel HEX line %d: invalid record length", lineNum)
+		}
+
+		var sum uint8
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return 0, nil, errors.Errorf(
+				"Intel HEX line %d: bad checksum", lineNum)
+		}
+
+		addr := uint32(rec[1])<<8 | uint32(rec[2])
+		data := rec[4 : len(rec)-1]
+
+		switch rec[3] {
+		case IHEX_REC_DATA:
+			chunks = append(chunks, hexChunk{
+				addr: base + addr,
+				data: data,
+			})
+
+		case IHEX_REC_EOF:
+			eof = true
+
+		case IHEX_REC_EXT_SEG:
+			if len(data) != 2 {
+				return 0, nil, errors.Errorf(
+					"Intel HEX line %d: invalid extended segment record",
+					lineNum)
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+
+		case IHEX_REC_EXT_LINEAR:
+			if len(data) != 2 {
+				return 0, nil, errors.Errorf(
+					"Intel HEX line %d: invalid extended linear record",
+					lineNum)
+			}
+			base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+
+		case IHEX_REC_START_SEG, IHEX_REC_START_LINEAR:
+			// Start address; irrelevant to the image contents.
+
+		default:
+			return 0, nil, errors.Errorf(
+				"Intel HEX line %d: unknown record type 0x%02x",
+				lineNum, rec[3])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to read Intel HEX")
+	}
+
+	if !eof {
+		return 0, nil, errors.Errorf("Intel HEX missing EOF record")
+	}
+	if len(chunks) == 0 {
+		return 0, nil, errors.Errorf("Intel HEX contains no data")
+	}
+
+	sort.SliceStable(chunks, func(i int, j int) bool {
+		return chunks[i].addr < chunks[j].addr
+	})
+
+	start := chunks[0].addr
+	end := uint64(start)
+	for _, c := range chunks {
+		if uint64(c.addr) < end {
+			return 0, nil, errors.Errorf(
+				"Intel HEX contains overlapping records at 0x%08x", c.addr)
+		}
+		end = uint64(c.addr) + uint64(len(c.data))
+	}
+
+	if span := end - uint64(start); span > IHEX_MAX_SPAN {
+		return 0, nil, errors.Errorf(
+			"Intel HEX data spans too many bytes: have=%d max=%d",
+			span, IHEX_MAX_SPAN)
+	}
+
+	bin := bytes.Repeat([]byte{0xff}, int(end-uint64(start)))
+	for _, c := range chunks {
+		copy(bin[c.addr-start:], c.data)
+	}
+
+	return start, bin, nil
+}
+
+// ReadImageHex decodes an Intel HEX stream and parses the result as an image.
+// The image is assumed to start at the lowest address in the stream.  Gaps in
+// the address space are filled with 0xff.
+func ReadImageHex(r io.Reader) (Image, error) {
+	_, bin, err := decodeHex(r)
+	if err != nil {
+		return Image{}, err
+	}
+
+	img, err := ParseImage(bin)
+	if err != nil {
+		return Image{}, errors.Wrapf(err, "failed to parse Intel HEX image")
+	}
+
+	return img, nil
+}
@@ -0,0 +1,194 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestWriteHex(t *testing.T) {
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin := &bytes.Buffer{}
+	if _, err := img.Write(bin); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start close to a 64KB boundary so that an extended address record is
+	// needed partway through.
+	const base = 0x0800fff8
+
+	out := &bytes.Buffer{}
+	if err := img.WriteHex(out, base); err != nil {
+		t.Fatal(err)
+	}
+
+	var data []byte
+	var upper uint32
+	next := uint32(base)
+	eof := false
+
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		line := s.Text()
+		if eof {
+			t.Fatalf("record follows EOF: %s", line)
+		}
+		if !strings.HasPrefix(line, ":") {
+			t.Fatalf("record missing start code: %s", line)
+		}
+
+		rec, err := hex.DecodeString(line[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec) > 5+IHEX_REC_DATA_LEN || int(rec[0]) != len(rec)-5 {
+			t.Fatalf("bad record length: %s", line)
+		}
+
+		var sum uint8
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			t.Fatalf("bad record checksum: %s", line)
+		}
+
+		payload := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case IHEX_REC_EXT_LINEAR:
+			upper = uint32(payload[0])<<24 | uint32(payload[1])<<16
+		case IHEX_REC_DATA:
+			addr := upper | uint32(rec[1])<<8 | uint32(rec[2])
+			if addr != next {
+				t.Fatalf("wrong record address: have=0x%08x want=0x%08x",
+					addr, next)
+			}
+			data = append(data, payload...)
+			next += uint32(len(payload))
+		case IHEX_REC_EOF:
+			eof = true
+		default:
+			t.Fatalf("unexpected record type: %s", line)
+		}
+	}
+
+	if !eof {
+		t.Fatalf("missing EOF record")
+	}
+	if !bytes.Equal(data, bin.Bytes()) {
+		t.Fatalf("Intel HEX data does not match binary image")
+	}
+}
+
+func TestReadImageHex(t *testing.T) {
+	imgData := readImageData("good-unsigned-unencrypted")
+	img, err := ParseImage(imgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := img.WriteHex(out, 0x0800fff8); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+
+	img2, err := ReadImageHex(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bytes.Buffer{}
+	if _, err := img2.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), imgData) {
+		t.Fatalf("Intel HEX image does not round trip")
+	}
+
+	// Corrupt a data byte without fixing the checksum.
+	lines := strings.Split(text, "\n")
+	bad := []byte(lines[2])
+	if bad[9] == '0' {
+		bad[9] = '1'
+	} else {
+		bad[9] = '0'
+	}
+	lines[2] = string(bad)
+	if _, err := ReadImageHex(
+		strings.NewReader(strings.Join(lines, "\n"))); err == nil {
+
+		t.Fatalf("Intel HEX with bad checksum accepted")
+	}
+
+	// Gaps are filled with 0xff.
+	_, bin, err := decodeHex(strings.NewReader(
+		":0100000011EE\n:0100030022DA\n:00000001FF\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bin, []byte{0x11, 0xff, 0xff, 0x22}) {
+		t.Fatalf("wrong gap fill: %x", bin)
+	}
+
+	hexRecs := func(recs ...func(b *bytes.Buffer) error) string {
+		b := &bytes.Buffer{}
+		for _, r := range recs {
+			if err := r(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeHexRecord(b, IHEX_REC_EOF, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	rec := func(recType uint8, addr uint16,
+		data ...byte) func(b *bytes.Buffer) error {
+
+		return func(b *bytes.Buffer) error {
+			return writeHexRecord(b, recType, addr, data)
+		}
+	}
+
+	// Overlapping records.
+	text = hexRecs(
+		rec(IHEX_REC_DATA, 0x10, 1, 2, 3, 4),
+		rec(IHEX_REC_DATA, 0x12, 5))
+	if _, _, err := decodeHex(strings.NewReader(text)); err == nil {
+		t.Fatalf("Intel HEX with overlapping records accepted")
+	}
+
+	// Sparse records near the top of the address space.
+	text = hexRecs(
+		rec(IHEX_REC_DATA, 0, 1),
+		rec(IHEX_REC_EXT_LINEAR, 0, 0xff, 0xff),
+		rec(IHEX_REC_DATA, 0xfff0, 2))
+	if _, _, err := decodeHex(strings.NewReader(text)); err == nil {
+		t.Fatalf("Intel HEX spanning 4 GiB accepted")
+	}
+}
@@ -20,19 +20,25 @@
 package image
 
 import (
+	"bytes"
+	"crypto"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"unicode/utf8"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/sec"
 )
 
 const (
-	IMAGE_MAGIC         = 0x96f3b83d /* Image header magic */
-	IMAGE_TRAILER_MAGIC = 0x6907     /* Image tlv info magic */
+	IMAGE_MAGIC              = 0x96f3b83d /* Image header magic */
+	IMAGE_TRAILER_MAGIC      = 0x6907     /* Image tlv info magic */
+	IMAGE_PROT_TRAILER_MAGIC = 0x6908     /* Image protected tlv info magic */
 )
 
 const (
@@ -48,33 +54,117 @@ const (
 	IMAGE_F_PIC          = 0x00000001
 	IMAGE_F_ENCRYPTED    = 0x00000004 /* encrypted image */
 	IMAGE_F_NON_BOOTABLE = 0x00000010 /* non bootable image */
+	IMAGE_F_RAM_LOAD     = 0x00000020 /* copied to RAM before execution */
+
+	IMAGE_F_COMPRESSED_LZMA1         = 0x00000200 /* LZMA1-compressed body */
+	IMAGE_F_COMPRESSED_LZMA2         = 0x00000400 /* LZMA2-compressed body */
+	IMAGE_F_COMPRESSED_ARM_THUMB_FLT = 0x00000800 /* ARM-Thumb BCJ filter */
 )
 
 /*
  * Image trailer TLV types.
  */
 const (
-	IMAGE_TLV_KEYHASH  = 0x01
-	IMAGE_TLV_SHA256   = 0x10
-	IMAGE_TLV_RSA2048  = 0x20
-	IMAGE_TLV_ECDSA224 = 0x21
-	IMAGE_TLV_ECDSA256 = 0x22
-	IMAGE_TLV_RSA3072  = 0x23
-	IMAGE_TLV_ED25519  = 0x24
-	IMAGE_TLV_ENC_RSA  = 0x30
-	IMAGE_TLV_ENC_KEK  = 0x31
+	IMAGE_TLV_KEYHASH          = 0x01
+	IMAGE_TLV_SHA256           = 0x10
+	IMAGE_TLV_RSA2048          = 0x20
+	IMAGE_TLV_ECDSA224         = 0x21
+	IMAGE_TLV_ECDSA256         = 0x22
+	IMAGE_TLV_RSA3072          = 0x23
+	IMAGE_TLV_ED25519          = 0x24
+	IMAGE_TLV_ENC_RSA          = 0x30
+	IMAGE_TLV_ENC_KEK          = 0x31
+	IMAGE_TLV_ENC_EC256        = 0x32
+	IMAGE_TLV_ENC_GCM          = 0xa2 // Vendor-defined; not part of MCUboot.
+	IMAGE_TLV_DEPENDENCY       = 0x40
+	IMAGE_TLV_SEC_CNT          = 0x50
+	IMAGE_TLV_BOOT_RECORD      = 0x60
+	IMAGE_TLV_DECOMP_SIZE      = 0x70
+	IMAGE_TLV_DECOMP_SHA       = 0x71
+	IMAGE_TLV_DECOMP_SIGNATURE = 0x72
+	IMAGE_TLV_CRC16            = 0xa0 // Vendor-defined; not part of MCUboot.
+	IMAGE_TLV_BUILD_INFO       = 0xa1 // Vendor-defined; not part of MCUboot.
 )
 
-var imageTlvTypeNameMap = map[uint8]string{
-	IMAGE_TLV_KEYHASH:  "KEYHASH",
-	IMAGE_TLV_SHA256:   "SHA256",
-	IMAGE_TLV_RSA2048:  "RSA2048",
-	IMAGE_TLV_ECDSA224: "ECDSA224",
-	IMAGE_TLV_ECDSA256: "ECDSA256",
-	IMAGE_TLV_RSA3072:  "RSA3072",
-	IMAGE_TLV_ED25519:  "ED25519",
-	IMAGE_TLV_ENC_RSA:  "ENC_RSA",
-	IMAGE_TLV_ENC_KEK:  "ENC_KEK",
+// ImageTlvDecodeFunc converts the data of an image TLV into a JSON-friendly
+// structured representation.
+type ImageTlvDecodeFunc func(data []byte) (interface{}, error)
+
+type imageTlvTypeDesc struct {
+	name   string
+	decode ImageTlvDecodeFunc
+}
+
+// Populated via RegisterImageTlvDecoder().
+var imageTlvTypeDescMap = map[uint8]imageTlvTypeDesc{}
+
+// RegisterImageTlvDecoder adds a TLV type to the set that this package
+// recognizes.  The name is reported in map and JSON representations of
+// images, and the decode function (which may be nil) renders the TLV's data
+// in those representations.  TLVs without a decoder, or whose decoder fails,
+// are rendered as hex.  Registering a type that is already known replaces the
+// existing registration.
+func RegisterImageTlvDecoder(tlvType uint8, name string,
+	decode ImageTlvDecodeFunc) {
+
+	imageTlvTypeDescMap[tlvType] = imageTlvTypeDesc{
+		name:   name,
+		decode: decode,
+	}
+}
+
+func decodeTlvHex(data []byte) (interface{}, error) {
+	return hex.EncodeToString(data), nil
+}
+
+func decodeTlvU16(data []byte) (interface{}, error) {
+	if len(data) != 2 {
+		return nil, errors.Errorf("invalid TLV length: have=%d want=2",
+			len(data))
+	}
+	return binary.LittleEndian.Uint16(data), nil
+}
+
+func decodeTlvU32(data []byte) (interface{}, error) {
+	if len(data) != 4 {
+		return nil, errors.Errorf("invalid TLV length: have=%d want=4",
+			len(data))
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+func decodeTlvString(data []byte) (interface{}, error) {
+	if !utf8.Valid(data) {
+		return nil, errors.Errorf("TLV contains invalid UTF-8")
+	}
+	return string(data), nil
+}
+
+func init() {
+	RegisterImageTlvDecoder(IMAGE_TLV_KEYHASH, "KEYHASH", decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_SHA256, "SHA256", decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_RSA2048, "RSA2048", decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_ECDSA224, "ECDSA224", decodeTlvEcdsa224)
+	RegisterImageTlvDecoder(IMAGE_TLV_ECDSA256, "ECDSA256", decodeTlvEcdsa256)
+	RegisterImageTlvDecoder(IMAGE_TLV_RSA3072, "RSA3072", decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_ED25519, "ED25519", decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_ENC_RSA, "ENC_RSA",
+		decodeTlvEnc("RSA-OAEP"))
+	RegisterImageTlvDecoder(IMAGE_TLV_ENC_KEK, "ENC_KEK",
+		decodeTlvEnc("AES-KW"))
+	RegisterImageTlvDecoder(IMAGE_TLV_ENC_EC256, "ENC_EC256", decodeTlvEncEc256)
+	RegisterImageTlvDecoder(IMAGE_TLV_ENC_GCM, "ENC_GCM",
+		decodeTlvEnc("AES-GCM"))
+	RegisterImageTlvDecoder(IMAGE_TLV_DEPENDENCY, "DEPENDENCY",
+		decodeTlvDependency)
+	RegisterImageTlvDecoder(IMAGE_TLV_SEC_CNT, "SEC_CNT", decodeTlvU32)
+	RegisterImageTlvDecoder(IMAGE_TLV_BOOT_RECORD, "BOOT_RECORD", decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_DECOMP_SIZE, "DECOMP_SIZE", decodeTlvU32)
+	RegisterImageTlvDecoder(IMAGE_TLV_DECOMP_SHA, "DECOMP_SHA", decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_DECOMP_SIGNATURE, "DECOMP_SIGNATURE",
+		decodeTlvHex)
+	RegisterImageTlvDecoder(IMAGE_TLV_CRC16, "CRC16", decodeTlvU16)
+	RegisterImageTlvDecoder(IMAGE_TLV_BUILD_INFO, "BUILD_INFO", decodeTlvString)
 }
 
 type ImageVersion struct {
@@ -86,9 +176,9 @@ type ImageVersion struct {
 
 type ImageHdr struct {
 	Magic uint32
-	Pad1  uint32
+	Pad1  uint32 /* Load address; see LoadAddr() */
 	HdrSz uint16
-	Pad2  uint16
+	Pad2  uint16 /* Protected TLV region size; see ProtSz() */
 	ImgSz uint32
 	Flags uint32
 	Vers  ImageVersion
@@ -112,52 +202,75 @@ type ImageTrailer struct {
 }
 
 type Image struct {
-	Header ImageHdr
-	Pad    []byte
-	Body   []byte
-	Tlvs   []ImageTlv
+	Header   ImageHdr
+	Pad      []byte
+	Body     []byte
+	ProtTlvs []ImageTlv // Covered by the image hash.
+	Tlvs     []ImageTlv
+
+	// TLVs found after the region declared by the trailer; only populated by
+	// ParseImageOpts with EXTRA_TLVS_PARSE.  These are not written by Write.
+	ExtraTlvs []ImageTlv
 }
 
 type ImageOffsets struct {
-	Header    int
-	Body      int
-	Trailer   int
-	Tlvs      []int
-	TotalSize int
+	Header      int
+	Body        int
+	ProtTrailer int // -1 if the image has no protected TLVs.
+	ProtTlvs    []int
+	Trailer     int
+	Tlvs        []int
+	TotalSize   int
 }
 
 func ImageTlvTypeIsValid(tlvType uint8) bool {
-	_, ok := imageTlvTypeNameMap[tlvType]
+	_, ok := imageTlvTypeDescMap[tlvType]
 	return ok
 }
 
 func ImageTlvTypeName(tlvType uint8) string {
-	name, ok := imageTlvTypeNameMap[tlvType]
+	desc, ok := imageTlvTypeDescMap[tlvType]
 	if !ok {
 		return "???"
 	}
 
-	return name
+	return desc.name
 }
 
 func ImageTlvTypeIsSig(tlvType uint8) bool {
-	return tlvType == IMAGE_TLV_RSA2048 ||
-		tlvType == IMAGE_TLV_RSA3072 ||
-		tlvType == IMAGE_TLV_ECDSA224 ||
-		tlvType == IMAGE_TLV_ECDSA256 ||
-		tlvType == IMAGE_TLV_ED25519
+	return sigTlvAlgo(tlvType) != sec.SIGN_ALGO_UNKNOWN
 }
 
 func ImageTlvTypeIsSecret(tlvType uint8) bool {
 	return tlvType == IMAGE_TLV_ENC_RSA ||
-		tlvType == IMAGE_TLV_ENC_KEK
+		tlvType == IMAGE_TLV_ENC_KEK ||
+		tlvType == IMAGE_TLV_ENC_EC256 ||
+		tlvType == IMAGE_TLV_ENC_GCM
 }
 
+// String renders an image version in its full four-component form (see
+// StringFull).
 func (ver ImageVersion) String() string {
+	return ver.StringFull()
+}
+
+// StringFull renders an image version as "major.minor.rev.build".  The build
+// number is always included, even if it is zero.
+func (ver ImageVersion) StringFull() string {
 	return fmt.Sprintf("%d.%d.%d.%d",
 		ver.Major, ver.Minor, ver.Rev, ver.BuildNum)
 }
 
+// StringShort renders an image version as "major.minor.rev", appending
+// ".build" only if the build number is nonzero.
+func (ver ImageVersion) StringShort() string {
+	if ver.BuildNum == 0 {
+		return fmt.Sprintf("%d.%d.%d", ver.Major, ver.Minor, ver.Rev)
+	}
+
+	return ver.StringFull()
+}
+
 func (tlv *ImageTlv) Clone() ImageTlv {
 	return ImageTlv{
 		Header: tlv.Header,
@@ -165,25 +278,65 @@ func (tlv *ImageTlv) Clone() ImageTlv {
 	}
 }
 
-func (tlv *ImageTlv) Write(w io.Writer) (int, error) {
-	totalSize := 0
+// Maximum number of data bytes an image TLV can hold (limited by the 16-bit
+// length field).  Every TLV type uses this 16-bit form; MCUboot defines no
+// variant with a 32-bit length, and such a TLV would not fit anyway, since
+// each TLV region's total length is itself recorded in a 16-bit trailer
+// field.  Payloads larger than this must be carried outside the TLV regions
+// (e.g., in the image body).
+const IMAGE_TLV_MAX_DATA_LEN = 0xffff
+
+// validateLen ensures a TLV's data fits in its 16-bit length field and agrees
+// with the length recorded in its header.
+func (tlv *ImageTlv) validateLen() error {
+	if len(tlv.Data) > IMAGE_TLV_MAX_DATA_LEN {
+		return errors.Errorf(
+			"image TLV data too long: type=%s len=%d max=%d",
+			ImageTlvTypeName(tlv.Header.Type), len(tlv.Data),
+			IMAGE_TLV_MAX_DATA_LEN)
+	}
 
-	err := binary.Write(w, binary.LittleEndian, &tlv.Header)
-	if err != nil {
-		return totalSize, errors.Wrapf(err, "failed to write image TLV header")
+	if int(tlv.Header.Len) != len(tlv.Data) {
+		return errors.Errorf(
+			"image TLV length mismatch: type=%s header_len=%d data_len=%d",
+			ImageTlvTypeName(tlv.Header.Type), tlv.Header.Len, len(tlv.Data))
 	}
-	totalSize += IMAGE_TLV_SIZE
 
-	size, err := w.Write(tlv.Data)
-	if err != nil {
-		return totalSize, errors.Wrapf(err, "failed to write image TLV data")
+	return nil
+}
+
+// EncodeImageTlv writes a TLV in its on-disk form: the 4-byte little-endian
+// header (type, pad byte, and 16-bit data length) followed by the data.  The
+// header's length must agree with the data.  This is the single place where
+// the TLV byte layout is produced; the inverse of parsing a TLV.
+func EncodeImageTlv(w io.Writer, tlv ImageTlv) error {
+	if err := tlv.validateLen(); err != nil {
+		return err
 	}
-	totalSize += size
 
-	return totalSize, nil
+	if err := binary.Write(w, binary.LittleEndian, &tlv.Header); err != nil {
+		return errors.Wrapf(err, "failed to write image TLV header")
+	}
+
+	if _, err := w.Write(tlv.Data); err != nil {
+		return errors.Wrapf(err, "failed to write image TLV data")
+	}
+
+	return nil
+}
+
+func (tlv *ImageTlv) Write(w io.Writer) (int, error) {
+	if err := EncodeImageTlv(w, *tlv); err != nil {
+		return 0, err
+	}
+
+	return IMAGE_TLV_SIZE + len(tlv.Data), nil
 }
 
-// Clone performs a deep copy of an image.
+// Clone performs a deep copy of an image: the header, padding, body, and every
+// TLV (protected and unprotected) including its data bytes.  The trailers are
+// derived from the TLVs, so they are effectively copied as well.  Mutating the
+// clone never affects the original.
 func (img *Image) Clone() Image {
 	dup := Image{
 		Header: img.Header,
@@ -192,10 +345,21 @@ func (img *Image) Clone() Image {
 		Tlvs:   make([]ImageTlv, len(img.Tlvs)),
 	}
 
+	if img.ProtTlvs != nil {
+		dup.ProtTlvs = make([]ImageTlv, len(img.ProtTlvs))
+		for i, tlv := range img.ProtTlvs {
+			dup.ProtTlvs[i] = tlv.Clone()
+		}
+	}
+
 	for i, tlv := range img.Tlvs {
 		dup.Tlvs[i] = tlv.Clone()
 	}
 
+	for _, tlv := range img.ExtraTlvs {
+		dup.ExtraTlvs = append(dup.ExtraTlvs, tlv.Clone())
+	}
+
 	return dup
 }
 
@@ -221,8 +385,8 @@ func (img *Image) FindTlvIndices(tlvType uint8) []int {
 	})
 }
 
-// FindTlvIndices searches an image for TLVs satisfying the given predicate and
-// returns them.
+// FindTlvsIf searches an image's unprotected region for TLVs satisfying the
+// given predicate and returns them.
 func (img *Image) FindTlvsIf(pred func(tlv ImageTlv) bool) []*ImageTlv {
 	var tlvs []*ImageTlv
 
@@ -235,6 +399,8 @@ func (img *Image) FindTlvsIf(pred func(tlv ImageTlv) bool) []*ImageTlv {
 }
 
 // FindTlvs retrieves all TLVs in an image's footer with the specified type.
+// Only the unprotected region is searched; use FindTlvsAnyRegion to include
+// protected TLVs.
 func (img *Image) FindTlvs(tlvType uint8) []*ImageTlv {
 	var tlvs []*ImageTlv
 
@@ -248,6 +414,7 @@ func (img *Image) FindTlvs(tlvType uint8) []*ImageTlv {
 
 // FindUniqueTlv retrieves a TLV in an image's footer with the specified
 // type.  It returns an error if there is more than one TLV with this type.
+// Only the unprotected region is searched (see FindUniqueTlvAnyRegion).
 func (i *Image) FindUniqueTlv(tlvType uint8) (*ImageTlv, error) {
 	tlvs := i.FindTlvs(tlvType)
 	if len(tlvs) == 0 {
@@ -261,21 +428,169 @@ func (i *Image) FindUniqueTlv(tlvType uint8) (*ImageTlv, error) {
 	return tlvs[0], nil
 }
 
+// TlvWithRegion is a TLV paired with the region of the image it resides in.
+type TlvWithRegion struct {
+	Tlv *ImageTlv
+
+	// True if the TLV is in the protected region (covered by the image hash).
+	Protected bool
+}
+
+// AllTlvs retrieves every TLV in an image, protected and unprotected, in
+// on-disk order (i.e., all protected TLVs first).  Each entry points into the
+// image's TLV slices.
+func (img *Image) AllTlvs() []TlvWithRegion {
+	var all []TlvWithRegion
+
+	for i, _ := range img.ProtTlvs {
+		all = append(all, TlvWithRegion{
+			Tlv:       &img.ProtTlvs[i],
+			Protected: true,
+		})
+	}
+	for i, _ := range img.Tlvs {
+		all = append(all, TlvWithRegion{
+			Tlv:       &img.Tlvs[i],
+			Protected: false,
+		})
+	}
+
+	return all
+}
+
+// FindTlvsAnyRegion retrieves all TLVs with the specified type from both
+// regions of an image, in on-disk order.  Each result indicates which region
+// the TLV resides in.  The distinction matters for types that may appear in
+// either region: a protected TLV is covered by the image hash (and therefore
+// by the signatures), while an unprotected one is not.
+func (img *Image) FindTlvsAnyRegion(tlvType uint8) []TlvWithRegion {
+	var tlvs []TlvWithRegion
+
+	for _, r := range img.AllTlvs() {
+		if r.Tlv.Header.Type == tlvType {
+			tlvs = append(tlvs, r)
+		}
+	}
+
+	return tlvs
+}
+
+// FindUniqueTlvAnyRegion retrieves a TLV with the specified type from either
+// the protected or unprotected region of an image.  The returned bool is true
+// if the TLV is in the protected region.  It returns an error if there is more
+// than one TLV with this type.
+func (img *Image) FindUniqueTlvAnyRegion(tlvType uint8) (
+	*ImageTlv, bool, error) {
+
+	tlvs := img.FindTlvsAnyRegion(tlvType)
+	if len(tlvs) == 0 {
+		return nil, false, nil
+	}
+	if len(tlvs) > 1 {
+		return nil, false, errors.Errorf(
+			"image contains %d TLVs with type %d", len(tlvs), tlvType)
+	}
+
+	return tlvs[0].Tlv, tlvs[0].Protected, nil
+}
+
+// EachTlv calls the supplied function once for every TLV in an image, in
+// on-disk order (protected TLVs first).  Iteration stops early if the
+// function returns false.
+func (img *Image) EachTlv(fn func(tlv ImageTlv, protected bool) bool) {
+	for _, r := range img.AllTlvs() {
+		if !fn(*r.Tlv, r.Protected) {
+			return
+		}
+	}
+}
+
+// UnknownTlvTypes returns the distinct types of all TLVs in an image that
+// this package does not recognize (see RegisterImageTlvDecoder), in ascending
+// order.  Protected, unprotected, and extra TLVs are all considered.  The
+// result is informational only; unknown TLVs are preserved as raw data.
+func (img *Image) UnknownTlvTypes() []uint8 {
+	seen := map[uint8]struct{}{}
+
+	check := func(tlv ImageTlv) {
+		if !ImageTlvTypeIsValid(tlv.Header.Type) {
+			seen[tlv.Header.Type] = struct{}{}
+		}
+	}
+
+	img.EachTlv(func(tlv ImageTlv, protected bool) bool {
+		check(tlv)
+		return true
+	})
+	for _, tlv := range img.ExtraTlvs {
+		check(tlv)
+	}
+
+	var types []uint8
+	for typ, _ := range seen {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+// layoutTlvs calculates the offset of each TLV in a region whose first TLV
+// starts at off.  It returns the offsets and the offset just past the last
+// TLV.
+func layoutTlvs(off int, tlvs []ImageTlv) ([]int, int) {
+	var offs []int
+	for _, tlv := range tlvs {
+		offs = append(offs, off)
+		off += IMAGE_TLV_SIZE + len(tlv.Data)
+	}
+
+	return offs, off
+}
+
+// tlvRegionSize calculates the size of a TLV region, including its trailer,
+// without truncating to the trailer's 16-bit length field.
+func tlvRegionSize(tlvs []ImageTlv) int {
+	_, end := layoutTlvs(IMAGE_TRAILER_SIZE, tlvs)
+	return end
+}
+
+// AddTlv appends a copy of the given TLV to an image's unprotected region.  It
+// returns an error if the TLV's data does not fit in its length field or if
+// the region would exceed the trailer's 16-bit length.
+func (i *Image) AddTlv(tlv ImageTlv) error {
+	if err := tlv.validateLen(); err != nil {
+		return err
+	}
+
+	total := tlvRegionSize(i.Tlvs) + IMAGE_TLV_SIZE + len(tlv.Data)
+	if total > 0xffff {
+		return errors.Errorf(
+			"cannot add image TLV: TLV region too large; have=%d max=%d",
+			total, 0xffff)
+	}
+
+	i.Tlvs = append(i.Tlvs, tlv.Clone())
+	return nil
+}
+
 // RemoveTlvsIf removes all TLVs from an image that satisfy the supplied
-// predicate.  It returns a slice of the removed TLVs.
+// predicate.  It returns a slice of the removed TLVs.  The image's TLV slice
+// is replaced rather than modified in place, so other images sharing the old
+// slice are unaffected.
 func (i *Image) RemoveTlvsIf(pred func(tlv ImageTlv) bool) []ImageTlv {
 	rmed := []ImageTlv{}
+	kept := make([]ImageTlv, 0, len(i.Tlvs))
 
-	for idx := 0; idx < len(i.Tlvs); {
-		tlv := i.Tlvs[idx]
+	for _, tlv := range i.Tlvs {
 		if pred(tlv) {
 			rmed = append(rmed, tlv)
-			i.Tlvs = append(i.Tlvs[:idx], i.Tlvs[idx+1:]...)
 		} else {
-			idx++
+			kept = append(kept, tlv)
 		}
 	}
 
+	i.Tlvs = kept
 	return rmed
 }
 
@@ -289,18 +604,82 @@ func (i *Image) RemoveTlvsWithType(tlvType uint8) []ImageTlv {
 
 // ImageTrailer constructs an image trailer corresponding to the given image.
 func (img *Image) Trailer() ImageTrailer {
-	trailer := ImageTrailer{
+	return ImageTrailer{
 		Magic:     IMAGE_TRAILER_MAGIC,
-		TlvTotLen: IMAGE_TRAILER_SIZE,
+		TlvTotLen: uint16(tlvRegionSize(img.Tlvs)),
+	}
+}
+
+// HeaderBytes serializes an image's header as it appears on disk.  The
+// header padding (Pad) is not included.
+func (img *Image) HeaderBytes() []byte {
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, &img.Header)
+	return b.Bytes()
+}
+
+// TrailerBytes serializes an image's trailer (magic and total TLV length) as
+// it appears on disk.
+func (img *Image) TrailerBytes() []byte {
+	trailer := img.Trailer()
+
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, &trailer)
+	return b.Bytes()
+}
+
+// ProtTrailer constructs a protected TLV trailer corresponding to the given
+// image.
+func (img *Image) ProtTrailer() ImageTrailer {
+	return ImageTrailer{
+		Magic:     IMAGE_PROT_TRAILER_MAGIC,
+		TlvTotLen: uint16(tlvRegionSize(img.ProtTlvs)),
 	}
-	for _, tlv := range img.Tlvs {
-		trailer.TlvTotLen += IMAGE_TLV_SIZE + tlv.Header.Len
+}
+
+// ProtSize calculates the size of an image's protected TLV region, including
+// the protected trailer.  It returns 0 if the image has no protected TLVs.
+func (img *Image) ProtSize() uint16 {
+	if len(img.ProtTlvs) == 0 {
+		return 0
 	}
 
-	return trailer
+	return img.ProtTrailer().TlvTotLen
+}
+
+// ProtTlvCount returns the number of TLVs in an image's protected region.
+func (img *Image) ProtTlvCount() int {
+	return len(img.ProtTlvs)
 }
 
-// Hash retrieves the contents of an image's SHA256 TLV.
+// ProtTotalLen calculates the size of an image's protected TLV region from
+// its parsed TLVs, including the protected trailer.  It is 0 if the image has
+// no protected TLVs.  For a well-formed image it equals the header's ProtSz;
+// VerifyStructure reports a mismatch.
+func (img *Image) ProtTotalLen() int {
+	if len(img.ProtTlvs) == 0 {
+		return 0
+	}
+
+	return tlvRegionSize(img.ProtTlvs)
+}
+
+// TlvCount returns the number of TLVs in an image's unprotected region.
+func (img *Image) TlvCount() int {
+	return len(img.Tlvs)
+}
+
+// TlvTotalLen calculates the size of an image's unprotected TLV region from
+// its parsed TLVs, including the trailer.
+func (img *Image) TlvTotalLen() int {
+	return tlvRegionSize(img.Tlvs)
+}
+
+// Hash retrieves the hash stored in an image's SHA256 TLV.  The hash is not
+// recomputed, so the result reflects whatever the TLV contains; use CalcHash
+// to compute the hash from the image contents, or VerifyHash to compare the
+// two.  An error is returned if the image does not contain exactly one SHA256
+// TLV.
 func (i *Image) Hash() ([]byte, error) {
 	tlv, err := i.FindUniqueTlv(IMAGE_TLV_SHA256)
 	if err != nil {
@@ -315,83 +694,312 @@ func (i *Image) Hash() ([]byte, error) {
 	return tlv.Data, nil
 }
 
-// CalcHash calculates a SHA256 of the given image.
+// BuildInfo retrieves the contents of an image's BUILD_INFO TLV (typically the
+// source commit the image was built from).  Only the protected region is
+// searched, since an unprotected TLV is not covered by the image hash; if
+// there is more than one, the first is used.  The bool return value is false
+// if the image has no protected BUILD_INFO TLV.  An error is returned if the
+// TLV does not contain valid UTF-8.
+func (i *Image) BuildInfo() (string, bool, error) {
+	for _, tlv := range i.ProtTlvs {
+		if tlv.Header.Type == IMAGE_TLV_BUILD_INFO {
+			if !utf8.Valid(tlv.Data) {
+				return "", false, errors.Errorf(
+					"BUILD_INFO TLV contains invalid UTF-8")
+			}
+			return string(tlv.Data), true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// CalcHash computes the SHA256 of the given image's contents (see
+// SigningDigest for the bytes covered).  The image's SHA256 TLV is neither
+// consulted nor modified; use Hash to retrieve the stored value.
 func (i *Image) CalcHash() ([]byte, error) {
-	return calcHash(nil, i.Header, i.Pad, i.Body)
+	return calcHash(nil, i.Header, i.Pad, i.Body, i.ProtTlvs)
+}
+
+// DigestOpts supplies information that affects an image's signing digest
+// but is not recorded in the image itself.
+type DigestOpts struct {
+	// For the application image of a split pair: the loader image hash that
+	// seeded the app's hash (see ImageCreator.InitialHash).  Nil for an image
+	// whose hash was not seeded.
+	InitialHash []byte
+}
+
+// SigningDigest returns the digest that an image's signatures cover.  This is
+// the SHA256 of the following byte sequence, in order:
+//  1. The 32-byte image header, including the protected TLV size (ProtSz).
+//  2. The header padding (HdrSz - 32 bytes), as it appears on disk.
+//  3. The plaintext body (ImgSz bytes).
+//  4. If the header's ProtSz is nonzero, the protected trailer (magic 0x6908
+//     and total length) followed by each protected TLV (header plus data).
+//     Legacy images (ProtSz == 0) end the sequence at the body.
+//
+// Unprotected TLVs, including the SHA256 TLV itself, are not covered.  An
+// image whose hash was seeded with a loader hash requires SigningDigestOpts.
+// An encrypted image must be decrypted first (see Decrypt), since the
+// digest covers the plaintext body.
+//
+// The returned hash identifies the algorithm that produced the digest; it is
+// always crypto.SHA256.  As in MCUboot, every signature type signs this
+// digest rather than the covered bytes: RSA-PSS and ECDSA sign it as a
+// SHA256 digest, and ED25519 signs the 32 digest bytes as its message.  This
+// is the digest passed to an ExtSigner's SignFunc.
+func (i *Image) SigningDigest() ([]byte, crypto.Hash, error) {
+	return i.SigningDigestOpts(DigestOpts{})
+}
+
+// SigningDigestOpts is like SigningDigest, but allows the caller to supply the
+// initial hash of a split application image.  When an initial hash is given,
+// it precedes the byte sequence described in SigningDigest.
+func (i *Image) SigningDigestOpts(opts DigestOpts) ([]byte, crypto.Hash,
+	error) {
+
+	// A decrypted image retains its encrypted flag (the flag is covered by
+	// the hash), but Decrypt removes its secret TLV.
+	secrets := i.FindTlvsIf(func(tlv ImageTlv) bool {
+		return ImageTlvTypeIsSecret(tlv.Header.Type)
+	})
+	if i.IsEncrypted() && len(secrets) > 0 {
+		return nil, 0, errors.Errorf(
+			"cannot compute signing digest of encrypted image; decrypt first")
+	}
+
+	digest, err := calcHash(opts.InitialHash, i.Header, i.Pad, i.Body,
+		i.ProtTlvs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return digest, crypto.SHA256, nil
 }
 
 // WritePlusOffsets writes a binary image to the given writer.  It returns
 // the offsets of the image components that got written.
 func (i *Image) WritePlusOffsets(w io.Writer) (ImageOffsets, error) {
-	offs := ImageOffsets{}
-	offset := 0
+	offs := i.layout()
 
-	offs.Header = offset
+	if sz := tlvRegionSize(i.ProtTlvs); sz > 0xffff {
+		return offs, errors.Errorf(
+			"image protected TLV region too large: have=%d max=%d",
+			sz, 0xffff)
+	}
+	if sz := tlvRegionSize(i.Tlvs); sz > 0xffff {
+		return offs, errors.Errorf(
+			"image TLV region too large: have=%d max=%d", sz, 0xffff)
+	}
 
 	err := binary.Write(w, binary.LittleEndian, &i.Header)
 	if err != nil {
 		return offs, errors.Wrapf(err, "failed to write image header")
 	}
-	offset += IMAGE_HEADER_SIZE
 
 	err = binary.Write(w, binary.LittleEndian, i.Pad)
 	if err != nil {
 		return offs, errors.Wrapf(err, "failed to write image padding")
 	}
-	offset += len(i.Pad)
 
-	offs.Body = offset
-	size, err := w.Write(i.Body)
-	if err != nil {
+	// Zero-fill any header padding not represented in the Pad field.
+	extra := offs.Body - IMAGE_HEADER_SIZE - len(i.Pad)
+	if extra > 0 {
+		if _, err := w.Write(make([]byte, extra)); err != nil {
+			return offs, errors.Wrapf(err, "failed to write image padding")
+		}
+	}
+
+	if _, err := w.Write(i.Body); err != nil {
 		return offs, errors.Wrapf(err, "failed to write image body")
 	}
-	offset += size
+
+	if offs.ProtTrailer >= 0 {
+		protTrailer := i.ProtTrailer()
+		err = binary.Write(w, binary.LittleEndian, &protTrailer)
+		if err != nil {
+			return offs, errors.Wrapf(err,
+				"failed to write image protected trailer")
+		}
+
+		for _, tlv := range i.ProtTlvs {
+			if _, err := tlv.Write(w); err != nil {
+				return offs, errors.Wrapf(err,
+					"failed to write image protected TLV")
+			}
+		}
+	}
 
 	trailer := i.Trailer()
-	offs.Trailer = offset
 	err = binary.Write(w, binary.LittleEndian, &trailer)
 	if err != nil {
 		return offs, errors.Wrapf(err, "failed to write image trailer")
 	}
-	offset += IMAGE_TRAILER_SIZE
 
 	for _, tlv := range i.Tlvs {
-		offs.Tlvs = append(offs.Tlvs, offset)
-		size, err := tlv.Write(w)
-		if err != nil {
+		if _, err := tlv.Write(w); err != nil {
 			return offs, errors.Wrapf(err, "failed to write image TLV")
 		}
-		offset += size
 	}
 
-	offs.TotalSize = offset
-
 	return offs, nil
 }
 
+// layout calculates the offset of each of an image's components as Write
+// places them.  This is the single source of the image layout: Write, Offsets,
+// TotalSize, TlvOffsets, and SizeBreakdown are all derived from it.
+func (i *Image) layout() ImageOffsets {
+	offs := ImageOffsets{ProtTrailer: -1}
+
+	off := IMAGE_HEADER_SIZE + len(i.Pad)
+	if hdrSz := int(i.Header.HdrSz); hdrSz > off {
+		off = hdrSz
+	}
+
+	offs.Body = off
+	off += len(i.Body)
+
+	if len(i.ProtTlvs) > 0 || i.Header.ProtSz() > 0 {
+		offs.ProtTrailer = off
+		offs.ProtTlvs, off = layoutTlvs(off+IMAGE_TRAILER_SIZE, i.ProtTlvs)
+	}
+
+	offs.Trailer = off
+	offs.Tlvs, off = layoutTlvs(off+IMAGE_TRAILER_SIZE, i.Tlvs)
+
+	offs.TotalSize = off
+
+	return offs
+}
+
 // Offsets returns the offsets of each of an image's components if it were
 // serialized.
 func (i *Image) Offsets() (ImageOffsets, error) {
 	return i.WritePlusOffsets(ioutil.Discard)
 }
 
-// TotalSize returns the size of the image if it were serialized, in bytes.
-func (i *Image) TotalSize() (int, error) {
+// ImageWriteOpts controls how an image is serialized.
+type ImageWriteOpts struct {
+	// Byte used to pad the end of the image up to the specified alignment.
+	FillByte byte
+
+	// If greater than 1, the output is padded with FillByte such that its
+	// total size is a multiple of this value.  The padding follows the
+	// last TLV; it is not covered by the image hash and is not accounted for
+	// in the trailer's TLV length.
+	Align int
+}
+
+// TlvOffset describes where a TLV is located within a serialized image.
+type TlvOffset struct {
+	Tlv *ImageTlv
+
+	// True if the TLV is in the protected region.
+	Protected bool
+
+	// Absolute offset of the TLV's header.
+	Offset int
+
+	// Total length of the TLV, including its header.
+	Len int
+}
+
+// TlvOffsets returns the location of every TLV in an image as Write would
+// place it, in on-disk order (protected TLVs first).  Each entry points into
+// the image's TLV slices.  An error is returned if the image cannot be
+// serialized.
+func (i *Image) TlvOffsets() ([]TlvOffset, error) {
 	offs, err := i.Offsets()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return offs.TotalSize, nil
+
+	return i.tlvOffsets(offs), nil
+}
+
+// tlvOffsets locates each of an image's TLVs within the given layout.  The
+// length of each TLV is the distance to the next component.
+func (i *Image) tlvOffsets(offs ImageOffsets) []TlvOffset {
+	var tlvOffs []TlvOffset
+	region := func(tlvs []ImageTlv, starts []int, end int, prot bool) {
+		for idx := range tlvs {
+			next := end
+			if idx+1 < len(starts) {
+				next = starts[idx+1]
+			}
+			tlvOffs = append(tlvOffs, TlvOffset{
+				Tlv:       &tlvs[idx],
+				Protected: prot,
+				Offset:    starts[idx],
+				Len:       next - starts[idx],
+			})
+		}
+	}
+	region(i.ProtTlvs, offs.ProtTlvs, offs.Trailer, true)
+	region(i.Tlvs, offs.Tlvs, offs.TotalSize, false)
+
+	return tlvOffs
 }
 
 // Write serializes and writes a Mynewt image.
 func (i *Image) Write(w io.Writer) (int, error) {
-	offs, err := i.WritePlusOffsets(w)
+	return i.WriteWithOpts(w, ImageWriteOpts{})
+}
+
+// WriteTo implements io.WriterTo.  It is equivalent to Write; the returned
+// count equals TotalSize on success.
+func (i *Image) WriteTo(w io.Writer) (int64, error) {
+	n, err := i.Write(w)
+	return int64(n), err
+}
+
+// countWriter counts the bytes successfully written to an underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// WriteWithOpts serializes and writes a Mynewt image according to the given
+// options.  It returns the number of bytes written, including any alignment
+// padding.  On failure, the count reflects the bytes written before the
+// error.  The zero-valued options produce the same output as Write.
+func (i *Image) WriteWithOpts(w io.Writer, opts ImageWriteOpts) (int, error) {
+	if opts.Align < 0 {
+		return 0, errors.Errorf("invalid image write alignment: %d",
+			opts.Align)
+	}
+
+	cw := &countWriter{w: w}
+
+	offs, err := i.WritePlusOffsets(cw)
 	if err != nil {
-		return 0, err
+		return cw.n, err
+	}
+
+	if opts.Align > 1 {
+		if rem := offs.TotalSize % opts.Align; rem != 0 {
+			pad := bytes.Repeat([]byte{opts.FillByte}, opts.Align-rem)
+			if _, err := cw.Write(pad); err != nil {
+				return cw.n, errors.Wrapf(err,
+					"failed to write image alignment padding")
+			}
+		}
 	}
 
-	return offs.TotalSize, nil
+	return cw.n, nil
+}
+
+// TotalSize calculates the number of bytes an image occupies on disk (i.e.,
+// the number of bytes Write would produce) without serializing it.
+func (i *Image) TotalSize() int {
+	return i.layout().TotalSize
 }
 
 // WriteToFile writes a Mynewt image to a file.
@@ -411,6 +1019,13 @@ func (i *Image) WriteToFile(filename string) error {
 // CollectSigs returns a slice of all signatures present in an image's
 // trailer.
 func (img *Image) CollectSigs() ([]sec.Sig, error) {
+	return img.collectSigs(false)
+}
+
+// collectSigs gathers an image's signatures.  If lenient is true, a signature
+// without a preceding keyhash TLV (as produced by some legacy tools) is
+// returned with a nil KeyHash rather than treated as an error.
+func (img *Image) collectSigs(lenient bool) ([]sec.Sig, error) {
 	var sigs []sec.Sig
 
 	var keyHashTlv *ImageTlv
@@ -425,13 +1040,24 @@ func (img *Image) CollectSigs() ([]sec.Sig, error) {
 			keyHashTlv = t
 		} else if ImageTlvTypeIsSig(t.Header.Type) {
 			if keyHashTlv == nil {
-				return nil, errors.Errorf(
-					"image contains signature tlv without preceding keyhash")
+				if !lenient {
+					return nil, errors.Errorf(
+						"image contains signature tlv without " +
+							"preceding keyhash")
+				}
+
+				sigs = append(sigs, sec.Sig{
+					KeyHash: nil,
+					Data:    t.Data,
+					Type:    sigTlvAlgo(t.Header.Type),
+				})
+				continue
 			}
 
 			sigs = append(sigs, sec.Sig{
 				KeyHash: keyHashTlv.Data,
 				Data:    t.Data,
+				Type:    sigTlvAlgo(t.Header.Type),
 			})
 
 			keyHashTlv = nil
@@ -441,19 +1067,62 @@ func (img *Image) CollectSigs() ([]sec.Sig, error) {
 	return sigs, nil
 }
 
+// SigInfo describes a single signature TLV in an image.
+type SigInfo struct {
+	Type    SignAlgo // Signature TLV type (e.g., SIGN_ALGO_ECDSA256).
+	KeyHash []byte   // Nil if no keyhash TLV precedes the signature.
+	Len     int
+}
+
+// NumSignatures returns the number of signature TLVs in an image.
+func (img *Image) NumSignatures() int {
+	return len(img.FindTlvIndicesIf(func(tlv ImageTlv) bool {
+		return ImageTlvTypeIsSig(tlv.Header.Type)
+	}))
+}
+
+// SignatureInfo describes each signature TLV in an image, in order.  A
+// signature is paired with the keyhash TLV that immediately precedes it, if
+// any.  Unlike CollectSigs, this function does not fail on unpaired TLVs.
+func (img *Image) SignatureInfo() []SigInfo {
+	var infos []SigInfo
+
+	var keyHash []byte
+	for _, t := range img.Tlvs {
+		if t.Header.Type == IMAGE_TLV_KEYHASH {
+			keyHash = t.Data
+		} else if ImageTlvTypeIsSig(t.Header.Type) {
+			infos = append(infos, SigInfo{
+				Type:    sigTlvAlgo(t.Header.Type),
+				KeyHash: keyHash,
+				Len:     len(t.Data),
+			})
+			keyHash = nil
+		} else {
+			keyHash = nil
+		}
+	}
+
+	return infos
+}
+
 // CollectSecret finds the "secret" TLV in an image and returns its body.  It
 // returns nil if there is no "secret" TLV.
 func (img *Image) CollectSecret() ([]byte, error) {
-	tlv, err := img.FindUniqueTlv(IMAGE_TLV_ENC_RSA)
-	if err != nil {
-		return nil, err
-	}
+	tlvs := img.FindTlvsIf(func(tlv ImageTlv) bool {
+		return ImageTlvTypeIsSecret(tlv.Header.Type)
+	})
 
-	if tlv == nil {
+	if len(tlvs) == 0 {
 		return nil, nil
 	}
 
-	return tlv.Data, nil
+	if len(tlvs) > 1 {
+		return nil, errors.Errorf(
+			"image contains >1 \"secret\" TLVs (%d)", len(tlvs))
+	}
+
+	return tlvs[0].Data, nil
 }
 
 // ExtractSecret finds the "secret" TLV in an image, removes it, and returns
@@ -525,8 +1194,14 @@ func Decrypt(img Image, privEncKey sec.PrivEncKey) (Image, error) {
 				"have=%d want=1", len(tlvs))
 	}
 
+	var plainSecret []byte
+	var err error
 	cipherSecret := tlvs[0].Data
-	plainSecret, err := privEncKey.Decrypt(cipherSecret)
+	if tlvs[0].Header.Type == IMAGE_TLV_ENC_GCM {
+		plainSecret, err = privEncKey.DecryptGcm(cipherSecret)
+	} else {
+		plainSecret, err = privEncKey.Decrypt(cipherSecret)
+	}
 	if err != nil {
 		return img, err
 	}
@@ -541,7 +1216,62 @@ func Decrypt(img Image, privEncKey sec.PrivEncKey) (Image, error) {
 	return dup, nil
 }
 
+// CtrNonce returns the initial AES-CTR counter block used to encrypt an image's
+// body.  The counter starts at zero at the first byte of the body and is
+// incremented as a 128-bit big-endian integer for each 16-byte block; the
+// same derivation is used by Encrypt() and Decrypt().  An error is returned if
+// the image is not encrypted.
+func (img *Image) CtrNonce() ([]byte, error) {
+	secret, err := img.verifyEncState()
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.Errorf(
+			"cannot determine CTR nonce: image not encrypted")
+	}
+
+	return sec.AesCtrNonce(), nil
+}
+
 // IsEncrypted indicates whether an image's "encrypted" flag is set.
 func (img *Image) IsEncrypted() bool {
 	return img.Header.Flags&IMAGE_F_ENCRYPTED != 0
 }
+
+// LoadAddr returns the image's load address, which is stored in the header
+// field named Pad1.  An execute-in-place image must have the base address of
+// the flash area it runs from (see Image.ValidateXIP); a RAM-loaded image is
+// copied to this address before it runs.
+func (h *ImageHdr) LoadAddr() uint32 {
+	return h.Pad1
+}
+
+// SetLoadAddr sets the image's load address (see LoadAddr).
+func (h *ImageHdr) SetLoadAddr(addr uint32) {
+	h.Pad1 = addr
+}
+
+// ProtSz returns the size of the image's protected TLV region, including its
+// trailer, which is stored in the header field named Pad2.  Zero indicates a
+// legacy image without a protected region.
+func (h *ImageHdr) ProtSz() uint16 {
+	return h.Pad2
+}
+
+// SetProtSz sets the size of the image's protected TLV region (see ProtSz).
+func (h *ImageHdr) SetProtSz(sz uint16) {
+	h.Pad2 = sz
+}
+
+// IsBootable indicates whether an image's "non-bootable" flag is clear.
+func (img *Image) IsBootable() bool {
+	return img.Header.Flags&IMAGE_F_NON_BOOTABLE == 0
+}
+
+// IsRamLoad indicates whether an image's "RAM load" flag is set.  A RAM-loaded
+// image is copied to its load address before it runs; any other image
+// executes in place from flash.
+func (img *Image) IsRamLoad() bool {
+	return img.Header.Flags&IMAGE_F_RAM_LOAD != 0
+}
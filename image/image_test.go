@@ -20,9 +20,22 @@
 package image
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/manifest"
@@ -167,6 +180,12 @@ func testOne(t *testing.T, e entry) {
 		}
 	}
 
+	err = img.VerifyManifestHash(man, []sec.PrivEncKey{kek})
+	if err != nil {
+		fatalErr("manifest hash", "bad", "good", err)
+		return
+	}
+
 	isk := readPubSignKey()
 
 	idx, err := img.VerifySigs([]sec.PubSignKey{isk})
@@ -182,99 +201,1851 @@ func testOne(t *testing.T, e entry) {
 	}
 }
 
-func TestImageVerify(t *testing.T) {
-	entries := []entry{
-		entry{
-			basename:  "garbage",
-			form:      false,
-			structure: false,
-			man:       false,
-			sign:      false,
-			encrypted: false,
-		},
-		entry{
-			basename:  "truncated",
-			form:      false,
-			structure: false,
-			man:       false,
-			sign:      false,
-			encrypted: false,
-		},
-		entry{
-			basename:  "bad-hash",
-			form:      true,
-			structure: true,
-			hash:      false,
-			man:       false,
-			sign:      false,
-			encrypted: false,
-		},
-		entry{
-			basename:  "mismatch-hash",
-			form:      true,
-			structure: true,
-			hash:      true,
-			man:       false,
-			sign:      false,
-			encrypted: false,
-		},
-		entry{
-			basename:  "mismatch-version",
-			form:      true,
-			structure: true,
-			hash:      true,
-			man:       false,
-			sign:      false,
-			encrypted: false,
-		},
-		entry{
-			basename:  "bad-signature",
-			form:      true,
-			structure: true,
-			hash:      true,
-			man:       true,
-			sign:      false,
-			encrypted: false,
-		},
-		entry{
-			basename:  "wrong-enc-key",
-			form:      true,
-			structure: true,
-			hash:      false,
-			man:       true,
-			sign:      true,
-			encrypted: true,
-		},
-		entry{
-			basename:  "good-unsigned-unencrypted",
-			form:      true,
-			structure: true,
-			hash:      true,
-			man:       true,
-			sign:      false,
-			encrypted: false,
-		},
-		entry{
-			basename:  "good-signed-unencrypted",
-			form:      true,
-			structure: true,
-			hash:      true,
-			man:       true,
-			sign:      true,
-			encrypted: false,
-		},
-		entry{
-			basename:  "good-signed-encrypted",
-			form:      true,
-			structure: true,
-			hash:      true,
-			man:       true,
-			sign:      true,
-			encrypted: true,
-		},
+func TestValidateXIP(t *testing.T) {
+	const base = 0x08020000
+
+	create := func(setup func(ic *ImageCreator)) Image {
+		ic := NewImageCreator()
+		ic.Body = make([]byte, 64)
+		setup(&ic)
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
 	}
 
-	for _, e := range entries {
-		testOne(t, e)
+	img := create(func(ic *ImageCreator) { ic.LoadAddr = base })
+	if img.Header.LoadAddr() != base || img.Header.Pad1 != base {
+		t.Fatalf("wrong load address: 0x%08x", img.Header.LoadAddr())
+	}
+	if err := img.ValidateXIP(base); err != nil {
+		t.Fatalf("valid XIP image rejected: %s", err.Error())
+	}
+	if err := img.ValidateXIP(base + 0x1000); err == nil {
+		t.Fatalf("XIP image with wrong load address accepted")
+	}
+
+	img.Header.SetLoadAddr(base + 0x1000)
+	if err := img.ValidateXIP(base + 0x1000); err != nil {
+		t.Fatalf("updated load address rejected: %s", err.Error())
+	}
+
+	img = create(func(ic *ImageCreator) {
+		ic.LoadAddr = base
+		ic.Bootable = false
+	})
+	if err := img.ValidateXIP(base); err == nil {
+		t.Fatalf("non-bootable XIP image accepted")
+	}
+
+	img = create(func(ic *ImageCreator) {
+		ic.LoadAddr = 0x20000000
+		ic.RamLoad = true
+	})
+	if !img.IsRamLoad() {
+		t.Fatalf("RAM-load flag not set")
+	}
+	if err := img.ValidateXIP(0x20000000); err == nil {
+		t.Fatalf("RAM-loaded image accepted as XIP")
+	}
+}
+
+func TestImageRawBytes(t *testing.T) {
+	imgData := readImageData("good-signed-unencrypted")
+
+	img, err := ParseImage(imgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offs, err := img.Offsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := img.HeaderBytes()
+	if !bytes.Equal(hdr, imgData[offs.Header:offs.Header+IMAGE_HEADER_SIZE]) {
+		t.Fatalf("header bytes differ from image: have=%x", hdr)
+	}
+
+	trailer := img.TrailerBytes()
+	want := imgData[offs.Trailer : offs.Trailer+IMAGE_TRAILER_SIZE]
+	if !bytes.Equal(trailer, want) {
+		t.Fatalf("trailer bytes differ from image: have=%x want=%x",
+			trailer, want)
+	}
+}
+
+func TestImageTlvOffsets(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.ProtTlvs = append(img.ProtTlvs, ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_SEC_CNT, Len: 4},
+		Data:   []byte{1, 0, 0, 0},
+	})
+	img.Header.SetProtSz(img.ProtSize())
+
+	buf := &bytes.Buffer{}
+	if _, err := img.Write(buf); err != nil {
+		t.Fatal(err)
 	}
+	data := buf.Bytes()
+
+	offs, err := img.TlvOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offs) != len(img.ProtTlvs)+len(img.Tlvs) {
+		t.Fatalf("wrong TLV offset count: have=%d want=%d",
+			len(offs), len(img.ProtTlvs)+len(img.Tlvs))
+	}
+	if !offs[0].Protected || offs[len(offs)-1].Protected {
+		t.Fatalf("TLV offsets not in on-disk order")
+	}
+
+	for i, off := range offs {
+		if off.Offset+off.Len > len(data) {
+			t.Fatalf("TLV %d extends past end of image", i)
+		}
+		tlv, _, err := parseRawTlv(data, off.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlv.Header != off.Tlv.Header ||
+			!bytes.Equal(tlv.Data, off.Tlv.Data) ||
+			IMAGE_TLV_SIZE+len(tlv.Data) != off.Len {
+
+			t.Fatalf("TLV %d not at reported offset %d", i, off.Offset)
+		}
+	}
+
+	// An image that cannot be serialized has no TLV offsets.
+	big := make([]byte, 0xffff)
+	img.Tlvs = append(img.Tlvs, ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_BOOT_RECORD, Len: 0xffff},
+		Data:   big,
+	})
+	if _, err := img.TlvOffsets(); err == nil {
+		t.Fatalf("oversized TLV region accepted")
+	}
+}
+
+func TestImageLegacy(t *testing.T) {
+	// These fixtures were produced before protected TLVs existed.
+	for _, basename := range []string{
+		"good-unsigned-unencrypted",
+		"good-signed-unencrypted",
+	} {
+		imgData := readImageData(basename)
+
+		img, err := ParseImage(imgData)
+		if err != nil {
+			t.Fatalf("%s: %s", basename, err.Error())
+		}
+
+		if img.Header.ProtSz() != 0 || len(img.ProtTlvs) != 0 {
+			t.Fatalf("%s: legacy image has protected TLVs: prot_sz=%d count=%d",
+				basename, img.Header.ProtSz(), len(img.ProtTlvs))
+		}
+
+		sum := sha256.Sum256(imgData[:IMAGE_HEADER_SIZE+len(img.Body)])
+		hash, err := img.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash, sum[:]) {
+			t.Fatalf("%s: legacy image hash does not cover header+body: "+
+				"have=%x want=%x", basename, hash, sum)
+		}
+		if _, err := img.VerifyHash(nil); err != nil {
+			t.Fatalf("%s: %s", basename, err.Error())
+		}
+
+		b := &bytes.Buffer{}
+		if _, err := img.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), imgData) {
+			t.Fatalf("%s: legacy image does not round trip", basename)
+		}
+	}
+}
+
+func TestImageClone(t *testing.T) {
+	imgData := readImageData("good-signed-unencrypted")
+	orig, err := ParseImage(imgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func() []byte {
+		b := &bytes.Buffer{}
+		if _, err := orig.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	origBytes := encode()
+
+	dup := orig.Clone()
+	dup.Header.Vers.Major++
+	dup.Body[0] ^= 0xff
+	dup.Tlvs[0].Data[0] ^= 0xff
+	dup.RemoveTlvsWithType(IMAGE_TLV_SHA256)
+	if err := dup.AddTlv(ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_BUILD_INFO, Len: 3},
+		Data:   []byte("abc"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing TLVs from a shallow copy must not disturb the original either.
+	shallow := orig
+	shallow.RemoveTlvsWithType(IMAGE_TLV_KEYHASH)
+
+	if !bytes.Equal(origBytes, encode()) {
+		t.Fatalf("mutating a clone modified the original image")
+	}
+}
+
+func TestCorruptError(t *testing.T) {
+	good := readImageData("good-unsigned-unencrypted")
+	img, err := ParseImage(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailerOff := IMAGE_HEADER_SIZE + len(img.Body)
+
+	mutate := func(fn func(b []byte) []byte) []byte {
+		return fn(append([]byte(nil), good...))
+	}
+
+	type tcase struct {
+		name string
+		data []byte
+		off  int
+	}
+
+	tcases := []tcase{
+		{"bad magic", mutate(func(b []byte) []byte {
+			b[0] ^= 0xff
+			return b
+		}), 0},
+		{"short header", good[:IMAGE_HEADER_SIZE/2], 0},
+		{"small header size", mutate(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[8:], IMAGE_HEADER_SIZE-1)
+			return b
+		}), 0},
+		{"short body", good[:IMAGE_HEADER_SIZE+len(img.Body)/2],
+			IMAGE_HEADER_SIZE},
+		{"bad trailer magic", mutate(func(b []byte) []byte {
+			b[trailerOff] ^= 0xff
+			return b
+		}), trailerOff},
+		{"short TLVs", good[:len(good)-1], trailerOff},
+	}
+
+	for _, tc := range tcases {
+		_, err := ParseImage(tc.data)
+		if err == nil {
+			t.Fatalf("%s: corrupt image accepted", tc.name)
+		}
+
+		var ce *CorruptError
+		if !errors.As(err, &ce) {
+			t.Fatalf("%s: wrong error type: %T", tc.name, err)
+		}
+		if ce.Offset != tc.off {
+			t.Fatalf("%s: wrong offset: have=%d want=%d",
+				tc.name, ce.Offset, tc.off)
+		}
+	}
+
+	// Input that isn't an image at all is rejected by its magic.
+	for _, data := range [][]byte{
+		[]byte(`{"name": "targets/app", "image": "app.img"}`),
+		[]byte{0x3d, 0xb8},
+		nil,
+	} {
+		_, err := ParseImage(data)
+		var ce *CorruptError
+		if !errors.As(err, &ce) || ce.Offset != 0 {
+			t.Fatalf("non-image %q: wrong error: %v", data, err)
+		}
+		if len(data) >= 4 && ce.Have != hex.EncodeToString(data[:4]) {
+			t.Fatalf("non-image %q: wrong magic reported: %s", data, ce.Have)
+		}
+	}
+
+	// A missing file is an I/O failure, not a corrupt image.
+	_, err = ReadImage(testdataPath + "/no-such-image.img")
+	var ce *CorruptError
+	if err == nil || errors.As(err, &ce) {
+		t.Fatalf("I/O failure reported as corrupt image: %v", err)
+	}
+}
+
+func TestSigningDigest(t *testing.T) {
+	// Legacy image: the digest covers the 32-byte header and the body.
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, hash, err := img.SigningDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != crypto.SHA256 {
+		t.Fatalf("wrong hash algorithm: %v", hash)
+	}
+	want := "8eb006d574ace63cce18a1f2d8f0f2645f1a0e8630a39fb86bbfbb805d4cd3b9"
+	if hex.EncodeToString(digest) != want {
+		t.Fatalf("wrong digest: have=%x want=%s", digest, want)
+	}
+
+	// Image with protected TLVs: the digest additionally covers the
+	// protected trailer and TLVs.
+	ic := NewImageCreator()
+	ic.Body = bytes.Repeat([]byte{0xa5}, 100)
+	ic.ProtTlvs = []ImageTlv{{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_SEC_CNT, Len: 4},
+		Data:   []byte{7, 0, 0, 0},
+	}}
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := img.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	covered := int(img.Header.HdrSz) + int(img.Header.ImgSz) +
+		int(img.Header.ProtSz())
+	sum := sha256.Sum256(b.Bytes()[:covered])
+
+	digest, _, err = img.SigningDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, sum[:]) {
+		t.Fatalf("wrong digest: have=%x want=%x", digest, sum)
+	}
+
+	// Split app: the digest is seeded with the loader hash.
+	loaderHash := bytes.Repeat([]byte{0x11}, IMAGE_HASH_SZ)
+	ic.InitialHash = loaderHash
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _, err = img.SigningDigestOpts(DigestOpts{
+		InitialHash: loaderHash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := img.Hash(); !bytes.Equal(digest, stored) {
+		t.Fatalf("wrong seeded digest: have=%x want=%x", digest, stored)
+	}
+	if digest, _, _ := img.SigningDigest(); bytes.Equal(digest,
+		img.Tlvs[0].Data) {
+
+		t.Fatalf("unseeded digest matches seeded hash")
+	}
+
+	// Encrypted images must be decrypted first.
+	ic.InitialHash = nil
+	ic.PlainSecret = make([]byte, 16)
+	ic.CipherSecret = make([]byte, 24)
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := img.SigningDigest(); err == nil {
+		t.Fatalf("signing digest computed over ciphertext")
+	}
+}
+
+func TestSlotUsage(t *testing.T) {
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// imgtool's default trailer: 128 sectors * 3 * 1 + 4 * 8 + 16.
+	ic := NewImageCreator()
+	if sz := ic.SlotTrailerSize(); sz != 432 {
+		t.Fatalf("wrong trailer size: have=%d want=432", sz)
+	}
+
+	// An 8-byte write size: 128 * 3 * 8 + 4 * 8 + 16.
+	if sz := SlotTrailerSize(8, 128); sz != 3120 {
+		t.Fatalf("wrong trailer size: have=%d want=3120", sz)
+	}
+
+	used, free, reserve, err := img.SlotUsage(0x8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != img.TotalSize() || reserve != 432 ||
+		used+free+reserve != 0x8000 {
+
+		t.Fatalf("wrong slot usage: used=%d free=%d reserve=%d",
+			used, free, reserve)
+	}
+
+	// Exactly full.
+	if _, free, _, err := img.SlotUsage(used + reserve); err != nil ||
+		free != 0 {
+
+		t.Fatalf("full slot: free=%d err=%v", free, err)
+	}
+
+	if _, free, _, err := img.SlotUsage(used + reserve - 1); err == nil ||
+		free != -1 {
+
+		t.Fatalf("image fit in undersized slot: free=%d", free)
+	}
+}
+
+func TestTlvStats(t *testing.T) {
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 100)
+	ic.ProtTlvs = []ImageTlv{{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_SEC_CNT, Len: 4},
+		Data:   []byte{1, 0, 0, 0},
+	}}
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.ProtTlvCount() != 1 || img.TlvCount() != 1 {
+		t.Fatalf("wrong TLV counts: prot=%d unprot=%d",
+			img.ProtTlvCount(), img.TlvCount())
+	}
+	if img.ProtTotalLen() != int(img.Header.ProtSz()) ||
+		img.ProtTotalLen() != IMAGE_TRAILER_SIZE+IMAGE_TLV_SIZE+4 {
+
+		t.Fatalf("wrong protected length: have=%d header=%d",
+			img.ProtTotalLen(), img.Header.ProtSz())
+	}
+	if img.TlvTotalLen() != int(img.Trailer().TlvTotLen) {
+		t.Fatalf("wrong TLV length: have=%d trailer=%d",
+			img.TlvTotalLen(), img.Trailer().TlvTotLen)
+	}
+
+	if err := img.VerifyStructure(); err != nil {
+		t.Fatal(err)
+	}
+	img.Header.Pad2 += 4
+	if err := img.VerifyStructure(); err == nil {
+		t.Fatalf("wrong ProtSz passed structure check")
+	}
+}
+
+func TestImageWriteTo(t *testing.T) {
+	imgData := readImageData("good-signed-unencrypted")
+	img, err := ParseImage(imgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wt io.WriterTo = &img
+
+	h := sha256.New()
+	n, err := wt.WriteTo(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(img.TotalSize()) {
+		t.Fatalf("wrong byte count: have=%d want=%d", n, img.TotalSize())
+	}
+
+	want := sha256.Sum256(imgData[:img.TotalSize()])
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatalf("WriteTo output differs from original image")
+	}
+
+	// A failed write reports the bytes actually written.
+	for _, limit := range []int{0, 10, IMAGE_HEADER_SIZE, img.TotalSize() - 1} {
+		lw := &limitWriter{limit: limit}
+		n, err := img.WriteTo(lw)
+		if err == nil {
+			t.Fatalf("limit %d: write succeeded", limit)
+		}
+		if n != int64(lw.buf.Len()) || n != int64(limit) {
+			t.Fatalf("limit %d: wrong byte count: have=%d written=%d",
+				limit, n, lw.buf.Len())
+		}
+	}
+}
+
+// limitWriter accepts up to limit bytes and fails thereafter.
+type limitWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	room := lw.limit - lw.buf.Len()
+	if len(p) <= room {
+		return lw.buf.Write(p)
+	}
+
+	lw.buf.Write(p[:room])
+	return room, io.ErrShortWrite
+}
+
+func TestImagePadding(t *testing.T) {
+	for _, basename := range []string{
+		// HdrSz == 32; body immediately follows the header.
+		"good-unsigned-unencrypted",
+		// HdrSz == 128; 96 bytes of padding precede the body.
+		"good-padded-unsigned",
+	} {
+		imgData := readImageData(basename)
+
+		img, err := ParseImage(imgData)
+		if err != nil {
+			t.Fatalf("%s: %s", basename, err.Error())
+		}
+
+		bodyOff := int(img.Header.HdrSz)
+		if len(img.Pad) != bodyOff-IMAGE_HEADER_SIZE {
+			t.Fatalf("%s: wrong pad length: have=%d want=%d",
+				basename, len(img.Pad), bodyOff-IMAGE_HEADER_SIZE)
+		}
+		if !bytes.Equal(img.Body, imgData[bodyOff:bodyOff+len(img.Body)]) {
+			t.Fatalf("%s: body parsed from wrong offset", basename)
+		}
+
+		if _, err := img.VerifyHash(nil); err != nil {
+			t.Fatalf("%s: %s", basename, err.Error())
+		}
+
+		b := &bytes.Buffer{}
+		offs, err := img.WritePlusOffsets(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offs.Body != bodyOff {
+			t.Fatalf("%s: wrong body offset: have=%d want=%d",
+				basename, offs.Body, bodyOff)
+		}
+		if !bytes.Equal(b.Bytes(), imgData) {
+			t.Fatalf("%s: image does not round trip", basename)
+		}
+	}
+}
+
+func TestVerifyReport(t *testing.T) {
+	type reportEntry struct {
+		basename string
+		hash     bool
+		version  bool
+		tlv      bool
+		encFlag  bool
+	}
+
+	entries := []reportEntry{
+		{"good-signed-unencrypted", true, true, true, true},
+		{"good-signed-encrypted", true, true, false, true},
+		{"mismatch-hash", false, true, true, true},
+		{"mismatch-version", true, false, true, true},
+	}
+
+	for _, e := range entries {
+		img, err := ParseImage(readImageData(e.basename))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := VerifyImageAgainstManifest(img, readManifest(e.basename))
+		if err != nil {
+			t.Fatalf("%s: %s", e.basename, err.Error())
+		}
+
+		have := []bool{r.Hash.Ok, r.Version.Ok, r.Tlv.Ok, r.EncFlag.Ok}
+		want := []bool{e.hash, e.version, e.tlv, e.encFlag}
+		for i := range have {
+			if have[i] != want[i] {
+				t.Fatalf("%s: wrong report: have=%+v", e.basename, r)
+			}
+		}
+
+		// Only the encrypted image's hash check is skipped, and a skipped
+		// check doesn't fail the report.
+		if r.Tlv.Skipped != img.IsEncrypted() {
+			t.Fatalf("%s: wrong skipped status: have=%+v", e.basename, r)
+		}
+		ok := e.hash && e.version && (e.tlv || img.IsEncrypted()) && e.encFlag
+		if r.Ok() != ok {
+			t.Fatalf("%s: wrong report status: have=%+v", e.basename, r)
+		}
+	}
+}
+
+func TestCtrNonce(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-encrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, err := img.CtrNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decrypt the body independently of Decrypt() and compare.
+	kek := readPrivEncKey()
+	cipherSecret, err := img.CollectSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := kek.Decrypt(cipherSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := aes.NewCipher(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, len(img.Body))
+	cipher.NewCTR(blk, nonce).XORKeyStream(plain, img.Body)
+
+	dec, err := Decrypt(img, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, dec.Body) {
+		t.Fatalf("external CTR decryption differs from Decrypt()")
+	}
+
+	plainImg, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plainImg.CtrNonce(); err == nil {
+		t.Fatalf("unencrypted image has CTR nonce")
+	}
+}
+
+func TestImageVersionString(t *testing.T) {
+	entries := []struct {
+		ver   ImageVersion
+		short string
+		full  string
+	}{
+		{ImageVersion{1, 2, 3, 0}, "1.2.3", "1.2.3.0"},
+		{ImageVersion{1, 2, 3, 4}, "1.2.3.4", "1.2.3.4"},
+		{ImageVersion{0, 0, 0, 0}, "0.0.0", "0.0.0.0"},
+	}
+
+	for _, e := range entries {
+		if s := e.ver.StringShort(); s != e.short {
+			t.Fatalf("wrong short version: have=%s want=%s", s, e.short)
+		}
+		if s := e.ver.StringFull(); s != e.full {
+			t.Fatalf("wrong full version: have=%s want=%s", s, e.full)
+		}
+	}
+}
+
+func TestCreateProtTlvs(t *testing.T) {
+	secCnt := ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_SEC_CNT, Len: 4},
+		Data:   []byte{7, 0, 0, 0},
+	}
+
+	create := func(protTlvs []ImageTlv) Image {
+		ic := NewImageCreator()
+		ic.Version = ImageVersion{1, 2, 3, 4}
+		ic.Body = make([]byte, 100)
+		ic.ProtTlvs = protTlvs
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	plain := create(nil)
+	img := create([]ImageTlv{secCnt})
+
+	if img.Header.ProtSz() != IMAGE_TRAILER_SIZE+IMAGE_TLV_SIZE+4 {
+		t.Fatalf("wrong protected size: have=%d", img.Header.ProtSz())
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := img.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	img2, err := ParseImage(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img2.ProtTlvs) != 1 ||
+		img2.ProtTlvs[0].Header != secCnt.Header ||
+		!bytes.Equal(img2.ProtTlvs[0].Data, secCnt.Data) {
+
+		t.Fatalf("protected TLVs did not survive round trip: %+v",
+			img2.ProtTlvs)
+	}
+
+	if _, err := img2.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	h1, _ := plain.Hash()
+	h2, _ := img2.Hash()
+	if bytes.Equal(h1, h2) {
+		t.Fatalf("protected TLVs not covered by hash")
+	}
+
+	// Tampering with a protected TLV must invalidate the hash.
+	img2.ProtTlvs[0].Data[0] = 8
+	if _, err := img2.VerifyHash(nil); err == nil {
+		t.Fatalf("modified protected TLV passed hash check")
+	}
+}
+
+func TestImageTlvDecoder(t *testing.T) {
+	const testTlvType = 0xf0
+
+	RegisterImageTlvDecoder(testTlvType, "TEST",
+		func(data []byte) (interface{}, error) {
+			if len(data) != 2 {
+				return nil, errors.Errorf("bad length")
+			}
+			return int(data[0]) + int(data[1]), nil
+		})
+	defer delete(imageTlvTypeDescMap, testTlvType)
+
+	if name := ImageTlvTypeName(testTlvType); name != "TEST" {
+		t.Fatalf("wrong TLV type name: have=%s want=TEST", name)
+	}
+
+	tlv := ImageTlv{
+		Header: ImageTlvHdr{Type: testTlvType, Len: 2},
+		Data:   []byte{1, 2},
+	}
+	if v := tlv.Map(0, 0)["data"]; v != 3 {
+		t.Fatalf("wrong decoded TLV data: have=%v want=3", v)
+	}
+
+	// Data that the decoder rejects falls back to hex.
+	tlv.Data = []byte{1, 2, 3}
+	tlv.Header.Len = 3
+	if v := tlv.Map(0, 0)["data"]; v != "010203" {
+		t.Fatalf("wrong fallback TLV data: have=%v want=010203", v)
+	}
+}
+
+func TestUnknownTlvTypes(t *testing.T) {
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if types := img.UnknownTlvTypes(); len(types) != 0 {
+		t.Fatalf("unexpected unknown TLV types: %v", types)
+	}
+
+	for _, typ := range []uint8{0xf3, 0xf1, 0xf3} {
+		if err := img.AddTlv(ImageTlv{
+			Header: ImageTlvHdr{Type: typ, Len: 1},
+			Data:   []byte{typ},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := img.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	img, err = ParseImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := img.UnknownTlvTypes()
+	if !bytes.Equal(types, []uint8{0xf1, 0xf3}) {
+		t.Fatalf("wrong unknown TLV types: have=%v want=[241 243]", types)
+	}
+}
+
+func TestImageVerify(t *testing.T) {
+	entries := []entry{
+		entry{
+			basename:  "garbage",
+			form:      false,
+			structure: false,
+			man:       false,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "truncated",
+			form:      false,
+			structure: false,
+			man:       false,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "bad-hash",
+			form:      true,
+			structure: true,
+			hash:      false,
+			man:       false,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "mismatch-hash",
+			form:      true,
+			structure: true,
+			hash:      true,
+			man:       false,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "mismatch-version",
+			form:      true,
+			structure: true,
+			hash:      true,
+			man:       false,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "bad-signature",
+			form:      true,
+			structure: true,
+			hash:      true,
+			man:       true,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "wrong-enc-key",
+			form:      true,
+			structure: true,
+			hash:      false,
+			man:       true,
+			sign:      true,
+			encrypted: true,
+		},
+		entry{
+			basename:  "enc-flag-no-tlv",
+			form:      true,
+			structure: false,
+			man:       false,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "enc-tlv-no-flag",
+			form:      true,
+			structure: false,
+			man:       false,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "good-unsigned-unencrypted",
+			form:      true,
+			structure: true,
+			hash:      true,
+			man:       true,
+			sign:      false,
+			encrypted: false,
+		},
+		entry{
+			basename:  "good-signed-unencrypted",
+			form:      true,
+			structure: true,
+			hash:      true,
+			man:       true,
+			sign:      true,
+			encrypted: false,
+		},
+		entry{
+			basename:  "good-signed-encrypted",
+			form:      true,
+			structure: true,
+			hash:      true,
+			man:       true,
+			sign:      true,
+			encrypted: true,
+		},
+	}
+
+	for _, e := range entries {
+		testOne(t, e)
+	}
+}
+
+func TestFindTlvsAnyRegion(t *testing.T) {
+	dep := func(b byte) ImageTlv {
+		return ImageTlv{
+			Header: ImageTlvHdr{Type: IMAGE_TLV_DEPENDENCY, Len: 12},
+			Data:   append([]byte{b}, make([]byte, 11)...),
+		}
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.ProtTlvs = []ImageTlv{dep(1)}
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddTlv(dep(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	deps := img.FindTlvsAnyRegion(IMAGE_TLV_DEPENDENCY)
+	if len(deps) != 2 || !deps[0].Protected || deps[1].Protected {
+		t.Fatalf("wrong dependency TLVs: %+v", deps)
+	}
+	if len(img.FindTlvs(IMAGE_TLV_DEPENDENCY)) != 1 {
+		t.Fatalf("FindTlvs searched the protected region")
+	}
+
+	if _, _, err := img.FindUniqueTlvAnyRegion(
+		IMAGE_TLV_DEPENDENCY); err == nil {
+
+		t.Fatalf("duplicate TLV reported as unique")
+	}
+	tlv, prot, err := img.FindUniqueTlvAnyRegion(IMAGE_TLV_SHA256)
+	if err != nil || tlv == nil || prot {
+		t.Fatalf("wrong SHA256 lookup: tlv=%v prot=%v err=%v", tlv, prot, err)
+	}
+
+	// Only the protected dependency is covered by the hash.
+	before, err := img.CalcHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps[1].Tlv.Data[0] ^= 0xff
+	after, err := img.CalcHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("unprotected TLV changed the image hash")
+	}
+	deps[0].Tlv.Data[0] ^= 0xff
+	after, err = img.CalcHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Fatalf("protected TLV did not change the image hash")
+	}
+}
+
+func TestAllTlvs(t *testing.T) {
+	img := Image{
+		ProtTlvs: []ImageTlv{
+			{Header: ImageTlvHdr{Type: IMAGE_TLV_SEC_CNT}},
+		},
+		Tlvs: []ImageTlv{
+			{Header: ImageTlvHdr{Type: IMAGE_TLV_SHA256}},
+			{Header: ImageTlvHdr{Type: IMAGE_TLV_KEYHASH}},
+		},
+	}
+
+	type expTlv struct {
+		typ       uint8
+		protected bool
+	}
+	exp := []expTlv{
+		{IMAGE_TLV_SEC_CNT, true},
+		{IMAGE_TLV_SHA256, false},
+		{IMAGE_TLV_KEYHASH, false},
+	}
+
+	all := img.AllTlvs()
+	if len(all) != len(exp) {
+		t.Fatalf("wrong TLV count: have=%d want=%d", len(all), len(exp))
+	}
+	for i, r := range all {
+		if r.Tlv.Header.Type != exp[i].typ || r.Protected != exp[i].protected {
+			t.Fatalf("TLV %d: have=(%d,%v) want=(%d,%v)", i,
+				r.Tlv.Header.Type, r.Protected, exp[i].typ, exp[i].protected)
+		}
+	}
+
+	// Stop after the second TLV.
+	count := 0
+	img.EachTlv(func(tlv ImageTlv, protected bool) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Fatalf("EachTlv did not stop early: count=%d", count)
+	}
+}
+
+func TestImageTotalSize(t *testing.T) {
+	for _, basename := range []string{
+		"good-unsigned-unencrypted",
+		"good-signed-unencrypted",
+		"good-signed-encrypted",
+		"good-padded-unsigned",
+	} {
+		img, err := ParseImage(readImageData(basename))
+		if err != nil {
+			t.Fatalf("%s: %s", basename, err.Error())
+		}
+
+		b := &bytes.Buffer{}
+		if _, err := img.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if img.TotalSize() != b.Len() {
+			t.Fatalf("%s: wrong total size: have=%d want=%d",
+				basename, img.TotalSize(), b.Len())
+		}
+	}
+}
+
+func TestImageWriteOpts(t *testing.T) {
+	imgData := readImageData("good-unsigned-unencrypted")
+	img, err := ParseImage(imgData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Default options match Write.
+	b := &bytes.Buffer{}
+	if _, err := img.WriteWithOpts(b, ImageWriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), imgData) {
+		t.Fatalf("default write options altered image")
+	}
+
+	b = &bytes.Buffer{}
+	size, err := img.WriteWithOpts(b, ImageWriteOpts{
+		FillByte: 0xff,
+		Align:    4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != b.Len() || size%4096 != 0 || size < len(imgData) {
+		t.Fatalf("wrong aligned size: have=%d len=%d", size, b.Len())
+	}
+	if !bytes.Equal(b.Bytes()[:len(imgData)], imgData) {
+		t.Fatalf("aligned write altered image")
+	}
+	for _, c := range b.Bytes()[len(imgData):] {
+		if c != 0xff {
+			t.Fatalf("wrong fill byte: 0x%02x", c)
+		}
+	}
+
+	// Padding is ignored by the parser and the hash.
+	padded, err := ParseImage(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := padded.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	img := Image{}
+	if _, ok, err := img.BuildInfo(); err != nil || ok {
+		t.Fatalf("image without BUILD_INFO TLV reported build info")
+	}
+
+	commit := "0d0b6a7e8c2f6d1a3b4c5d6e7f8091a2b3c4d5e6"
+	img.ProtTlvs = []ImageTlv{{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_BUILD_INFO,
+			Len:  uint16(len(commit)),
+		},
+		Data: []byte(commit),
+	}}
+
+	info, ok, err := img.BuildInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || info != commit {
+		t.Fatalf("wrong build info: have=%q want=%q", info, commit)
+	}
+	if ImageTlvTypeName(IMAGE_TLV_BUILD_INFO) != "BUILD_INFO" {
+		t.Fatalf("BUILD_INFO TLV type not registered")
+	}
+
+	// Invalid UTF-8.
+	img.ProtTlvs[0].Data = []byte{'a', 0xff, 'b'}
+	img.ProtTlvs[0].Header.Len = 3
+	if _, _, err := img.BuildInfo(); err == nil {
+		t.Fatalf("BUILD_INFO TLV with invalid UTF-8 accepted")
+	}
+
+	// Unprotected TLVs are ignored.
+	img.Tlvs, img.ProtTlvs = img.ProtTlvs, nil
+	img.Tlvs[0].Data = []byte(commit)
+	img.Tlvs[0].Header.Len = uint16(len(commit))
+	if _, ok, err := img.BuildInfo(); err != nil || ok {
+		t.Fatalf("unprotected BUILD_INFO TLV reported as build info")
+	}
+}
+
+func TestTlvTooLong(t *testing.T) {
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_BUILD_INFO},
+		Data:   make([]byte, IMAGE_TLV_MAX_DATA_LEN+1),
+	}
+	long.Header.Len = uint16(len(long.Data)) // Truncates to 0.
+
+	if err := img.AddTlv(long); err == nil {
+		t.Fatalf("over-long TLV added")
+	}
+
+	img.Tlvs = append(img.Tlvs, long)
+	if _, err := img.Write(ioutil.Discard); err == nil {
+		t.Fatalf("image with over-long TLV written")
+	}
+}
+
+func TestStoredVsCalcHash(t *testing.T) {
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calc, err := img.CalcHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, calc) {
+		t.Fatalf("stored hash differs from calculated: %x != %x", stored, calc)
+	}
+
+	// Altering the body changes the calculated hash but not the stored one.
+	img.Body[0] ^= 0xff
+	stored2, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calc2, err := img.CalcHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, stored2) || bytes.Equal(calc, calc2) {
+		t.Fatalf("Hash recomputed or CalcHash did not")
+	}
+
+	img.RemoveTlvsWithType(IMAGE_TLV_SHA256)
+	if _, err := img.Hash(); err == nil {
+		t.Fatalf("Hash succeeded without SHA256 TLV")
+	}
+}
+
+func TestFixedPlainSecret(t *testing.T) {
+	f, err := ioutil.TempFile("", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bytes.Repeat([]byte{0x5a}, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	opts := ImageCreateOpts{
+		SrcBinFilename:    f.Name(),
+		SrcEncKeyFilename: testdataPath + "/enc-key-pub.pem",
+		Version:           ImageVersion{1, 2, 3, 4},
+		PlainSecret:       bytes.Repeat([]byte{0x11}, 16),
+	}
+
+	img1, err := GenerateImage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img2, err := GenerateImage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img1.Body, img2.Body) {
+		t.Fatalf("fixed content-encryption key produced different bodies")
+	}
+
+	opts.PlainSecret = nil
+	img3, err := GenerateImage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(img1.Body, img3.Body) {
+		t.Fatalf("random content-encryption key reused")
+	}
+
+	opts.PlainSecret = []byte{1, 2, 3}
+	if _, err := GenerateImage(opts); err == nil {
+		t.Fatalf("invalid content-encryption key accepted")
+	}
+}
+
+func TestEncKeyGcm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	body := bytes.Repeat([]byte{0x5a}, 1000)
+	binPath := dir + "/body"
+	if err := ioutil.WriteFile(binPath, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kek := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, 16))
+	kekPath := dir + "/kek"
+	if err := ioutil.WriteFile(kekPath, []byte(kek), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := GenerateImage(ImageCreateOpts{
+		SrcBinFilename:    binPath,
+		SrcEncKeyFilename: kekPath,
+		Version:           ImageVersion{1, 2, 3, 4},
+		EncKeyGcm:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlv, err := img.FindUniqueTlv(IMAGE_TLV_ENC_GCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlv == nil {
+		t.Fatalf("GCM-wrapped secret TLV missing")
+	}
+
+	privKe, err := sec.ParsePrivEncKey([]byte(kek))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := Decrypt(img, privKe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec.Body, body) {
+		t.Fatalf("decrypted body differs from original")
+	}
+
+	// A corrupted tag must be reported as such.
+	tlv.Data[len(tlv.Data)-1] ^= 0x01
+	_, err = Decrypt(img, privKe)
+	if _, ok := errors.Cause(err).(*sec.ErrGcmTag); !ok {
+		t.Fatalf("corrupted tag: wrong error: %v", err)
+	}
+}
+
+func TestDuplicateTlvs(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.VerifyStructure(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Signatures and key hashes may repeat.
+	for _, r := range img.AllTlvs() {
+		if ImageTlvTypeIsRepeatable(r.Tlv.Header.Type) {
+			img.Tlvs = append(img.Tlvs, r.Tlv.Clone())
+		}
+	}
+	if err := img.VerifyStructure(); err != nil {
+		t.Fatalf("repeatable TLVs rejected: %s", err.Error())
+	}
+
+	// A second hash TLV is illegal.
+	hash, err := img.FindUniqueTlv(IMAGE_TLV_SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Tlvs = append(img.Tlvs, hash.Clone())
+
+	err = img.VerifyStructure()
+	if err == nil {
+		t.Fatalf("duplicate SHA256 TLV accepted")
+	}
+	if !strings.Contains(err.Error(), "SHA256") {
+		t.Fatalf("error does not name duplicated type: %s", err.Error())
+	}
+}
+
+func TestSizeBreakdown(t *testing.T) {
+	data := readImageData("good-signed-unencrypted")
+	img, err := ParseImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := img.SizeBreakdown()
+	if r.TotalSize != len(data) || r.TotalSize != img.TotalSize() {
+		t.Fatalf("wrong total size: have=%d want=%d", r.TotalSize, len(data))
+	}
+	if r.Header != int(img.Header.HdrSz) || r.Body != int(img.Header.ImgSz) {
+		t.Fatalf("wrong header/body sizes: %+v", r)
+	}
+	if len(r.Sigs) != img.NumSignatures() ||
+		len(r.Sigs)+len(r.Tlvs) != len(img.Tlvs) {
+
+		t.Fatalf("wrong TLV entries: sigs=%+v tlvs=%+v", r.Sigs, r.Tlvs)
+	}
+	if r.ProtTrailer != 0 || len(r.ProtTlvs) != 0 {
+		t.Fatalf("unexpected protected entries: %+v", r)
+	}
+}
+
+func TestVerifyKeyRing(t *testing.T) {
+	ring := sec.NewKeyRing()
+	if err := ring.AddSignKey("sign", readPubSignKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := ParseImage(readImageData("good-signed-encrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No encryption key; the hash cannot be checked.
+	if _, err := img.VerifyKeyRing(ring); err == nil {
+		t.Fatalf("encrypted image verified without encryption key")
+	}
+
+	if err := ring.AddEncKey("enc", readPrivEncKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := img.VerifyKeyRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Name != "sign" {
+		t.Fatalf("wrong key verified image: %s", k.Name)
+	}
+
+	body, err := img.ExtractBody(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain.Body) {
+		t.Fatalf("extracted body differs from plaintext image body")
+	}
+
+	// An unsigned image does not verify against a ring.
+	unsigned, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = unsigned.ExtractBody(ring)
+	var unsignedErr *ErrUnsigned
+	if !errors.As(err, &unsignedErr) {
+		t.Fatalf("wrong error for unsigned image: %v", err)
+	}
+}
+
+func TestParseExtraTlvs(t *testing.T) {
+	orig := readImageData("good-unsigned-unencrypted")
+
+	data := append([]byte{}, orig...)
+	data = append(data, IMAGE_TLV_BUILD_INFO, 0, 3, 0, 'a', 'b', 'c')
+	data = append(data, 0xff, 0xff, 0xff, 0xff)
+
+	img, warnings, err := ParseImageOpts(data, ImageParseOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.ExtraTlvs) != 0 || len(warnings) != 0 {
+		t.Fatalf("trailing data not ignored")
+	}
+
+	_, _, err = ParseImageOpts(data,
+		ImageParseOpts{ExtraTlvs: EXTRA_TLVS_REJECT})
+	var ce *CorruptError
+	if !errors.As(err, &ce) || ce.Offset != len(orig) {
+		t.Fatalf("trailing TLV not rejected: %v", err)
+	}
+
+	img, warnings, err = ParseImageOpts(data,
+		ImageParseOpts{ExtraTlvs: EXTRA_TLVS_PARSE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.ExtraTlvs) != 1 || string(img.ExtraTlvs[0].Data) != "abc" {
+		t.Fatalf("wrong extra TLVs: %+v", img.ExtraTlvs)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning; got %v", warnings)
+	}
+
+	// Erased padding is not an extra TLV, even in strict mode.
+	padded := readImageData("good-padded-unsigned")
+	if _, _, err := ParseImageOpts(padded,
+		ImageParseOpts{ExtraTlvs: EXTRA_TLVS_REJECT}); err != nil {
+
+		t.Fatalf("padded image rejected: %s", err.Error())
+	}
+}
+
+func TestEncFlagMismatch(t *testing.T) {
+	entries := []struct {
+		basename string
+		want     string
+	}{
+		{"enc-flag-no-tlv", "flag set in image header, but image contains no"},
+		{"enc-tlv-no-flag", "flag unset in image header, but image contains " +
+			"encryption TLV (ENC_"},
+	}
+
+	for _, e := range entries {
+		img, err := ParseImage(readImageData(e.basename))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = img.VerifyStructure()
+		if err == nil || !strings.Contains(err.Error(), e.want) {
+			t.Fatalf("%s: wrong error: %v", e.basename, err)
+		}
+	}
+}
+
+func TestVerifyContext(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-encrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigKeys := []sec.PubSignKey{readPubSignKey()}
+	encKeys := []sec.PrivEncKey{readPrivEncKey()}
+
+	encIdx, sigIdx, err := img.Verify(sigKeys, encKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encIdx != 0 || sigIdx != 0 {
+		t.Fatalf("wrong key indices: enc=%d sig=%d", encIdx, sigIdx)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = img.VerifyContext(ctx, sigKeys, encKeys)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled verification not aborted: %v", err)
+	}
+
+	unsigned, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = unsigned.VerifyContext(context.Background(), sigKeys, nil)
+	var unsignedErr *ErrUnsigned
+	if !errors.As(err, &unsignedErr) {
+		t.Fatalf("unsigned image: wrong error: %v", err)
+	}
+}
+
+func TestSigErrors(t *testing.T) {
+	otherKey, err := sec.ReadPrivSignKey(testdataPath + "/rsa3072-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring := []sec.PubSignKey{readPubSignKey()}
+	other := []sec.PubSignKey{otherKey.PubKey()}
+
+	parse := func(basename string) Image {
+		img, err := ParseImage(readImageData(basename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	img := parse("good-unsigned-unencrypted")
+	_, err = img.VerifyWithRing(ring)
+	var unsigned *ErrUnsigned
+	if !errors.As(err, &unsigned) {
+		t.Fatalf("unsigned image: wrong error: %v", err)
+	}
+	_, err = img.VerifySigs(ring)
+	if !errors.As(err, &unsigned) {
+		t.Fatalf("unsigned image: wrong VerifySigs error: %v", err)
+	}
+	_, _, err = img.Verify(ring, nil)
+	if !errors.As(err, &unsigned) {
+		t.Fatalf("unsigned image: wrong Verify error: %v", err)
+	}
+
+	img = parse("bad-signature")
+	_, err = img.VerifySigs(ring)
+	var mismatch *ErrSignatureMismatch
+	if !errors.As(err, &mismatch) || mismatch.KeyIdx != 0 {
+		t.Fatalf("bad signature: wrong error: %v", err)
+	}
+
+	_, _, err = img.Verify(ring, nil)
+	if !errors.As(err, &mismatch) || mismatch.KeyIdx != 0 {
+		t.Fatalf("bad signature: wrong Verify error: %v", err)
+	}
+
+	img = parse("good-signed-unencrypted")
+	_, err = img.VerifyWithRing(other)
+	var noKey *ErrNoMatchingKey
+	if !errors.As(err, &noKey) {
+		t.Fatalf("unknown signer: wrong error: %v", err)
+	}
+	_, err = img.VerifySigs(other)
+	if !errors.As(err, &noKey) {
+		t.Fatalf("unknown signer: wrong VerifySigs error: %v", err)
+	}
+}
+
+func TestVerifyAndVersion(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := []sec.PubSignKey{readPubSignKey()}
+
+	ver, keyIdx, err := VerifyAndVersion(&img, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != img.Header.Vers || keyIdx != 0 {
+		t.Fatalf("wrong result: ver=%s key=%d", ver.String(), keyIdx)
+	}
+
+	// A modified header is caught by the hash check.
+	img.Header.Vers.Major++
+	ver, _, err = VerifyAndVersion(&img, ring)
+	if err == nil || ver != (ImageVersion{}) {
+		t.Fatalf("version returned for tampered image: %s", ver.String())
+	}
+
+	unsigned, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyAndVersion(&unsigned, ring); err == nil {
+		t.Fatalf("version returned for unsigned image")
+	}
+}
+
+func TestSupportedAlgos(t *testing.T) {
+	hashes := SupportedHashes()
+	if len(hashes) == 0 || hashes[0].TlvType != IMAGE_TLV_SHA256 ||
+		hashes[0].Size != hashes[0].Hash.Size() {
+
+		t.Fatalf("wrong supported hashes: %+v", hashes)
+	}
+
+	algos := SupportedSignAlgos()
+	if len(algos) != 5 {
+		t.Fatalf("wrong number of signature algorithms: %d", len(algos))
+	}
+	for _, algo := range algos {
+		if !ImageTlvTypeIsSig(uint8(algo)) {
+			t.Fatalf("%s not a signature TLV type", algo)
+		}
+		if sigTlvAlgo(uint8(algo)) != algo {
+			t.Fatalf("%s does not round trip", algo)
+		}
+		if algo.String() != ImageTlvTypeName(uint8(algo)) {
+			t.Fatalf("%s has wrong TLV type", algo)
+		}
+	}
+}
+
+func TestManifestHashAlgo(t *testing.T) {
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := readManifest("good-unsigned-unencrypted")
+
+	r, err := VerifyImageAgainstManifest(img, man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Hash.Ok || !strings.Contains(r.Hash.Detail, "inferred") {
+		t.Fatalf("inferred hash algorithm not reported: %+v", r.Hash)
+	}
+
+	man.HashAlgo = "sha256"
+	if err := img.VerifyManifest(man); err != nil {
+		t.Fatal(err)
+	}
+
+	man.HashAlgo = "sha512"
+	if err := img.VerifyManifest(man); err == nil {
+		t.Fatalf("hash with wrong length for algorithm accepted")
+	}
+	r, _ = VerifyImageAgainstManifest(img, man)
+	if r.Hash.Ok {
+		t.Fatalf("hash with wrong length for algorithm reported ok")
+	}
+}
+
+func TestVerifyManifestBuildNumWildcard(t *testing.T) {
+	img, err := ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.Vers.BuildNum != 0 {
+		t.Fatalf("test image has nonzero build number")
+	}
+
+	man := readManifest("good-unsigned-unencrypted")
+	man.Version = fmt.Sprintf("%d.%d.%d.42",
+		img.Header.Vers.Major, img.Header.Vers.Minor, img.Header.Vers.Rev)
+
+	opts := ManifestVerifyOpts{BuildNumWildcard: true}
+	if err := img.VerifyManifest(man); err == nil {
+		t.Fatalf("zeroed build number accepted without wildcard option")
+	}
+	if err := img.VerifyManifestOpts(man, opts); err != nil {
+		t.Fatalf("zeroed build number rejected: %s", err.Error())
+	}
+
+	man.Version = fmt.Sprintf("%d.%d.%d.42",
+		img.Header.Vers.Major, img.Header.Vers.Minor, img.Header.Vers.Rev+1)
+	if err := img.VerifyManifestOpts(man, opts); err == nil {
+		t.Fatalf("revision mismatch accepted with wildcard option")
+	}
+}
+
+func TestEncodeImageTlv(t *testing.T) {
+	for typ := range imageTlvTypeDescMap {
+		tlv := ImageTlv{
+			Header: ImageTlvHdr{Type: typ, Len: 3},
+			Data:   []byte{typ, 0x55, 0xaa},
+		}
+
+		buf := &bytes.Buffer{}
+		if err := EncodeImageTlv(buf, tlv); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != IMAGE_TLV_SIZE+len(tlv.Data) {
+			t.Fatalf("wrong encoded size for %s: %d",
+				ImageTlvTypeName(typ), buf.Len())
+		}
+
+		dec, sz, err := parseRawTlv(buf.Bytes(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sz != buf.Len() || dec.Header != tlv.Header ||
+			!bytes.Equal(dec.Data, tlv.Data) {
+
+			t.Fatalf("TLV %s did not round trip: have=%+v want=%+v",
+				ImageTlvTypeName(typ), dec, tlv)
+		}
+	}
+
+	bad := ImageTlv{Header: ImageTlvHdr{Type: IMAGE_TLV_SHA256, Len: 2}}
+	if err := EncodeImageTlv(&bytes.Buffer{}, bad); err == nil {
+		t.Fatalf("TLV with inconsistent length encoded")
+	}
+}
+
+func TestHashVerifyingReader(t *testing.T) {
+	data := readImageData("good-unsigned-unencrypted")
+	img, err := ParseImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hr := NewHashVerifyingReader(iotest.OneByteReader(bytes.NewReader(data)))
+	out, err := ioutil.ReadAll(hr)
+	if err != nil {
+		t.Fatalf("good image failed streaming verification: %s", err.Error())
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("reader modified image data")
+	}
+	if !bytes.Equal(hr.Digest(), want) {
+		t.Fatalf("wrong digest: have=%x want=%x", hr.Digest(), want)
+	}
+
+	// Data following the TLV region is passed through, but not retained.
+	padded := append(append([]byte(nil), data...),
+		bytes.Repeat([]byte{0xff}, 64*1024)...)
+	hr = NewHashVerifyingReader(bytes.NewReader(padded))
+	out, err = ioutil.ReadAll(hr)
+	if err != nil {
+		t.Fatalf("padded image failed streaming verification: %s",
+			err.Error())
+	}
+	if !bytes.Equal(out, padded) {
+		t.Fatalf("reader modified image data")
+	}
+	if len(hr.tlvs) != hr.tlvLen || hr.tlvLen != len(data)-hr.hashLen {
+		t.Fatalf("wrong amount of TLV data retained: have=%d want=%d",
+			len(hr.tlvs), len(data)-hr.hashLen)
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[img.Header.HdrSz] ^= 0xff
+	hr = NewHashVerifyingReader(bytes.NewReader(bad))
+	if _, err := ioutil.ReadAll(hr); err == nil {
+		t.Fatalf("corrupt image passed streaming verification")
+	}
+
+	hr = NewHashVerifyingReader(bytes.NewReader(data[:len(data)/2]))
+	if _, err := ioutil.ReadAll(hr); err == nil {
+		t.Fatalf("truncated image passed streaming verification")
+	}
+
+	enc := readImageData("good-signed-encrypted")
+	hr = NewHashVerifyingReader(bytes.NewReader(enc))
+	if _, err := ioutil.ReadAll(hr); err == nil {
+		t.Fatalf("encrypted image passed streaming verification")
+	}
+}
+
+func TestManifestVersion(t *testing.T) {
+	man := readManifest("good-unsigned-unencrypted")
+	ver, err := ManifestVersion(man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver.String() != man.Version {
+		t.Fatalf("wrong version: have=%s want=%s", ver.String(), man.Version)
+	}
+
+	man.Version = "1.0.0-rc1"
+	_, err = ManifestVersion(man)
+	var e *ErrVersionUnparseable
+	if !errors.As(err, &e) || e.Raw != "1.0.0-rc1" {
+		t.Fatalf("wrong error for unparseable version: %v", err)
+	}
+	if e.Err == nil || !strings.Contains(err.Error(), e.Err.Error()) {
+		t.Fatalf("parse error not wrapped: %v", err)
+	}
+}
+
+func TestBodyErased(t *testing.T) {
+	body := bytes.Repeat([]byte{0xff}, 4096)
+	img, err := Build(body, ImageVersion{}, BuildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.BodyIsErased() || img.BodyIsZero() {
+		t.Fatalf("erased body not detected")
+	}
+	warnings, err := img.VerifyStructureWarnings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning; got %v", warnings)
+	}
+
+	// A single programmed byte, between sampled offsets.
+	img.Body[4000] = 0x00
+	if img.BodyIsErased() {
+		t.Fatalf("partially programmed body reported as erased")
+	}
+
+	img.Body = make([]byte, 4096)
+	if !img.BodyIsZero() || img.BodyIsErased() {
+		t.Fatalf("zero body not detected")
+	}
+
+	img, err = ParseImage(readImageData("good-unsigned-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings, err = img.VerifyStructureWarnings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestMapStructuredTlvs(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-encrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTlvs := func(opts ImageMapOpts, wantStructured bool) {
+		m, err := img.MapOpts(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checked := 0
+		for _, tm := range m["tlvs"].([]map[string]interface{}) {
+			typ := tm["type"].(uint8)
+			if !ImageTlvTypeIsSig(typ) && !ImageTlvTypeIsSecret(typ) {
+				continue
+			}
+			if typ == IMAGE_TLV_RSA2048 || typ == IMAGE_TLV_RSA3072 ||
+				typ == IMAGE_TLV_ED25519 {
+
+				continue
+			}
+
+			_, structured := tm["data"].(map[string]interface{})
+			if structured != wantStructured {
+				t.Fatalf("wrong rendering of %s TLV: %v (raw=%v)",
+					tm["_typestr"], tm["data"], opts.Raw)
+			}
+			checked++
+		}
+		if checked == 0 {
+			t.Fatalf("image contains no TLVs with structured rendering")
+		}
+	}
+
+	checkTlvs(ImageMapOpts{}, true)
+	checkTlvs(ImageMapOpts{Raw: true}, false)
 }
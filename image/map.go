@@ -20,12 +20,97 @@
 package image
 
 import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 
 	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
 )
 
+// ImageMapOpts controls how an image is rendered by MapOpts and JsonOpts.
+type ImageMapOpts struct {
+	// If true, every TLV's data is rendered as hex, even if its type has a
+	// structured decoder.
+	Raw bool
+}
+
+func decodeTlvEcdsa(curve elliptic.Curve, data []byte) (interface{}, error) {
+	es, err := sec.DecodeEcdsaSig(curve, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"r": hex.EncodeToString(es.R.Bytes()),
+		"s": hex.EncodeToString(es.S.Bytes()),
+	}, nil
+}
+
+func decodeTlvEcdsa224(data []byte) (interface{}, error) {
+	return decodeTlvEcdsa(elliptic.P224(), data)
+}
+
+func decodeTlvEcdsa256(data []byte) (interface{}, error) {
+	return decodeTlvEcdsa(elliptic.P256(), data)
+}
+
+// decodeTlvEnc returns a decoder for an encryption TLV whose data is a
+// content key wrapped with the specified algorithm.
+func decodeTlvEnc(algo string) ImageTlvDecodeFunc {
+	return func(data []byte) (interface{}, error) {
+		return map[string]interface{}{
+			"algorithm":       algo,
+			"wrapped_key_len": len(data),
+		}, nil
+	}
+}
+
+func decodeTlvEncEc256(data []byte) (interface{}, error) {
+	if len(data) != sec.ECIES_P256_TOTAL_SZ {
+		return nil, errors.Errorf("invalid TLV length: have=%d want=%d",
+			len(data), sec.ECIES_P256_TOTAL_SZ)
+	}
+
+	tagOff := sec.ECIES_P256_PUBKEY_SZ
+	ciphOff := tagOff + sec.ECIES_P256_TAG_SZ
+
+	return map[string]interface{}{
+		"algorithm":       "ECIES-P256",
+		"wrapped_key_len": sec.ECIES_P256_SECRET_SZ,
+		"ephemeral_key":   hex.EncodeToString(data[:tagOff]),
+		"tag":             hex.EncodeToString(data[tagOff:ciphOff]),
+		"wrapped_key":     hex.EncodeToString(data[ciphOff:]),
+	}, nil
+}
+
+// decodeTlvDependency decodes an MCUboot image dependency: a one-byte image
+// ID, three bytes of padding, and the minimum required version.
+func decodeTlvDependency(data []byte) (interface{}, error) {
+	var dep struct {
+		ImageId uint8
+		Pad1    uint8
+		Pad2    uint16
+		Vers    ImageVersion
+	}
+
+	if len(data) != binary.Size(&dep) {
+		return nil, errors.Errorf("invalid TLV length: have=%d want=%d",
+			len(data), binary.Size(&dep))
+	}
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.LittleEndian, &dep); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode dependency TLV")
+	}
+
+	return map[string]interface{}{
+		"image_id": dep.ImageId,
+		"version":  dep.Vers.String(),
+	}, nil
+}
+
 func (h *ImageHdr) Map(offset int) map[string]interface{} {
 	return map[string]interface{}{
 		"_offset": offset,
@@ -33,6 +118,7 @@ func (h *ImageHdr) Map(offset int) map[string]interface{} {
 		"hdr_sz":  h.HdrSz,
 		"img_sz":  h.ImgSz,
 		"magic":   h.Magic,
+		"prot_sz": h.ProtSz(),
 		"vers":    h.Vers.String(),
 	}
 }
@@ -51,19 +137,46 @@ func (t *ImageTrailer) Map(offset int) map[string]interface{} {
 	}
 }
 
+// decodedData renders a TLV's data using its registered decoder.  The data is
+// hex-encoded if raw is true, if there is no decoder, or if decoding fails.
+func (t *ImageTlv) decodedData(raw bool) interface{} {
+	desc, ok := imageTlvTypeDescMap[t.Header.Type]
+	if !raw && ok && desc.decode != nil {
+		if v, err := desc.decode(t.Data); err == nil {
+			return v
+		}
+	}
+
+	return hex.EncodeToString(t.Data)
+}
+
 func (t *ImageTlv) Map(index int, offset int) map[string]interface{} {
+	return t.mapOpts(index, offset, ImageMapOpts{})
+}
+
+func (t *ImageTlv) mapOpts(index int, offset int,
+	opts ImageMapOpts) map[string]interface{} {
+
 	return map[string]interface{}{
 		"_index":   index,
 		"_offset":  offset,
 		"_typestr": ImageTlvTypeName(t.Header.Type),
-		"data":     hex.EncodeToString(t.Data),
+		"data":     t.decodedData(opts.Raw),
 		"len":      t.Header.Len,
 		"type":     t.Header.Type,
 	}
 }
 
-// Map produces a JSON-friendly map representation of an image.
+// Map produces a JSON-friendly map representation of an image.  The data of
+// TLVs of known types is decoded into a structured form (e.g., the r and s of
+// an ECDSA signature); other TLVs are rendered as hex.
 func (img *Image) Map() (map[string]interface{}, error) {
+	return img.MapOpts(ImageMapOpts{})
+}
+
+// MapOpts is like Map, but the rendering is controlled by the specified
+// options.
+func (img *Image) MapOpts(opts ImageMapOpts) (map[string]interface{}, error) {
 	offs, err := img.Offsets()
 	if err != nil {
 		return nil, err
@@ -72,21 +185,38 @@ func (img *Image) Map() (map[string]interface{}, error) {
 	m := map[string]interface{}{}
 	m["header"] = img.Header.Map(offs.Header)
 	m["body"] = rawBodyMap(offs.Body)
+	if len(img.ProtTlvs) > 0 {
+		protTrailer := img.ProtTrailer()
+		m["prot_trailer"] = protTrailer.Map(offs.ProtTrailer)
+
+		protTlvMaps := []map[string]interface{}{}
+		for i, tlv := range img.ProtTlvs {
+			protTlvMaps = append(protTlvMaps,
+				tlv.mapOpts(i, offs.ProtTlvs[i], opts))
+		}
+		m["prot_tlvs"] = protTlvMaps
+	}
 	trailer := img.Trailer()
 	m["trailer"] = trailer.Map(offs.Trailer)
 
 	tlvMaps := []map[string]interface{}{}
 	for i, tlv := range img.Tlvs {
-		tlvMaps = append(tlvMaps, tlv.Map(i, offs.Tlvs[i]))
+		tlvMaps = append(tlvMaps, tlv.mapOpts(i, offs.Tlvs[i], opts))
 	}
 	m["tlvs"] = tlvMaps
 
 	return m, nil
 }
 
-// Json produces a JSON representation of an image.
+// Json produces a JSON representation of an image (see Map).
 func (img *Image) Json() (string, error) {
-	m, err := img.Map()
+	return img.JsonOpts(ImageMapOpts{})
+}
+
+// JsonOpts is like Json, but the rendering is controlled by the specified
+// options.
+func (img *Image) JsonOpts(opts ImageMapOpts) (string, error) {
+	m, err := img.MapOpts(opts)
 	if err != nil {
 		return "", err
 	}
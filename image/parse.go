@@ -22,6 +22,7 @@ package image
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"strconv"
@@ -30,6 +31,38 @@ import (
 	"github.com/apache/mynewt-artifact/errors"
 )
 
+// CorruptError indicates that image data is malformed: a magic number is
+// wrong, a length is inconsistent, or the data ends early.  It is returned by
+// the image parsers so that callers can tell a bad image apart from, e.g., an
+// I/O failure.
+type CorruptError struct {
+	Offset int    // Offset within the image data where the problem was found.
+	Want   string // What the parser expected.
+	Have   string // What it found instead.
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("corrupt image at offset %d: expected %s, got %s",
+		e.Offset, e.Want, e.Have)
+}
+
+func newCorruptError(offset int, want string, have string) error {
+	return errors.WithStack(&CorruptError{
+		Offset: offset,
+		Want:   want,
+		Have:   have,
+	})
+}
+
+// remString describes how many bytes remain after the specified offset.
+func remString(imgData []byte, offset int) string {
+	rem := len(imgData) - offset
+	if rem < 0 {
+		rem = 0
+	}
+	return fmt.Sprintf("%d bytes", rem)
+}
+
 // ParseVersion parses an image version string (e.g., "1.2.3.4")
 func ParseVersion(versStr string) (ImageVersion, error) {
 	var err error
@@ -70,6 +103,26 @@ func ParseVersion(versStr string) (ImageVersion, error) {
 	return ver, nil
 }
 
+// checkImageMagic verifies that image data begins with the image header magic.
+// It is a cheap guard against inputs that are not images at all; the error
+// reports the bytes actually found.
+func checkImageMagic(imgData []byte) error {
+	var want [4]byte
+	binary.LittleEndian.PutUint32(want[:], IMAGE_MAGIC)
+
+	if len(imgData) < len(want) {
+		return newCorruptError(0, fmt.Sprintf("image magic %x", want),
+			fmt.Sprintf("%d bytes (%x)", len(imgData), imgData))
+	}
+
+	if !bytes.Equal(imgData[:len(want)], want[:]) {
+		return newCorruptError(0, fmt.Sprintf("image magic %x", want),
+			fmt.Sprintf("%x", imgData[:len(want)]))
+	}
+
+	return nil
+}
+
 func parseRawHeader(imgData []byte, offset int) (ImageHdr, int, error) {
 	var hdr ImageHdr
 
@@ -77,20 +130,28 @@ func parseRawHeader(imgData []byte, offset int) (ImageHdr, int, error) {
 	r.Seek(int64(offset), io.SeekStart)
 
 	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
-		return hdr, 0, errors.Wrapf(err, "error reading image header")
+		return hdr, 0, newCorruptError(offset,
+			fmt.Sprintf("%d-byte image header", IMAGE_HEADER_SIZE),
+			remString(imgData, offset))
 	}
 
 	if hdr.Magic != IMAGE_MAGIC {
-		return hdr, 0, errors.Errorf(
-			"image magic incorrect; expected 0x%08x, got 0x%08x",
-			uint32(IMAGE_MAGIC), hdr.Magic)
+		return hdr, 0, newCorruptError(offset,
+			fmt.Sprintf("image magic 0x%08x", uint32(IMAGE_MAGIC)),
+			fmt.Sprintf("0x%08x", hdr.Magic))
+	}
+
+	if hdr.HdrSz < IMAGE_HEADER_SIZE {
+		return hdr, 0, newCorruptError(offset,
+			fmt.Sprintf("header size of at least %d", IMAGE_HEADER_SIZE),
+			fmt.Sprintf("%d", hdr.HdrSz))
 	}
 
 	remLen := len(imgData) - offset
 	if remLen < int(hdr.HdrSz) {
-		return hdr, 0, errors.Errorf(
-			"image header incomplete; expected %d bytes, got %d bytes",
-			hdr.HdrSz, remLen)
+		return hdr, 0, newCorruptError(offset,
+			fmt.Sprintf("%d-byte header and padding", hdr.HdrSz),
+			remString(imgData, offset))
 	}
 
 	return hdr, int(hdr.HdrSz), nil
@@ -103,9 +164,9 @@ func parseRawBody(imgData []byte, hdr ImageHdr,
 	remLen := len(imgData) - offset
 
 	if remLen < imgSz {
-		return nil, 0, errors.Errorf(
-			"image body incomplete; expected %d bytes, got %d bytes",
-			imgSz, remLen)
+		return nil, 0, newCorruptError(offset,
+			fmt.Sprintf("%d-byte image body", imgSz),
+			remString(imgData, offset))
 	}
 
 	return imgData[offset : offset+imgSz], imgSz, nil
@@ -118,8 +179,9 @@ func parseRawTrailer(imgData []byte, offset int) (ImageTrailer, int, error) {
 	r.Seek(int64(offset), io.SeekStart)
 
 	if err := binary.Read(r, binary.LittleEndian, &trailer); err != nil {
-		return trailer, 0, errors.Wrapf(err,
-			"image contains invalid trailer at offset %d", offset)
+		return trailer, 0, newCorruptError(offset,
+			fmt.Sprintf("%d-byte TLV trailer", IMAGE_TRAILER_SIZE),
+			remString(imgData, offset))
 	}
 
 	return trailer, IMAGE_TRAILER_SIZE, nil
@@ -132,45 +194,228 @@ func parseRawTlv(imgData []byte, offset int) (ImageTlv, int, error) {
 	r.Seek(int64(offset), io.SeekStart)
 
 	if err := binary.Read(r, binary.LittleEndian, &tlv.Header); err != nil {
-		return tlv, 0, errors.Wrapf(err,
-			"image contains invalid TLV at offset %d", offset)
+		return tlv, 0, newCorruptError(offset,
+			fmt.Sprintf("%d-byte TLV header", IMAGE_TLV_SIZE),
+			remString(imgData, offset))
 	}
 
 	tlv.Data = make([]byte, tlv.Header.Len)
-	if _, err := r.Read(tlv.Data); err != nil {
-		return tlv, 0, errors.Wrapf(err,
-			"image contains invalid TLV at offset %d", offset)
+	if _, err := io.ReadFull(r, tlv.Data); err != nil {
+		return tlv, 0, newCorruptError(offset+IMAGE_TLV_SIZE,
+			fmt.Sprintf("%d bytes of %s TLV data", tlv.Header.Len,
+				ImageTlvTypeName(tlv.Header.Type)),
+			remString(imgData, offset+IMAGE_TLV_SIZE))
 	}
 
 	return tlv, IMAGE_TLV_SIZE + int(tlv.Header.Len), nil
 }
 
+func parseRawProtTlvs(imgData []byte, hdr ImageHdr,
+	offset int) ([]ImageTlv, int, error) {
+
+	protSz := int(hdr.ProtSz())
+	remLen := len(imgData) - offset
+	if remLen < protSz {
+		return nil, 0, newCorruptError(offset,
+			fmt.Sprintf("%d-byte protected TLV region", protSz),
+			remString(imgData, offset))
+	}
+
+	// Restrict parsing to the protected region.
+	region := imgData[:offset+protSz]
+
+	trailer, size, err := parseRawTrailer(region, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if trailer.Magic != IMAGE_PROT_TRAILER_MAGIC {
+		return nil, 0, newCorruptError(offset,
+			fmt.Sprintf("protected trailer magic 0x%04x",
+				IMAGE_PROT_TRAILER_MAGIC),
+			fmt.Sprintf("0x%04x", trailer.Magic))
+	}
+	if int(trailer.TlvTotLen) != protSz {
+		return nil, 0, newCorruptError(offset,
+			fmt.Sprintf("protected TLV length %d (from header)", protSz),
+			fmt.Sprintf("%d (from protected trailer)", trailer.TlvTotLen))
+	}
+	offset += size
+
+	var tlvs []ImageTlv
+	for offset < len(region) {
+		tlv, size, err := parseRawTlv(region, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		tlvs = append(tlvs, tlv)
+
+		if offset+size > len(region) {
+			return nil, 0, newCorruptError(offset,
+				"protected TLV within protected region",
+				fmt.Sprintf("TLV extending %d bytes beyond region",
+					offset+size-len(region)))
+		}
+		offset += size
+	}
+
+	return tlvs, protSz, nil
+}
+
+// ExtraTlvPolicy specifies how the parser treats data following the TLV
+// region declared by an image's trailer.  Trailing bytes that all have the
+// same erased-flash value (0x00 or 0xff) are padding and are always ignored.
+type ExtraTlvPolicy int
+
+const (
+	// Ignore trailing data.
+	EXTRA_TLVS_IGNORE ExtraTlvPolicy = iota
+
+	// Reject an image with trailing data.
+	EXTRA_TLVS_REJECT
+
+	// Parse trailing data as a sequence of TLVs (see Image.ExtraTlvs).
+	EXTRA_TLVS_PARSE
+)
+
+// ImageParseOpts controls how an image is parsed.
+type ImageParseOpts struct {
+	ExtraTlvs ExtraTlvPolicy
+}
+
+// isErasedPadding indicates whether every byte in b is 0x00, or every byte is
+// 0xff.
+func isErasedPadding(b []byte) bool {
+	if len(b) == 0 {
+		return true
+	}
+
+	return bytes.Count(b, b[:1]) == len(b) && (b[0] == 0x00 || b[0] == 0xff)
+}
+
+// parseExtraTlvs parses the TLVs appended after an image's declared TLV
+// region, stopping at erased padding or the end of the data.
+func parseExtraTlvs(imgData []byte, offset int) ([]ImageTlv, error) {
+	var tlvs []ImageTlv
+	for !isErasedPadding(imgData[offset:]) {
+		tlv, size, err := parseRawTlv(imgData, offset)
+		if err != nil {
+			return nil, err
+		}
+		if offset+size > len(imgData) {
+			return nil, newCorruptError(offset,
+				"TLV within image data",
+				fmt.Sprintf("TLV extending %d bytes beyond end",
+					offset+size-len(imgData)))
+		}
+
+		tlvs = append(tlvs, tlv)
+		offset += size
+	}
+
+	return tlvs, nil
+}
+
+// ParseImage parses an image from its binary form.  Any data following the
+// image's TLV region is ignored.
 func ParseImage(imgData []byte) (Image, error) {
+	img, _, err := ParseImageOpts(imgData, ImageParseOpts{})
+	return img, err
+}
+
+// ParseImageOpts is like ParseImage, but allows the treatment of data
+// following the declared TLV region to be specified.  Some tools append
+// vendor TLVs without updating the trailer's TlvTotLen; with
+// EXTRA_TLVS_PARSE such TLVs are returned in the image's ExtraTlvs slice
+// rather than causing a parse failure.  The returned strings are warnings
+// about non-standard content accepted by the parser.
+func ParseImageOpts(imgData []byte,
+	opts ImageParseOpts) (Image, []string, error) {
+
+	img, totalLen, err := parseImage(imgData)
+	if err != nil {
+		return img, nil, err
+	}
+
+	if opts.ExtraTlvs == EXTRA_TLVS_IGNORE ||
+		isErasedPadding(imgData[totalLen:]) {
+
+		return img, nil, nil
+	}
+
+	if opts.ExtraTlvs == EXTRA_TLVS_REJECT {
+		return Image{}, nil, newCorruptError(totalLen,
+			"end of image or erased padding",
+			fmt.Sprintf("%d bytes of data", len(imgData)-totalLen))
+	}
+
+	extra, err := parseExtraTlvs(imgData, totalLen)
+	if err != nil {
+		return Image{}, nil, err
+	}
+	img.ExtraTlvs = extra
+
+	warnings := []string{fmt.Sprintf(
+		"image contains %d TLVs beyond declared TLV region (offset %d)",
+		len(extra), totalLen)}
+
+	return img, warnings, nil
+}
+
+// parseImage parses an image and returns the number of bytes it occupies.
+func parseImage(imgData []byte) (Image, int, error) {
 	img := Image{}
 	offset := 0
 
+	if err := checkImageMagic(imgData); err != nil {
+		return img, 0, err
+	}
+
 	hdr, size, err := parseRawHeader(imgData, offset)
 	if err != nil {
-		return img, err
+		return img, 0, err
 	}
+
+	// The body starts immediately after the HdrSz bytes of header.  Any bytes
+	// between the fixed-size header and the body are padding; an image built
+	// without padding has HdrSz equal to the header size.
+	pad := append([]byte{}, imgData[offset+IMAGE_HEADER_SIZE:offset+size]...)
 	offset += size
 
 	body, size, err := parseRawBody(imgData, hdr, offset)
 	if err != nil {
-		return img, err
+		return img, 0, err
 	}
 	offset += size
 
+	// Images produced by older tools have no protected TLV region.
+	protTlvs := []ImageTlv{}
+	if hdr.ProtSz() > 0 {
+		protTlvs, size, err = parseRawProtTlvs(imgData, hdr, offset)
+		if err != nil {
+			return img, 0, err
+		}
+		offset += size
+	}
+
+	trailerOff := offset
 	trailer, size, err := parseRawTrailer(imgData, offset)
 	if err != nil {
-		return img, err
+		return img, 0, err
 	}
 	offset += size
 
-	totalLen := IMAGE_HEADER_SIZE + len(body) + int(trailer.TlvTotLen)
+	if trailer.Magic != IMAGE_TRAILER_MAGIC {
+		return img, 0, newCorruptError(trailerOff,
+			fmt.Sprintf("TLV trailer magic 0x%04x", IMAGE_TRAILER_MAGIC),
+			fmt.Sprintf("0x%04x", trailer.Magic))
+	}
+
+	totalLen := trailerOff + int(trailer.TlvTotLen)
 	if len(imgData) < totalLen {
-		return img, errors.Errorf("image data truncated: have=%d want=%d",
-			len(imgData), totalLen)
+		return img, 0, newCorruptError(trailerOff,
+			fmt.Sprintf("%d-byte TLV region", trailer.TlvTotLen),
+			remString(imgData, trailerOff))
 	}
 
 	// Trim excess data following image trailer.
@@ -181,30 +426,35 @@ func ParseImage(imgData []byte) (Image, error) {
 	for offset < len(imgData) {
 		tlv, size, err := parseRawTlv(imgData, offset)
 		if err != nil {
-			return img, err
+			return img, 0, err
 		}
 
 		tlvs = append(tlvs, tlv)
 
-		offset += size
-		if offset > len(imgData) {
-			return img, errors.Errorf("TLVs extend beyond end of image")
+		if offset+size > len(imgData) {
+			return img, 0, newCorruptError(offset,
+				"TLV within TLV region",
+				fmt.Sprintf("TLV extending %d bytes beyond region",
+					offset+size-len(imgData)))
 		}
+		offset += size
 
 		tlvLen += size
 	}
 
 	if int(trailer.TlvTotLen) != tlvLen {
-		return img, errors.Errorf(
-			"invalid image: trailer indicates TLV-length=%d; actual=%d",
-			trailer.TlvTotLen, tlvLen)
+		return img, 0, newCorruptError(trailerOff,
+			fmt.Sprintf("TLV length %d (from trailer)", trailer.TlvTotLen),
+			fmt.Sprintf("%d bytes of TLVs", tlvLen))
 	}
 
 	img.Header = hdr
+	img.Pad = pad
 	img.Body = body
+	img.ProtTlvs = protTlvs
 	img.Tlvs = tlvs
 
-	return img, nil
+	return img, totalLen, nil
 }
 
 func ReadImage(filename string) (Image, error) {
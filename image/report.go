@@ -0,0 +1,252 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// VerifyCheck is the result of a single image-vs-manifest check.
+type VerifyCheck struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail"`
+
+	// The check could not be performed; Detail explains why.  A skipped
+	// check is never Ok.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// OkOrSkipped indicates whether a check passed or could not be performed.
+func (c *VerifyCheck) OkOrSkipped() bool {
+	return c.Ok || c.Skipped
+}
+
+// VerifyReport describes how an image compares to its manifest.  Each field
+// corresponds to one check.
+type VerifyReport struct {
+	// Manifest `id` and `image_hash` agree with the image's SHA256 TLV.
+	Hash VerifyCheck `json:"hash"`
+
+	// Manifest `build_version` agrees with the image header.
+	Version VerifyCheck `json:"version"`
+
+	// The image's SHA256 TLV agrees with the hash calculated from the image
+	// contents.  The hash of an encrypted image covers its plaintext, so
+	// this check is skipped for encrypted images.
+	Tlv VerifyCheck `json:"tlv"`
+
+	// The header's encrypted flag agrees with the presence of an encryption
+	// TLV.
+	EncFlag VerifyCheck `json:"enc_flag"`
+}
+
+// Ok indicates whether every check in a report passed or was skipped.
+func (r *VerifyReport) Ok() bool {
+	return r.Hash.OkOrSkipped() && r.Version.OkOrSkipped() &&
+		r.Tlv.OkOrSkipped() && r.EncFlag.OkOrSkipped()
+}
+
+func (img *Image) reportHash(man manifest.Manifest) VerifyCheck {
+	hash, err := img.Hash()
+	if err != nil {
+		return VerifyCheck{Detail: err.Error()}
+	}
+	imgHash := hex.EncodeToString(hash)
+
+	inferred, err := checkManifestHashAlgo(man)
+	if err != nil {
+		return VerifyCheck{Detail: err.Error()}
+	}
+
+	if man.BuildID != imgHash || man.ImageHash != imgHash {
+		return VerifyCheck{
+			Detail: fmt.Sprintf(
+				"manifest image hash different from image TLV: "+
+					"id=%s image_hash=%s img=%s",
+				man.BuildID, man.ImageHash, imgHash),
+		}
+	}
+
+	detail := imgHash
+	if inferred {
+		detail += " (warning: manifest hash algorithm not recorded; " +
+			"inferred from hash length)"
+	}
+
+	return VerifyCheck{Ok: true, Detail: detail}
+}
+
+func (img *Image) reportVersion(man manifest.Manifest) (VerifyCheck, error) {
+	ver, err := ManifestVersion(man)
+	if err != nil {
+		err = errors.Wrapf(err, "manifest contains invalid `version` field")
+		return VerifyCheck{Detail: err.Error()}, err
+	}
+
+	if ver != img.Header.Vers {
+		return VerifyCheck{
+			Detail: fmt.Sprintf(
+				"manifest version different from image header: man=%s img=%s",
+				ver.String(), img.Header.Vers.String()),
+		}, nil
+	}
+
+	return VerifyCheck{Ok: true, Detail: ver.String()}, nil
+}
+
+func (img *Image) reportTlv() VerifyCheck {
+	if img.IsEncrypted() {
+		return VerifyCheck{
+			Skipped: true,
+			Detail: "image is encrypted; hash covers the plaintext and " +
+				"was not checked",
+		}
+	}
+
+	tlvHash, err := img.Hash()
+	if err != nil {
+		return VerifyCheck{Detail: err.Error()}
+	}
+
+	calc, err := img.calcContentHash(nil)
+	if err != nil {
+		return VerifyCheck{Detail: err.Error()}
+	}
+
+	match, err := hashTlvMatches(tlvHash, calc, 0)
+	if err != nil {
+		return VerifyCheck{Detail: err.Error()}
+	}
+	if !match {
+		return VerifyCheck{
+			Detail: fmt.Sprintf(
+				"image contains incorrect hash: have=%x want=%x",
+				tlvHash, calc),
+		}
+	}
+
+	return VerifyCheck{Ok: true, Detail: hex.EncodeToString(calc)}
+}
+
+func (img *Image) reportEncFlag() VerifyCheck {
+	secret, err := img.verifyEncState()
+	if err != nil {
+		return VerifyCheck{Detail: err.Error()}
+	}
+
+	if secret == nil {
+		return VerifyCheck{Ok: true, Detail: "unencrypted"}
+	}
+
+	return VerifyCheck{Ok: true, Detail: "encrypted"}
+}
+
+// VerifyImageAgainstManifest compares an image to its manifest and reports the
+// outcome of each check.  All checks are run regardless of earlier failures.
+// Mismatches are recorded in the report rather than returned as errors; the
+// returned error is non-nil only if the manifest or image could not be parsed.
+func VerifyImageAgainstManifest(img Image,
+	man manifest.Manifest) (VerifyReport, error) {
+
+	r := VerifyReport{}
+
+	r.Hash = img.reportHash(man)
+	r.Tlv = img.reportTlv()
+	r.EncFlag = img.reportEncFlag()
+
+	var err error
+	r.Version, err = img.reportVersion(man)
+
+	return r, err
+}
+
+// SizeEntry is the on-disk size of a single TLV, including its 4-byte header.
+type SizeEntry struct {
+	Name string `json:"name"` // TLV type name (e.g., "SHA256").
+	Size int    `json:"size"`
+}
+
+// SizeReport describes how the bytes of an image are distributed among its
+// components.  The component sizes sum to TotalSize.
+type SizeReport struct {
+	// The image header, including any padding (HdrSz bytes).
+	Header int `json:"header"`
+
+	// The image body (ImgSz bytes).
+	Body int `json:"body"`
+
+	// The protected TLV trailer; 0 if the image has no protected region.
+	ProtTrailer int `json:"prot_trailer"`
+
+	// Each protected TLV, in on-disk order.
+	ProtTlvs []SizeEntry `json:"prot_tlvs"`
+
+	// The unprotected TLV trailer.
+	Trailer int `json:"trailer"`
+
+	// Each unprotected signature TLV, in on-disk order.
+	Sigs []SizeEntry `json:"sigs"`
+
+	// Each other unprotected TLV (e.g., hash, keyhash), in on-disk order.
+	Tlvs []SizeEntry `json:"tlvs"`
+
+	TotalSize int `json:"total_size"`
+}
+
+// SizeBreakdown reports the size contribution of each of an image's
+// components, as they would be written by Write.
+func (img *Image) SizeBreakdown() SizeReport {
+	offs := img.layout()
+
+	bodyEnd := offs.Trailer
+	if offs.ProtTrailer >= 0 {
+		bodyEnd = offs.ProtTrailer
+	}
+
+	r := SizeReport{
+		Header:    offs.Body - offs.Header,
+		Body:      bodyEnd - offs.Body,
+		Trailer:   IMAGE_TRAILER_SIZE,
+		TotalSize: offs.TotalSize,
+	}
+	if offs.ProtTrailer >= 0 {
+		r.ProtTrailer = IMAGE_TRAILER_SIZE
+	}
+
+	for _, to := range img.tlvOffsets(offs) {
+		e := SizeEntry{
+			Name: ImageTlvTypeName(to.Tlv.Header.Type),
+			Size: to.Len,
+		}
+		if to.Protected {
+			r.ProtTlvs = append(r.ProtTlvs, e)
+		} else if ImageTlvTypeIsSig(to.Tlv.Header.Type) {
+			r.Sigs = append(r.Sigs, e)
+		} else {
+			r.Tlvs = append(r.Tlvs, e)
+		}
+	}
+
+	return r
+}
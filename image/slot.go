@@ -0,0 +1,72 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// MCUboot image trailer parameters.
+const (
+	IMAGE_SLOT_MAGIC_SZ  = 16 // Size of the boot magic.
+	IMAGE_SLOT_MAX_ALIGN = 8  // Alignment of the boot magic and flags.
+)
+
+// SlotTrailerSize calculates the number of bytes MCUboot reserves at the top
+// of an image slot for its trailer: the swap status area (three entries of
+// writeSize bytes for each of maxSectors sectors), four flag fields
+// (swap_size, swap_info, copy_done, and image_ok), and the boot magic.
+func SlotTrailerSize(writeSize int, maxSectors int) int {
+	magicSz := (IMAGE_SLOT_MAGIC_SZ + IMAGE_SLOT_MAX_ALIGN - 1) /
+		IMAGE_SLOT_MAX_ALIGN * IMAGE_SLOT_MAX_ALIGN
+
+	return maxSectors*3*writeSize + IMAGE_SLOT_MAX_ALIGN*4 + magicSz
+}
+
+// SlotTrailerSize calculates the size of the MCUboot trailer in the slots an
+// image creator targets (see ImageCreator.SlotWriteSize and SlotMaxSectors).
+func (ic *ImageCreator) SlotTrailerSize() int {
+	return SlotTrailerSize(ic.SlotWriteSize, ic.SlotMaxSectors)
+}
+
+// SlotUsage calculates how an image fills a slot of the specified size,
+// assuming the default trailer parameters of NewImageCreator.  It returns
+// the number of bytes the image occupies, the number of bytes left over, and
+// the number of bytes reserved for the MCUboot trailer; the three always sum
+// to slotSize.  An error is returned if the image and trailer do not fit, in
+// which case free is negative.
+func (img *Image) SlotUsage(slotSize int) (used int, free int,
+	trailerReserve int, err error) {
+
+	ic := NewImageCreator()
+
+	used = img.TotalSize()
+	trailerReserve = ic.SlotTrailerSize()
+	free = slotSize - used - trailerReserve
+
+	if free < 0 {
+		err = errors.Errorf(
+			"image does not fit in slot: "+
+				"image=%d trailer=%d slot=%d overflow=%d",
+			used, trailerReserve, slotSize, -free)
+	}
+
+	return used, free, trailerReserve, err
+}
@@ -0,0 +1,151 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// Names of the files WriteSplitImages produces.
+const (
+	SPLIT_APP_IMG_FILENAME    = "app.img"
+	SPLIT_LOADER_IMG_FILENAME = "loader.img"
+)
+
+// serializeHashed serializes an image and calculates its hash from the
+// result, so that the hash describes exactly the bytes to be written.  The
+// hash is seeded with initialHash, if any, as a split app's is with its
+// loader's, and must match the image's hash TLV.  Encrypted images are
+// rejected, since their hash covers the plaintext body rather than the
+// written bytes.
+func serializeHashed(img Image, which string,
+	initialHash []byte) ([]byte, []byte, error) {
+
+	if img.IsEncrypted() {
+		return nil, nil, errors.Errorf(
+			"cannot hash encrypted %s image", which)
+	}
+
+	buf := &bytes.Buffer{}
+	offs, err := img.WritePlusOffsets(buf)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to serialize %s image",
+			which)
+	}
+
+	// The hash covers everything up to the unprotected TLV trailer.
+	hash := sha256.New()
+	hash.Write(initialHash)
+	hash.Write(buf.Bytes()[:offs.Trailer])
+	calc := hash.Sum(nil)
+
+	tlvHash, err := img.Hash()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "%s image", which)
+	}
+
+	ok, err := hashTlvMatches(tlvHash, calc, 0)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "%s image", which)
+	}
+	if !ok {
+		if initialHash != nil {
+			return nil, nil, errors.Errorf(
+				"%s image hash does not chain from the loader hash; "+
+					"initial hash is not %x", which, initialHash)
+		}
+		return nil, nil, errors.Errorf(
+			"%s image hash TLV does not match its contents", which)
+	}
+
+	return buf.Bytes(), calc, nil
+}
+
+// WriteSplitImages writes the products of a split-image build to the
+// specified directory: the loader (SPLIT_LOADER_IMG_FILENAME), the app
+// (SPLIT_APP_IMG_FILENAME), and a manifest tying them together
+// (manifest.MANIFEST_FILENAME).  The supplied manifest provides the build
+// metadata (name, date, package lists, repos, etc.); its image names,
+// hashes, and version are filled in from the images, with each hash
+// calculated from the bytes actually written.  The app must be a split app,
+// i.e., not bootable, and its hash must be seeded with the loader's (see
+// ImageCreator.InitialHash).  Neither image may be encrypted.  The completed
+// manifest is returned.
+func WriteSplitImages(dir string, loader Image, app Image,
+	man manifest.Manifest) (manifest.Manifest, error) {
+
+	if app.Header.Flags&IMAGE_F_NON_BOOTABLE == 0 {
+		return man, errors.Errorf(
+			"split app image is bootable; loader and app may be swapped")
+	}
+	if loader.Header.Flags&IMAGE_F_NON_BOOTABLE != 0 {
+		return man, errors.Errorf("loader image is not bootable")
+	}
+
+	loaderBin, loaderHash, err := serializeHashed(loader, "loader", nil)
+	if err != nil {
+		return man, err
+	}
+	appBin, appHash, err := serializeHashed(app, "app", loaderHash)
+	if err != nil {
+		return man, err
+	}
+
+	man.Image = SPLIT_APP_IMG_FILENAME
+	man.ImageHash = hex.EncodeToString(appHash)
+	man.BuildID = man.ImageHash
+	man.HashAlgo = "sha256"
+	man.Loader = SPLIT_LOADER_IMG_FILENAME
+	man.LoaderHash = hex.EncodeToString(loaderHash)
+	man.Version = app.Header.Vers.String()
+
+	if err := man.Validate(); err != nil {
+		return man, err
+	}
+
+	manBuf := &bytes.Buffer{}
+	if _, err := man.Write(manBuf); err != nil {
+		return man, err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{SPLIT_LOADER_IMG_FILENAME, loaderBin},
+		{SPLIT_APP_IMG_FILENAME, appBin},
+		{manifest.MANIFEST_FILENAME, manBuf.Bytes()},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, f.data, 0644); err != nil {
+			return man, errors.Wrapf(err, "failed to write %s", path)
+		}
+	}
+
+	return man, nil
+}
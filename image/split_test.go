@@ -0,0 +1,109 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+func TestWriteSplitImages(t *testing.T) {
+	loader, err := Build([]byte{0x00, 0x01, 0x02, 0x03},
+		ImageVersion{1, 0, 0, 0}, BuildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaderHash, err := loader.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 128)
+	ic.Version = ImageVersion{1, 2, 3, 4}
+	ic.InitialHash = loaderHash
+	ic.Bootable = false
+	app, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := readManifest("good-unsigned-unencrypted")
+	if _, err := WriteSplitImages(dir, app, loader, tmpl); err == nil {
+		t.Fatalf("swapped loader and app accepted")
+	}
+
+	// The app's hash must be seeded with this loader's.
+	other, err := Build([]byte{0x04, 0x05, 0x06, 0x07},
+		ImageVersion{1, 0, 0, 0}, BuildOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = WriteSplitImages(dir, other, app, tmpl)
+	if err == nil || !strings.Contains(err.Error(), "loader hash") {
+		t.Fatalf("app built against another loader accepted: %v", err)
+	}
+
+	if _, err := WriteSplitImages(dir, loader, app, tmpl); err != nil {
+		t.Fatal(err)
+	}
+
+	man, err := manifest.ReadManifestDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if man.Name != tmpl.Name || man.Version != "1.2.3.4" {
+		t.Fatalf("wrong manifest metadata: name=%s version=%s",
+			man.Name, man.Version)
+	}
+
+	readBack := func(path string) Image {
+		img, err := ReadImage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	appImg := readBack(man.ImagePath())
+	if err := appImg.VerifyManifest(man); err != nil {
+		t.Fatalf("written app does not match manifest: %s", err.Error())
+	}
+
+	loaderImg := readBack(man.LoaderPath())
+	hash, err := loaderImg.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if man.LoaderHash != hex.EncodeToString(hash) {
+		t.Fatalf("wrong loader hash: have=%s want=%x", man.LoaderHash, hash)
+	}
+}
@@ -0,0 +1,250 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// HashVerifyingReader passes a serialized image through unchanged while
+// verifying its hash in the same pass.  The hashed portion of the image (the
+// header, padding, body, and protected TLVs) is digested as it is read; the
+// unprotected TLV region that follows is buffered, and any data after it is
+// passed through without being retained.  When the underlying reader
+// reaches EOF, the digest is compared against the image's SHA256 TLV.  If
+// they disagree, or the image is malformed, Read returns an error in place of
+// io.EOF.
+//
+// The hash of an encrypted image covers its plaintext, so an encrypted image
+// cannot be verified this way; reading one fails once its header has been
+// read.  A truncated hash TLV is rejected (see HashOpts).
+type HashVerifyingReader struct {
+	r    io.Reader
+	hash hash.Hash
+
+	hdr     []byte // The first IMAGE_HEADER_SIZE bytes read.
+	hashLen int    // Length of hashed portion; -1 until header is read.
+	off     int    // Number of bytes read so far.
+	tlvLen  int    // Length of TLV region; -1 until trailer is read.
+	tlvs    []byte // The TLV region, including its trailer.
+
+	digest []byte
+	err    error
+}
+
+// NewHashVerifyingReader creates a HashVerifyingReader that reads a
+// serialized image from r.
+func NewHashVerifyingReader(r io.Reader) *HashVerifyingReader {
+	return &HashVerifyingReader{
+		r:       r,
+		hash:    sha256.New(),
+		hashLen: -1,
+		tlvLen:  -1,
+	}
+}
+
+// Digest returns the hash calculated from the image's contents.  It returns
+// nil until the hashed portion of the image has been read in full.
+func (hr *HashVerifyingReader) Digest() []byte {
+	return hr.digest
+}
+
+// consume processes a chunk of image data that has been read.
+func (hr *HashVerifyingReader) consume(b []byte) error {
+	for len(b) > 0 {
+		if hr.hashLen < 0 {
+			n := IMAGE_HEADER_SIZE - len(hr.hdr)
+			if n > len(b) {
+				n = len(b)
+			}
+			hr.hdr = append(hr.hdr, b[:n]...)
+			if len(hr.hdr) == IMAGE_HEADER_SIZE {
+				if err := hr.parseHeader(); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Until the header is complete, every byte read belongs to it.
+		if hr.hashLen < 0 || hr.off < hr.hashLen {
+			n := len(b)
+			if hr.hashLen >= 0 && n > hr.hashLen-hr.off {
+				n = hr.hashLen - hr.off
+			}
+			hr.hash.Write(b[:n])
+			hr.off += n
+			b = b[n:]
+
+			if hr.off == hr.hashLen {
+				hr.digest = hr.hash.Sum(nil)
+			}
+		} else {
+			want := IMAGE_TRAILER_SIZE
+			if hr.tlvLen >= 0 {
+				want = hr.tlvLen
+			}
+
+			n := want - len(hr.tlvs)
+			if n == 0 {
+				// Data beyond the TLV region is not retained.
+				hr.off += len(b)
+				b = nil
+				continue
+			}
+
+			if n > len(b) {
+				n = len(b)
+			}
+			hr.tlvs = append(hr.tlvs, b[:n]...)
+			hr.off += n
+			b = b[n:]
+
+			if hr.tlvLen < 0 && len(hr.tlvs) == IMAGE_TRAILER_SIZE {
+				if err := hr.parseTrailer(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseTrailer decodes the unprotected TLV trailer as soon as it has been
+// read, so that only the TLV region it describes is buffered.
+func (hr *HashVerifyingReader) parseTrailer() error {
+	trailer, _, err := parseRawTrailer(hr.tlvs, 0)
+	if err != nil {
+		return err
+	}
+	if trailer.Magic != IMAGE_TRAILER_MAGIC {
+		return newCorruptError(hr.hashLen,
+			fmt.Sprintf("TLV trailer magic 0x%04x", IMAGE_TRAILER_MAGIC),
+			fmt.Sprintf("0x%04x", trailer.Magic))
+	}
+	if trailer.TlvTotLen < IMAGE_TRAILER_SIZE {
+		return newCorruptError(hr.hashLen,
+			fmt.Sprintf("TLV region of at least %d bytes",
+				IMAGE_TRAILER_SIZE),
+			fmt.Sprintf("%d", trailer.TlvTotLen))
+	}
+
+	hr.tlvLen = int(trailer.TlvTotLen)
+	return nil
+}
+
+func (hr *HashVerifyingReader) parseHeader() error {
+	if err := checkImageMagic(hr.hdr); err != nil {
+		return err
+	}
+
+	var hdr ImageHdr
+	r := bytes.NewReader(hr.hdr)
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return errors.Wrapf(err, "failed to decode image header")
+	}
+
+	if hdr.HdrSz < IMAGE_HEADER_SIZE {
+		return newCorruptError(0,
+			fmt.Sprintf("header size of at least %d", IMAGE_HEADER_SIZE),
+			fmt.Sprintf("%d", hdr.HdrSz))
+	}
+
+	if hdr.Flags&IMAGE_F_ENCRYPTED != 0 {
+		return errors.Errorf(
+			"cannot verify hash of encrypted image while streaming")
+	}
+
+	hr.hashLen = int(hdr.HdrSz) + int(hdr.ImgSz) + int(hdr.ProtSz())
+	return nil
+}
+
+// verify compares the calculated digest against the image's SHA256 TLV.  It
+// is called once the underlying reader is exhausted.
+func (hr *HashVerifyingReader) verify() error {
+	if hr.hashLen < 0 || hr.off < hr.hashLen {
+		return errors.Errorf(
+			"image truncated: read %d bytes of hashed region", hr.off)
+	}
+
+	if hr.tlvLen < 0 || len(hr.tlvs) < hr.tlvLen {
+		want := fmt.Sprintf("%d-byte TLV trailer", IMAGE_TRAILER_SIZE)
+		if hr.tlvLen >= 0 {
+			want = fmt.Sprintf("%d-byte TLV region", hr.tlvLen)
+		}
+		return newCorruptError(hr.hashLen, want, remString(hr.tlvs, 0))
+	}
+
+	for off := IMAGE_TRAILER_SIZE; off < len(hr.tlvs); {
+		tlv, size, err := parseRawTlv(hr.tlvs, off)
+		if err != nil {
+			return err
+		}
+		off += size
+
+		if tlv.Header.Type == IMAGE_TLV_SHA256 {
+			ok, err := hashTlvMatches(tlv.Data, hr.digest, 0)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errors.Errorf(
+					"image hash mismatch: tlv=%s calc=%s",
+					hex.EncodeToString(tlv.Data),
+					hex.EncodeToString(hr.digest))
+			}
+			return nil
+		}
+	}
+
+	return errors.Errorf("image does not contain hash TLV")
+}
+
+func (hr *HashVerifyingReader) Read(p []byte) (int, error) {
+	if hr.err != nil {
+		return 0, hr.err
+	}
+
+	n, err := hr.r.Read(p)
+	if cerr := hr.consume(p[:n]); cerr != nil {
+		hr.err = cerr
+		return n, cerr
+	}
+
+	if err == io.EOF {
+		if verr := hr.verify(); verr != nil {
+			hr.err = verr
+			return n, verr
+		}
+	}
+	if err != nil {
+		hr.err = err
+	}
+
+	return n, err
+}
@@ -0,0 +1,193 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// SwapIncompatReason identifies the check that made a candidate image
+// unsuitable for swapping with the installed one.
+type SwapIncompatReason int
+
+const (
+	SWAP_INCOMPAT_SIZE        SwapIncompatReason = iota // Doesn't fit in slot.
+	SWAP_INCOMPAT_SIGNER                                // No common signer.
+	SWAP_INCOMPAT_ENC                                   // Different enc scheme.
+	SWAP_INCOMPAT_ENC_UNKNOWN                           // Enc scheme unknown.
+)
+
+var swapIncompatReasonNameMap = map[SwapIncompatReason]string{
+	SWAP_INCOMPAT_SIZE:        "size",
+	SWAP_INCOMPAT_SIGNER:      "signer",
+	SWAP_INCOMPAT_ENC:         "encryption",
+	SWAP_INCOMPAT_ENC_UNKNOWN: "encryption-unknown",
+}
+
+func (r SwapIncompatReason) String() string {
+	name := swapIncompatReasonNameMap[r]
+	if name == "" {
+		name = "???"
+	}
+	return name
+}
+
+// ErrSwapIncompatible indicates that a candidate image cannot replace the
+// installed image.  A downgrade is reported as an ErrDowngrade instead.
+type ErrSwapIncompatible struct {
+	Reason SwapIncompatReason
+	Detail string
+}
+
+func (e *ErrSwapIncompatible) Error() string {
+	return fmt.Sprintf("images not swap compatible (%s): %s",
+		e.Reason.String(), e.Detail)
+}
+
+func swapIncompat(reason SwapIncompatReason, format string,
+	args ...interface{}) error {
+
+	return errors.WithStack(&ErrSwapIncompatible{
+		Reason: reason,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// swapSigners returns the indices of the keys that verify one of an image's
+// signatures.  An unencrypted image's hash is checked as well; an encrypted
+// image's signatures are checked against its hash TLV only, since its body
+// cannot be hashed without decrypting it.
+func swapSigners(img Image, keys []sec.PubSignKey) ([]int, error) {
+	if !img.IsEncrypted() {
+		if _, err := img.VerifyHash(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return img.VerifyWithRingAll(keys)
+}
+
+// checkSwapSigners ensures the two images are signed by at least one common
+// key from the provided set.  Each image's signatures are verified before
+// the signers are compared.  Two unsigned images are compatible.
+func checkSwapSigners(installed Image, candidate Image,
+	keys []sec.PubSignKey) error {
+
+	if installed.NumSignatures() == 0 && candidate.NumSignatures() == 0 {
+		return nil
+	}
+
+	instIdxs, err := swapSigners(installed, keys)
+	if err != nil {
+		return swapIncompat(SWAP_INCOMPAT_SIGNER,
+			"installed image does not verify: %s", err.Error())
+	}
+	candIdxs, err := swapSigners(candidate, keys)
+	if err != nil {
+		return swapIncompat(SWAP_INCOMPAT_SIGNER,
+			"candidate image does not verify: %s", err.Error())
+	}
+
+	for _, ii := range instIdxs {
+		for _, ci := range candIdxs {
+			if ii == ci {
+				return nil
+			}
+		}
+	}
+
+	return swapIncompat(SWAP_INCOMPAT_SIGNER,
+		"no common signing key: installed=%v candidate=%v",
+		instIdxs, candIdxs)
+}
+
+// checkSwapEnc ensures that the two images are either both encrypted or both
+// unencrypted, according to the encrypted flags in their headers, and that
+// encrypted images wrap their content keys with the same scheme.  The scheme
+// is identified by an image's secret TLV.  An installed image is normally
+// stored decrypted; Decrypt retains its encrypted flag but strips its secret
+// TLV, so its scheme cannot be determined.  SWAP_INCOMPAT_ENC_UNKNOWN is
+// reported in that case.
+func checkSwapEnc(installed Image, candidate Image) error {
+	instFlag := installed.IsEncrypted()
+	candFlag := candidate.IsEncrypted()
+	if instFlag != candFlag {
+		return swapIncompat(SWAP_INCOMPAT_ENC,
+			"encrypted flags differ: installed=%t candidate=%t",
+			instFlag, candFlag)
+	}
+	if !instFlag {
+		return nil
+	}
+
+	instEnc := installed.secretTlvName()
+	candEnc := candidate.secretTlvName()
+	if instEnc == "" || candEnc == "" {
+		return swapIncompat(SWAP_INCOMPAT_ENC_UNKNOWN,
+			"cannot determine encryption scheme: an encrypted image lacks "+
+				"a secret TLV (decrypted?): installed=%q candidate=%q",
+			instEnc, candEnc)
+	}
+	if instEnc != candEnc {
+		return swapIncompat(SWAP_INCOMPAT_ENC,
+			"encryption schemes differ: installed=%s candidate=%s",
+			instEnc, candEnc)
+	}
+
+	return nil
+}
+
+// SwapCompatible performs the pre-flight checks for replacing the installed
+// image with a candidate in an A/B update.  The keys parameter is the set of
+// trusted signing keys, i.e., the common root both images must be signed by;
+// it is required because an image's keyhash TLVs are not trustworthy on
+// their own.  The candidate must fit in a slot of the specified size (see
+// SlotUsage), be signed by one of the keys that also signed the installed
+// image, be encrypted if and only if the installed image is, wrap its content
+// key with the same scheme as the installed image, and not be a downgrade
+// (see CheckDowngrade).  A decrypted installed image retains its encrypted
+// flag but not its secret TLV, so its scheme cannot be compared; this is
+// reported as SWAP_INCOMPAT_ENC_UNKNOWN.
+// Checks are performed in that order and the first failure is returned: an
+// *ErrSwapIncompatible naming the failed check, or an *ErrDowngrade.
+func SwapCompatible(installed Image, candidate Image, slotSize int,
+	keys []sec.PubSignKey) error {
+
+	if _, _, _, err := candidate.SlotUsage(slotSize); err != nil {
+		return swapIncompat(SWAP_INCOMPAT_SIZE, "%s", err.Error())
+	}
+
+	if err := checkSwapSigners(installed, candidate, keys); err != nil {
+		return err
+	}
+
+	if err := checkSwapEnc(installed, candidate); err != nil {
+		return err
+	}
+
+	if err := CheckDowngrade(candidate, installed); err != nil {
+		return err
+	}
+
+	return nil
+}
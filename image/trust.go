@@ -0,0 +1,128 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// TrustPolicy specifies the conditions an image's signatures must satisfy for
+// the image to be trusted.
+type TrustPolicy struct {
+	// The number of distinct roots that must have signed the image.  A value
+	// less than 1 is treated as 1.
+	MinRoots int
+
+	// The time at which the roots must be valid.  Roots whose validity
+	// period (see sec.PubSignKeyFromCert) does not include this time do not
+	// count toward the policy.  Roots without validity metadata are always
+	// valid.  The zero value disables the check.
+	At time.Time
+}
+
+// ErrKeyNotValidAtTime indicates that an image was signed by a root whose
+// validity period does not include the verification time.
+type ErrKeyNotValidAtTime struct {
+	KeyIdx    int
+	At        time.Time
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func (e *ErrKeyNotValidAtTime) Error() string {
+	return fmt.Sprintf(
+		"root %d not valid at %s: valid from %s to %s", e.KeyIdx,
+		e.At.Format(time.RFC3339), e.NotBefore.Format(time.RFC3339),
+		e.NotAfter.Format(time.RFC3339))
+}
+
+// VerifyTrust checks that an image is signed by enough trusted roots to
+// satisfy the given policy.  The image's SHA256 TLV is first compared to the
+// hash calculated from the image contents.  A root then counts toward the
+// policy if one of the image's signatures carries the root's keyhash and
+// validates against the hash.  Roots with identical keys are only counted
+// once.  An encrypted image must be decrypted first (see Decrypt).
+//
+// If the policy specifies a time, signatures from roots not valid at that
+// time are disregarded.  If this leaves the policy unsatisfied, an
+// ErrKeyNotValidAtTime is returned.
+func VerifyTrust(img Image, roots []sec.PubSignKey, policy TrustPolicy) error {
+	need := policy.MinRoots
+	if need < 1 {
+		need = 1
+	}
+	if need > len(roots) {
+		return errors.Errorf(
+			"trust policy cannot be satisfied: requires %d roots, have %d",
+			need, len(roots))
+	}
+
+	if img.IsEncrypted() {
+		return errors.Errorf(
+			"cannot verify trust of encrypted image: decrypt it first")
+	}
+	if err := img.verifyHashDecrypted(HashOpts{}); err != nil {
+		return errors.Wrapf(err, "image hash verification failed")
+	}
+
+	matches, err := img.ringMatches(roots, true)
+	if err != nil {
+		return errors.Wrapf(err, "image not signed by a trusted root")
+	}
+
+	var invalid error
+	seen := map[string]struct{}{}
+	for _, idx := range matches {
+		v := roots[idx].Validity
+		if !policy.At.IsZero() && v != nil && !v.ValidAt(policy.At) {
+			if invalid == nil {
+				invalid = errors.WithStack(&ErrKeyNotValidAtTime{
+					KeyIdx:    idx,
+					At:        policy.At,
+					NotBefore: v.NotBefore,
+					NotAfter:  v.NotAfter,
+				})
+			}
+			continue
+		}
+
+		pubBytes, err := roots[idx].Bytes()
+		if err != nil {
+			return err
+		}
+		seen[hex.EncodeToString(sec.RawKeyHash(pubBytes))] = struct{}{}
+	}
+
+	if len(seen) < need {
+		if invalid != nil {
+			return invalid
+		}
+		return errors.Errorf(
+			"image signed by too few trusted roots: have=%d want=%d",
+			len(seen), need)
+	}
+
+	return nil
+}
@@ -21,32 +21,131 @@ package image
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/manifest"
 	"github.com/apache/mynewt-artifact/sec"
 )
 
-func (img *Image) verifyHashDecrypted() error {
+// calcContentHash calculates the hash of a decrypted image, seeded with the
+// given initial hash (nil for an image whose hash was not seeded).  A
+// compressed image's hash covers the body as stored, as does its signing
+// digest.
+func (img *Image) calcContentHash(initialHash []byte) ([]byte, error) {
+	return calcHash(initialHash, img.Header, img.Pad, img.Body, img.ProtTlvs)
+}
+
+const (
+	// IMAGE_HASH_SZ is the size of a full SHA256 hash TLV.
+	IMAGE_HASH_SZ = sha256.Size
+
+	// IMAGE_HASH_MIN_SZ is the shortest truncated hash TLV that can be
+	// created or accepted (see HashOpts.MinLen).
+	IMAGE_HASH_MIN_SZ = 4
+)
+
+// HashOpts controls how an image's hash TLV is checked during verification.
+// The zero value requires a full-length SHA256 in an image whose hash was not
+// seeded.
+type HashOpts struct {
+	// If nonzero, a hash TLV with at least this many bytes is accepted and is
+	// compared against the leading bytes of the calculated digest.  Some
+	// constrained boot loaders store only a prefix of the SHA256.  A
+	// truncated hash provides correspondingly weaker protection: an n-byte
+	// prefix resists collisions only to about 2^(4n) work, so a 16-byte hash
+	// offers just 64-bit collision resistance.  Must be in
+	// [IMAGE_HASH_MIN_SZ, IMAGE_HASH_SZ].
+	MinLen int
+
+	// For the application image of a split pair: the loader image hash that
+	// seeded the app's hash (see ImageCreator.InitialHash).
+	InitialHash []byte
+}
+
+// hashTlvMatches reports whether the contents of a hash TLV agree with a
+// calculated digest.  Unless minLen is nonzero, the TLV must contain the full
+// digest; otherwise, a TLV of at least minLen bytes is compared against the
+// digest's leading bytes (see HashOpts.MinLen).
+func hashTlvMatches(tlvHash []byte, calc []byte, minLen int) (bool, error) {
+	if minLen == 0 {
+		minLen = len(calc)
+	} else if minLen < IMAGE_HASH_MIN_SZ || minLen > len(calc) {
+		return false, errors.Errorf(
+			"invalid minimum hash length: have=%d min=%d max=%d",
+			minLen, IMAGE_HASH_MIN_SZ, len(calc))
+	}
+
+	if len(tlvHash) < minLen || len(tlvHash) > len(calc) {
+		return false, errors.Errorf(
+			"image hash TLV has invalid length: have=%d min=%d max=%d",
+			len(tlvHash), minLen, len(calc))
+	}
+
+	return bytes.Equal(tlvHash, calc[:len(tlvHash)]), nil
+}
+
+// sigHash returns the digest an image's signatures are checked against.
+// This is normally the contents of the hash TLV.  A truncated hash TLV cannot
+// serve as the signed digest, so if opts permits truncation, the signing
+// digest is recalculated (seeded with opts.InitialHash) and checked against
+// the TLV.  An encrypted image with a truncated hash must be decrypted first.
+func (img *Image) sigHash(opts HashOpts) ([]byte, error) {
+	hash, err := img.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hash) >= IMAGE_HASH_SZ {
+		return hash, nil
+	}
+
+	digest, _, err := img.SigningDigestOpts(DigestOpts{
+		InitialHash: opts.InitialHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := hashTlvMatches(hash, digest, opts.MinLen)
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, errors.Errorf(
+			"signing digest does not match truncated hash TLV: "+
+				"have=%x want=%x", hash, digest)
+	}
+
+	return digest, nil
+}
+
+func (img *Image) verifyHashDecrypted(opts HashOpts) error {
 	// Verify the hash.
 	haveHash, err := img.Hash()
 	if err != nil {
 		return err
 	}
 
-	wantHash, err := img.CalcHash()
+	wantHash, err := img.calcContentHash(opts.InitialHash)
 	if err != nil {
 		return err
 	}
 
-	if !bytes.Equal(haveHash, wantHash) {
+	match, err := hashTlvMatches(haveHash, wantHash, opts.MinLen)
+	if err != nil {
+		return err
+	}
+	if !match {
 		return errors.Errorf(
 			"image contains incorrect hash: have=%x want=%x",
 			haveHash, wantHash)
 	}
 
-	return nil
+	return img.verifyDecompHash()
 }
 
 func (img *Image) verifyEncState() ([]byte, error) {
@@ -58,20 +157,72 @@ func (img *Image) verifyEncState() ([]byte, error) {
 	if img.Header.Flags&IMAGE_F_ENCRYPTED == 0 {
 		if secret != nil {
 			return nil, errors.Errorf(
-				"encrypted flag set in image header, but no encryption TLV")
+				"encrypted flag unset in image header, but image contains "+
+					"encryption TLV (%s)", img.secretTlvName())
 		}
 
 		return nil, nil
 	} else {
 		if secret == nil {
 			return nil, errors.Errorf(
-				"encryption TLV, but encrypted flag unset in image header")
+				"encrypted flag set in image header, but image contains " +
+					"no encryption TLV")
 		}
 
 		return secret, nil
 	}
 }
 
+// secretTlvName returns the type name of an image's first "secret" TLV, or
+// the empty string if it has none.
+func (img *Image) secretTlvName() string {
+	tlvs := img.FindTlvsIf(func(tlv ImageTlv) bool {
+		return ImageTlvTypeIsSecret(tlv.Header.Type)
+	})
+	if len(tlvs) == 0 {
+		return ""
+	}
+
+	return ImageTlvTypeName(tlvs[0].Header.Type)
+}
+
+// ImageTlvTypeIsRepeatable indicates whether an image may legitimately
+// contain more than one TLV of the specified type.  Key hashes, signatures,
+// and dependencies may repeat; all other types must be unique.
+func ImageTlvTypeIsRepeatable(tlvType uint8) bool {
+	return tlvType == IMAGE_TLV_KEYHASH ||
+		tlvType == IMAGE_TLV_DEPENDENCY ||
+		ImageTlvTypeIsSig(tlvType)
+}
+
+// verifyTlvUniqueness ensures that no TLV type that must be unique appears
+// more than once.  Both the protected and unprotected regions are considered.
+func (img *Image) verifyTlvUniqueness() error {
+	counts := map[uint8]int{}
+	var order []uint8
+
+	for _, r := range img.AllTlvs() {
+		typ := r.Tlv.Header.Type
+		if ImageTlvTypeIsRepeatable(typ) {
+			continue
+		}
+		if counts[typ] == 0 {
+			order = append(order, typ)
+		}
+		counts[typ]++
+	}
+
+	for _, typ := range order {
+		if counts[typ] > 1 {
+			return errors.Errorf(
+				"image contains %d TLVs with type %s; at most one allowed",
+				counts[typ], ImageTlvTypeName(typ))
+		}
+	}
+
+	return nil
+}
+
 // VerifyStructure checks an image's structure for internal consistency.  It
 // returns an error if the image is incorrect.
 func (img *Image) VerifyStructure() error {
@@ -84,36 +235,147 @@ func (img *Image) VerifyStructure() error {
 		}
 	}
 
+	if err := img.verifyTlvUniqueness(); err != nil {
+		return err
+	}
+
+	// Verify that the header's protected size agrees with the protected TLVs.
+	if protLen := img.ProtTotalLen(); int(img.Header.ProtSz()) != protLen {
+		return errors.Errorf(
+			"image header indicates protected TLV length=%d; actual=%d "+
+				"(%d TLVs)", img.Header.ProtSz(), protLen, img.ProtTlvCount())
+	}
+
 	if _, err := img.verifyEncState(); err != nil {
 		return err
 	}
 
+	if _, _, err := img.compInfo(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// bodySampleCount is the number of evenly spaced bytes bodyIsFilled checks
+// before scanning the whole body.
+const bodySampleCount = 64
+
+// bodyIsFilled indicates whether every byte of a non-empty body equals val.
+// A sample of bytes spread across the body is checked first, so that a
+// programmed body is usually rejected without a full scan.
+func bodyIsFilled(body []byte, val byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+
+	stride := len(body)/bodySampleCount + 1
+	for i := 0; i < len(body); i += stride {
+		if body[i] != val {
+			return false
+		}
+	}
+	if body[len(body)-1] != val {
+		return false
+	}
+
+	for _, b := range body {
+		if b != val {
+			return false
+		}
+	}
+
+	return true
+}
+
+// BodyIsErased indicates whether an image's body consists entirely of 0xff
+// bytes, as in a slot whose header was written but whose body was never
+// programmed.  A partially programmed body, in which only some bytes are
+// 0xff, is not reported.
+func (img *Image) BodyIsErased() bool {
+	return bodyIsFilled(img.Body, 0xff)
+}
+
+// BodyIsZero indicates whether an image's body consists entirely of 0x00
+// bytes.
+func (img *Image) BodyIsZero() bool {
+	return bodyIsFilled(img.Body, 0x00)
+}
+
+// VerifyStructureWarnings is like VerifyStructure, but it also reports
+// conditions that do not make the image malformed yet suggest a problem; for
+// example, a body that appears unprogrammed (see BodyIsErased and
+// BodyIsZero).  Such a body would also fail the hash check, but the warning
+// identifies the likely cause.
+func (img *Image) VerifyStructureWarnings() ([]string, error) {
+	if err := img.VerifyStructure(); err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	if img.BodyIsErased() {
+		warnings = append(warnings, fmt.Sprintf(
+			"image body is erased (all 0xff; %d bytes); "+
+				"slot may be unprogrammed", len(img.Body)))
+	} else if img.BodyIsZero() {
+		warnings = append(warnings, fmt.Sprintf(
+			"image body is all zeros (%d bytes); "+
+				"slot may be unprogrammed", len(img.Body)))
+	}
+
+	return warnings, nil
+}
+
 // VerifyHash calculates an image's hash and compares it to the image's SHA256
 // TLV.  If the image is encrypted, this function temporarily decrypts it
 // before calculating the hash.  The returned int is the index of the key that
 // was used to decrypt the image, or -1 if none.  An error is returned if the
 // hash is incorrect.
 func (img *Image) VerifyHash(privEncKeys []sec.PrivEncKey) (int, error) {
+	return img.VerifyHashOpts(privEncKeys, HashOpts{})
+}
+
+// VerifyHashOpts is like VerifyHash, but the hash TLV is checked according to
+// the given options (e.g., to accept a truncated hash).
+func (img *Image) VerifyHashOpts(privEncKeys []sec.PrivEncKey,
+	opts HashOpts) (int, error) {
+
+	idx, _, err := img.verifyHash(context.Background(), privEncKeys, opts)
+	return idx, err
+}
+
+// verifyCanceled returns a non-nil error if ctx has been canceled.
+func verifyCanceled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "image verification canceled")
+	}
+
+	return nil
+}
+
+// verifyHash checks an image's hash, decrypting it first if necessary.  It
+// returns the index of the decryption key (-1 if none) and the decrypted
+// image (the image itself if it is not encrypted).
+func (img *Image) verifyHash(ctx context.Context,
+	privEncKeys []sec.PrivEncKey, opts HashOpts) (int, *Image, error) {
+
 	secret, err := img.verifyEncState()
 	if err != nil {
-		return -1, err
+		return -1, nil, err
 	}
 
 	if secret == nil {
 		// Image not encrypted.
-		if err := img.verifyHashDecrypted(); err != nil {
-			return -1, err
+		if err := img.verifyHashDecrypted(opts); err != nil {
+			return -1, nil, err
 		}
 
-		return -1, nil
+		return -1, img, nil
 	}
 
 	// Image is encrypted.
 	if len(privEncKeys) == 0 {
-		return -1, errors.Errorf(
+		return -1, nil, errors.Errorf(
 			"attempt to verify hash of encrypted image: no keys provided")
 	}
 
@@ -121,42 +383,182 @@ func (img *Image) VerifyHash(privEncKeys []sec.PrivEncKey) (int, error) {
 	// decrypt and then check the hash.
 	var hashErr error
 	for i, key := range privEncKeys {
+		if err := verifyCanceled(ctx); err != nil {
+			return -1, nil, err
+		}
+
 		dec, err := Decrypt(*img, key)
 		if err != nil {
-			return -1, err
+			return -1, nil, err
 		}
 
-		hashErr = dec.verifyHashDecrypted()
+		hashErr = dec.verifyHashDecrypted(opts)
 		if hashErr == nil {
-			return i, nil
+			return i, &dec, nil
 		}
 	}
 
-	return -1, hashErr
+	return -1, nil, hashErr
+}
+
+// Verify performs a full check of an image: its structure, its hash (see
+// VerifyHash), and its signatures (see VerifySigs).  An unsigned image is an
+// error (ErrUnsigned).  The returned ints are the index of the encryption key
+// used to decrypt the image (-1 if unused) and the index of the signing key
+// that verified a signature.
+func (img *Image) Verify(sigKeys []sec.PubSignKey,
+	privEncKeys []sec.PrivEncKey) (int, int, error) {
+
+	return img.VerifyContext(context.Background(), sigKeys, privEncKeys)
+}
+
+// VerifyContext is like Verify, but stops early if ctx is canceled.  The
+// context is checked before each phase and before each decryption attempt,
+// so a canceled verification returns promptly without starting further
+// expensive work (e.g., an RSA unwrap or a hash of a large body).
+func (img *Image) VerifyContext(ctx context.Context, sigKeys []sec.PubSignKey,
+	privEncKeys []sec.PrivEncKey) (int, int, error) {
+
+	return img.verify(ctx, sigKeys, privEncKeys, HashOpts{})
+}
+
+// VerifyOpts is like Verify, but the hash TLV is checked according to the
+// given options (see VerifyHashOpts).  The signatures of an encrypted image
+// with a truncated hash are checked against its decrypted contents.
+func (img *Image) VerifyOpts(sigKeys []sec.PubSignKey,
+	privEncKeys []sec.PrivEncKey, opts HashOpts) (int, int, error) {
+
+	return img.verify(context.Background(), sigKeys, privEncKeys, opts)
+}
+
+func (img *Image) verify(ctx context.Context, sigKeys []sec.PubSignKey,
+	privEncKeys []sec.PrivEncKey, opts HashOpts) (int, int, error) {
+
+	if err := verifyCanceled(ctx); err != nil {
+		return -1, -1, err
+	}
+	if err := img.VerifyStructure(); err != nil {
+		return -1, -1, err
+	}
+
+	if err := verifyCanceled(ctx); err != nil {
+		return -1, -1, err
+	}
+	encIdx, dec, err := img.verifyHash(ctx, privEncKeys, opts)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	if err := verifyCanceled(ctx); err != nil {
+		return -1, -1, err
+	}
+	sigIdx, err := dec.verifySigs(sigKeys, false, sec.SigVerifyOpts{}, opts)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return encIdx, sigIdx, nil
+}
+
+// ErrUnsigned indicates that an image has no signatures, but verification
+// required one.
+type ErrUnsigned struct{}
+
+func (e *ErrUnsigned) Error() string {
+	return "image is not signed"
+}
+
+// ErrSignatureMismatch indicates that an image signature names one of the
+// provided keys (via its keyhash TLV) but does not verify with it; i.e., the
+// image or its signature has been modified since it was signed.
+type ErrSignatureMismatch struct {
+	KeyIdx int // Index of the key the signature names.
+}
+
+func (e *ErrSignatureMismatch) Error() string {
+	return fmt.Sprintf(
+		"image signature does not verify with its key (index %d)", e.KeyIdx)
+}
+
+// ErrNoMatchingKey indicates that none of an image's signatures name any of
+// the provided keys.
+type ErrNoMatchingKey struct{}
+
+func (e *ErrNoMatchingKey) Error() string {
+	return "image signatures do not match provided keys"
+}
+
+// sigFailure returns the error describing why none of an image's signatures
+// verified with any of the provided keys.  A signature whose keyhash names
+// one of the keys indicates tampering (ErrSignatureMismatch); otherwise the
+// signer is unknown (ErrNoMatchingKey).  A signature without a keyhash cannot
+// be attributed and is treated as the latter.
+func sigFailure(keys []sec.PubSignKey, sigs []sec.Sig) error {
+	for _, sig := range sigs {
+		if sig.KeyHash == nil {
+			continue
+		}
+
+		for keyIdx, k := range keys {
+			ok, err := sig.IdentifiesKey(k)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return errors.WithStack(
+					&ErrSignatureMismatch{KeyIdx: keyIdx})
+			}
+		}
+	}
+
+	return errors.WithStack(&ErrNoMatchingKey{})
 }
 
 // VerifySigs checks an image's attached signatures against the provided set of
-// keys.  It succeeds if the image has no signatures or if any signature can be
-// verified.  The returned int is the index of the key that was used to verify
-// a signature, or -1 if none.  An error is returned if there is at least one
-// signature and they all fail the check.
+// keys.  It succeeds if any signature can be verified.  The returned int is
+// the index of the key that was used to verify a signature.  Otherwise, the
+// error distinguishes the cause: ErrUnsigned if the image has no signatures,
+// ErrSignatureMismatch if a signature names one of the keys but does not
+// verify, or ErrNoMatchingKey if no signature names any of the keys.
 func (img *Image) VerifySigs(keys []sec.PubSignKey) (int, error) {
-	sigs, err := img.CollectSigs()
+	return img.VerifySigsOpts(keys, HashOpts{})
+}
+
+// VerifySigsOpts is like VerifySigs, but the image's hash TLV is interpreted
+// according to the given options.  If the TLV is truncated, the signatures
+// are checked against the recalculated signing digest (see sigHash).
+func (img *Image) VerifySigsOpts(keys []sec.PubSignKey,
+	opts HashOpts) (int, error) {
+
+	return img.verifySigs(keys, false, sec.SigVerifyOpts{}, opts)
+}
+
+// VerifySigsStrict is like VerifySigs, but an ECDSA signature that is not in
+// low-S form does not verify.
+func (img *Image) VerifySigsStrict(keys []sec.PubSignKey) (int, error) {
+	return img.verifySigs(keys, false, sec.SigVerifyOpts{RejectHighS: true},
+		HashOpts{})
+}
+
+func (img *Image) verifySigs(keys []sec.PubSignKey, lenient bool,
+	opts sec.SigVerifyOpts, hashOpts HashOpts) (int, error) {
+
+	sigs, err := img.collectSigs(lenient)
 	if err != nil {
 		return -1, err
 	}
 
 	if len(sigs) == 0 {
-		return -1, nil
+		return -1, errors.WithStack(&ErrUnsigned{})
 	}
 
-	hash, err := img.Hash()
+	hash, err := img.sigHash(hashOpts)
 	if err != nil {
 		return -1, err
 	}
 
 	for keyIdx, k := range keys {
-		sigIdx, err := sec.VerifySigs(k, sigs, hash)
+		sigIdx, err := sec.VerifySigsOpts(k, sigs, hash, opts)
 		if err != nil {
 			return -1, err
 		}
@@ -166,21 +568,438 @@ func (img *Image) VerifySigs(keys []sec.PubSignKey) (int, error) {
 		}
 	}
 
-	return -1, errors.Errorf("image signatures do not match provided keys")
+	return -1, sigFailure(keys, sigs)
+}
+
+// VerifySigsLegacy is like VerifySigs, but it also accepts signatures that
+// lack a preceding keyhash TLV, as produced by some older tools.  Such
+// signatures are checked against every supplied key in turn, which is slower
+// than the keyhash-guided match used for the others.  The returned int is the
+// index of the key that verified a signature; an unsigned image is an error
+// (ErrUnsigned).
+func (img *Image) VerifySigsLegacy(keys []sec.PubSignKey) (int, error) {
+	return img.verifySigs(keys, true, sec.SigVerifyOpts{}, HashOpts{})
+}
+
+// SigVerifyFunc verifies a single image signature on behalf of the caller;
+// e.g., by passing it to a service that holds the public keys.  It receives
+// the keyhash that precedes the signature, the signed digest, the signature,
+// and the signature algorithm.  It returns true if the keyhash names a
+// trusted key and the signature verifies with it, and false otherwise.  An
+// error indicates that verification could not be performed.
+type SigVerifyFunc func(keyHash []byte, digest []byte, sig []byte,
+	algo SignAlgo) (bool, error)
+
+// VerifySigsFunc is like VerifySigs, but each signature is checked by the
+// provided function rather than against a set of public keys; the caller
+// needs only the keyhashes of its trusted keys.  The returned int is the
+// index of the first signature that verified.  An unsigned image is an error
+// (ErrUnsigned), as is one whose signatures all fail (ErrNoMatchingKey).  If
+// the function returns an error, verification stops and the error is
+// returned with the offending keyhash.
+func (img *Image) VerifySigsFunc(verify SigVerifyFunc) (int, error) {
+	// Validate the keyhash/signature pairing.
+	if _, err := img.CollectSigs(); err != nil {
+		return -1, err
+	}
+
+	digest, err := img.sigHash(HashOpts{})
+	if err != nil {
+		return -1, err
+	}
+
+	sigIdx := 0
+	var keyHash []byte
+	for _, t := range img.Tlvs {
+		if t.Header.Type == IMAGE_TLV_KEYHASH {
+			keyHash = t.Data
+			continue
+		}
+		if !ImageTlvTypeIsSig(t.Header.Type) {
+			continue
+		}
+
+		ok, err := verify(keyHash, digest, t.Data, sigTlvAlgo(t.Header.Type))
+		if err != nil {
+			return -1, errors.Wrapf(err,
+				"signature verifier failed; keyhash=%x", keyHash)
+		}
+		if ok {
+			return sigIdx, nil
+		}
+
+		keyHash = nil
+		sigIdx++
+	}
+
+	if sigIdx == 0 {
+		return -1, errors.WithStack(&ErrUnsigned{})
+	}
+
+	return -1, errors.WithStack(&ErrNoMatchingKey{})
+}
+
+// VerifyFunc is like Verify, but signatures are checked by the provided
+// function (see VerifySigsFunc).  The returned ints are the index of the
+// encryption key used to decrypt the image (-1 if unused) and the index of
+// the signature that verified.
+func (img *Image) VerifyFunc(verify SigVerifyFunc,
+	privEncKeys []sec.PrivEncKey) (int, int, error) {
+
+	if err := img.VerifyStructure(); err != nil {
+		return -1, -1, err
+	}
+
+	encIdx, err := img.VerifyHash(privEncKeys)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	sigIdx, err := img.VerifySigsFunc(verify)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return encIdx, sigIdx, nil
+}
+
+// VerifyDetached checks a standalone signature, such as one produced by an
+// external signer before it is embedded in the image, against the image's
+// signing digest (see SigningDigest).  algo must agree with the type of the
+// public key.  An error is returned if the signature is invalid.
+func (img *Image) VerifyDetached(sig []byte, pub sec.PubSignKey,
+	algo SignAlgo) error {
+
+	if !ImageTlvTypeIsSig(uint8(algo)) {
+		return errors.Errorf("invalid signature algorithm: %d", algo)
+	}
+
+	if algo != pub.Type() {
+		return errors.Errorf(
+			"signature algorithm does not match key: algo=%s key=%s",
+			ImageTlvTypeName(uint8(algo)), pub.Type())
+	}
+
+	digest, hash, err := img.SigningDigest()
+	if err != nil {
+		return err
+	}
+
+	if err := pub.VerifyDigest(digest, hash, sig); err != nil {
+		return errors.Wrapf(err, "detached signature invalid")
+	}
+
+	return nil
+}
+
+// VerifyAll checks every signature in an image, rather than stopping at the
+// first that verifies as VerifySigs does.  Every signature is checked against
+// the signing digest (see SigningDigest); no per-signature digest scheme is
+// currently recognized.  If the image contains a TLV of an unrecognized type,
+// which may carry metadata for such a scheme, a warning is returned and the
+// single-digest assumption is still applied.
+//
+// The returned slice contains, for each signature in order, the index of the
+// key that verified it.  An error is returned if any signature fails to
+// verify against all of the keys, or ErrUnsigned if the image has no
+// signatures.
+func (img *Image) VerifyAll(keys []sec.PubSignKey) ([]int, []string, error) {
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sigs) == 0 {
+		return nil, nil, errors.WithStack(&ErrUnsigned{})
+	}
+
+	var warnings []string
+	seen := map[uint8]bool{}
+	for _, t := range img.AllTlvs() {
+		typ := t.Tlv.Header.Type
+		if !ImageTlvTypeIsValid(typ) && !seen[typ] {
+			warnings = append(warnings, fmt.Sprintf(
+				"image contains TLV with unrecognized type %d; "+
+					"assuming all signatures cover the signing digest", typ))
+			seen[typ] = true
+		}
+	}
+
+	digest, _, err := img.SigningDigest()
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	var matches []int
+	for i, sig := range sigs {
+		keyIdx := -1
+		for j, k := range keys {
+			sigIdx, err := sec.VerifySigs(k, []sec.Sig{sig}, digest)
+			if err != nil {
+				return nil, warnings, err
+			}
+			if sigIdx != -1 {
+				keyIdx = j
+				break
+			}
+		}
+
+		if keyIdx == -1 {
+			return nil, warnings, errors.Errorf(
+				"image signature %d does not match provided keys", i)
+		}
+		matches = append(matches, keyIdx)
+	}
+
+	return matches, warnings, nil
+}
+
+// ringMatches returns the indices of the keys in a keyring that validate one
+// of an image's signatures.  If all is false, the search stops at the first
+// match.
+func (img *Image) ringMatches(ring []sec.PubSignKey, all bool) ([]int, error) {
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return nil, err
+	}
+	if len(sigs) == 0 {
+		return nil, errors.WithStack(&ErrUnsigned{})
+	}
+
+	hash, err := img.sigHash(HashOpts{})
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []int
+	for keyIdx, k := range ring {
+		sigIdx, err := sec.VerifySigs(k, sigs, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if sigIdx != -1 {
+			matches = append(matches, keyIdx)
+			if !all {
+				break
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, sigFailure(ring, sigs)
+	}
+
+	return matches, nil
+}
+
+// VerifyWithRing checks an image's signatures against a keyring.  It returns
+// the index of the first key whose keyhash and signature both validate.  As
+// with VerifySigs, an unsigned image is an error (ErrUnsigned).  Signatures
+// are checked against the image's SHA256 TLV; use VerifyHash to check the TLV
+// itself.
+func (img *Image) VerifyWithRing(ring []sec.PubSignKey) (int, error) {
+	matches, err := img.ringMatches(ring, false)
+	if err != nil {
+		return -1, err
+	}
+
+	return matches[0], nil
+}
+
+// VerifyAndVersion establishes that an image is intact and signed by a key in
+// the ring and, only then, returns the version from its header along with the
+// index of the ring key that verified it.  The image's structure, hash, and
+// signatures are all checked, since a signature only covers the header by way
+// of the hash TLV.  The image must not be encrypted; decrypt it first (see
+// Decrypt).  On failure the returned version is zero and must not be used.
+func VerifyAndVersion(img *Image, ring []sec.PubSignKey) (ImageVersion, int,
+	error) {
+
+	if err := img.VerifyStructure(); err != nil {
+		return ImageVersion{}, -1, err
+	}
+
+	if _, err := img.VerifyHash(nil); err != nil {
+		return ImageVersion{}, -1, err
+	}
+
+	keyIdx, err := img.VerifyWithRing(ring)
+	if err != nil {
+		return ImageVersion{}, -1, err
+	}
+
+	return img.Header.Vers, keyIdx, nil
+}
+
+// VerifyWithRingAll is like VerifyWithRing, but it returns the indices of all
+// keys that validate a signature.
+func (img *Image) VerifyWithRingAll(ring []sec.PubSignKey) ([]int, error) {
+	return img.ringMatches(ring, true)
+}
+
+// verifyKeyRing fully checks an image against a keyring: its structure, its
+// hash (decrypting it with the ring's encryption keys if necessary), and its
+// signatures.  As with VerifyWithRing, an unsigned image is an error.  It
+// returns the ring entry of the key that verified a signature and the
+// decrypted image.
+func (img *Image) verifyKeyRing(ring *sec.KeyRing) (sec.NamedSignKey, *Image,
+	error) {
+
+	if err := img.VerifyStructure(); err != nil {
+		return sec.NamedSignKey{}, nil, err
+	}
+
+	_, dec, err := img.verifyHash(context.Background(), ring.PrivEncKeys(),
+		HashOpts{})
+	if err != nil {
+		return sec.NamedSignKey{}, nil, err
+	}
+
+	keyIdx, err := dec.VerifyWithRing(ring.PubSignKeys())
+	if err != nil {
+		return sec.NamedSignKey{}, nil, err
+	}
+
+	return ring.SignKeys[keyIdx], dec, nil
+}
+
+// VerifyKeyRing performs a full check of an image using the keys in a
+// keyring.  It returns the entry of the signing key that verified one of the
+// image's signatures.  As with Verify, an unsigned image is an error
+// (ErrUnsigned).
+func (img *Image) VerifyKeyRing(ring *sec.KeyRing) (sec.NamedSignKey, error) {
+	k, _, err := img.verifyKeyRing(ring)
+	return k, err
+}
+
+// ExtractBody returns an image's plaintext body: decrypted with one of the
+// ring's encryption keys if necessary and decompressed if the image is
+// compressed.  The body is only returned if the image verifies against the
+// ring (see VerifyKeyRing).
+func (img *Image) ExtractBody(ring *sec.KeyRing) ([]byte, error) {
+	_, dec, err := img.verifyKeyRing(ring)
+	if err != nil {
+		return nil, err
+	}
+
+	return dec.DecompressBody()
+}
+
+// ValidateXIP checks that an image is suitable for executing in place from a
+// flash area mapped at the specified base address.  It returns an error if the
+// image is RAM-loaded, is not bootable, or has a load address other than
+// flashBase.  Callers can use IsRamLoad() to skip this check for RAM-loaded
+// images.
+func (img *Image) ValidateXIP(flashBase uint32) error {
+	if img.IsRamLoad() {
+		return errors.Errorf(
+			"image is not execute-in-place: RAM load flag set; "+
+				"load_addr=0x%08x", img.Header.LoadAddr())
+	}
+
+	if !img.IsBootable() {
+		return errors.Errorf(
+			"execute-in-place image is not bootable: flags=0x%08x",
+			img.Header.Flags)
+	}
+
+	if img.Header.LoadAddr() != flashBase {
+		return errors.Errorf(
+			"execute-in-place image has wrong load address: "+
+				"have=0x%08x want=0x%08x",
+			img.Header.LoadAddr(), flashBase)
+	}
+
+	return nil
+}
+
+// ErrVersionUnparseable indicates that a version string is not of the form
+// "major[.minor[.rev[.build]]]".
+type ErrVersionUnparseable struct {
+	Raw string
+	Err error // The parse error.
+}
+
+func (e *ErrVersionUnparseable) Error() string {
+	return fmt.Sprintf("version string not parseable: \"%s\": %s",
+		e.Raw, e.Err.Error())
+}
+
+func (e *ErrVersionUnparseable) Unwrap() error {
+	return e.Err
+}
+
+// ManifestVersion parses a manifest's `build_version` field with
+// ParseVersion.  The manifest retains the raw string for display.  If the
+// string is not a valid image version, an *ErrVersionUnparseable carrying the
+// raw value and the parse error is returned; this does not affect the rest of
+// the manifest.
+func ManifestVersion(man manifest.Manifest) (ImageVersion, error) {
+	ver, err := ParseVersion(man.Version)
+	if err != nil {
+		return ImageVersion{}, errors.Wrapf(
+			&ErrVersionUnparseable{Raw: man.Version, Err: err},
+			"failed to parse manifest version")
+	}
+
+	return ver, nil
+}
+
+// checkManifestHashAlgo verifies that a manifest's image hash is consistent
+// with its hash algorithm and that the algorithm is the one images use
+// (SHA256).  The returned bool indicates that the manifest does not record the
+// algorithm and it was inferred from the hash's length.
+func checkManifestHashAlgo(man manifest.Manifest) (bool, error) {
+	algo, inferred, err := man.ImageHashAlgo()
+	if err != nil {
+		return false, err
+	}
+
+	if algo != "" && algo != "sha256" {
+		return false, errors.Errorf(
+			"manifest image hash algorithm unsupported: have=%s want=sha256",
+			algo)
+	}
+
+	return inferred, nil
+}
+
+// ManifestVerifyOpts controls how an image is compared to its manifest.
+type ManifestVerifyOpts struct {
+	// If true, a build number of 0 in the image header matches any build
+	// number in the manifest.  This accommodates builds that zero the build
+	// number in the header and record the real one only in the manifest.  The
+	// major, minor, and revision numbers must still match exactly.
+	BuildNumWildcard bool
 }
 
 // VerifyManifest compares an image's structure to its manifest.  It returns
 // an error if the image doesn't match the manifest.
 func (img *Image) VerifyManifest(man manifest.Manifest) error {
-	ver, err := ParseVersion(man.Version)
+	return img.VerifyManifestOpts(man, ManifestVerifyOpts{})
+}
+
+// VerifyManifestOpts is like VerifyManifest, but the comparison is controlled
+// by the provided options.
+func (img *Image) VerifyManifestOpts(man manifest.Manifest,
+	opts ManifestVerifyOpts) error {
+
+	if _, err := checkManifestHashAlgo(man); err != nil {
+		return err
+	}
+
+	ver, err := ManifestVersion(man)
 	if err != nil {
 		return errors.Wrapf(err, "manifest contains invalid `version` field")
 	}
 
+	buildNumOk := ver.BuildNum == img.Header.Vers.BuildNum ||
+		(opts.BuildNumWildcard && img.Header.Vers.BuildNum == 0)
+
 	if ver.Major != img.Header.Vers.Major ||
 		ver.Minor != img.Header.Vers.Minor ||
 		ver.Rev != img.Header.Vers.Rev ||
-		ver.BuildNum != img.Header.Vers.BuildNum {
+		!buildNumOk {
 
 		return errors.Errorf(
 			"manifest version different from image header: man=%s img=%s",
@@ -213,3 +1032,75 @@ func (img *Image) VerifyManifest(man manifest.Manifest) error {
 
 	return nil
 }
+
+// calcPlainHash calculates the hash of an image's plaintext.  If the image is
+// encrypted, each of the provided keys is tried in turn; the result from the
+// first key that reproduces the image's SHA256 TLV is returned.  If no key
+// succeeds, the hash produced by the final key is returned.
+func (img *Image) calcPlainHash(privEncKeys []sec.PrivEncKey) ([]byte, error) {
+	secret, err := img.verifyEncState()
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		return img.calcContentHash(nil)
+	}
+
+	if len(privEncKeys) == 0 {
+		return nil, errors.Errorf(
+			"attempt to calculate hash of encrypted image: no keys provided")
+	}
+
+	tlvHash, _ := img.Hash()
+
+	var hash []byte
+	for _, key := range privEncKeys {
+		dec, err := Decrypt(*img, key)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err = dec.calcContentHash(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(hash, tlvHash) {
+			break
+		}
+	}
+
+	return hash, nil
+}
+
+// VerifyManifestHash checks that the image hash recorded in a manifest, the
+// image's SHA256 TLV, and the hash calculated from the image's contents all
+// agree.  The decryption keys are only used if the image is encrypted.  On
+// mismatch, the returned error reports all three values.
+func (img *Image) VerifyManifestHash(man manifest.Manifest,
+	privEncKeys []sec.PrivEncKey) error {
+
+	if _, err := checkManifestHashAlgo(man); err != nil {
+		return err
+	}
+
+	var tlvHash string
+	if hash, err := img.Hash(); err == nil {
+		tlvHash = hex.EncodeToString(hash)
+	}
+
+	calc, err := img.calcPlainHash(privEncKeys)
+	if err != nil {
+		return err
+	}
+	calcHash := hex.EncodeToString(calc)
+
+	if man.ImageHash != tlvHash || tlvHash != calcHash {
+		return errors.Errorf(
+			"image hash mismatch: man=%s tlv=%s calc=%s",
+			man.ImageHash, tlvHash, calcHash)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package imagetest creates small, valid Mynewt images in memory for use in
+// tests, so that consumers of this module need not hand-craft image bytes or
+// keep fixtures on disk.
+package imagetest
+
+import (
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// ImageOpts describes an image to generate with NewImage.
+type ImageOpts struct {
+	Version image.ImageVersion
+
+	// Image body.  If nil, a short fixed placeholder body is used.
+	Body []byte
+
+	// Keys to sign the image with.  If empty, the image is unsigned.
+	SigKeys []sec.PrivSignKey
+
+	// Key to encrypt the image's content key with.  If nil, the image is not
+	// encrypted.
+	EncKey *sec.PubEncKey
+
+	// Content-encryption key.  If nil, a fixed key is used so that the
+	// encrypted body is reproducible.  Only used if EncKey is specified.
+	PlainSecret []byte
+}
+
+// defaultBody is the body NewImage uses when none is specified.
+var defaultBody = []byte{
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+	0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+}
+
+// defaultPlainSecret is the content key NewImage uses when none is
+// specified.  It is public, so images encrypted with it are only fit for
+// tests.
+var defaultPlainSecret = []byte{
+	0x54, 0x45, 0x53, 0x54, 0x2d, 0x4b, 0x45, 0x59,
+	0x2d, 0x30, 0x30, 0x30, 0x30, 0x30, 0x30, 0x31,
+}
+
+// NewImage creates a minimal valid image entirely in memory, suitable for
+// feeding to image.ParseImage or Image.Verify without reading fixtures from
+// disk.  The image is assembled by image.Build, so it tracks the real
+// format.
+func NewImage(opts ImageOpts) (image.Image, error) {
+	body := opts.Body
+	if body == nil {
+		body = defaultBody
+	}
+
+	plainSecret := opts.PlainSecret
+	if opts.EncKey != nil && plainSecret == nil {
+		plainSecret = defaultPlainSecret
+	}
+
+	return image.Build(body, opts.Version, image.BuildOpts{
+		SigKeys:     opts.SigKeys,
+		EncKey:      opts.EncKey,
+		PlainSecret: plainSecret,
+	})
+}
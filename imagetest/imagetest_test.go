@@ -0,0 +1,93 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package imagetest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+func TestNewImage(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigKey := sec.PrivSignKey{Ed25519: &edKey}
+	kek, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := NewImage(ImageOpts{
+		Version: image.ImageVersion{Major: 2, Minor: 1, BuildNum: 7},
+		SigKeys: []sec.PrivSignKey{sigKey},
+		EncKey:  &sec.PubEncKey{Aes: kek},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image survives a round trip through its serialized form.
+	buf := &bytes.Buffer{}
+	if _, err := img.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	img, err = image.ParseImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.Vers.String() != "2.1.0.7" {
+		t.Fatalf("wrong version: %s", img.Header.Vers.String())
+	}
+
+	encIdx, sigIdx, err := img.Verify(
+		[]sec.PubSignKey{sigKey.PubKey()},
+		[]sec.PrivEncKey{sec.PrivEncKey{Aes: kek}})
+	if err != nil {
+		t.Fatalf("test image failed verification: %s", err.Error())
+	}
+	if encIdx != 0 || sigIdx != 0 {
+		t.Fatalf("wrong key indices: enc=%d sig=%d", encIdx, sigIdx)
+	}
+
+	// Encryption with the default content key is reproducible.
+	img2, err := NewImage(ImageOpts{
+		EncKey: &sec.PubEncKey{Aes: kek},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img3, err := NewImage(ImageOpts{
+		EncKey: &sec.PubEncKey{Aes: kek},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img2.Body, img3.Body) {
+		t.Fatalf("test image body not reproducible")
+	}
+}
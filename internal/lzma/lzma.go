@@ -0,0 +1,571 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package lzma implements decoding of raw LZMA2 streams, as produced by
+// xz-utils with FORMAT_RAW and as embedded in compressed MCUboot images, and
+// the ARM-Thumb branch-conversion filter that may precede them.
+package lzma
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+const (
+	numStates          = 12
+	posStatesMax       = 1 << 4
+	probInit           = 1 << 10
+	bitModelTotalBits  = 11
+	numMoveBits        = 5
+	topValue           = 1 << 24
+	matchMinLen        = 2
+	endPosModelIndex   = 14
+	numFullDistances   = 1 << (endPosModelIndex >> 1)
+	numAlignBits       = 4
+	numLenToPosStates  = 4
+	lenLowBits         = 3
+	lenMidBits         = 3
+	lenHighBits        = 8
+	lenLowSymbols      = 1 << lenLowBits
+	lenMidSymbols      = 1 << lenMidBits
+	lzma2MaxPropsLcLp  = 4
+	lzma2MaxPropsPb    = 4
+	lzma2DictSizeMaxId = 40
+)
+
+// DictSize returns the dictionary size encoded by an LZMA2 dictionary size
+// byte, as stored in the header of an xz LZMA2 filter.
+func DictSize(id byte) (uint32, error) {
+	if id > lzma2DictSizeMaxId {
+		return 0, errors.Errorf("invalid LZMA2 dictionary size: %d", id)
+	}
+	if id == lzma2DictSizeMaxId {
+		return 0xffffffff, nil
+	}
+
+	return (2 | uint32(id&1)) << (id/2 + 11), nil
+}
+
+// rangeDecoder is the LZMA binary arithmetic decoder.
+type rangeDecoder struct {
+	in    []byte
+	rng   uint32
+	code  uint32
+	fault bool
+}
+
+func (rd *rangeDecoder) init(in []byte) error {
+	if len(in) < 5 || in[0] != 0 {
+		return errors.Errorf("corrupt LZMA chunk: bad range coder header")
+	}
+
+	rd.rng = 0xffffffff
+	rd.code = uint32(in[1])<<24 | uint32(in[2])<<16 |
+		uint32(in[3])<<8 | uint32(in[4])
+	rd.in = in[5:]
+	rd.fault = false
+
+	if rd.code == rd.rng {
+		return errors.Errorf("corrupt LZMA chunk: bad range coder header")
+	}
+
+	return nil
+}
+
+func (rd *rangeDecoder) normalize() {
+	if rd.rng < topValue {
+		rd.rng <<= 8
+		if len(rd.in) == 0 {
+			rd.fault = true
+			rd.code <<= 8
+			return
+		}
+		rd.code = rd.code<<8 | uint32(rd.in[0])
+		rd.in = rd.in[1:]
+	}
+}
+
+func (rd *rangeDecoder) bit(prob *uint16) uint32 {
+	v := uint32(*prob)
+	bound := (rd.rng >> bitModelTotalBits) * v
+
+	var sym uint32
+	if rd.code < bound {
+		v += ((1 << bitModelTotalBits) - v) >> numMoveBits
+		rd.rng = bound
+		sym = 0
+	} else {
+		v -= v >> numMoveBits
+		rd.code -= bound
+		rd.rng -= bound
+		sym = 1
+	}
+	*prob = uint16(v)
+	rd.normalize()
+
+	return sym
+}
+
+func (rd *rangeDecoder) directBits(n uint) uint32 {
+	var res uint32
+	for ; n > 0; n-- {
+		rd.rng >>= 1
+		rd.code -= rd.rng
+		t := 0 - (rd.code >> 31)
+		rd.code += rd.rng & t
+		if rd.code == rd.rng {
+			rd.fault = true
+		}
+		rd.normalize()
+		res = res<<1 + t + 1
+	}
+
+	return res
+}
+
+func (rd *rangeDecoder) bitTree(probs []uint16, numBits uint) uint32 {
+	m := uint32(1)
+	for i := uint(0); i < numBits; i++ {
+		m = m<<1 + rd.bit(&probs[m])
+	}
+
+	return m - (1 << numBits)
+}
+
+func (rd *rangeDecoder) bitTreeReverse(probs []uint16, numBits uint) uint32 {
+	m := uint32(1)
+	var sym uint32
+	for i := uint(0); i < numBits; i++ {
+		bit := rd.bit(&probs[m])
+		m = m<<1 + bit
+		sym |= bit << i
+	}
+
+	return sym
+}
+
+func initProbs(probs []uint16) {
+	for i := range probs {
+		probs[i] = probInit
+	}
+}
+
+// lenDecoder decodes match lengths.
+type lenDecoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [posStatesMax][lenLowSymbols]uint16
+	mid     [posStatesMax][lenMidSymbols]uint16
+	high    [1 << lenHighBits]uint16
+}
+
+func (ld *lenDecoder) init() {
+	ld.choice = probInit
+	ld.choice2 = probInit
+	for i := range ld.low {
+		initProbs(ld.low[i][:])
+		initProbs(ld.mid[i][:])
+	}
+	initProbs(ld.high[:])
+}
+
+func (ld *lenDecoder) decode(rd *rangeDecoder, posState uint32) uint32 {
+	if rd.bit(&ld.choice) == 0 {
+		return rd.bitTree(ld.low[posState][:], lenLowBits)
+	}
+	if rd.bit(&ld.choice2) == 0 {
+		return lenLowSymbols + rd.bitTree(ld.mid[posState][:], lenMidBits)
+	}
+
+	return lenLowSymbols + lenMidSymbols + rd.bitTree(ld.high[:], lenHighBits)
+}
+
+// decoder holds the LZMA state that persists across LZMA2 chunks.
+type decoder struct {
+	lc, lp, pb uint
+	dictSize   uint32
+
+	// Decoded output; the dictionary is the portion after dictStart.
+	out       []byte
+	dictStart int
+	limit     int
+
+	state                  uint32
+	rep0, rep1, rep2, rep3 uint32
+
+	literal    []uint16
+	posSlot    [numLenToPosStates][1 << 6]uint16
+	posDecoder [1 + numFullDistances - endPosModelIndex]uint16
+	align      [1 << numAlignBits]uint16
+	isMatch    [numStates << 4]uint16
+	isRep      [numStates]uint16
+	isRepG0    [numStates]uint16
+	isRepG1    [numStates]uint16
+	isRepG2    [numStates]uint16
+	isRep0Long [numStates << 4]uint16
+	lenDec     lenDecoder
+	repLenDec  lenDecoder
+}
+
+func (d *decoder) setProps(props byte) error {
+	if props >= 9*5*5 {
+		return errors.Errorf("invalid LZMA properties: 0x%02x", props)
+	}
+
+	p := uint(props)
+	d.lc = p % 9
+	p /= 9
+	d.lp = p % 5
+	d.pb = p / 5
+
+	if d.lc+d.lp > lzma2MaxPropsLcLp || d.pb > lzma2MaxPropsPb {
+		return errors.Errorf("invalid LZMA2 properties: 0x%02x", props)
+	}
+
+	return nil
+}
+
+func (d *decoder) resetState() {
+	d.literal = make([]uint16, 0x300<<(d.lc+d.lp))
+	initProbs(d.literal)
+	for i := range d.posSlot {
+		initProbs(d.posSlot[i][:])
+	}
+	initProbs(d.posDecoder[:])
+	initProbs(d.align[:])
+	initProbs(d.isMatch[:])
+	initProbs(d.isRep[:])
+	initProbs(d.isRepG0[:])
+	initProbs(d.isRepG1[:])
+	initProbs(d.isRepG2[:])
+	initProbs(d.isRep0Long[:])
+	d.lenDec.init()
+	d.repLenDec.init()
+
+	d.state = 0
+	d.rep0, d.rep1, d.rep2, d.rep3 = 0, 0, 0, 0
+}
+
+// dictLen returns the number of bytes available for back-references.
+func (d *decoder) dictLen() uint32 {
+	n := uint32(len(d.out) - d.dictStart)
+	if n > d.dictSize {
+		n = d.dictSize
+	}
+	return n
+}
+
+// getByte returns the byte dist bytes before the end of the output.
+func (d *decoder) getByte(dist uint32) byte {
+	return d.out[len(d.out)-int(dist)]
+}
+
+func (d *decoder) putByte(b byte) error {
+	if len(d.out) >= d.limit {
+		return errors.Errorf(
+			"LZMA2 stream exceeds expected size: limit=%d", d.limit)
+	}
+	d.out = append(d.out, b)
+	return nil
+}
+
+func (d *decoder) decodeLiteral(rd *rangeDecoder) error {
+	pos := uint32(len(d.out) - d.dictStart)
+
+	prevByte := uint32(0)
+	if pos > 0 {
+		prevByte = uint32(d.getByte(1))
+	}
+
+	litState := ((pos & (1<<d.lp - 1)) << d.lc) + (prevByte >> (8 - d.lc))
+	probs := d.literal[0x300*litState:]
+
+	sym := uint32(1)
+	if d.state >= 7 {
+		matchByte := uint32(d.getByte(d.rep0 + 1))
+		for sym < 0x100 {
+			matchBit := (matchByte >> 7) & 1
+			matchByte <<= 1
+			bit := rd.bit(&probs[((1+matchBit)<<8)+sym])
+			sym = sym<<1 | bit
+			if matchBit != bit {
+				break
+			}
+		}
+	}
+	for sym < 0x100 {
+		sym = sym<<1 | rd.bit(&probs[sym])
+	}
+
+	return d.putByte(byte(sym - 0x100))
+}
+
+func (d *decoder) decodeDistance(rd *rangeDecoder, length uint32) uint32 {
+	lenState := length
+	if lenState > numLenToPosStates-1 {
+		lenState = numLenToPosStates - 1
+	}
+
+	posSlot := rd.bitTree(d.posSlot[lenState][:], 6)
+	if posSlot < 4 {
+		return posSlot
+	}
+
+	numDirectBits := uint(posSlot>>1) - 1
+	dist := (2 | (posSlot & 1)) << numDirectBits
+	if posSlot < endPosModelIndex {
+		dist += rd.bitTreeReverse(d.posDecoder[dist-posSlot:], numDirectBits)
+	} else {
+		dist += rd.directBits(numDirectBits-numAlignBits) << numAlignBits
+		dist += rd.bitTreeReverse(d.align[:], numAlignBits)
+	}
+
+	return dist
+}
+
+// decodeChunk decodes an LZMA chunk that inflates to exactly unpacked bytes.
+func (d *decoder) decodeChunk(in []byte, unpacked int) error {
+	rd := rangeDecoder{}
+	if err := rd.init(in); err != nil {
+		return err
+	}
+
+	end := len(d.out) + unpacked
+	if end > d.limit {
+		return errors.Errorf(
+			"LZMA2 stream exceeds expected size: limit=%d", d.limit)
+	}
+
+	pbMask := uint32(1)<<d.pb - 1
+	for len(d.out) < end {
+		posState := uint32(len(d.out)-d.dictStart) & pbMask
+
+		if rd.bit(&d.isMatch[d.state<<4+posState]) == 0 {
+			if err := d.decodeLiteral(&rd); err != nil {
+				return err
+			}
+			switch {
+			case d.state < 4:
+				d.state = 0
+			case d.state < 10:
+				d.state -= 3
+			default:
+				d.state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rd.bit(&d.isRep[d.state]) != 0 {
+			if d.dictLen() == 0 {
+				return errors.Errorf("corrupt LZMA chunk: match in empty " +
+					"dictionary")
+			}
+
+			if rd.bit(&d.isRepG0[d.state]) == 0 {
+				if rd.bit(&d.isRep0Long[d.state<<4+posState]) == 0 {
+					// Short rep: a single byte at distance rep0.
+					if d.state < 7 {
+						d.state = 9
+					} else {
+						d.state = 11
+					}
+					if err := d.putByte(d.getByte(d.rep0 + 1)); err != nil {
+						return err
+					}
+					continue
+				}
+			} else {
+				var dist uint32
+				if rd.bit(&d.isRepG1[d.state]) == 0 {
+					dist = d.rep1
+				} else {
+					if rd.bit(&d.isRepG2[d.state]) == 0 {
+						dist = d.rep2
+					} else {
+						dist = d.rep3
+						d.rep3 = d.rep2
+					}
+					d.rep2 = d.rep1
+				}
+				d.rep1 = d.rep0
+				d.rep0 = dist
+			}
+
+			length = d.repLenDec.decode(&rd, posState)
+			if d.state < 7 {
+				d.state = 8
+			} else {
+				d.state = 11
+			}
+		} else {
+			d.rep3 = d.rep2
+			d.rep2 = d.rep1
+			d.rep1 = d.rep0
+			length = d.lenDec.decode(&rd, posState)
+			if d.state < 7 {
+				d.state = 7
+			} else {
+				d.state = 10
+			}
+
+			d.rep0 = d.decodeDistance(&rd, length)
+			if d.rep0 == 0xffffffff {
+				return errors.Errorf(
+					"corrupt LZMA chunk: end marker in LZMA2 stream")
+			}
+		}
+
+		if d.rep0 >= d.dictLen() {
+			return errors.Errorf(
+				"corrupt LZMA chunk: match distance out of range")
+		}
+
+		length += matchMinLen
+		if int(length) > end-len(d.out) {
+			return errors.Errorf("corrupt LZMA chunk: match exceeds chunk")
+		}
+		for ; length > 0; length-- {
+			d.out = append(d.out, d.getByte(d.rep0+1))
+		}
+	}
+
+	if rd.fault || len(rd.in) != 0 {
+		return errors.Errorf("corrupt LZMA chunk: compressed size mismatch")
+	}
+
+	return nil
+}
+
+// DecodeLzma2 decodes a raw LZMA2 stream using the specified dictionary size.
+// Decoding fails if the output would exceed limit bytes, which guards
+// against streams that inflate without bound.
+func DecodeLzma2(in []byte, dictSize uint32, limit int) ([]byte, error) {
+	d := decoder{
+		dictSize: dictSize,
+		limit:    limit,
+	}
+
+	needDictReset := true
+	needProps := true
+	for {
+		if len(in) == 0 {
+			return nil, errors.Errorf("truncated LZMA2 stream")
+		}
+		ctrl := in[0]
+		in = in[1:]
+
+		if ctrl == 0x00 {
+			break
+		}
+
+		if ctrl >= 0xe0 || ctrl == 0x01 {
+			needProps = true
+			needDictReset = false
+			d.dictStart = len(d.out)
+		} else if needDictReset {
+			return nil, errors.Errorf(
+				"corrupt LZMA2 stream: missing dictionary reset")
+		}
+
+		if ctrl < 0x80 {
+			// Uncompressed chunk.
+			if ctrl > 0x02 {
+				return nil, errors.Errorf(
+					"corrupt LZMA2 stream: invalid control byte 0x%02x", ctrl)
+			}
+			if len(in) < 2 {
+				return nil, errors.Errorf("truncated LZMA2 stream")
+			}
+			size := (int(in[0])<<8 | int(in[1])) + 1
+			in = in[2:]
+			if len(in) < size {
+				return nil, errors.Errorf("truncated LZMA2 stream")
+			}
+			if len(d.out)+size > d.limit {
+				return nil, errors.Errorf(
+					"LZMA2 stream exceeds expected size: limit=%d", d.limit)
+			}
+			d.out = append(d.out, in[:size]...)
+			in = in[size:]
+			continue
+		}
+
+		// LZMA chunk.
+		if len(in) < 4 {
+			return nil, errors.Errorf("truncated LZMA2 stream")
+		}
+		unpacked := (int(ctrl&0x1f)<<16 | int(in[0])<<8 | int(in[1])) + 1
+		packed := (int(in[2])<<8 | int(in[3])) + 1
+		in = in[4:]
+
+		if ctrl >= 0xc0 {
+			if len(in) < 1 {
+				return nil, errors.Errorf("truncated LZMA2 stream")
+			}
+			if err := d.setProps(in[0]); err != nil {
+				return nil, err
+			}
+			in = in[1:]
+			needProps = false
+		} else if needProps {
+			return nil, errors.Errorf(
+				"corrupt LZMA2 stream: missing properties")
+		}
+		if ctrl >= 0xa0 {
+			d.resetState()
+		}
+
+		if len(in) < packed {
+			return nil, errors.Errorf("truncated LZMA2 stream")
+		}
+		if err := d.decodeChunk(in[:packed], unpacked); err != nil {
+			return nil, err
+		}
+		in = in[packed:]
+	}
+
+	if len(in) != 0 {
+		return nil, errors.Errorf(
+			"LZMA2 stream followed by %d bytes of trailing data", len(in))
+	}
+
+	return d.out, nil
+}
+
+// DecodeArmThumb reverses the ARM-Thumb branch-conversion filter in place.
+// The filter converts the targets of Thumb BL instructions from absolute to
+// relative form, starting at offset 0.
+func DecodeArmThumb(buf []byte) {
+	for i := 0; i+4 <= len(buf); i += 2 {
+		if buf[i+1]&0xf8 != 0xf0 || buf[i+3]&0xf8 != 0xf8 {
+			continue
+		}
+
+		src := (uint32(buf[i+1])&7)<<19 | uint32(buf[i])<<11 |
+			(uint32(buf[i+3])&7)<<8 | uint32(buf[i+2])
+		src <<= 1
+
+		dest := (src - uint32(i+4)) >> 1
+		buf[i+1] = 0xf0 | byte((dest>>19)&0x7)
+		buf[i] = byte(dest >> 11)
+		buf[i+3] = 0xf8 | byte((dest>>8)&0x7)
+		buf[i+2] = byte(dest)
+		i += 2
+	}
+}
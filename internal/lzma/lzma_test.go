@@ -0,0 +1,144 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package lzma
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+// The vectors below were produced by Python's lzma module with
+// format=FORMAT_RAW and a single LZMA2 filter (preset 6), unless noted.
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecodeLzma2(t *testing.T) {
+	text := bytes.Repeat(
+		[]byte("The quick brown fox jumps over the lazy dog. "), 8)
+
+	out, err := DecodeLzma2(mustHex(
+		"e0016700355d002a1a08a2032566f14b78c5a205ff2ee6d9d2201aad34f8e2"+
+			"1de84136fadc0669bb3ce410342709ebb366e3ed3798ed925f3e60000000"),
+		1<<20, len(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, text) {
+		t.Fatalf("wrong LZMA chunk output: %q", out)
+	}
+
+	// Incompressible input is stored in an uncompressed chunk.
+	out, err = DecodeLzma2(mustHex(
+		"01002f2291d8cdc310411e7ec27378a661c935187c07e4d5636e9bc3c400b2"+
+			"7244b8cd3a97f11ae651070506a68a02f0e161af00"), 1<<20, 48)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 48 || out[0] != 0x22 || out[47] != 0xaf {
+		t.Fatalf("wrong uncompressed chunk output: %x", out)
+	}
+
+	// Multiple LZMA chunks; dict_size=1MiB.
+	packed, err := ioutil.ReadFile("testdata/pattern-3m.lz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 3*1024*1024)
+	for i := range want {
+		want[i] = byte((i*i + i/7) % 251)
+	}
+	out, err = DecodeLzma2(packed, 1<<20, len(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Fatalf("wrong multi-chunk output")
+	}
+
+	// The output limit is enforced.
+	if _, err := DecodeLzma2(packed, 1<<20, len(want)-1); err == nil {
+		t.Fatalf("output limit not enforced")
+	}
+
+	// Truncated and corrupt streams are rejected.
+	for _, bad := range [][]byte{
+		packed[:len(packed)-1],
+		packed[:len(packed)/2],
+		append(append([]byte(nil), packed...), 0),
+		{0x80, 0x00, 0x00, 0x00, 0x00},
+		{},
+	} {
+		if _, err := DecodeLzma2(bad, 1<<20, len(want)); err == nil {
+			t.Fatalf("corrupt stream accepted: len=%d", len(bad))
+		}
+	}
+}
+
+func TestDecodeArmThumb(t *testing.T) {
+	// Filters: ARMTHUMB, then LZMA2.
+	out, err := DecodeLzma2(mustHex(
+		"e0027f00895d00003c2148f2e187c24c7ec6c1301ff893601874d0129386b7"+
+			"7521625f052ccd44a2a0c5f842d72a19edc2ff8a8d42e028bd21731db214"+
+			"bf3b3def8576cc843be1df997b0952a0c8997fe8e16189febe86fca55bef"+
+			"9b2886ac2062387b73d926bd73887eec2f4710025499cb60258b09f1a868"+
+			"40fb6f8a0db03b9811b8c6c16dc2fe12d144ef695d3c9f00"),
+		1<<20, 640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DecodeArmThumb(out)
+
+	var want []byte
+	for i := 0; i < 64; i++ {
+		want = append(want, 0x00, 0xf0|byte(i&7), 0x10+byte(i), 0xf8)
+		want = append(want, 0x00, 0xbf, 0x00, 0xbf, 0x00, 0xbf)
+	}
+	if !bytes.Equal(out, want) {
+		t.Fatalf("wrong ARM-Thumb output: %x", out)
+	}
+}
+
+func TestDictSize(t *testing.T) {
+	for id, want := range map[byte]uint32{
+		0:  4 << 10,
+		1:  6 << 10,
+		18: 2 << 20,
+		19: 3 << 20,
+		40: 0xffffffff,
+	} {
+		have, err := DictSize(id)
+		if err != nil || have != want {
+			t.Fatalf("wrong dictionary size for %d: have=%d want=%d",
+				id, have, want)
+		}
+	}
+
+	if _, err := DictSize(41); err == nil {
+		t.Fatalf("invalid dictionary size accepted")
+	}
+}
@@ -0,0 +1,142 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// BuildID is the decoded form of a manifest's `id` field.  Only the
+// "<commit>[-dirty][-<timestamp>]" convention is recognized; any other value
+// is reported with Structured=false and only Raw populated.
+type BuildID struct {
+	Raw        string
+	Structured bool
+	Commit     string
+	Dirty      bool
+	Timestamp  time.Time // Zero if the build ID has no timestamp.
+}
+
+var buildIDCommitRe = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+var buildIDNumericRe = regexp.MustCompile(`^[0-9]+$`)
+
+// buildIDEpochMinDigits is the minimum length of an epoch-seconds timestamp
+// component; 9 digits reaches back to 1973.
+const buildIDEpochMinDigits = 9
+
+// Accepted layouts for a calendar timestamp component.  These are tried
+// before the epoch form, so a date such as 20240101 is never mistaken for a
+// count of seconds.
+var buildIDTimeLayouts = []string{
+	"20060102T150405Z",
+	"20060102T150405",
+	"20060102150405",
+	"20060102",
+}
+
+func parseBuildIDTime(s string) (time.Time, bool, error) {
+	for _, layout := range buildIDTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true, nil
+		}
+	}
+
+	if !buildIDNumericRe.MatchString(s) {
+		return time.Time{}, false, nil
+	}
+
+	// A numeric component with the length of a calendar layout that failed
+	// to parse is an invalid date, not an epoch value.
+	if len(s) == len("20060102") || len(s) == len("20060102150405") {
+		return time.Time{}, false, errors.Errorf(
+			"build ID contains invalid timestamp: %s", s)
+	}
+
+	// Other numeric components of plausible length are seconds since the
+	// Unix epoch.  Shorter values (e.g., a bare year) are not timestamps.
+	if len(s) < buildIDEpochMinDigits {
+		return time.Time{}, false, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false, errors.Errorf(
+			"build ID contains invalid timestamp: %s", s)
+	}
+	return time.Unix(secs, 0).UTC(), true, nil
+}
+
+// ParseBuildID decodes a build ID string.  An error is returned only if the
+// string follows the recognized convention but contains an invalid
+// timestamp.
+func ParseBuildID(s string) (BuildID, error) {
+	bid := BuildID{
+		Raw: s,
+	}
+
+	// An all-digit first component is more likely a date or a counter than
+	// a commit.
+	parts := strings.Split(s, "-")
+	if !buildIDCommitRe.MatchString(parts[0]) ||
+		buildIDNumericRe.MatchString(parts[0]) || len(parts) > 3 {
+
+		return bid, nil
+	}
+
+	commit := parts[0]
+	dirty := false
+	var ts time.Time
+
+	rest := parts[1:]
+	if len(rest) > 0 && rest[0] == "dirty" {
+		dirty = true
+		rest = rest[1:]
+	}
+	if len(rest) > 1 {
+		return bid, nil
+	}
+	if len(rest) == 1 {
+		t, ok, err := parseBuildIDTime(rest[0])
+		if err != nil {
+			return bid, err
+		}
+		if !ok {
+			return bid, nil
+		}
+		ts = t
+	}
+
+	bid.Structured = true
+	bid.Commit = commit
+	bid.Dirty = dirty
+	bid.Timestamp = ts
+
+	return bid, nil
+}
+
+// ParsedBuildID decodes the manifest's `id` field.  The raw string remains
+// available in the returned object's Raw field.
+func (m *Manifest) ParsedBuildID() (BuildID, error) {
+	return ParseBuildID(m.BuildID)
+}
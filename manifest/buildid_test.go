@@ -0,0 +1,110 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBuildID(t *testing.T) {
+	type entry struct {
+		raw        string
+		structured bool
+		commit     string
+		dirty      bool
+		timestamp  time.Time
+	}
+
+	entries := []entry{
+		entry{
+			raw:        "a1b2c3d",
+			structured: true,
+			commit:     "a1b2c3d",
+		},
+		entry{
+			raw:        "a1b2c3d-dirty",
+			structured: true,
+			commit:     "a1b2c3d",
+			dirty:      true,
+		},
+		entry{
+			raw:        "a1b2c3d-dirty-1546300800",
+			structured: true,
+			commit:     "a1b2c3d",
+			dirty:      true,
+			timestamp:  time.Unix(1546300800, 0).UTC(),
+		},
+		entry{
+			raw:        "a1b2c3d-20190101T000000Z",
+			structured: true,
+			commit:     "a1b2c3d",
+			timestamp:  time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		// Eight digits are a date, not epoch seconds.
+		entry{
+			raw:        "a1b2c3d-20240101",
+			structured: true,
+			commit:     "a1b2c3d",
+			timestamp:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		// Image hash; too long to be a commit.
+		entry{
+			raw: "e1cbb6fe5e4f7bd5ba1ff6d2f1d0133a" +
+				"6a988f4ee1f1f67bc9d3a7ab5d093b4c",
+		},
+		entry{
+			raw: "a1b2c3d-clean",
+		},
+		// Too short to be epoch seconds.
+		entry{
+			raw: "a1b2c3d-2024",
+		},
+		// A date alone is not a commit.
+		entry{
+			raw: "20240101",
+		},
+		entry{
+			raw: "",
+		},
+	}
+
+	for _, e := range entries {
+		bid, err := ParseBuildID(e.raw)
+		if err != nil {
+			t.Fatalf("build ID \"%s\": unexpected error: %s",
+				e.raw, err.Error())
+		}
+
+		if bid.Raw != e.raw {
+			t.Fatalf("build ID \"%s\": wrong raw value: %s", e.raw, bid.Raw)
+		}
+		if bid.Structured != e.structured ||
+			bid.Commit != e.commit ||
+			bid.Dirty != e.dirty ||
+			!bid.Timestamp.Equal(e.timestamp) {
+
+			t.Fatalf("build ID \"%s\": wrong decoding: %+v", e.raw, bid)
+		}
+	}
+	if _, err := ParseBuildID("a1b2c3d-20241399"); err == nil {
+		t.Fatalf("invalid calendar date accepted")
+	}
+}
@@ -0,0 +1,86 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"sort"
+)
+
+// PkgChange describes a package whose version differs between two
+// manifests.  A package's version is the commit of the repo containing it.
+// A version is empty if the package is absent from the corresponding
+// manifest.
+type PkgChange struct {
+	Name       string `json:"name"`
+	OldVersion string `json:"old_version"`
+	NewVersion string `json:"new_version"`
+}
+
+// pkgVersions maps each of a manifest's packages to its version.
+func (m *Manifest) pkgVersions() map[string]string {
+	repoCommits := map[string]string{}
+	for _, r := range m.Repos {
+		commit := r.Commit
+		if r.Dirty {
+			commit += "-dirty"
+		}
+		repoCommits[r.Name] = commit
+	}
+
+	vers := make(map[string]string, len(m.Pkgs))
+	for _, p := range m.Pkgs {
+		vers[p.Name] = repoCommits[p.Repo]
+	}
+
+	return vers
+}
+
+// ChangedPackages lists the packages that were added, removed, or changed
+// version between two manifests.  The result is sorted by package name.
+func ChangedPackages(oldMan Manifest, newMan Manifest) []PkgChange {
+	oldVers := oldMan.pkgVersions()
+	newVers := newMan.pkgVersions()
+
+	var changes []PkgChange
+	for name, ov := range oldVers {
+		nv, ok := newVers[name]
+		if !ok || nv != ov {
+			changes = append(changes, PkgChange{
+				Name:       name,
+				OldVersion: ov,
+				NewVersion: nv,
+			})
+		}
+	}
+	for name, nv := range newVers {
+		if _, ok := oldVers[name]; !ok {
+			changes = append(changes, PkgChange{
+				Name:       name,
+				NewVersion: nv,
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i int, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes
+}
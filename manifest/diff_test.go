@@ -0,0 +1,72 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangedPackages(t *testing.T) {
+	oldMan := Manifest{
+		Pkgs: []*ManifestPkg{
+			&ManifestPkg{Name: "kernel/os", Repo: "apache-mynewt-core"},
+			&ManifestPkg{Name: "apps/blinky", Repo: "my-app"},
+			&ManifestPkg{Name: "sys/log", Repo: "apache-mynewt-core"},
+			&ManifestPkg{Name: "lib/old", Repo: "my-app"},
+		},
+		Repos: []*ManifestRepo{
+			&ManifestRepo{Name: "apache-mynewt-core", Commit: "aaaa"},
+			&ManifestRepo{Name: "my-app", Commit: "1111"},
+		},
+	}
+
+	newMan := Manifest{
+		Pkgs: []*ManifestPkg{
+			&ManifestPkg{Name: "sys/log", Repo: "apache-mynewt-core"},
+			&ManifestPkg{Name: "lib/new", Repo: "my-app"},
+			&ManifestPkg{Name: "apps/blinky", Repo: "my-app"},
+			&ManifestPkg{Name: "kernel/os", Repo: "apache-mynewt-core"},
+		},
+		Repos: []*ManifestRepo{
+			&ManifestRepo{Name: "apache-mynewt-core", Commit: "aaaa"},
+			&ManifestRepo{Name: "my-app", Commit: "2222", Dirty: true},
+		},
+	}
+
+	want := []PkgChange{
+		PkgChange{Name: "apps/blinky", OldVersion: "1111",
+			NewVersion: "2222-dirty"},
+		PkgChange{Name: "lib/new", OldVersion: "",
+			NewVersion: "2222-dirty"},
+		PkgChange{Name: "lib/old", OldVersion: "1111", NewVersion: ""},
+	}
+
+	for i := 0; i < 5; i++ {
+		have := ChangedPackages(oldMan, newMan)
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("wrong package changes: have=%+v want=%+v", have, want)
+		}
+	}
+
+	if c := ChangedPackages(oldMan, oldMan); len(c) != 0 {
+		t.Fatalf("identical manifests have package changes: %+v", c)
+	}
+}
@@ -20,9 +20,13 @@
 package manifest
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/apache/mynewt-artifact/errors"
@@ -64,6 +68,10 @@ type ManifestRepo struct {
 }
 
 type Manifest struct {
+	// Absent (0) in manifests that predate schema versioning; these are
+	// treated as version 1.  See Migrate().
+	SchemaVersion int `json:"schema_version,omitempty"`
+
 	Name       string            `json:"name"`
 	Date       string            `json:"build_time"`
 	Version    string            `json:"build_version"`
@@ -80,8 +88,19 @@ type Manifest struct {
 
 	PkgSizes       []*ManifestSizePkg `json:"pkgsz"`
 	LoaderPkgSizes []*ManifestSizePkg `json:"loader_pkgsz,omitempty"`
+
+	// Algorithm that produced ImageHash (e.g., "sha256"); see
+	// ImageHashAlgo.  Absent in manifests written by older tools.
+	HashAlgo string `json:"hash_algo,omitempty"`
+
+	// Absolute path of the directory the manifest was read from; empty if
+	// unknown.  Set by ReadManifestDir.
+	baseDir string
 }
 
+// Name of the manifest file within a build directory.
+const MANIFEST_FILENAME = "manifest.json"
+
 // ReadManifest reads a JSON manifest from a file.
 func ReadManifest(path string) (Manifest, error) {
 	m := Manifest{}
@@ -99,9 +118,183 @@ func ReadManifest(path string) (Manifest, error) {
 	return m, nil
 }
 
-// Write serializes a manifest as JSON and writes it to the given writer.
+// manifestHashSizes maps each recognized manifest hash algorithm to the size
+// of its digest, in bytes.
+var manifestHashSizes = map[string]int{
+	"sha256": 32,
+	"sha384": 48,
+	"sha512": 64,
+}
+
+// ImageHashAlgo determines the algorithm of a manifest's image hash and checks
+// that the hash has the corresponding length.  If the manifest does not
+// record the algorithm (HashAlgo), it is inferred from the hash's length and
+// the returned bool is true; callers should treat such a manifest with
+// suspicion and may wish to warn.  An error is returned if the hash is not
+// valid hex, if its length does not match the recorded algorithm, or if the
+// algorithm is unknown or cannot be inferred.  A manifest without an image
+// hash yields an empty algorithm.
+func (m *Manifest) ImageHashAlgo() (string, bool, error) {
+	if m.ImageHash == "" {
+		return "", false, nil
+	}
+
+	hash, err := hex.DecodeString(m.ImageHash)
+	if err != nil {
+		return "", false, errors.Errorf(
+			"manifest image hash is not valid hex: %s", m.ImageHash)
+	}
+
+	if m.HashAlgo != "" {
+		want, ok := manifestHashSizes[m.HashAlgo]
+		if !ok {
+			return "", false, errors.Errorf(
+				"manifest hash algorithm unknown: %s", m.HashAlgo)
+		}
+		if len(hash) != want {
+			return "", false, errors.Errorf(
+				"manifest image hash has wrong length for %s: have=%d want=%d",
+				m.HashAlgo, len(hash), want)
+		}
+
+		return m.HashAlgo, false, nil
+	}
+
+	for algo, size := range manifestHashSizes {
+		if len(hash) == size {
+			return algo, true, nil
+		}
+	}
+
+	return "", false, errors.Errorf(
+		"manifest image hash has unrecognized length: %d", len(hash))
+}
+
+// ParseManifest decodes a JSON manifest.
+func ParseManifest(content []byte) (Manifest, error) {
+	m := Manifest{}
+
+	if err := json.Unmarshal(content, &m); err != nil {
+		return m, errors.Wrapf(err, "failure decoding manifest")
+	}
+
+	return m, nil
+}
+
+// ReadManifestDir reads the manifest file in the specified directory (see
+// MANIFEST_FILENAME).  The directory is recorded so that ImagePath and
+// LoaderPath can resolve the manifest's relative paths against it.
+func ReadManifestDir(dir string) (Manifest, error) {
+	m, err := ReadManifest(filepath.Join(dir, MANIFEST_FILENAME))
+	if err != nil {
+		return m, err
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return m, errors.Wrapf(err,
+			"failed to resolve manifest directory \"%s\"", dir)
+	}
+	m.baseDir = abs
+
+	return m, nil
+}
+
+// BaseDir returns the absolute path of the directory the manifest was read
+// from, or "" if the manifest was not read with ReadManifestDir.
+func (m *Manifest) BaseDir() string {
+	return m.baseDir
+}
+
+// resolvePath resolves a path recorded in the manifest against the
+// manifest's directory.  Absolute and empty paths are returned unchanged, as
+// are all paths if the manifest's directory is unknown.
+func (m *Manifest) resolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) || m.baseDir == "" {
+		return path
+	}
+
+	return filepath.Join(m.baseDir, path)
+}
+
+// ImagePath returns the path of the manifest's image file, resolved against
+// the manifest's directory.  The raw value remains available in the Image
+// field.
+func (m *Manifest) ImagePath() string {
+	return m.resolvePath(m.Image)
+}
+
+// LoaderPath returns the path of the manifest's loader file, resolved against
+// the manifest's directory, or "" if the manifest has no loader.  The raw
+// value remains available in the Loader field.
+func (m *Manifest) LoaderPath() string {
+	return m.resolvePath(m.Loader)
+}
+
+// ReposSorted returns a copy of a manifest's repo list sorted by name (and by
+// commit for entries with the same name).  Nil entries are omitted.  The
+// manifest is not modified.
+func (m *Manifest) ReposSorted() []*ManifestRepo {
+	repos := make([]*ManifestRepo, 0, len(m.Repos))
+	for _, r := range m.Repos {
+		if r == nil {
+			continue
+		}
+		dup := *r
+		repos = append(repos, &dup)
+	}
+
+	sort.SliceStable(repos, func(i int, j int) bool {
+		if repos[i].Name != repos[j].Name {
+			return repos[i].Name < repos[j].Name
+		}
+		return repos[i].Commit < repos[j].Commit
+	})
+
+	return repos
+}
+
+// Validate checks a manifest for internal inconsistencies.  Currently, this
+// means a repo listed more than once with different commits, which indicates
+// a broken build.  All problems are reported in a single error.
+func (m *Manifest) Validate() error {
+	var problems []string
+
+	commits := map[string]string{}
+	for _, r := range m.ReposSorted() {
+		if commit, ok := commits[r.Name]; ok {
+			if commit != r.Commit {
+				problems = append(problems, fmt.Sprintf(
+					"repo %s listed with conflicting commits: %s, %s",
+					r.Name, commit, r.Commit))
+			}
+		} else {
+			commits[r.Name] = r.Commit
+		}
+	}
+
+	if _, _, err := m.ImageHashAlgo(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid manifest:\n    %s",
+			strings.Join(problems, "\n    "))
+	}
+
+	return nil
+}
+
+// Write serializes a manifest as JSON and writes it to the given writer.  The
+// output is deterministic: repos are written in sorted order (see
+// ReposSorted) and map keys are sorted by the JSON encoder.
 func (m *Manifest) Write(w io.Writer) (int, error) {
-	buffer, err := json.MarshalIndent(m, "", "  ")
+	sorted := *m
+	if m.Repos != nil {
+		sorted.Repos = m.ReposSorted()
+	}
+
+	buffer, err := json.MarshalIndent(&sorted, "", "  ")
 	if err != nil {
 		return 0, errors.Wrapf(err, "Cannot encode manifest")
 	}
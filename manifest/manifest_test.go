@@ -0,0 +1,173 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReposSorted(t *testing.T) {
+	m := Manifest{
+		Repos: []*ManifestRepo{
+			&ManifestRepo{Name: "mynewt-nimble", Commit: "bbbb"},
+			&ManifestRepo{Name: "apache-mynewt-core", Commit: "aaaa"},
+			&ManifestRepo{Name: "mcuboot", Commit: "cccc"},
+		},
+	}
+
+	sorted := m.ReposSorted()
+	names := []string{}
+	for _, r := range sorted {
+		names = append(names, r.Name)
+	}
+	want := "apache-mynewt-core,mcuboot,mynewt-nimble"
+	if strings.Join(names, ",") != want {
+		t.Fatalf("wrong repo order: have=%v want=%s", names, want)
+	}
+	if m.Repos[0].Name != "mynewt-nimble" {
+		t.Fatalf("ReposSorted modified the manifest")
+	}
+	sorted[0].Commit = "dddd"
+	if m.Repos[1].Commit != "aaaa" {
+		t.Fatalf("ReposSorted result aliases the manifest")
+	}
+
+	// Writing is independent of file order.
+	rev := Manifest{Repos: []*ManifestRepo{m.Repos[2], m.Repos[0], m.Repos[1]}}
+	b1 := &bytes.Buffer{}
+	b2 := &bytes.Buffer{}
+	if _, err := m.Write(b1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rev.Write(b2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+		t.Fatalf("manifest output depends on repo order")
+	}
+
+	if err := m.Validate(); err != nil {
+		t.Fatalf("valid manifest rejected: %s", err.Error())
+	}
+	m.Repos = append(m.Repos,
+		&ManifestRepo{Name: "mcuboot", Commit: "eeee"})
+	if err := m.Validate(); err == nil {
+		t.Fatalf("conflicting repo commits accepted")
+	}
+
+	// Nil entries are skipped.
+	m.Repos = []*ManifestRepo{nil, m.Repos[0], nil}
+	sorted = m.ReposSorted()
+	if len(sorted) != 1 || sorted[0].Name != "mynewt-nimble" {
+		t.Fatalf("wrong repos with nil entries: have=%v", sorted)
+	}
+}
+
+func TestReadManifestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := `{
+  "name": "targets/app",
+  "image": "app.img",
+  "loader": "",
+  "repos": []
+}`
+	path := filepath.Join(dir, MANIFEST_FILENAME)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadManifestDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join(m.BaseDir(), "app.img")
+	if !filepath.IsAbs(m.ImagePath()) || m.ImagePath() != want {
+		t.Fatalf("wrong image path: have=%s want=%s", m.ImagePath(), want)
+	}
+	if m.Image != "app.img" {
+		t.Fatalf("raw image path modified: %s", m.Image)
+	}
+	if m.LoaderPath() != "" {
+		t.Fatalf("wrong loader path: have=%s want=\"\"", m.LoaderPath())
+	}
+
+	// Without a base directory, paths are returned unchanged.
+	m2, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.ImagePath() != "app.img" {
+		t.Fatalf("wrong image path: have=%s want=app.img", m2.ImagePath())
+	}
+}
+
+func TestImageHashAlgo(t *testing.T) {
+	hash32 := strings.Repeat("ab", 32)
+
+	m := Manifest{ImageHash: hash32}
+	algo, inferred, err := m.ImageHashAlgo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "sha256" || !inferred {
+		t.Fatalf("wrong inferred algorithm: have=%s,%v want=sha256,true",
+			algo, inferred)
+	}
+
+	m.HashAlgo = "sha256"
+	algo, inferred, err = m.ImageHashAlgo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo != "sha256" || inferred {
+		t.Fatalf("wrong recorded algorithm: have=%s,%v want=sha256,false",
+			algo, inferred)
+	}
+
+	// A 32-byte hash labeled as SHA-512.
+	m.HashAlgo = "sha512"
+	if _, _, err := m.ImageHashAlgo(); err == nil {
+		t.Fatalf("hash with wrong length accepted")
+	}
+	if err := m.Validate(); err == nil {
+		t.Fatalf("manifest with wrong hash length accepted")
+	}
+
+	m = Manifest{ImageHash: hash32[:40]}
+	if _, _, err := m.ImageHashAlgo(); err == nil {
+		t.Fatalf("hash with unrecognized length accepted")
+	}
+
+	m = Manifest{ImageHash: "zz"}
+	if _, _, err := m.ImageHashAlgo(); err == nil {
+		t.Fatalf("non-hex hash accepted")
+	}
+}
@@ -22,7 +22,9 @@ package manifest
 import (
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/flash"
@@ -75,8 +77,8 @@ type MfgManifest struct {
 	Meta    *MfgManifestMeta    `json:"meta,omitempty"`
 }
 
-// ReadMfgManifest reads a JSON mfg manifest from a byte slice and produces an
-// MfgManifest object.
+// ParseMfgManifest reads a JSON mfg manifest from a byte slice and produces an
+// MfgManifest object.  The result is not validated; see Validate.
 func ParseMfgManifest(jsonText []byte) (MfgManifest, error) {
 	m := MfgManifest{
 		// Backwards compatibility: assume 0xff if unspecified.
@@ -107,6 +109,58 @@ func ReadMfgManifest(path string) (MfgManifest, error) {
 	return m, nil
 }
 
+// The only mfg manifest format version this package supports.
+const MFG_MANIFEST_FORMAT = 2
+
+// Validate checks that an mfg manifest contains the fields required to
+// manufacture a device: a supported format version, at least one target, and
+// for each target a name, a non-negative offset, and an image or binary path.
+// All problems are reported in a single error.
+func (m *MfgManifest) Validate() error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if m.Format != MFG_MANIFEST_FORMAT {
+		addf("unsupported format: have=%d want=%d",
+			m.Format, MFG_MANIFEST_FORMAT)
+	}
+
+	if len(m.Targets) == 0 {
+		addf("no targets")
+	}
+
+	offsets := map[int]string{}
+	for i, t := range m.Targets {
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+			addf("target %s has no name", name)
+		}
+
+		if t.Offset < 0 {
+			addf("target %s has invalid offset: %d", name, t.Offset)
+		} else if other, ok := offsets[t.Offset]; ok {
+			addf("targets %s and %s have the same offset: %d",
+				other, name, t.Offset)
+		} else {
+			offsets[t.Offset] = name
+		}
+
+		if t.ImagePath == "" && t.BinPath == "" {
+			addf("target %s has neither image_path nor bin_path", name)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid mfg manifest:\n    %s",
+			strings.Join(problems, "\n    "))
+	}
+
+	return nil
+}
+
 // IsBoot indicates whether an mfg manifest target is a boot loader.
 func (mt *MfgManifestTarget) IsBoot() bool {
 	return mt.BinPath != ""
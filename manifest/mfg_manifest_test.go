@@ -0,0 +1,77 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMfgManifestValidate(t *testing.T) {
+	good := []byte(`{
+  "name": "targets/mfg",
+  "format": 2,
+  "targets": [
+    { "name": "targets/boot", "offset": 0, "bin_path": "boot.bin" },
+    { "name": "targets/app", "offset": 32768, "image_path": "app.img" }
+  ]
+}`)
+
+	m, err := ParseMfgManifest(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("valid mfg manifest rejected: %s", err.Error())
+	}
+
+	bad := []byte(`{
+  "name": "targets/mfg",
+  "format": 1,
+  "targets": [
+    { "name": "targets/boot", "offset": 0, "bin_path": "boot.bin" },
+    { "name": "", "offset": 0 }
+  ]
+}`)
+
+	m, err = ParseMfgManifest(bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Validate()
+	if err == nil {
+		t.Fatalf("invalid mfg manifest accepted")
+	}
+
+	// All problems are reported.
+	for _, s := range []string{
+		"unsupported format", "has no name", "same offset", "neither",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("error missing \"%s\": %s", s, err.Error())
+		}
+	}
+
+	m.Targets = nil
+	m.Format = MFG_MANIFEST_FORMAT
+	if err := m.Validate(); err == nil {
+		t.Fatalf("mfg manifest without targets accepted")
+	}
+}
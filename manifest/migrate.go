@@ -0,0 +1,92 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// The manifest schema version produced by Migrate().
+const MANIFEST_SCHEMA_VERSION = 2
+
+// manifestMigrations maps each schema version to a function that upgrades a
+// manifest from that version to the next one.
+var manifestMigrations = map[int]func(m *Manifest) error{
+	1: migrateV1,
+}
+
+// migrateV1 upgrades a version 1 manifest to version 2.  Version 1 manifests
+// may lack the `image_hash` field (the hash was recorded only as `id`) and
+// may omit empty collections.
+func migrateV1(m *Manifest) error {
+	if m.ImageHash == "" {
+		m.ImageHash = m.BuildID
+	}
+	if m.Pkgs == nil {
+		m.Pkgs = []*ManifestPkg{}
+	}
+	if m.Repos == nil {
+		m.Repos = []*ManifestRepo{}
+	}
+	if m.Syscfg == nil {
+		m.Syscfg = map[string]string{}
+	}
+
+	m.SchemaVersion = 2
+	return nil
+}
+
+// EffectiveSchemaVersion returns the schema version of a manifest.  Manifests
+// without a `schema_version` field are version 1.
+func (m *Manifest) EffectiveSchemaVersion() int {
+	if m.SchemaVersion == 0 {
+		return 1
+	}
+	return m.SchemaVersion
+}
+
+// Migrate upgrades a manifest to the latest schema version
+// (MANIFEST_SCHEMA_VERSION).  The original manifest is not modified.  An
+// error is returned if the manifest's schema version is unknown.
+func (m *Manifest) Migrate() (Manifest, error) {
+	dup := *m
+
+	ver := dup.EffectiveSchemaVersion()
+	if ver < 1 || ver > MANIFEST_SCHEMA_VERSION {
+		return dup, errors.Errorf(
+			"unknown manifest schema version: have=%d max=%d",
+			ver, MANIFEST_SCHEMA_VERSION)
+	}
+
+	for ver < MANIFEST_SCHEMA_VERSION {
+		migrate := manifestMigrations[ver]
+		if migrate == nil {
+			return dup, errors.Errorf(
+				"no migration from manifest schema version %d", ver)
+		}
+		if err := migrate(&dup); err != nil {
+			return dup, errors.Wrapf(err,
+				"failed to migrate manifest from schema version %d", ver)
+		}
+		ver = dup.EffectiveSchemaVersion()
+	}
+
+	return dup, nil
+}
@@ -0,0 +1,81 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	v1 := `{
+		"name": "targets/blinky",
+		"build_version": "1.2.3.4",
+		"id": "0123456789abcdef"
+	}`
+
+	var m Manifest
+	if err := json.Unmarshal([]byte(v1), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.EffectiveSchemaVersion() != 1 {
+		t.Fatalf("wrong schema version: have=%d want=1",
+			m.EffectiveSchemaVersion())
+	}
+
+	m2, err := m.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SchemaVersion != 0 || m.ImageHash != "" {
+		t.Fatalf("Migrate() modified original manifest")
+	}
+	if m2.ImageHash != m.BuildID {
+		t.Fatalf("image hash not filled in: have=%s want=%s",
+			m2.ImageHash, m.BuildID)
+	}
+
+	b, err := json.Marshal(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["schema_version"] != float64(MANIFEST_SCHEMA_VERSION) {
+		t.Fatalf("migrated manifest has wrong schema_version: %v",
+			raw["schema_version"])
+	}
+
+	// Migrating an up-to-date manifest is a no-op.
+	m3, err := m2.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m3.SchemaVersion != MANIFEST_SCHEMA_VERSION {
+		t.Fatalf("wrong schema version: have=%d", m3.SchemaVersion)
+	}
+
+	m.SchemaVersion = 99
+	if _, err := m.Migrate(); err == nil {
+		t.Fatalf("unknown schema version accepted")
+	}
+}
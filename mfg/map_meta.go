@@ -24,15 +24,20 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/apache/mynewt-artifact/errors"
 )
 
-func (t *MetaTlv) bodyMap() (map[string]interface{}, error) {
+func (t *MetaTlv) bodyMap(order binary.ByteOrder) (map[string]interface{},
+	error) {
+
 	r := bytes.NewReader(t.Data)
 
 	readBody := func(dst interface{}) error {
-		if err := binary.Read(r, binary.LittleEndian, dst); err != nil {
+		if err := binary.Read(r, order, dst); err != nil {
 			return errors.Wrapf(err, "error parsing TLV data")
 		}
 		return nil
@@ -86,8 +91,17 @@ func (b *MetaTlvBodyMmrRef) Map() map[string]interface{} {
 	}
 }
 
-// Map produces a JSON-friendly map representation of an MMR TLV.
+// Map produces a JSON-friendly map representation of an MMR TLV.  The TLV
+// data is decoded as little-endian.
 func (t *MetaTlv) Map(index int, offset int) map[string]interface{} {
+	return t.MapOrder(index, offset, binary.LittleEndian)
+}
+
+// MapOrder is like Map, but decodes the TLV data with the specified byte
+// order.
+func (t *MetaTlv) MapOrder(index int, offset int,
+	order binary.ByteOrder) map[string]interface{} {
+
 	hmap := map[string]interface{}{
 		"_type_name": MetaTlvTypeName(t.Header.Type),
 		"type":       t.Header.Type,
@@ -96,7 +110,7 @@ func (t *MetaTlv) Map(index int, offset int) map[string]interface{} {
 
 	var body interface{}
 
-	bmap, err := t.bodyMap()
+	bmap, err := t.bodyMap(order)
 	if err != nil {
 		body = hex.EncodeToString(t.Data)
 	} else {
@@ -128,7 +142,7 @@ func (m *Meta) Map(endOffset int) map[string]interface{} {
 
 	tlvs := []map[string]interface{}{}
 	for i, t := range m.Tlvs {
-		tlv := t.Map(i, startOffset+offsets.Tlvs[i])
+		tlv := t.MapOrder(i, startOffset+offsets.Tlvs[i], m.byteOrder())
 		tlvs = append(tlvs, tlv)
 	}
 
@@ -154,3 +168,52 @@ func (m *Meta) Json(offset int) (string, error) {
 
 	return string(bin), nil
 }
+
+// Maximum number of characters of a decoded TLV value shown by Meta.String.
+const metaStringValMax = 16
+
+// summary produces a short single-line description of an MMR TLV's data,
+// derived from its map representation.
+func (t *MetaTlv) summary(order binary.ByteOrder) string {
+	bmap, err := t.bodyMap(order)
+	if err != nil {
+		return "data=" + hex.EncodeToString(t.Data)
+	}
+
+	var keys []string
+	for k, _ := range bmap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var fields []string
+	for _, k := range keys {
+		val := fmt.Sprintf("%v", bmap[k])
+		if len(val) > metaStringValMax {
+			val = val[:metaStringValMax] + "..."
+		}
+		fields = append(fields, k+"="+val)
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// String produces a human-readable description of an MMR: one line per TLV
+// followed by the footer.  Offsets are relative to the start of the MMR.  The
+// output is intended for display, not parsing; use Json for the latter.
+func (m *Meta) String() string {
+	offsets := m.Offsets()
+
+	var lines []string
+	for i, t := range m.Tlvs {
+		lines = append(lines, fmt.Sprintf("[%d] off=%d %s size=%d: %s",
+			i, offsets.Tlvs[i], MetaTlvTypeName(t.Header.Type),
+			t.Header.Size, t.summary(m.byteOrder())))
+	}
+
+	lines = append(lines, fmt.Sprintf(
+		"footer off=%d: size=%d version=%d magic=0x%08x",
+		offsets.Footer, m.Footer.Size, m.Footer.Version, m.Footer.Magic))
+
+	return strings.Join(lines, "\n")
+}
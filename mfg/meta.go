@@ -112,12 +112,19 @@ type MetaTlv struct {
 }
 
 type Meta struct {
+	// TLVs in on-disk order: Tlvs[0] is the first TLV in the MMR (the one at
+	// the lowest offset).  Parsing and serialization preserve this order.
 	Tlvs   []MetaTlv
 	Footer MetaFooter
+
+	// Byte order of the MMR's multi-byte fields.  Nil means little-endian.
+	ByteOrder binary.ByteOrder
 }
 
+// MetaOffsets holds the offsets of an MMR's elements, relative to the start
+// of the MMR.
 type MetaOffsets struct {
-	Tlvs      []int
+	Tlvs      []int // Tlvs[i] is the offset of Meta.Tlvs[i].
 	Footer    int
 	TotalSize int
 }
@@ -136,37 +143,111 @@ func MetaTlvTypeName(typ uint8) string {
 	return name
 }
 
-func writeElem(elem interface{}, w io.Writer) error {
-	/* XXX: Assume target platform uses little endian. */
-	if err := binary.Write(w, binary.LittleEndian, elem); err != nil {
+// byteOrder returns the byte order of an MMR's multi-byte fields.
+func (meta *Meta) byteOrder() binary.ByteOrder {
+	if meta.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return meta.ByteOrder
+}
+
+// countWriter counts the bytes successfully written to an underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func writeElem(elem interface{}, order binary.ByteOrder, w io.Writer) error {
+	if err := binary.Write(w, order, elem); err != nil {
 		return errors.Wrapf(err, "failed to write MMR element")
 	}
 	return nil
 }
 
-func (tlv *MetaTlv) Write(w io.Writer) (int, error) {
-	sz := 0
+// EncodeMetaTlv writes an MMR TLV in its on-disk form: the 2-byte header
+// (type and 8-bit data size) followed by the data.  The header's size must
+// agree with the data.  TLV headers and data are byte arrays, so the MMR's
+// byte order does not apply.
+func EncodeMetaTlv(w io.Writer, tlv MetaTlv) error {
+	if len(tlv.Data) > 0xff {
+		return errors.Errorf("MMR TLV data too long: type=%s len=%d max=%d",
+			MetaTlvTypeName(tlv.Header.Type), len(tlv.Data), 0xff)
+	}
+	if int(tlv.Header.Size) != len(tlv.Data) {
+		return errors.Errorf(
+			"MMR TLV size mismatch: type=%s header_size=%d data_len=%d",
+			MetaTlvTypeName(tlv.Header.Type), tlv.Header.Size, len(tlv.Data))
+	}
+
+	if err := writeElem(tlv.Header, binary.LittleEndian, w); err != nil {
+		return err
+	}
 
-	if err := writeElem(tlv.Header, w); err != nil {
-		return sz, err
+	if err := writeElem(tlv.Data, binary.LittleEndian, w); err != nil {
+		return err
 	}
-	sz += META_TLV_HEADER_SZ
 
-	if err := writeElem(tlv.Data, w); err != nil {
-		return sz, err
+	return nil
+}
+
+func (tlv *MetaTlv) Write(w io.Writer) (int, error) {
+	if err := EncodeMetaTlv(w, *tlv); err != nil {
+		return 0, err
 	}
-	sz += len(tlv.Data)
 
-	return sz, nil
+	return META_TLV_HEADER_SZ + len(tlv.Data), nil
+}
+
+// Bytes serializes a TLV as it appears in an MMR: the two-byte header
+// followed by the data.  The result is identical to what Write produces.
+func (tlv *MetaTlv) Bytes() []byte {
+	b := &bytes.Buffer{}
+	tlv.Write(b)
+	return b.Bytes()
+}
+
+// RawData returns a copy of a TLV's data, not including its header.
+func (tlv *MetaTlv) RawData() []byte {
+	return append([]byte(nil), tlv.Data...)
+}
+
+// Valid indicates whether a footer is plausibly that of an MMR: its magic is
+// correct, its version is supported, and its size accounts for at least the
+// footer itself.  The MMR's byte order must already have been applied when
+// the footer was decoded.
+func (f *MetaFooter) Valid() bool {
+	mf := DefaultMetaFormat()
+	return mf.Valid(f)
+}
+
+// Recompute updates a footer's size field to reflect an MMR containing
+// tlvsLen bytes of TLVs (headers included).
+func (f *MetaFooter) Recompute(tlvsLen int) {
+	f.Size = uint16(tlvsLen + META_FOOTER_SZ)
 }
 
 // StructuredBody constructs the appropriate "body" object from a raw TLV
-// (e.g., MetaTlvBodyHash from a TLV with type=META_TLV_TYPE_HASH).
+// (e.g., MetaTlvBodyHash from a TLV with type=META_TLV_TYPE_HASH).  The TLV
+// data is decoded as little-endian.
 func (tlv *MetaTlv) StructuredBody() (interface{}, error) {
+	return tlv.StructuredBodyOrder(binary.LittleEndian)
+}
+
+// StructuredBodyOrder is like StructuredBody, but decodes the TLV data with
+// the specified byte order.
+func (tlv *MetaTlv) StructuredBodyOrder(
+	order binary.ByteOrder) (interface{}, error) {
+
 	r := bytes.NewReader(tlv.Data)
 
 	readBody := func(dst interface{}) error {
-		if err := binary.Read(r, binary.LittleEndian, dst); err != nil {
+		if err := binary.Read(r, order, dst); err != nil {
 			return errors.Wrapf(err, "error parsing TLV data")
 		}
 		return nil
@@ -214,7 +295,7 @@ func (meta *Meta) WritePlusOffsets(w io.Writer) (MetaOffsets, error) {
 		sz += tlvSz
 	}
 
-	if err := writeElem(meta.Footer, w); err != nil {
+	if err := writeElem(meta.Footer, meta.byteOrder(), w); err != nil {
 		return mo, err
 	}
 	mo.Footer = sz
@@ -247,11 +328,45 @@ func (meta *Meta) Size() int {
 	return meta.Offsets().TotalSize
 }
 
-// Bytes serializes an MMR to binary form.
+// tlvsSize calculates the serialized length of an MMR's TLVs, including
+// their headers.
+func (meta *Meta) tlvsSize() int {
+	sz := 0
+	for _, tlv := range meta.Tlvs {
+		sz += META_TLV_HEADER_SZ + len(tlv.Data)
+	}
+
+	return sz
+}
+
+// TotalSize calculates the serialized length of an MMR: all TLVs plus the
+// footer.  Unlike Size(), this does not depend on a serialization pass.
+func (meta *Meta) TotalSize() int {
+	return meta.tlvsSize() + META_FOOTER_SZ
+}
+
+// WriteTo implements io.WriterTo.  It streams an MMR's binary form to the
+// given writer without an intermediate buffer.  As with Bytes(), the
+// serialized footer's size field is recomputed from the TLV content; the Meta
+// object itself is not modified.  On success, the returned count equals
+// TotalSize(); on failure, it is the number of bytes actually written.
+func (meta *Meta) WriteTo(w io.Writer) (int64, error) {
+	dup := *meta
+	dup.Footer.Recompute(meta.tlvsSize())
+
+	cw := &countWriter{w: w}
+	_, err := dup.Write(cw)
+
+	return cw.n, err
+}
+
+// Bytes serializes an MMR to binary form.  The serialized footer's size field
+// is recomputed so that it always matches the TLV content; the Meta object
+// itself is not modified (see MetaFooter.Recompute).
 func (meta *Meta) Bytes() ([]byte, error) {
 	b := &bytes.Buffer{}
 
-	_, err := meta.Write(b)
+	_, err := meta.WriteTo(b)
 	if err != nil {
 		return nil, err
 	}
@@ -273,7 +388,8 @@ func (meta *Meta) FindTlvIndices(typ uint8) []int {
 	return indices
 }
 
-// FindTlvIndices searches an MMR for all TLVs of the specified type.
+// FindTlvs searches an MMR for all TLVs of the specified type.  The returned
+// pointers refer to the MMR's TLVs, so modifications are reflected in the MMR.
 func (meta *Meta) FindTlvs(typ uint8) []*MetaTlv {
 	indices := meta.FindTlvIndices(typ)
 
@@ -285,14 +401,23 @@ func (meta *Meta) FindTlvs(typ uint8) []*MetaTlv {
 	return tlvs
 }
 
-// FindTlvIndices searches an MMR for the first TLV of the specified type.
-func (meta *Meta) FindFirstTlv(typ uint8) *MetaTlv {
-	tlvs := meta.FindTlvs(typ)
-	if len(tlvs) == 0 {
-		return nil
+// FindTlv searches an MMR for the first TLV of the specified type.  The bool
+// return value is false if the MMR has no such TLV.
+func (meta *Meta) FindTlv(typ uint8) (*MetaTlv, bool) {
+	for i, _ := range meta.Tlvs {
+		if meta.Tlvs[i].Header.Type == typ {
+			return &meta.Tlvs[i], true
+		}
 	}
 
-	return tlvs[0]
+	return nil, false
+}
+
+// FindFirstTlv searches an MMR for the first TLV of the specified type.  It
+// returns nil if the MMR has no such TLV.
+func (meta *Meta) FindFirstTlv(typ uint8) *MetaTlv {
+	tlv, _ := meta.FindTlv(typ)
+	return tlv
 }
 
 // HashOffset calculates the offset of the SHA256 TLV in an MMR if it were
@@ -325,6 +450,63 @@ func (meta *Meta) Hash() []byte {
 	return tlv.Data
 }
 
+// ValidateFlashAreas checks each flash area TLV in an MMR against the sizes of
+// the flash devices it refers to.  deviceSizes maps device number to device
+// size in bytes; areas on devices absent from the map are not checked.  One
+// error is returned for each malformed or out-of-bounds area.
+func (meta *Meta) ValidateFlashAreas(deviceSizes map[int]int) []error {
+	var errs []error
+
+	for _, tlv := range meta.FindTlvs(META_TLV_TYPE_FLASH_AREA) {
+		body, err := tlv.StructuredBodyOrder(meta.byteOrder())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fa := body.(*MetaTlvBodyFlashArea)
+
+		devSize, ok := deviceSizes[int(fa.Device)]
+		if !ok {
+			continue
+		}
+
+		end := uint64(fa.Offset) + uint64(fa.Size)
+		if end > uint64(devSize) {
+			errs = append(errs, errors.Errorf(
+				"flash area %d extends beyond end of device %d: "+
+					"offset=%d size=%d device_size=%d",
+				fa.Area, fa.Device, fa.Offset, fa.Size, devSize))
+		}
+	}
+
+	return errs
+}
+
+// UpgradeFooter rewrites an MMR's footer in the layout of the specified
+// version.  All TLVs are preserved, and the footer's size and version fields
+// are recalculated.  Downgrading to an older version and upgrading to an
+// unsupported one are rejected.  Versions 1 and 2 share a footer layout, so
+// upgrading from version 1 changes only the footer fields.
+func (meta *Meta) UpgradeFooter(toVersion uint8) error {
+	if !MetaVersionIsSupported(toVersion) {
+		return errors.Errorf(
+			"cannot upgrade MMR footer: unsupported version: %d", toVersion)
+	}
+
+	if toVersion < meta.Footer.Version {
+		return errors.Errorf(
+			"cannot downgrade MMR footer: have=%d want=%d",
+			meta.Footer.Version, toVersion)
+	}
+
+	meta.Footer.Version = toVersion
+	meta.Footer.Pad8 = 0xff
+	meta.Footer.Magic = META_MAGIC
+	meta.Footer.Recompute(meta.tlvsSize())
+
+	return nil
+}
+
 // Clone performs a deep copy of an MMR.
 func (meta *Meta) Clone() Meta {
 	tlvs := make([]MetaTlv, len(meta.Tlvs))
@@ -337,7 +519,8 @@ func (meta *Meta) Clone() Meta {
 	}
 
 	return Meta{
-		Tlvs:   tlvs,
-		Footer: meta.Footer,
+		Tlvs:      tlvs,
+		Footer:    meta.Footer,
+		ByteOrder: meta.ByteOrder,
 	}
 }
@@ -20,7 +20,10 @@
 package mfg
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"sort"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/flash"
@@ -32,6 +35,10 @@ const MFG_BIN_IMG_FILENAME = "mfgimg.bin"
 const MFG_HEX_IMG_FILENAME = "mfgimg.hex"
 const MANIFEST_FILENAME = "manifest.json"
 
+// The erased-flash value of typical NOR flash; the conventional fill byte for
+// the gaps in an mfgimage.
+const MFG_DEFAULT_ERASE_VAL = 0xff
+
 type Mfg struct {
 	Bin  []byte
 	Meta *Meta
@@ -64,6 +71,45 @@ func AddPadding(b []byte, eraseVal byte, padLen int) []byte {
 	return b
 }
 
+// MfgPart is a binary, such as a boot loader or image, to be placed at a fixed
+// offset within an mfgimage.
+type MfgPart struct {
+	Offset int
+	Data   []byte
+}
+
+// BuildBin lays out a set of parts into an mfgimage binary.  Gaps between
+// parts are filled with eraseVal, the erased-flash value of the target device
+// (usually MFG_DEFAULT_ERASE_VAL; some external flashes erase to 0x00).  The
+// binary ends at the end of the last part.  The fill is part of the mfg hash,
+// so it must be applied here rather than after the hash is calculated (see
+// Mfg.Finalize).  An error is returned if any parts overlap.
+func BuildBin(parts []MfgPart, eraseVal byte) ([]byte, error) {
+	sorted := make([]MfgPart, len(parts))
+	copy(sorted, parts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	var bin []byte
+	for _, p := range sorted {
+		if p.Offset < 0 {
+			return nil, errors.Errorf(
+				"invalid mfg part offset: %d", p.Offset)
+		}
+		if p.Offset < len(bin) {
+			return nil, errors.Errorf(
+				"mfg parts overlap; offset=%d prev_end=%d",
+				p.Offset, len(bin))
+		}
+
+		bin = AddPadding(bin, eraseVal, p.Offset-len(bin))
+		bin = append(bin, p.Data...)
+	}
+
+	return bin, nil
+}
+
 // Calculates the SHA256 hash, using the full manufacturing image as input.
 // Hash-calculation algorithm is as follows:
 // 1. Zero out the 32 bytes that will contain the hash.
@@ -116,6 +162,146 @@ func (m *Mfg) RefillHash(eraseVal byte) error {
 	return nil
 }
 
+// HashExclusion is a range of bytes within an mfgimage that is zeroed before
+// the mfg hash is calculated.
+type HashExclusion struct {
+	Offset int
+	Size   int
+}
+
+// HashExclusions returns the default set of byte ranges excluded from the
+// mfg hash: just the data of the MMR's hash TLV.  Callers verifying an
+// mfgimage format that excludes additional regions (e.g., a signature area)
+// should append to this list and pass the result to VerifyHashExcluding.
+func (m *Mfg) HashExclusions() ([]HashExclusion, error) {
+	if m.Meta == nil {
+		return nil, errors.Errorf("mfgimage has no MMR")
+	}
+
+	hashOff := m.Meta.HashOffset()
+	if hashOff < 0 {
+		return nil, errors.Errorf("MMR has no hash TLV")
+	}
+
+	return []HashExclusion{{
+		Offset: m.MetaOff + hashOff,
+		Size:   META_HASH_SZ,
+	}}, nil
+}
+
+// VerifyHash checks an mfgimage's SHA256 TLV against the contents of the
+// full binary.  The hash is calculated the same way the manufacturing tool
+// calculates it: the bytes of the hash TLV's data are zeroed in a copy of the
+// serialized mfgimage, and SHA256 is applied to the result.  An error is
+// returned if the mfgimage has no hash TLV or if the hash is incorrect; on
+// mismatch the error reports both digests.
+func (m *Mfg) VerifyHash() error {
+	excl, err := m.HashExclusions()
+	if err != nil {
+		return errors.Wrapf(err, "cannot verify mfg hash")
+	}
+
+	return m.VerifyHashExcluding(excl)
+}
+
+// serializedBin returns a copy of an mfgimage's binary with its MMR
+// re-serialized in place, so that the result reflects any changes made to the
+// Meta object.
+func (m *Mfg) serializedBin() ([]byte, error) {
+	metaBytes, err := m.Meta.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	metaEnd := m.MetaOff + len(metaBytes)
+	if metaEnd > len(m.Bin) {
+		return nil, errors.Errorf(
+			"MMR extends beyond end of mfgimage; mmr_end=%d mfgimg_len=%d",
+			metaEnd, len(m.Bin))
+	}
+
+	bin := make([]byte, len(m.Bin))
+	copy(bin, m.Bin)
+	copy(bin[m.MetaOff:metaEnd], metaBytes)
+
+	return bin, nil
+}
+
+// zeroExclusions zeroes each of the specified byte ranges in bin.
+func zeroExclusions(bin []byte, excl []HashExclusion) error {
+	for _, e := range excl {
+		if e.Offset < 0 || e.Size < 0 || e.Offset+e.Size > len(bin) {
+			return errors.Errorf(
+				"excluded region out of range; offset=%d size=%d mfgimg_len=%d",
+				e.Offset, e.Size, len(bin))
+		}
+		for i := e.Offset; i < e.Offset+e.Size; i++ {
+			bin[i] = 0
+		}
+	}
+
+	return nil
+}
+
+// HashCoverage returns exactly the bytes that the mfg hash is calculated
+// over: a copy of the full mfgimage binary, with the MMR as currently
+// described by the Meta object, in which the 32 data bytes of the MMR's hash
+// TLV are zeroed.  The TLV's two-byte header is not zeroed, nor is anything
+// else.  Applying SHA256 to the result yields the value VerifyHash expects in
+// the hash TLV.  An error is returned if the mfgimage has no hash TLV.
+func (m *Mfg) HashCoverage() ([]byte, error) {
+	excl, err := m.HashExclusions()
+	if err != nil {
+		return nil, err
+	}
+
+	bin, err := m.serializedBin()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := zeroExclusions(bin, excl); err != nil {
+		return nil, err
+	}
+
+	return bin, nil
+}
+
+// VerifyHashExcluding is like VerifyHash, but zeroes the specified byte
+// ranges rather than the default set (see HashExclusions) before calculating
+// the hash.  The list should normally include the hash TLV's data.
+func (m *Mfg) VerifyHashExcluding(excl []HashExclusion) error {
+	if m.Meta == nil {
+		return errors.Errorf("cannot verify mfg hash: mfgimage has no MMR")
+	}
+
+	hashOff := m.Meta.HashOffset()
+	if hashOff < 0 {
+		return errors.Errorf("cannot verify mfg hash: MMR has no hash TLV")
+	}
+	hashOff += m.MetaOff
+
+	bin, err := m.serializedBin()
+	if err != nil {
+		return errors.Wrapf(err, "cannot verify mfg hash")
+	}
+
+	have := make([]byte, META_HASH_SZ)
+	copy(have, bin[hashOff:hashOff+META_HASH_SZ])
+
+	if err := zeroExclusions(bin, excl); err != nil {
+		return errors.Wrapf(err, "cannot verify mfg hash")
+	}
+
+	want := CalcHash(bin)
+	if !bytes.Equal(have, want) {
+		return errors.Errorf(
+			"mmr contains incorrect hash: have=%x want=%x", have, want)
+	}
+
+	return nil
+}
+
 // Hash retrieves the SHA256 value associated with an mfgimage.  If the
 // mfgimage has an MMR with a SHA256 TLV, the TLV's value is returned.
 // Otherwise, the hash is calculated and returned.
@@ -158,6 +344,78 @@ func (m *Mfg) Bytes(eraseVal byte) ([]byte, error) {
 	return binCopy, nil
 }
 
+// Finalize produces the final serialized form of an mfgimage whose MMR
+// contains a hash TLV.  The hash TLV is refilled with the hash of the binary
+// laid out with the TLV's data zeroed (see RefillHash), and the result is
+// serialized.  The mfgimage's binary is padded with eraseVal if it does not
+// extend to the end of the MMR, so that VerifyHash passes both for the
+// mfgimage and for the returned binary.
+func (m *Mfg) Finalize(eraseVal byte) ([]byte, error) {
+	if m.Meta == nil {
+		return nil, errors.Errorf("cannot finalize mfgimage: no MMR")
+	}
+
+	tlv := m.Meta.FindFirstTlv(META_TLV_TYPE_HASH)
+	if tlv == nil {
+		return nil, errors.Errorf(
+			"cannot finalize mfgimage: MMR has no hash TLV")
+	}
+	if len(tlv.Data) != META_HASH_SZ {
+		return nil, errors.Errorf(
+			"cannot finalize mfgimage: hash TLV has wrong size; "+
+				"have=%d want=%d", len(tlv.Data), META_HASH_SZ)
+	}
+
+	if err := m.RefillHash(eraseVal); err != nil {
+		return nil, err
+	}
+
+	bin, err := m.Bytes(eraseVal)
+	if err != nil {
+		return nil, err
+	}
+
+	if padLen := len(bin) - len(m.Bin); padLen > 0 {
+		m.Bin = AddPadding(m.Bin, eraseVal, padLen)
+	}
+
+	return bin, nil
+}
+
+// SetMeta replaces an mfgimage's MMR with a copy of the one provided.  The new
+// MMR is positioned such that it ends where the existing MMR ends; its
+// footer's size field is recalculated.  An error is returned if the mfgimage
+// has no MMR or if the new MMR is larger than the existing region.  If the new
+// MMR contains a hash TLV, it is refilled with the resulting mfg hash.
+func (m *Mfg) SetMeta(meta *Meta, eraseVal byte) error {
+	if m.Meta == nil {
+		return errors.Errorf("cannot set MMR: mfgimage has no MMR region")
+	}
+
+	dup := meta.Clone()
+	dup.Footer.Recompute(dup.tlvsSize())
+
+	oldSz := int(m.Meta.Footer.Size)
+	newSz := int(dup.Footer.Size)
+	if newSz > oldSz {
+		return errors.Errorf(
+			"cannot set MMR: new MMR too large for region; have=%d max=%d",
+			newSz, oldSz)
+	}
+
+	// Erase the old region; the new MMR gets spliced in during
+	// serialization.
+	endOff := m.MetaOff + oldSz
+	for i := m.MetaOff; i < endOff && i < len(m.Bin); i++ {
+		m.Bin[i] = eraseVal
+	}
+
+	m.Meta = &dup
+	m.MetaOff = endOff - newSz
+
+	return m.RefillHash(eraseVal)
+}
+
 // Clone performs a deep copy of an mfgimage.
 func (m *Mfg) Clone() Mfg {
 	var meta *Meta
@@ -203,6 +461,14 @@ func (m *Mfg) ExtractFlashArea(area flash.FlashArea,
 	return b[area.Offset:end], nil
 }
 
+// byteOrder returns the byte order of an mfgimage's MMR.
+func (m *Mfg) byteOrder() binary.ByteOrder {
+	if m.Meta == nil {
+		return binary.LittleEndian
+	}
+	return m.Meta.byteOrder()
+}
+
 // Tlvs retrieves the slice of TLVs present in an mfgimage's MMR.  It returns
 // nil if the mfgimage has no MMR.
 func (m *Mfg) Tlvs() []MetaTlv {
@@ -213,6 +479,26 @@ func (m *Mfg) Tlvs() []MetaTlv {
 	}
 }
 
+// UnknownTlvTypes returns the distinct types of all TLVs in an mfgimage's MMR
+// that this package does not recognize, in ascending order.  The result is
+// informational only; unknown TLVs are preserved as raw data.
+func (m *Mfg) UnknownTlvTypes() []uint8 {
+	seen := map[uint8]struct{}{}
+	for _, tlv := range m.Tlvs() {
+		if _, ok := metaTlvTypeNameMap[tlv.Header.Type]; !ok {
+			seen[tlv.Header.Type] = struct{}{}
+		}
+	}
+
+	var types []uint8
+	for typ, _ := range seen {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
 func (m *Mfg) extractImage(area flash.FlashArea, eraseVal byte) (image.Image, error) {
 	bin, err := m.ExtractFlashArea(area, eraseVal)
 	if err != nil {
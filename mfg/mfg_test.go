@@ -20,10 +20,19 @@
 package mfg
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/imagetest"
 	"github.com/apache/mynewt-artifact/manifest"
 	"github.com/apache/mynewt-artifact/sec"
 )
@@ -146,6 +155,430 @@ func testOne(t *testing.T, e entry) {
 	}
 }
 
+func TestMfgSetMeta(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the last TLV; the MMR should shrink and remain valid.
+	meta := m.Meta.Clone()
+	meta.Tlvs = meta.Tlvs[:len(meta.Tlvs)-1]
+	if err := m.SetMeta(&meta, man.EraseVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.MetaOff+int(m.Meta.Footer.Size) != man.Meta.EndOffset {
+		t.Fatalf("MMR has wrong end offset: have=%d want=%d",
+			m.MetaOff+int(m.Meta.Footer.Size), man.Meta.EndOffset)
+	}
+
+	bin, err := m.Bytes(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2, err := Parse(bin, man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.VerifyStructure(man.EraseVal); err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.Meta.Tlvs) != len(meta.Tlvs) {
+		t.Fatalf("MMR has wrong TLV count: have=%d want=%d",
+			len(m2.Meta.Tlvs), len(meta.Tlvs))
+	}
+
+	// An MMR larger than the reserved region must be rejected.
+	big := m.Meta.Clone()
+	big.Tlvs = append(big.Tlvs, big.Tlvs...)
+	big.Tlvs = append(big.Tlvs, big.Tlvs...)
+	if err := m.SetMeta(&big, man.EraseVal); err == nil {
+		t.Fatalf("oversized MMR accepted")
+	}
+}
+
+func TestMetaFooterSize(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := m.Meta.Clone()
+	if int(meta.Footer.Size) != meta.TotalSize() {
+		t.Fatalf("parsed MMR has wrong size: have=%d want=%d",
+			meta.Footer.Size, meta.TotalSize())
+	}
+
+	origSize := meta.Footer.Size
+	check := func(desc string) {
+		b, err := meta.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := parseMeta(b)
+		if err != nil {
+			t.Fatalf("%s: %s", desc, err.Error())
+		}
+		if len(b) != meta.TotalSize() || int(parsed.Footer.Size) != len(b) {
+			t.Fatalf("%s: MMR footer size stale: footer=%d total=%d len=%d",
+				desc, parsed.Footer.Size, meta.TotalSize(), len(b))
+		}
+
+		// Serialization does not modify the Meta object.
+		if meta.Footer.Size != origSize {
+			t.Fatalf("%s: Bytes modified footer: have=%d want=%d",
+				desc, meta.Footer.Size, origSize)
+		}
+	}
+
+	meta.Tlvs = append(meta.Tlvs, meta.Tlvs[0])
+	check("after adding TLV")
+
+	meta.Tlvs = meta.Tlvs[:1]
+	check("after removing TLVs")
+
+	meta.Footer.Recompute(len(meta.Tlvs[0].Bytes()))
+	if int(meta.Footer.Size) != meta.TotalSize() {
+		t.Fatalf("Recompute produced wrong size: have=%d want=%d",
+			meta.Footer.Size, meta.TotalSize())
+	}
+}
+
+func TestMfgUnknownTlvTypes(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if types := m.UnknownTlvTypes(); len(types) != 0 {
+		t.Fatalf("unexpected unknown TLV types: %v", types)
+	}
+
+	m.Meta.Tlvs = append(m.Meta.Tlvs, MetaTlv{
+		Header: MetaTlvHeader{Type: 0x7f, Size: 1},
+		Data:   []byte{0},
+	})
+	if types := m.UnknownTlvTypes(); !bytes.Equal(types, []uint8{0x7f}) {
+		t.Fatalf("wrong unknown TLV types: have=%v want=[127]", types)
+	}
+}
+
+func TestMetaWriteTo(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := m.Meta.Clone()
+	meta.Tlvs = append(meta.Tlvs, meta.Tlvs[0])
+
+	var _ io.WriterTo = &meta
+
+	buf := &bytes.Buffer{}
+	n, err := meta.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(meta.TotalSize()) || int(n) != buf.Len() {
+		t.Fatalf("wrong WriteTo count: have=%d want=%d written=%d",
+			n, meta.TotalSize(), buf.Len())
+	}
+
+	b, err := meta.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), b) {
+		t.Fatalf("WriteTo and Bytes produce different MMRs")
+	}
+
+	// A failed write reports the bytes that made it out.
+	for _, limit := range []int{0, 1, len(b) - META_FOOTER_SZ, len(b) - 1} {
+		lw := &limitWriter{limit: limit}
+		n, err := meta.WriteTo(lw)
+		if err == nil {
+			t.Fatalf("limit %d: WriteTo succeeded", limit)
+		}
+		if n != int64(limit) || lw.buf.Len() != limit {
+			t.Fatalf("limit %d: wrong WriteTo count: have=%d written=%d",
+				limit, n, lw.buf.Len())
+		}
+	}
+}
+
+// limitWriter accepts up to limit bytes and fails thereafter.
+type limitWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	room := lw.limit - lw.buf.Len()
+	if len(p) <= room {
+		return lw.buf.Write(p)
+	}
+
+	lw.buf.Write(p[:room])
+	return room, io.ErrShortWrite
+}
+
+func TestMetaBigEndian(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leJson, err := m.Meta.Json(man.Meta.EndOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Convert the MMR to big-endian: the footer is handled during
+	// serialization; the multi-byte flash area fields are swapped here.
+	be := m.Clone()
+	be.Meta.ByteOrder = binary.BigEndian
+	for i, tlv := range be.Meta.Tlvs {
+		if tlv.Header.Type != META_TLV_TYPE_FLASH_AREA {
+			continue
+		}
+		d := be.Meta.Tlvs[i].Data
+		binary.BigEndian.PutUint32(d[2:], binary.LittleEndian.Uint32(d[2:]))
+		binary.BigEndian.PutUint32(d[6:], binary.LittleEndian.Uint32(d[6:]))
+	}
+
+	beBin, err := be.Bytes(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parse() erases the MMR from the slice it is given.
+	m2, err := Parse(append([]byte(nil), beBin...), man.Meta.EndOffset,
+		man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2.Meta.ByteOrder != binary.BigEndian {
+		t.Fatalf("big-endian MMR not detected")
+	}
+
+	// Flash area bodies decode identically in either byte order.
+	for i, tlv := range m2.Meta.Tlvs {
+		if tlv.Header.Type != META_TLV_TYPE_FLASH_AREA {
+			continue
+		}
+		beBody, err := tlv.StructuredBodyOrder(binary.BigEndian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leBody, err := m.Meta.Tlvs[i].StructuredBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(beBody, leBody) {
+			t.Fatalf("wrong big-endian flash area: have=%+v want=%+v",
+				beBody, leBody)
+		}
+	}
+
+	beJson, err := m2.Meta.Json(man.Meta.EndOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beJson != leJson {
+		t.Fatalf("big-endian MMR JSON differs:\nhave=%s\nwant=%s",
+			beJson, leJson)
+	}
+
+	bin2, err := m2.Bytes(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bin2, beBin) {
+		t.Fatalf("big-endian MMR does not round trip")
+	}
+}
+
+func TestMfgVerifyHash(t *testing.T) {
+	for _, basename := range []string{
+		"hash1-fm1-ext0-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign0",
+	} {
+		man := readManifest(basename)
+		m, err := Parse(readMfgData(basename), man.Meta.EndOffset,
+			man.EraseVal)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Verification leaves the Meta object untouched, even if its
+		// footer does not match the TLV content.
+		m.Meta.Footer.Size++
+		before := m.Meta.Clone()
+		if err := m.VerifyHash(); err != nil {
+			t.Fatalf("%s: %s", basename, err.Error())
+		}
+		if !reflect.DeepEqual(*m.Meta, before) {
+			t.Fatalf("%s: VerifyHash modified MMR", basename)
+		}
+		m.Meta.Footer.Size--
+
+		// Corrupt a byte outside the MMR; the hash must no longer match.
+		m.Bin[0] ^= 0xff
+		if err := m.VerifyHash(); err == nil {
+			t.Fatalf("%s: corrupt mfgimage passed hash check", basename)
+		}
+	}
+
+	basename := "hashx-fm1-ext0-tgts1-sign0"
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyHash(); err == nil {
+		t.Fatalf("%s: bad hash passed hash check", basename)
+	}
+}
+
+func TestMfgFinalize(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the binary, clobber the stored hash, and truncate the binary
+	// before the end of the MMR.
+	m.Bin[0] ^= 0xff
+	copy(m.Meta.Hash(), bytes.Repeat([]byte{0xee}, META_HASH_SZ))
+	m.Bin = m.Bin[:m.MetaOff]
+
+	bin, err := m.Finalize(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyHash(); err != nil {
+		t.Fatalf("finalized mfgimage failed hash check: %s", err.Error())
+	}
+
+	m2, err := Parse(bin, man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.VerifyHash(); err != nil {
+		t.Fatalf("finalized binary failed hash check: %s", err.Error())
+	}
+	if !bytes.Equal(m2.Meta.Hash(), m.Meta.Hash()) {
+		t.Fatalf("hash TLV not patched: have=%x want=%x",
+			m2.Meta.Hash(), m.Meta.Hash())
+	}
+}
+
+func TestBuildBin(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lay the mfgimage out again as two parts with a zero-filled gap.
+	gapOff := m.MetaOff / 2
+	gapEnd := gapOff + 16
+	parts := []MfgPart{
+		{Offset: gapEnd, Data: m.Bin[gapEnd:]},
+		{Offset: 0, Data: m.Bin[:gapOff]},
+	}
+	bin, err := BuildBin(parts, 0x00)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bin) != len(m.Bin) {
+		t.Fatalf("wrong length: have=%d want=%d", len(bin), len(m.Bin))
+	}
+	if !bytes.Equal(bin[gapOff:gapEnd], make([]byte, gapEnd-gapOff)) {
+		t.Fatalf("gap not filled: %x", bin[gapOff:gapEnd])
+	}
+
+	// The fill must be covered by the hash.
+	m.Bin = bin
+	if _, err := m.Finalize(0x00); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyHash(); err != nil {
+		t.Fatalf("hash check failed: %s", err.Error())
+	}
+	m.Bin[gapOff] = MFG_DEFAULT_ERASE_VAL
+	if err := m.VerifyHash(); err == nil {
+		t.Fatalf("hash check passed with modified fill")
+	}
+
+	parts = append(parts, MfgPart{Offset: gapOff - 1, Data: []byte{1, 2}})
+	if _, err := BuildBin(parts, 0x00); err == nil {
+		t.Fatalf("overlapping parts accepted")
+	}
+}
+
+func TestMfgVerifyHashExcluding(t *testing.T) {
+	basename := "hash1-fm1-ext0-tgts1-sign0"
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	excl, err := m.HashExclusions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(excl) != 1 || excl[0].Size != META_HASH_SZ {
+		t.Fatalf("wrong default exclusions: %+v", excl)
+	}
+
+	// Hash the image as a format that also excludes its first 16 bytes.
+	extra := HashExclusion{Offset: 0, Size: 16}
+	for i := 0; i < extra.Size; i++ {
+		m.Bin[i] = 0
+	}
+	if err := m.RefillHash(man.EraseVal); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < extra.Size; i++ {
+		m.Bin[i] = 0xa5
+	}
+
+	if err := m.VerifyHash(); err == nil {
+		t.Fatalf("modified mfgimage passed default hash check")
+	}
+	if err := m.VerifyHashExcluding(append(excl, extra)); err != nil {
+		t.Fatalf("hash check with exclusion failed: %s", err.Error())
+	}
+
+	bad := HashExclusion{Offset: len(m.Bin) - 1, Size: 2}
+	if err := m.VerifyHashExcluding(append(excl, bad)); err == nil {
+		t.Fatalf("out-of-range exclusion accepted")
+	}
+}
+
 func TestMfgVerify(t *testing.T) {
 	entries := []entry{
 		// Not an mfgimage.
@@ -234,3 +667,459 @@ func TestMfgVerify(t *testing.T) {
 		testOne(t, e)
 	}
 }
+
+func TestMetaTlvOrder(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	bin := readMfgData(basename)
+
+	// Parse erases the MMR from the binary; keep the original.
+	m, err := Parse(append([]byte(nil), bin...), man.Meta.EndOffset,
+		man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each TLV must be found at its reported offset, in on-disk order.
+	mo := m.Meta.Offsets()
+	if len(mo.Tlvs) != len(m.Meta.Tlvs) {
+		t.Fatalf("offset count mismatch: have=%d want=%d",
+			len(mo.Tlvs), len(m.Meta.Tlvs))
+	}
+	for i, tlv := range m.Meta.Tlvs {
+		if i > 0 && mo.Tlvs[i] <= mo.Tlvs[i-1] {
+			t.Fatalf("TLV offsets not ascending: %v", mo.Tlvs)
+		}
+
+		off := m.MetaOff + mo.Tlvs[i]
+		raw := tlv.Bytes()
+		if !bytes.Equal(bin[off:off+len(raw)], raw) ||
+			!bytes.Equal(raw[META_TLV_HEADER_SZ:], tlv.RawData()) {
+
+			t.Fatalf("TLV %d serialized incorrectly: %x", i, raw)
+		}
+		if bin[off] != tlv.Header.Type ||
+			!bytes.Equal(bin[off+META_TLV_HEADER_SZ:][:len(tlv.Data)],
+				tlv.Data) {
+
+			t.Fatalf("TLV %d (%s) not found at offset %d",
+				i, MetaTlvTypeName(tlv.Header.Type), off)
+		}
+	}
+
+	// Reversing the TLVs must survive a round trip.
+	meta := m.Meta.Clone()
+	for i, j := 0, len(meta.Tlvs)-1; i < j; i, j = i+1, j-1 {
+		meta.Tlvs[i], meta.Tlvs[j] = meta.Tlvs[j], meta.Tlvs[i]
+	}
+	b, err := meta.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseMeta(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range meta.Tlvs {
+		if parsed.Tlvs[i].Header.Type != meta.Tlvs[i].Header.Type ||
+			!bytes.Equal(parsed.Tlvs[i].Data, meta.Tlvs[i].Data) {
+
+			t.Fatalf("TLV %d reordered by round trip", i)
+		}
+	}
+}
+
+func TestMetaFindTlv(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlv, ok := m.Meta.FindTlv(META_TLV_TYPE_HASH)
+	if !ok || tlv.Header.Type != META_TLV_TYPE_HASH {
+		t.Fatalf("failed to find hash TLV")
+	}
+	if m.Meta.FindFirstTlv(META_TLV_TYPE_HASH) != tlv {
+		t.Fatalf("FindTlv and FindFirstTlv disagree")
+	}
+
+	areas := m.Meta.FindTlvs(META_TLV_TYPE_FLASH_AREA)
+	if len(areas) != len(man.FlashAreas) {
+		t.Fatalf("wrong flash area TLV count: have=%d want=%d",
+			len(areas), len(man.FlashAreas))
+	}
+
+	if _, ok := m.Meta.FindTlv(0xaa); ok {
+		t.Fatalf("found TLV with unknown type")
+	}
+}
+
+func TestMetaValidateFlashAreas(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devEnd := 0
+	for _, fa := range man.FlashAreas {
+		if fa.Device == man.Device && fa.Offset+fa.Size > devEnd {
+			devEnd = fa.Offset + fa.Size
+		}
+	}
+
+	if errs := m.Meta.ValidateFlashAreas(nil); len(errs) != 0 {
+		t.Fatalf("unknown devices not skipped: %v", errs)
+	}
+
+	sizes := map[int]int{man.Device: devEnd}
+	if errs := m.Meta.ValidateFlashAreas(sizes); len(errs) != 0 {
+		t.Fatalf("valid flash areas rejected: %v", errs)
+	}
+
+	sizes[man.Device] = devEnd - 1
+	if errs := m.Meta.ValidateFlashAreas(sizes); len(errs) == 0 {
+		t.Fatalf("out-of-bounds flash area accepted")
+	}
+}
+
+func TestMetaString(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := m.Meta.String()
+	lines := strings.Split(s, "\n")
+	if len(lines) != len(m.Meta.Tlvs)+1 {
+		t.Fatalf("wrong line count: have=%d want=%d\n%s",
+			len(lines), len(m.Meta.Tlvs)+1, s)
+	}
+
+	hashPrefix := hex.EncodeToString(m.Meta.Hash())[:metaStringValMax]
+	if !strings.Contains(s, "hash="+hashPrefix+"...") {
+		t.Fatalf("hash summary missing:\n%s", s)
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "footer") {
+		t.Fatalf("footer line missing:\n%s", s)
+	}
+}
+
+func TestMetaBadMagic(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	bin := readMfgData(basename)
+
+	m, err := Parse(append([]byte(nil), bin...), man.Meta.EndOffset,
+		man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Meta.Footer.Valid() {
+		t.Fatalf("valid footer reported invalid: %+v", m.Meta.Footer)
+	}
+
+	// Point at the wrong offset.
+	_, err = Parse(append([]byte(nil), bin...), man.Meta.EndOffset-4,
+		man.EraseVal)
+	if err == nil {
+		t.Fatalf("MMR parsed at wrong offset")
+	}
+	bad, ok := errors.Cause(err).(*ErrBadMetaMagic)
+	if !ok {
+		t.Fatalf("wrong error type: %v", err)
+	}
+	if len(bad.Have) != 4 {
+		t.Fatalf("wrong magic bytes reported: %x", bad.Have)
+	}
+
+	ftr := m.Meta.Footer
+	ftr.Magic++
+	if ftr.Valid() {
+		t.Fatalf("footer with bad magic reported valid")
+	}
+}
+
+func TestFindMeta(t *testing.T) {
+	for _, basename := range []string{
+		"hash1-fm1-ext0-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign0",
+	} {
+		man := readManifest(basename)
+		bin := readMfgData(basename)
+
+		meta, off, err := FindMeta(bin)
+		if err != nil {
+			t.Fatalf("%s: %s", basename, err.Error())
+		}
+
+		if off+int(meta.Footer.Size) != man.Meta.EndOffset {
+			t.Fatalf("%s: MMR found at wrong offset: have=%d want=%d",
+				basename, off+int(meta.Footer.Size), man.Meta.EndOffset)
+		}
+		if int(meta.Footer.Size) != man.Meta.Size {
+			t.Fatalf("%s: wrong MMR size: have=%d want=%d",
+				basename, meta.Footer.Size, man.Meta.Size)
+		}
+	}
+
+	// A lone magic number without a plausible MMR is ignored.
+	bin := make([]byte, 64)
+	binary.LittleEndian.PutUint32(bin[40:], META_MAGIC)
+	if _, _, err := FindMeta(bin); err == nil {
+		t.Fatalf("false-positive MMR accepted")
+	}
+}
+
+func TestMetaFooterVersion(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	end := man.Meta.EndOffset
+
+	for _, v := range []uint8{1, 2} {
+		bin := readMfgData(basename)
+		bin[end-6] = v
+		m, err := Parse(bin, end, man.EraseVal)
+		if err != nil {
+			t.Fatalf("version %d footer rejected: %s", v, err.Error())
+		}
+		if m.Meta.Footer.Version != v {
+			t.Fatalf("wrong footer version: have=%d want=%d",
+				m.Meta.Footer.Version, v)
+		}
+	}
+
+	bin := readMfgData(basename)
+	bin[end-6] = 9
+	_, err := Parse(bin, end, man.EraseVal)
+	if err == nil || !strings.Contains(err.Error(), "9") {
+		t.Fatalf("unsupported footer version not reported: %v", err)
+	}
+}
+
+func TestMetaUpgradeFooter(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	end := man.Meta.EndOffset
+
+	bin := readMfgData(basename)
+	bin[end-6] = 1
+	m, err := Parse(bin, end, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := m.Meta.Clone()
+
+	if err := meta.UpgradeFooter(9); err == nil {
+		t.Fatalf("upgrade to unsupported version accepted")
+	}
+
+	if err := meta.UpgradeFooter(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.UpgradeFooter(1); err == nil {
+		t.Fatalf("footer downgrade accepted")
+	}
+
+	// The upgraded MMR survives a round trip with its TLVs intact.
+	data, err := meta.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := parseMeta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded.Footer.Version != 2 ||
+		int(upgraded.Footer.Size) != len(data) {
+
+		t.Fatalf("wrong upgraded footer: %+v", upgraded.Footer)
+	}
+	if !reflect.DeepEqual(upgraded.Tlvs, m.Meta.Tlvs) {
+		t.Fatalf("TLVs not preserved by footer upgrade")
+	}
+}
+
+func TestParseCustomMetaFormat(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	end := man.Meta.EndOffset
+
+	// Stamp a fork's magic and version into the footer.
+	const customMagic = 0x5a5aa5a5
+	bin := readMfgData(basename)
+	bin[end-6] = 7
+	binary.LittleEndian.PutUint32(bin[end-4:], customMagic)
+
+	_, err := Parse(append([]byte(nil), bin...), end, man.EraseVal)
+	var bad *ErrBadMetaMagic
+	if !errors.As(err, &bad) || bad.Want != META_MAGIC {
+		t.Fatalf("custom magic accepted by default parser: %v", err)
+	}
+
+	mf := MetaFormat{Magic: customMagic, Versions: []uint8{7}}
+	m, err := ParseFormat(append([]byte(nil), bin...), end, man.EraseVal, mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Meta.Footer.Version != 7 || len(m.Meta.Tlvs) == 0 {
+		t.Fatalf("wrong custom MMR: %+v", m.Meta.Footer)
+	}
+
+	meta, off, err := FindMetaFormat(bin, mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != m.MetaOff || len(meta.Tlvs) != len(m.Meta.Tlvs) {
+		t.Fatalf("wrong MMR found: off=%d want=%d", off, m.MetaOff)
+	}
+
+	mf.Versions = []uint8{2}
+	if _, err := ParseFormat(bin, end, man.EraseVal, mf); err == nil {
+		t.Fatalf("unaccepted footer version parsed")
+	}
+}
+
+func TestVerifyAllImages(t *testing.T) {
+	path := fmt.Sprintf("%s/sign-key.pem", testdataPath)
+	key, err := sec.ReadPrivSignKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeImg := func(opts imagetest.ImageOpts) []byte {
+		img, err := imagetest.NewImage(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		if _, err := img.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	files := map[string][]byte{
+		"signed.img": writeImg(imagetest.ImageOpts{
+			SigKeys: []sec.PrivSignKey{key},
+		}),
+		"unsigned.img": writeImg(imagetest.ImageOpts{}),
+		"garbage.img":  []byte("not an image"),
+	}
+	resolve := func(path string) ([]byte, error) {
+		data, ok := files[path]
+		if !ok {
+			return nil, errors.Errorf("file not found: %s", path)
+		}
+		return data, nil
+	}
+
+	man := manifest.MfgManifest{
+		Targets: []manifest.MfgManifestTarget{
+			{Name: "boot", BinPath: "boot.bin"},
+			{Name: "good", ImagePath: "signed.img"},
+			{Name: "unsigned", ImagePath: "unsigned.img"},
+			{Name: "missing", ImagePath: "missing.img"},
+			{Name: "garbage", ImagePath: "garbage.img"},
+		},
+	}
+
+	ring := sec.NewKeyRing()
+	if err := ring.AddSignKey("test", key.PubKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	results := VerifyAllImages(man, resolve, ring)
+	if len(results) != 4 {
+		t.Fatalf("wrong result count: have=%d want=4", len(results))
+	}
+
+	want := []bool{true, false, false, false}
+	for i, r := range results {
+		if r.Ok() != want[i] {
+			t.Fatalf("wrong result for target %s: %v", r.Target, r.Err)
+		}
+	}
+	if results[0].SignKeyIdx != 0 {
+		t.Fatalf("wrong sign key index: %d", results[0].SignKeyIdx)
+	}
+	var unsigned *image.ErrUnsigned
+	if !errors.As(results[1].Err, &unsigned) {
+		t.Fatalf("wrong error for unsigned image: %v", results[1].Err)
+	}
+}
+
+func TestEncodeMetaTlv(t *testing.T) {
+	for typ := range metaTlvTypeNameMap {
+		tlv := MetaTlv{
+			Header: MetaTlvHeader{Type: typ, Size: 2},
+			Data:   []byte{typ, 0xaa},
+		}
+
+		buf := &bytes.Buffer{}
+		if err := EncodeMetaTlv(buf, tlv); err != nil {
+			t.Fatal(err)
+		}
+
+		dec, sz, err := parseMetaTlv(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sz != buf.Len() || dec.Header != tlv.Header ||
+			!bytes.Equal(dec.Data, tlv.Data) {
+
+			t.Fatalf("TLV %s did not round trip: have=%+v want=%+v",
+				MetaTlvTypeName(typ), dec, tlv)
+		}
+	}
+
+	bad := MetaTlv{Header: MetaTlvHeader{Type: META_TLV_TYPE_HASH, Size: 1}}
+	if err := EncodeMetaTlv(&bytes.Buffer{}, bad); err == nil {
+		t.Fatalf("TLV with inconsistent size encoded")
+	}
+}
+
+func TestMfgHashCoverage(t *testing.T) {
+	basename := "hash1-fm1-ext0-tgts1-sign0"
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cov, err := m.HashCoverage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := m.Bytes(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cov) != len(full) {
+		t.Fatalf("wrong coverage length: have=%d want=%d",
+			len(cov), len(full))
+	}
+	if !bytes.Equal(CalcHash(cov), m.Meta.Hash()) {
+		t.Fatalf("hash of coverage does not match hash TLV")
+	}
+
+	// Only the hash TLV's data differs from the binary.
+	hashOff := m.MetaOff + m.Meta.HashOffset()
+	for i := range cov {
+		inHash := i >= hashOff && i < hashOff+META_HASH_SZ
+		if inHash && cov[i] != 0 {
+			t.Fatalf("hash byte not zeroed at offset %d", i)
+		}
+		if !inHash && cov[i] != full[i] {
+			t.Fatalf("byte outside hash TLV modified at offset %d", i)
+		}
+	}
+}
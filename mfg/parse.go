@@ -22,26 +22,163 @@ package mfg
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/apache/mynewt-artifact/errors"
 )
 
-func parseMetaFooter(bin []byte) (MetaFooter, int, error) {
-	r := bytes.NewReader(bin)
+// Size of the trailing portion common to every MMR footer layout: version,
+// padding, and magic.  This allows the footer version to be determined before
+// the rest of the footer is decoded.
+const metaFooterTailSz = 6
+
+// metaFooterParsers maps each supported MMR footer version to a function that
+// decodes a footer of that layout.  Each function is passed the MMR contents
+// up to and including the footer and returns the footer and its size.
+var metaFooterParsers = map[uint8]func(bin []byte,
+	order binary.ByteOrder) (MetaFooter, int, error){
+	1: parseMetaFooterV2,
+	2: parseMetaFooterV2,
+}
+
+// MetaVersionIsSupported indicates whether the specified MMR footer version
+// can be parsed.
+func MetaVersionIsSupported(version uint8) bool {
+	_, ok := metaFooterParsers[version]
+	return ok
+}
+
+// MetaFormat identifies the MMR footer format that the parser accepts.  Forks
+// of the boot loader may use a different footer magic or version numbers;
+// the footer layout must nevertheless match the stock one.
+type MetaFormat struct {
+	Magic uint32
+
+	// Footer versions to accept.  Versions without a parser of their own
+	// are decoded with the stock layout.  If empty, every version for which
+	// MetaVersionIsSupported returns true is accepted.
+	Versions []uint8
+}
+
+// DefaultMetaFormat returns the stock Mynewt MMR format: META_MAGIC and all
+// supported versions.
+func DefaultMetaFormat() MetaFormat {
+	return MetaFormat{Magic: META_MAGIC}
+}
+
+// footerParser returns the function that decodes a footer with the specified
+// version, or nil if the format does not accept the version.
+func (mf *MetaFormat) footerParser(version uint8) func(bin []byte,
+	order binary.ByteOrder) (MetaFooter, int, error) {
+
+	if len(mf.Versions) == 0 {
+		return metaFooterParsers[version]
+	}
+
+	for _, v := range mf.Versions {
+		if v == version {
+			if p := metaFooterParsers[version]; p != nil {
+				return p
+			}
+			return parseMetaFooterV2
+		}
+	}
+
+	return nil
+}
+
+// Valid is like MetaFooter.Valid, but checks the footer against this format
+// rather than the stock one.
+func (mf *MetaFormat) Valid(f *MetaFooter) bool {
+	return f.Magic == mf.Magic &&
+		mf.footerParser(f.Version) != nil &&
+		int(f.Size) >= META_FOOTER_SZ
+}
+
+// parseMetaFooterV2 decodes the 8-byte footer used by MMR versions 1 and 2.
+func parseMetaFooterV2(bin []byte,
+	order binary.ByteOrder) (MetaFooter, int, error) {
 
 	var ftr MetaFooter
-	if err := binary.Read(r, binary.LittleEndian, &ftr); err != nil {
+
+	if len(bin) < META_FOOTER_SZ {
+		return ftr, 0, errors.Errorf(
+			"binary too small to accommodate meta footer; "+
+				"bin-size=%d ftr-size=%d", len(bin), META_FOOTER_SZ)
+	}
+
+	r := bytes.NewReader(bin[len(bin)-META_FOOTER_SZ:])
+	if err := binary.Read(r, order, &ftr); err != nil {
 		return ftr, 0, errors.Wrapf(err,
 			"error reading meta footer")
 	}
 
-	if ftr.Magic != META_MAGIC {
-		return ftr, 0, errors.Errorf(
-			"meta footer contains invalid magic; exp:0x%08x, got:0x%08x",
-			META_MAGIC, ftr.Magic)
+	return ftr, META_FOOTER_SZ, nil
+}
+
+// ErrBadMetaMagic indicates that the bytes where an MMR footer's magic number
+// was expected do not contain it.  This usually means the MMR offset is wrong.
+type ErrBadMetaMagic struct {
+	// The four bytes found in place of the magic, in on-disk order.
+	Have []byte
+
+	// The expected magic.
+	Want uint32
+}
+
+func (e *ErrBadMetaMagic) Error() string {
+	return fmt.Sprintf(
+		"meta footer contains invalid magic; exp:0x%08x, got:0x%08x",
+		e.Want, binary.LittleEndian.Uint32(e.Have))
+}
+
+// detectMetaByteOrder determines the byte order of an MMR by inspecting the
+// magic number in its footer.
+func detectMetaByteOrder(tail []byte,
+	wantMagic uint32) (binary.ByteOrder, error) {
+
+	magic := binary.LittleEndian.Uint32(tail[2:])
+	if magic == wantMagic {
+		return binary.LittleEndian, nil
+	}
+	if binary.BigEndian.Uint32(tail[2:]) == wantMagic {
+		return binary.BigEndian, nil
 	}
 
-	return ftr, META_FOOTER_SZ, nil
+	return nil, errors.WithStack(&ErrBadMetaMagic{
+		Have: append([]byte(nil), tail[2:6]...),
+		Want: wantMagic,
+	})
+}
+
+func parseMetaFooter(bin []byte,
+	mf MetaFormat) (MetaFooter, int, binary.ByteOrder, error) {
+
+	if len(bin) < metaFooterTailSz {
+		return MetaFooter{}, 0, nil, errors.Errorf(
+			"binary too small to accommodate meta footer; "+
+				"bin-size=%d ftr-size=%d", len(bin), metaFooterTailSz)
+	}
+
+	tail := bin[len(bin)-metaFooterTailSz:]
+	order, err := detectMetaByteOrder(tail, mf.Magic)
+	if err != nil {
+		return MetaFooter{}, 0, nil, err
+	}
+
+	version := tail[0]
+	parser := mf.footerParser(version)
+	if parser == nil {
+		return MetaFooter{}, 0, nil, errors.Errorf(
+			"meta footer contains unsupported version: %d", version)
+	}
+
+	ftr, sz, err := parser(bin, order)
+	if err != nil {
+		return MetaFooter{}, 0, nil, err
+	}
+
+	return ftr, sz, order, nil
 }
 
 func parseMetaTlv(bin []byte) (MetaTlv, int, error) {
@@ -53,6 +190,11 @@ func parseMetaTlv(bin []byte) (MetaTlv, int, error) {
 	}
 
 	data := make([]byte, tlv.Header.Size)
+	if len(data) == 0 {
+		tlv.Data = data
+		return tlv, META_TLV_HEADER_SZ, nil
+	}
+
 	sz, err := r.Read(data)
 	if err != nil {
 		return tlv, 0, errors.Wrapf(err,
@@ -70,29 +212,33 @@ func parseMetaTlv(bin []byte) (MetaTlv, int, error) {
 }
 
 func parseMeta(bin []byte) (Meta, error) {
-	if len(bin) < META_FOOTER_SZ {
-		return Meta{}, errors.Errorf(
-			"binary too small to accommodate meta footer; "+
-				"bin-size=%d ftr-size=%d", len(bin), META_FOOTER_SZ)
-	}
+	return parseMetaFormat(bin, DefaultMetaFormat())
+}
 
-	ftr, _, err := parseMetaFooter(bin[len(bin)-META_FOOTER_SZ:])
+func parseMetaFormat(bin []byte, mf MetaFormat) (Meta, error) {
+	ftr, ftrSz, order, err := parseMetaFooter(bin, mf)
 	if err != nil {
 		return Meta{}, err
 	}
 
+	if int(ftr.Size) < ftrSz {
+		return Meta{}, errors.Errorf(
+			"meta footer indicates invalid size; min=%d got=%d",
+			ftrSz, ftr.Size)
+	}
+
 	if int(ftr.Size) > len(bin) {
 		return Meta{}, errors.Errorf(
 			"binary too small to accommodate meta region; "+
 				"bin-size=%d meta-size=%d", len(bin), ftr.Size)
 	}
 
-	ftrOff := len(bin) - META_FOOTER_SZ
+	ftrOff := len(bin) - ftrSz
 	off := len(bin) - int(ftr.Size)
 
 	tlvs := []MetaTlv{}
 	for off < ftrOff {
-		tlv, sz, err := parseMetaTlv(bin[off:])
+		tlv, sz, err := parseMetaTlv(bin[off:ftrOff])
 		if err != nil {
 			return Meta{}, err
 		}
@@ -100,16 +246,33 @@ func parseMeta(bin []byte) (Meta, error) {
 		off += sz
 	}
 
-	return Meta{
+	meta := Meta{
 		Tlvs:   tlvs,
 		Footer: ftr,
-	}, nil
+	}
+
+	// Leave the byte order unset for the common little-endian case.
+	if order != binary.LittleEndian {
+		meta.ByteOrder = order
+	}
+
+	return meta, nil
 }
 
 // Parse parses a serialized mfgimage (e.g., "mfgimg.bin") and produces an
 // Mfg object.  metaEndOff is the offset immediately following the MMR, or -1
-// if there is no MMR.
+// if there is no MMR.  The MMR's byte order is detected from its footer
+// magic; a big-endian MMR is re-serialized in big-endian.  The MMR's TLVs
+// are stored in the order they appear on disk (see Meta.Tlvs).
 func Parse(data []byte, metaEndOff int, eraseVal byte) (Mfg, error) {
+	return ParseFormat(data, metaEndOff, eraseVal, DefaultMetaFormat())
+}
+
+// ParseFormat is like Parse, but accepts an MMR in the specified format
+// rather than the stock one.
+func ParseFormat(data []byte, metaEndOff int, eraseVal byte,
+	mf MetaFormat) (Mfg, error) {
+
 	m := Mfg{
 		Bin: data,
 	}
@@ -121,7 +284,7 @@ func Parse(data []byte, metaEndOff int, eraseVal byte) (Mfg, error) {
 				metaEndOff, len(data))
 		}
 
-		meta, err := parseMeta(data[:metaEndOff])
+		meta, err := parseMetaFormat(data[:metaEndOff], mf)
 		if err != nil {
 			return m, err
 		}
@@ -135,3 +298,49 @@ func Parse(data []byte, metaEndOff int, eraseVal byte) (Mfg, error) {
 
 	return m, nil
 }
+
+// FindMeta locates and parses an MMR in a serialized mfgimage whose MMR offset
+// is unknown.  The binary is searched backwards from its end for a footer
+// magic (in either byte order); the first candidate whose footer is valid and
+// whose TLVs exactly fill the region the footer describes is returned, along
+// with the offset of the start of the MMR.  Unlike Parse, the binary is not
+// modified.
+func FindMeta(data []byte) (*Meta, int, error) {
+	return FindMetaFormat(data, DefaultMetaFormat())
+}
+
+// FindMetaFormat is like FindMeta, but searches for an MMR in the specified
+// format rather than the stock one.
+func FindMetaFormat(data []byte, mf MetaFormat) (*Meta, int, error) {
+	var magicLE [4]byte
+	var magicBE [4]byte
+	binary.LittleEndian.PutUint32(magicLE[:], mf.Magic)
+	binary.BigEndian.PutUint32(magicBE[:], mf.Magic)
+
+	// end is one past the last byte of the region still to be searched.
+	end := len(data)
+	for end >= META_FOOTER_SZ {
+		le := bytes.LastIndex(data[:end], magicLE[:])
+		be := bytes.LastIndex(data[:end], magicBE[:])
+		idx := le
+		if be > idx {
+			idx = be
+		}
+		if idx < 0 {
+			break
+		}
+
+		ftrEnd := idx + 4
+		if ftrEnd >= META_FOOTER_SZ {
+			meta, err := parseMetaFormat(data[:ftrEnd], mf)
+			if err == nil && mf.Valid(&meta.Footer) {
+				return &meta, ftrEnd - int(meta.Footer.Size), nil
+			}
+		}
+
+		// False positive; keep searching before this match.
+		end = ftrEnd - 1
+	}
+
+	return nil, -1, errors.Errorf("mfgimage does not contain an MMR")
+}
@@ -22,9 +22,13 @@ package mfg
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/image"
 	"github.com/apache/mynewt-artifact/manifest"
 	"github.com/apache/mynewt-artifact/sec"
 )
@@ -51,7 +55,7 @@ func (m *Mfg) validateManFlashMap(man manifest.MfgManifest) error {
 					"mmr contains flash map; manifest indicates otherwise")
 			}
 
-			body, err := t.StructuredBody()
+			body, err := t.StructuredBodyOrder(m.byteOrder())
 			if err != nil {
 				return err
 			}
@@ -98,7 +102,7 @@ func (m *Mfg) validateManMmrs(man manifest.MfgManifest) error {
 	seen := map[int]struct{}{}
 	for _, t := range m.Tlvs() {
 		if t.Header.Type == META_TLV_TYPE_MMR_REF {
-			body, err := t.StructuredBody()
+			body, err := t.StructuredBodyOrder(m.byteOrder())
 			if err != nil {
 				return err
 			}
@@ -125,9 +129,18 @@ func (m *Mfg) validateManMmrs(man manifest.MfgManifest) error {
 // VerifyStructure checks an mfgimage's structure and internal consistency.  It
 // returns an error if the mfgimage is incorrect.
 func (m *Mfg) VerifyStructure(eraseVal byte) error {
+	// Flash area and MMR ref TLVs may repeat; a hash TLV may not.
+	if m.Meta != nil {
+		if n := len(m.Meta.FindTlvs(META_TLV_TYPE_HASH)); n > 1 {
+			return errors.Errorf(
+				"mmr contains %d TLVs with type %s; at most one allowed",
+				n, MetaTlvTypeName(META_TLV_TYPE_HASH))
+		}
+	}
+
 	for _, t := range m.Tlvs() {
 		// Verify that TLV has a valid `type` field.
-		body, err := t.StructuredBody()
+		body, err := t.StructuredBodyOrder(m.byteOrder())
 		if err != nil {
 			return err
 		}
@@ -157,9 +170,10 @@ func (m *Mfg) VerifyStructure(eraseVal byte) error {
 // VerifyManifest compares an mfgimage's structure to its manifest.  It returns
 // an error if the mfgimage doesn't match the manifest.
 func (m *Mfg) VerifyManifest(man manifest.MfgManifest) error {
-	if man.Format != 2 {
+	if man.Format != manifest.MFG_MANIFEST_FORMAT {
 		return errors.Errorf(
-			"only mfgimage format 2 supported (have=%d)", man.Format)
+			"only mfgimage format %d supported (have=%d)",
+			manifest.MFG_MANIFEST_FORMAT, man.Format)
 	}
 
 	mfgHash, err := m.Hash(man.EraseVal)
@@ -222,3 +236,302 @@ func VerifySigs(man manifest.MfgManifest, keys []sec.PubSignKey) (int, error) {
 
 	return -1, errors.Errorf("mfg signatures do not match provided keys")
 }
+
+// ImageVerifyResult is the outcome of verifying one image referenced by an mfg
+// manifest.
+type ImageVerifyResult struct {
+	Target string // Name of the manifest target.
+	Path   string // Image path, as recorded in the manifest.
+
+	// Indices into the keyring's encryption and signing keys of the keys that
+	// decrypted and verified the image; -1 if unused.
+	EncKeyIdx  int
+	SignKeyIdx int
+
+	// Nil if the image verified; otherwise, the reason it did not.
+	Err error
+}
+
+// Ok indicates whether an image passed verification.
+func (r *ImageVerifyResult) Ok() bool {
+	return r.Err == nil
+}
+
+func verifyTargetImage(data []byte, ring *sec.KeyRing) (int, int, error) {
+	img, err := image.ParseImage(data)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	if err := img.VerifyStructure(); err != nil {
+		return -1, -1, err
+	}
+
+	encIdx, err := img.VerifyHash(ring.PrivEncKeys())
+	if err != nil {
+		return encIdx, -1, err
+	}
+
+	sigIdx, err := img.VerifyWithRing(ring.PubSignKeys())
+	if err != nil {
+		return encIdx, -1, err
+	}
+
+	return encIdx, sigIdx, nil
+}
+
+// VerifyAllImages verifies every image referenced by an mfg manifest: each is
+// loaded with resolve, parsed, and its hash and signature are checked against
+// the keyring.  An unsigned image fails verification.  Targets without an
+// image path (e.g., a boot loader binary) are skipped.  One result is
+// returned per image, in target order.  A missing file or a parse failure is
+// recorded in that image's result rather than returned, so every image is
+// checked.
+func VerifyAllImages(man manifest.MfgManifest,
+	resolve func(path string) ([]byte, error),
+	ring *sec.KeyRing) []ImageVerifyResult {
+
+	var results []ImageVerifyResult
+	for _, t := range man.Targets {
+		if t.ImagePath == "" {
+			continue
+		}
+
+		r := ImageVerifyResult{
+			Target:     t.Name,
+			Path:       t.ImagePath,
+			EncKeyIdx:  -1,
+			SignKeyIdx: -1,
+		}
+
+		data, err := resolve(t.ImagePath)
+		if err != nil {
+			r.Err = errors.Wrapf(err, "failed to read image; target=\"%s\"",
+				t.Name)
+		} else {
+			r.EncKeyIdx, r.SignKeyIdx, err = verifyTargetImage(data, ring)
+			if err != nil {
+				r.Err = errors.Wrapf(err,
+					"image verification failed; target=\"%s\"", t.Name)
+			}
+		}
+
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// targetExtent calculates the number of bytes a target occupies in an
+// mfgimage.  For an image target, the image is parsed from the binary; for a
+// boot target, the size of its flash area is used.
+func targetExtent(man manifest.MfgManifest, t manifest.MfgManifestTarget,
+	mfgBin []byte) (int, error) {
+
+	if t.IsBoot() {
+		fa := man.FindFlashAreaDevOff(man.Device, t.Offset)
+		if fa == nil {
+			return 0, nil
+		}
+		return fa.Size, nil
+	}
+
+	if t.Offset < 0 || t.Offset > len(mfgBin) {
+		return 0, errors.Errorf(
+			"target \"%s\" offset beyond end of mfgimage: "+
+				"offset=%d mfgimg_len=%d", t.Name, t.Offset, len(mfgBin))
+	}
+
+	img, err := image.ParseImage(mfgBin[t.Offset:])
+	if err != nil {
+		return 0, errors.Wrapf(err,
+			"target \"%s\" does not contain an image at offset %d",
+			t.Name, t.Offset)
+	}
+
+	return img.TotalSize(), nil
+}
+
+// VerifyTargets confirms that each target's image is present at its recorded
+// offset in the given mfgimage binary, and that no two targets overlap.  Image
+// targets are identified by parsing the image at their offset; mfg manifest
+// targets do not record an image version, so the version is not checked here.
+// The returned error identifies the first target that does not line up.
+func VerifyTargets(man manifest.MfgManifest, mfgBin []byte) error {
+	type extent struct {
+		name  string
+		start int
+		end   int
+	}
+
+	var extents []extent
+	for _, t := range man.Targets {
+		sz, err := targetExtent(man, t, mfgBin)
+		if err != nil {
+			return err
+		}
+
+		extents = append(extents, extent{
+			name:  t.Name,
+			start: t.Offset,
+			end:   t.Offset + sz,
+		})
+	}
+
+	sort.SliceStable(extents, func(i int, j int) bool {
+		return extents[i].start < extents[j].start
+	})
+
+	for i := 1; i < len(extents); i++ {
+		prev := extents[i-1]
+		cur := extents[i]
+		if cur.start < prev.end {
+			return errors.Errorf(
+				"mfg manifest targets overlap: \"%s\" (0x%x-0x%x) and "+
+					"\"%s\" (0x%x-0x%x)",
+				prev.name, prev.start, prev.end,
+				cur.name, cur.start, cur.end)
+		}
+	}
+
+	return nil
+}
+
+// verifyBinSize checks that an mfgimage binary fits within the device's flash
+// areas and contains the MMR.
+func verifyBinSize(man manifest.MfgManifest, mfgBin []byte) []string {
+	var findings []string
+
+	devEnd := 0
+	for _, fa := range man.FlashAreas {
+		if fa.Device == man.Device && fa.Offset+fa.Size > devEnd {
+			devEnd = fa.Offset + fa.Size
+		}
+	}
+	if devEnd > 0 && len(mfgBin) > devEnd {
+		findings = append(findings, fmt.Sprintf(
+			"mfgimage extends beyond flash map: mfgimg_len=%d flash_end=%d",
+			len(mfgBin), devEnd))
+	}
+
+	if man.Meta != nil && man.Meta.EndOffset > len(mfgBin) {
+		findings = append(findings, fmt.Sprintf(
+			"MMR extends beyond end of mfgimage: end_offset=%d mfgimg_len=%d",
+			man.Meta.EndOffset, len(mfgBin)))
+	}
+
+	return findings
+}
+
+// verifyBinHash parses the MMR at the offset recorded in the manifest and
+// checks its hash TLV (if any) and the manifest's mfg hash against the
+// binary.
+func verifyBinHash(man manifest.MfgManifest, mfgBin []byte) []string {
+	metaEndOff := -1
+	if man.Meta != nil {
+		metaEndOff = man.Meta.EndOffset
+	}
+
+	// Parse overwrites the MMR in the binary it is passed.
+	bin := append([]byte(nil), mfgBin...)
+	m, err := Parse(bin, metaEndOff, man.EraseVal)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var findings []string
+
+	if m.Meta != nil {
+		if int(m.Meta.Footer.Size) != man.Meta.Size {
+			findings = append(findings, fmt.Sprintf(
+				"MMR size differs from manifest: have=%d want=%d",
+				m.Meta.Footer.Size, man.Meta.Size))
+		}
+
+		hasHash := m.Meta.HashOffset() >= 0
+		if hasHash && !man.Meta.Hash {
+			findings = append(findings,
+				"MMR contains hash TLV, but manifest indicates otherwise")
+		} else if !hasHash && man.Meta.Hash {
+			findings = append(findings,
+				"manifest indicates MMR hash TLV, but MMR has none")
+		}
+
+		if hasHash {
+			if err := m.VerifyHash(); err != nil {
+				findings = append(findings, err.Error())
+			}
+		}
+	}
+
+	hash, err := m.RecalcHash(man.EraseVal)
+	if err != nil {
+		return append(findings, err.Error())
+	}
+	if calc := hex.EncodeToString(hash); calc != man.MfgHash {
+		findings = append(findings, fmt.Sprintf(
+			"manifest mfg hash differs from mfgimage: man=%s calc=%s",
+			man.MfgHash, calc))
+	}
+
+	return findings
+}
+
+// verifyBinTargets checks that each target is present at its offset and
+// fits within its flash area.
+func verifyBinTargets(man manifest.MfgManifest, mfgBin []byte) []string {
+	var findings []string
+
+	for _, t := range man.Targets {
+		fa := man.FindFlashAreaDevOff(man.Device, t.Offset)
+		if fa == nil {
+			findings = append(findings, fmt.Sprintf(
+				"no flash area corresponding to target \"%s\" at offset %d",
+				t.Name, t.Offset))
+			continue
+		}
+
+		sz, err := targetExtent(man, t, mfgBin)
+		if err != nil {
+			// Reported by VerifyTargets below.
+			continue
+		}
+
+		if sz > fa.Size {
+			findings = append(findings, fmt.Sprintf(
+				"target \"%s\" too large for flash area %s: "+
+					"size=%d area_size=%d", t.Name, fa.Name, sz, fa.Size))
+		}
+	}
+
+	if err := VerifyTargets(man, mfgBin); err != nil {
+		findings = append(findings, err.Error())
+	}
+
+	return findings
+}
+
+// VerifyBin checks an mfgimage binary against its manifest.  It verifies:
+//   - The binary fits within the device's flash map and contains the MMR.
+//   - The MMR at the declared end offset parses, has the declared size, and
+//     its hash TLV (if any) matches the binary.
+//   - The manifest's mfg hash matches the binary.
+//   - Each target appears at its offset and fits within its flash area.
+//
+// Mfg manifest targets do not record per-target hashes; use VerifyAllImages
+// to verify the images themselves.  All checks are run; the returned error
+// lists every finding.
+func VerifyBin(man manifest.MfgManifest, mfgBin []byte) error {
+	var findings []string
+
+	findings = append(findings, verifyBinSize(man, mfgBin)...)
+	findings = append(findings, verifyBinHash(man, mfgBin)...)
+	findings = append(findings, verifyBinTargets(man, mfgBin)...)
+
+	if len(findings) > 0 {
+		return errors.Errorf("mfgimage does not match manifest:\n    %s",
+			strings.Join(findings, "\n    "))
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"testing"
+)
+
+func TestVerifyBin(t *testing.T) {
+	good := []string{
+		"hash1-fm1-ext0-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign1",
+	}
+	for _, basename := range good {
+		man := readManifest(basename)
+		if err := VerifyBin(man, readMfgData(basename)); err != nil {
+			t.Fatalf("mfgimage \"%s\" failed manifest verification: %s",
+				basename, err.Error())
+		}
+	}
+
+	bad := []string{
+		// MMR and manifest contain the same incorrect hash.
+		"hashx-fm1-ext0-tgts1-sign0",
+		// MMR hash doesn't match manifest.
+		"hashm-fm1-ext0-tgts1-sign0",
+		// Manifest indicates build where there is none.
+		"hash1-fm1-ext1-tgtsm-sign0",
+	}
+	for _, basename := range bad {
+		man := readManifest(basename)
+		if err := VerifyBin(man, readMfgData(basename)); err == nil {
+			t.Fatalf("mfgimage \"%s\" passed manifest verification",
+				basename)
+		}
+	}
+
+	// Truncated binary.
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	bin := readMfgData(basename)
+	if err := VerifyBin(man, bin[:man.Meta.EndOffset-1]); err == nil {
+		t.Fatalf("truncated mfgimage \"%s\" passed manifest verification",
+			basename)
+	}
+}
+
+func TestVerifyTargets(t *testing.T) {
+	good := []string{
+		"hash1-fm1-ext0-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign1",
+	}
+	for _, basename := range good {
+		man := readManifest(basename)
+		if err := VerifyTargets(man, readMfgData(basename)); err != nil {
+			t.Fatalf("mfgimage \"%s\" failed target verification: %s",
+				basename, err.Error())
+		}
+	}
+
+	// Manifest indicates build where there is none.
+	basename := "hash1-fm1-ext1-tgtsm-sign0"
+	man := readManifest(basename)
+	if err := VerifyTargets(man, readMfgData(basename)); err == nil {
+		t.Fatalf("mfgimage \"%s\" passed target verification", basename)
+	}
+}
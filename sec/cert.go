@@ -0,0 +1,95 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// parseCert decodes an X.509 certificate in PEM or DER form.
+func parseCert(certBytes []byte) (*x509.Certificate, error) {
+	der := certBytes
+	if block, _ := pem.Decode(certBytes); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, errors.Errorf(
+				"error parsing certificate: PEM type=\"%s\"", block.Type)
+		}
+		der = block.Bytes
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing certificate")
+	}
+
+	return cert, nil
+}
+
+// KeyValidity is the period during which a signing key may be trusted, as
+// taken from the key's certificate.  Both bounds are inclusive.
+type KeyValidity struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ValidAt indicates whether the given time falls within the validity period.
+func (v *KeyValidity) ValidAt(t time.Time) bool {
+	return !t.Before(v.NotBefore) && !t.After(v.NotAfter)
+}
+
+// PubSignKeyFromCert extracts the public signing key (RSA, ECDSA, or
+// Ed25519) from an X.509 certificate in PEM or DER form.  The returned key
+// carries the certificate's validity period.  The certificate is not
+// otherwise validated; establishing trust in it is the caller's
+// responsibility.
+func PubSignKeyFromCert(certPEM []byte) (PubSignKey, error) {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return PubSignKey{}, err
+	}
+
+	key, err := pubSignKeyFromItf(cert.PublicKey)
+	if err != nil {
+		return PubSignKey{}, err
+	}
+
+	key.Validity = &KeyValidity{
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+
+	return key, nil
+}
+
+// CertSubject returns the subject of an X.509 certificate in PEM or DER form
+// (e.g., "CN=release-signer,O=Example"), for identifying the holder of a key
+// extracted with PubSignKeyFromCert.
+func CertSubject(certPEM []byte) (string, error) {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return "", err
+	}
+
+	return cert.Subject.String(), nil
+}
@@ -23,27 +23,53 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"io"
+	"math/big"
 
-	keywrap "github.com/NickBall/go-aes-key-wrap"
 	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/hkdf"
 )
 
-// XXX: Only RSA supported for now.
 type PrivEncKey struct {
+	// Only one of these members is non-nil.
 	Rsa *rsa.PrivateKey
+	Ec  *ecdsa.PrivateKey
+	Aes cipher.Block
 }
 
 type PubEncKey struct {
 	Rsa *rsa.PublicKey
+	Ec  *ecdsa.PublicKey
 	Aes cipher.Block
+
+	// If true, an AES key-encryption key wraps with AES-GCM rather than
+	// AES-KW.  Ignored for RSA and EC keys.
+	AesGcm bool
 }
 
+// ECIES-P256 parameters, as used by MCUboot.  An EC256-encrypted secret has
+// the following layout:
+//
+//	[ephemeral public key (65)] [HMAC-SHA256 tag (32)] [ciphertext (16)]
+const (
+	ECIES_P256_PUBKEY_SZ = 65
+	ECIES_P256_TAG_SZ    = 32
+	ECIES_P256_SECRET_SZ = 16
+	ECIES_P256_TOTAL_SZ  = ECIES_P256_PUBKEY_SZ + ECIES_P256_TAG_SZ +
+		ECIES_P256_SECRET_SZ
+)
+
+const eciesHkdfInfo = "MCUBoot_ECIES_v1"
+
 func parsePubKePem(b []byte) (PubEncKey, error) {
 	key := PubEncKey{}
 
@@ -55,6 +81,11 @@ func parsePubKePem(b []byte) (PubEncKey, error) {
 	switch pub := itf.(type) {
 	case *rsa.PublicKey:
 		key.Rsa = pub
+	case *ecdsa.PublicKey:
+		if err := checkEncCurve(pub.Curve); err != nil {
+			return key, err
+		}
+		key.Ec = pub
 	default:
 		return key, errors.Errorf(
 			"unknown public encryption key type: %T", pub)
@@ -91,11 +122,87 @@ func ParsePubEncKey(keyBytes []byte) (PubEncKey, error) {
 }
 
 func (key *PubEncKey) AssertValid() {
-	if key.Rsa == nil && key.Aes == nil {
-		panic("invalid public encryption key; neither RSA nor AES")
+	if key.Rsa == nil && key.Ec == nil && key.Aes == nil {
+		panic("invalid public encryption key; neither RSA nor EC nor AES")
 	}
 }
 
+// checkEncCurve ensures an EC encryption key uses the only supported curve.
+func checkEncCurve(curve elliptic.Curve) error {
+	if curve != elliptic.P256() {
+		return errors.Errorf(
+			"unsupported EC encryption key curve: %s; only P-256 is supported",
+			curve.Params().Name)
+	}
+
+	return nil
+}
+
+// eciesKeys derives the AES and HMAC keys from an ECDH shared secret.
+func eciesKeys(shared []byte) ([]byte, []byte, error) {
+	okm := make([]byte, ECIES_P256_SECRET_SZ+sha256.Size)
+	r := hkdf.New(sha256.New, shared, nil, []byte(eciesHkdfInfo))
+	if _, err := io.ReadFull(r, okm); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to derive ECIES keys")
+	}
+
+	return okm[:ECIES_P256_SECRET_SZ], okm[ECIES_P256_SECRET_SZ:], nil
+}
+
+// eciesShared computes the 32-byte ECDH shared secret (X coordinate).
+func eciesShared(x, y *big.Int, d []byte) []byte {
+	curve := elliptic.P256()
+	sx, _ := curve.ScalarMult(x, y, d)
+
+	shared := make([]byte, (curve.Params().BitSize+7)/8)
+	b := sx.Bytes()
+	copy(shared[len(shared)-len(b):], b)
+
+	return shared
+}
+
+func eciesHmac(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func encryptEc256(pubk *ecdsa.PublicKey, plainSecret []byte) ([]byte, error) {
+	if len(plainSecret) != ECIES_P256_SECRET_SZ {
+		return nil, errors.Errorf(
+			"invalid secret size for EC256 encryption: have=%d want=%d",
+			len(plainSecret), ECIES_P256_SECRET_SZ)
+	}
+
+	if pubk.Curve != elliptic.P256() ||
+		!pubk.Curve.IsOnCurve(pubk.X, pubk.Y) {
+		return nil, errors.Errorf("invalid EC256 encryption key")
+	}
+
+	eph, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate ephemeral key")
+	}
+
+	shared := eciesShared(pubk.X, pubk.Y, eph.D.Bytes())
+	aesKey, macKey, err := eciesKeys(shared)
+	if err != nil {
+		return nil, err
+	}
+
+	ciph, err := EncryptAES(plainSecret, aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Uncompressed SEC1 point encoding.
+	out := elliptic.Marshal(elliptic.P256(), eph.X, eph.Y)
+	out = append(out, eciesHmac(macKey, ciph)...)
+	out = append(out, ciph...)
+
+	return out, nil
+}
+
 func encryptRsa(pubk *rsa.PublicKey, plainSecret []byte) ([]byte, error) {
 	rng := rand.Reader
 	cipherSecret, err := rsa.EncryptOAEP(
@@ -107,13 +214,11 @@ func encryptRsa(pubk *rsa.PublicKey, plainSecret []byte) ([]byte, error) {
 	return cipherSecret, nil
 }
 
-func encryptAes(c cipher.Block, plain []byte) ([]byte, error) {
-	ciph, err := keywrap.Wrap(c, plain)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error key-wrapping")
+func encryptAes(c cipher.Block, plain []byte, gcm bool) ([]byte, error) {
+	if gcm {
+		return WrapKeyGcm(c, plain)
 	}
-
-	return ciph, nil
+	return WrapKey(c, plain)
 }
 
 func (k *PubEncKey) Encrypt(plain []byte) ([]byte, error) {
@@ -121,15 +226,35 @@ func (k *PubEncKey) Encrypt(plain []byte) ([]byte, error) {
 
 	if k.Rsa != nil {
 		return encryptRsa(k.Rsa, plain)
+	} else if k.Ec != nil {
+		return encryptEc256(k.Ec, plain)
 	} else {
-		return encryptAes(k.Aes, plain)
+		return encryptAes(k.Aes, plain, k.AesGcm)
 	}
 }
 
 func ParsePrivEncKey(keyBytes []byte) (PrivEncKey, error) {
+	b, err := base64.StdEncoding.DecodeString(string(keyBytes))
+	if err == nil {
+		// Symmetric key-encryption key; the same key wraps and unwraps.
+		pubk, err := parsePubKeBase64(b)
+		if err != nil {
+			return PrivEncKey{}, err
+		}
+		return PrivEncKey{
+			Aes: pubk.Aes,
+		}, nil
+	}
+
+	block, _ := pem.Decode(keyBytes)
+	if block != nil {
+		return parsePrivEncKeyPem(block)
+	}
+
 	rpk, err := x509.ParsePKCS1PrivateKey(keyBytes)
 	if err != nil {
-		return PrivEncKey{}, errors.Wrapf(err, "error parsing private key file")
+		return PrivEncKey{}, errors.WrapSensitive(err,
+			"error parsing private key file")
 	}
 
 	return PrivEncKey{
@@ -137,6 +262,60 @@ func ParsePrivEncKey(keyBytes []byte) (PrivEncKey, error) {
 	}, nil
 }
 
+func privEncKeyFromEc(epk *ecdsa.PrivateKey) (PrivEncKey, error) {
+	if err := checkEncCurve(epk.Curve); err != nil {
+		return PrivEncKey{}, err
+	}
+
+	return PrivEncKey{
+		Ec: epk,
+	}, nil
+}
+
+func parsePrivEncKeyPem(block *pem.Block) (PrivEncKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		rpk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return PrivEncKey{}, errors.WrapSensitive(err,
+				"error parsing private key file")
+		}
+		return PrivEncKey{Rsa: rpk}, nil
+
+	case "EC PRIVATE KEY":
+		// SEC1.
+		epk, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return PrivEncKey{}, errors.WrapSensitive(err,
+				"error parsing EC private key file")
+		}
+		return privEncKeyFromEc(epk)
+
+	case "PRIVATE KEY":
+		// PKCS#8.
+		itf, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return PrivEncKey{}, errors.WrapSensitive(err,
+				"error parsing private key file")
+		}
+
+		switch priv := itf.(type) {
+		case *rsa.PrivateKey:
+			return PrivEncKey{Rsa: priv}, nil
+		case *ecdsa.PrivateKey:
+			return privEncKeyFromEc(priv)
+		default:
+			return PrivEncKey{}, errors.Errorf(
+				"unknown private encryption key type: %T", priv)
+		}
+
+	default:
+		return PrivEncKey{}, errors.Errorf(
+			"unknown private encryption key format: PEM type=\"%s\"",
+			block.Type)
+	}
+}
+
 func decryptRsa(privk *rsa.PrivateKey, ciph []byte) ([]byte, error) {
 	rng := rand.Reader
 	plain, err := rsa.DecryptOAEP(sha256.New(), rng, privk, ciph, nil)
@@ -147,8 +326,82 @@ func decryptRsa(privk *rsa.PrivateKey, ciph []byte) ([]byte, error) {
 	return plain, nil
 }
 
+func (key *PrivEncKey) AssertValid() {
+	if key.Rsa == nil && key.Ec == nil && key.Aes == nil {
+		panic("invalid private encryption key; neither RSA nor EC nor AES")
+	}
+}
+
+func decryptEc256(privk *ecdsa.PrivateKey, ciph []byte) ([]byte, error) {
+	if len(ciph) != ECIES_P256_TOTAL_SZ {
+		return nil, errors.Errorf(
+			"invalid EC256 encrypted secret size: have=%d want=%d",
+			len(ciph), ECIES_P256_TOTAL_SZ)
+	}
+
+	pubBytes := ciph[:ECIES_P256_PUBKEY_SZ]
+	tag := ciph[ECIES_P256_PUBKEY_SZ : ECIES_P256_PUBKEY_SZ+ECIES_P256_TAG_SZ]
+	secret := ciph[ECIES_P256_PUBKEY_SZ+ECIES_P256_TAG_SZ:]
+
+	// Unmarshal rejects points that are not on the curve.
+	x, y := elliptic.Unmarshal(elliptic.P256(), pubBytes)
+	if x == nil {
+		return nil, errors.Errorf(
+			"EC256 encrypted secret contains invalid ephemeral key")
+	}
+
+	shared := eciesShared(x, y, privk.D.Bytes())
+	aesKey, macKey, err := eciesKeys(shared)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(tag, eciesHmac(macKey, secret)) {
+		return nil, errors.Errorf("EC256 encrypted secret has invalid tag")
+	}
+
+	return EncryptAES(secret, aesKey)
+}
+
+func decryptAes(c cipher.Block, ciph []byte) ([]byte, error) {
+	plain, err := UnwrapKey(c, ciph)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error key-unwrapping")
+	}
+
+	return plain, nil
+}
+
 func (k *PrivEncKey) Decrypt(ciph []byte) ([]byte, error) {
-	return decryptRsa(k.Rsa, ciph)
+	k.AssertValid()
+
+	if k.Rsa != nil {
+		return decryptRsa(k.Rsa, ciph)
+	} else if k.Ec != nil {
+		return decryptEc256(k.Ec, ciph)
+	} else {
+		return decryptAes(k.Aes, ciph)
+	}
+}
+
+// DecryptGcm unwraps a GCM-wrapped secret (see WrapKeyGcm).  Only AES
+// key-encryption keys support GCM wrapping.
+func (k *PrivEncKey) DecryptGcm(ciph []byte) ([]byte, error) {
+	k.AssertValid()
+
+	if k.Aes == nil {
+		return nil, errors.Errorf(
+			"GCM-wrapped secret requires an AES key-encryption key")
+	}
+
+	return UnwrapKeyGcm(k.Aes, ciph)
+}
+
+// AesCtrNonce returns the initial counter block used for AES-CTR image
+// encryption.  As in MCUboot, the counter block is all zeros; it is
+// incremented as a 128-bit big-endian integer for each 16-byte block of data.
+func AesCtrNonce() []byte {
+	return make([]byte, aes.BlockSize)
 }
 
 func EncryptAES(plain []byte, secret []byte) ([]byte, error) {
@@ -156,8 +409,7 @@ func EncryptAES(plain []byte, secret []byte) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Errorf("Failed to create block cipher")
 	}
-	nonce := make([]byte, 16)
-	stream := cipher.NewCTR(blk, nonce)
+	stream := cipher.NewCTR(blk, AesCtrNonce())
 
 	dataBuf := make([]byte, 16)
 	encBuf := make([]byte, 16)
@@ -0,0 +1,94 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func sec1Pem(t *testing.T, curve elliptic.Curve) []byte {
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	})
+}
+
+func TestEc256EncKeySec1(t *testing.T) {
+	privKey, err := ParsePrivEncKey(sec1Pem(t, elliptic.P256()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privKey.Ec == nil {
+		t.Fatalf("SEC1 key not parsed as EC")
+	}
+
+	pubKey := PubEncKey{Ec: &privKey.Ec.PublicKey}
+
+	plain := []byte("0123456789abcdef")
+	ciph, err := pubKey.Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciph) != ECIES_P256_TOTAL_SZ {
+		t.Fatalf("wrong EC256 ciphertext size: have=%d want=%d",
+			len(ciph), ECIES_P256_TOTAL_SZ)
+	}
+
+	dec, err := privKey.Decrypt(ciph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, plain) {
+		t.Fatalf("wrong EC256 plaintext: have=%x want=%x", dec, plain)
+	}
+
+	// Tampering with the ciphertext must be detected.
+	ciph[len(ciph)-1] ^= 0x01
+	if _, err := privKey.Decrypt(ciph); err == nil {
+		t.Fatalf("tampered EC256 ciphertext accepted")
+	}
+}
+
+func TestEc384EncKeyRejected(t *testing.T) {
+	_, err := ParsePrivEncKey(sec1Pem(t, elliptic.P384()))
+	if err == nil {
+		t.Fatalf("P-384 encryption key accepted")
+	}
+	if !strings.Contains(err.Error(), "P-384") {
+		t.Fatalf("error does not name curve: %s", err.Error())
+	}
+}
@@ -0,0 +1,103 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// AES-GCM key wrap.  A GCM-wrapped secret has the following layout:
+//
+//	[nonce (12)] [ciphertext (len(key))] [GCM tag (16)]
+
+package sec
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+const (
+	AES_GCM_NONCE_SZ = 12
+	AES_GCM_TAG_SZ   = 16
+)
+
+// ErrGcmTag indicates that a GCM-wrapped secret failed tag verification;
+// i.e., it was wrapped with a different key or has been tampered with.
+type ErrGcmTag struct{}
+
+func (e *ErrGcmTag) Error() string {
+	return "GCM key unwrap failed: tag mismatch"
+}
+
+// aesKeySizeValid indicates whether n is a valid AES key size, in bytes.
+func aesKeySizeValid(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// GcmWrappedSize returns the size of a GCM-wrapped key of the given length.
+func GcmWrappedSize(keyLen int) int {
+	return AES_GCM_NONCE_SZ + keyLen + AES_GCM_TAG_SZ
+}
+
+// IsGcmWrappedSize indicates whether n is the size of a GCM-wrapped AES key.
+func IsGcmWrappedSize(n int) bool {
+	return aesKeySizeValid(n - AES_GCM_NONCE_SZ - AES_GCM_TAG_SZ)
+}
+
+// WrapKeyGcm wraps an AES content key with AES-GCM using a random nonce.  The
+// result consists of the nonce, the ciphertext, and the tag.
+func WrapKeyGcm(c cipher.Block, plain []byte) ([]byte, error) {
+	if !aesKeySizeValid(len(plain)) {
+		return nil, errors.Errorf(
+			"cannot GCM-wrap key: invalid size: %d", len(plain))
+	}
+
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating GCM cipher")
+	}
+
+	nonce := make([]byte, AES_GCM_NONCE_SZ)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrapf(err, "error generating GCM nonce")
+	}
+
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// UnwrapKeyGcm reverses WrapKeyGcm.  The tag is verified before the key is
+// released; a tag mismatch yields an *ErrGcmTag.  Any other failure (e.g., a
+// truncated input) yields a plain error.
+func UnwrapKeyGcm(c cipher.Block, wrapped []byte) ([]byte, error) {
+	if !IsGcmWrappedSize(len(wrapped)) {
+		return nil, errors.Errorf(
+			"invalid GCM-wrapped key length: %d", len(wrapped))
+	}
+
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating GCM cipher")
+	}
+
+	nonce := wrapped[:AES_GCM_NONCE_SZ]
+	plain, err := gcm.Open(nil, nonce, wrapped[AES_GCM_NONCE_SZ:], nil)
+	if err != nil {
+		return nil, errors.WithStack(&ErrGcmTag{})
+	}
+
+	return plain, nil
+}
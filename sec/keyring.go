@@ -0,0 +1,243 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// NamedSignKey is a public signing key in a keyring.
+type NamedSignKey struct {
+	Name string
+	Key  PubSignKey
+}
+
+// NamedEncKey is a private encryption key in a keyring.
+type NamedEncKey struct {
+	Name string
+	Key  PrivEncKey
+}
+
+// KeyRing is a named collection of the keys needed to inspect images: public
+// signing keys for verifying signatures and private encryption keys for
+// decrypting.  The image package consumes a ring directly (see
+// Image.VerifyKeyRing and Image.ExtractBody).  Keys are kept in the order they
+// were added; the PubSignKeys and PrivEncKeys slices can also be passed to the
+// image package's other verification methods (e.g., Image.VerifyWithRing,
+// Image.VerifyHash), and an index those functions return identifies the
+// corresponding named entry.
+type KeyRing struct {
+	SignKeys []NamedSignKey
+	EncKeys  []NamedEncKey
+}
+
+// NewKeyRing creates an empty keyring.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{}
+}
+
+// AddSignKey adds a public signing key to a keyring.  An error is returned if
+// the ring already contains a signing key with the same name.
+func (r *KeyRing) AddSignKey(name string, key PubSignKey) error {
+	if _, ok := r.FindSignKey(name); ok {
+		return errors.Errorf("duplicate signing key in keyring: %s", name)
+	}
+
+	r.SignKeys = append(r.SignKeys, NamedSignKey{Name: name, Key: key})
+	return nil
+}
+
+// AddEncKey adds a private encryption key to a keyring.  An error is returned
+// if the ring already contains an encryption key with the same name.
+func (r *KeyRing) AddEncKey(name string, key PrivEncKey) error {
+	if _, ok := r.FindEncKey(name); ok {
+		return errors.Errorf("duplicate encryption key in keyring: %s", name)
+	}
+
+	r.EncKeys = append(r.EncKeys, NamedEncKey{Name: name, Key: key})
+	return nil
+}
+
+// FindSignKey retrieves the signing key with the specified name.
+func (r *KeyRing) FindSignKey(name string) (NamedSignKey, bool) {
+	for _, k := range r.SignKeys {
+		if k.Name == name {
+			return k, true
+		}
+	}
+
+	return NamedSignKey{}, false
+}
+
+// FindEncKey retrieves the encryption key with the specified name.
+func (r *KeyRing) FindEncKey(name string) (NamedEncKey, bool) {
+	for _, k := range r.EncKeys {
+		if k.Name == name {
+			return k, true
+		}
+	}
+
+	return NamedEncKey{}, false
+}
+
+// FindSignKeyByHash retrieves the signing key whose keyhash (see RawKeyHash)
+// matches the one provided, as found in an image's KEYHASH TLV.  The keyhash
+// must match exactly; a truncated keyhash matches no key.
+func (r *KeyRing) FindSignKeyByHash(keyHash []byte) (NamedSignKey, bool) {
+	for _, k := range r.SignKeys {
+		pubBytes, err := k.Key.Bytes()
+		if err != nil {
+			continue
+		}
+
+		if bytes.Equal(RawKeyHash(pubBytes), keyHash) {
+			return k, true
+		}
+	}
+
+	return NamedSignKey{}, false
+}
+
+// PubSignKeys returns the ring's signing keys, in order.
+func (r *KeyRing) PubSignKeys() []PubSignKey {
+	keys := make([]PubSignKey, len(r.SignKeys))
+	for i, k := range r.SignKeys {
+		keys[i] = k.Key
+	}
+
+	return keys
+}
+
+// PrivEncKeys returns the ring's encryption keys, in order.
+func (r *KeyRing) PrivEncKeys() []PrivEncKey {
+	keys := make([]PrivEncKey, len(r.EncKeys))
+	for i, k := range r.EncKeys {
+		keys[i] = k.Key
+	}
+
+	return keys
+}
+
+// encKeyPublicMatches reports whether a public key is the public half of a
+// private encryption key.
+func encKeyPublicMatches(enc PrivEncKey, pub PubSignKey) bool {
+	if enc.Rsa != nil && pub.Rsa != nil {
+		return enc.Rsa.N.Cmp(pub.Rsa.N) == 0 && enc.Rsa.E == pub.Rsa.E
+	}
+	if enc.Ec != nil && pub.Ec != nil {
+		return enc.Ec.Curve == pub.Ec.Curve &&
+			enc.Ec.X.Cmp(pub.Ec.X) == 0 && enc.Ec.Y.Cmp(pub.Ec.Y) == 0
+	}
+
+	return false
+}
+
+// readKeyRingFile parses a keyring file and classifies it by its key type.
+// Exactly one of the returned keys is non-nil.  A public key must be a
+// supported signing key; a private key must be a supported encryption key.
+func readKeyRingFile(keyBytes []byte) (*PubSignKey, *PrivEncKey, error) {
+	if block, _ := pem.Decode(keyBytes); block == nil {
+		return nil, nil, errors.Errorf("not a PEM file")
+	}
+
+	if pub, err := ParsePubSignKey(keyBytes); err == nil {
+		if pub.Type() == SIGN_ALGO_UNKNOWN {
+			return nil, nil, errors.Errorf(
+				"unsupported public signing key type")
+		}
+		return &pub, nil, nil
+	}
+
+	if priv, err := ParsePrivEncKey(keyBytes); err == nil {
+		return nil, &priv, nil
+	}
+
+	if _, err := ParsePrivSignKey(keyBytes); err == nil {
+		return nil, nil, errors.Errorf(
+			"private signing key; convert it to a public key")
+	}
+
+	return nil, nil, errors.Errorf(
+		"neither a public signing key nor a private encryption key")
+}
+
+// ReadKeyRingDir builds a keyring from the PEM files (*.pem) in a directory.
+// Each key is named after its file, minus the extension.  Keys are classified
+// by their decoded type, not by their PEM label: a public key must be a
+// supported signing key (RSA-2048, RSA-3072, ECDSA P-224 or P-256, or
+// Ed25519) and is loaded as a signing key; a private key must be a supported
+// encryption key (RSA or ECDSA P-256) and is loaded as an encryption key.
+// Any other file is rejected, including private signing keys (which are not
+// needed for verification and should be converted to public keys) and
+// encryption public keys.  Since RSA and P-256 keys serve both purposes, a
+// public key is only recognized as an encryption key if its private half is
+// also in the directory; encryption public keys should never be placed in a
+// keyring directory.  Files are processed in lexical order.
+func ReadKeyRingDir(dir string) (*KeyRing, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading keyring directory")
+	}
+	sort.Strings(paths)
+
+	r := NewKeyRing()
+	for _, path := range paths {
+		keyBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading key file")
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+		pub, priv, err := readKeyRingFile(keyBytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading key file %s", path)
+		}
+
+		if pub != nil {
+			err = r.AddSignKey(name, *pub)
+		} else {
+			err = r.AddEncKey(name, *priv)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sk := range r.SignKeys {
+		for _, ek := range r.EncKeys {
+			if encKeyPublicMatches(ek.Key, sk.Key) {
+				return nil, errors.Errorf(
+					"error reading keyring directory: "+
+						"%s is the public half of encryption key %s",
+					sk.Name, ek.Name)
+			}
+		}
+	}
+
+	return r, nil
+}
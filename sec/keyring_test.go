@@ -0,0 +1,142 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func writeKeyRingFile(t *testing.T, dir string, name string, pemType string,
+	der []byte) {
+
+	data := pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyRingDir(t *testing.T) {
+	encKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signPub, err := x509.MarshalPKIXPublicKey(&signKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeKeyRingFile(t, dir, "dev-enc.pem", "RSA PRIVATE KEY",
+		x509.MarshalPKCS1PrivateKey(encKey))
+	writeKeyRingFile(t, dir, "b-sign.pem", "PUBLIC KEY", signPub)
+
+	ring, err := ReadKeyRingDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.SignKeys) != 1 || len(ring.EncKeys) != 1 {
+		t.Fatalf("wrong key counts: sign=%d enc=%d",
+			len(ring.SignKeys), len(ring.EncKeys))
+	}
+	if ring.SignKeys[0].Name != "b-sign" || ring.EncKeys[0].Name != "dev-enc" {
+		t.Fatalf("wrong key names: sign=%s enc=%s",
+			ring.SignKeys[0].Name, ring.EncKeys[0].Name)
+	}
+
+	pubBytes, err := ring.SignKeys[0].Key.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyHash := RawKeyHash(pubBytes)
+	k, ok := ring.FindSignKeyByHash(keyHash)
+	if !ok || k.Name != "b-sign" {
+		t.Fatalf("keyhash lookup failed")
+	}
+	if _, ok := ring.FindSignKeyByHash(keyHash[:2]); ok {
+		t.Fatalf("truncated keyhash matched a key")
+	}
+}
+
+func TestKeyRingDirMisfits(t *testing.T) {
+	encKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encPub, err := x509.MarshalPKIXPublicKey(&encKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDer, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Pub, err := x509.MarshalPKIXPublicKey(&p384Key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pemType string
+		der     []byte
+		errText string
+	}{
+		{"ed25519-priv.pem", "PRIVATE KEY", edDer, "private signing key"},
+		{"p384-pub.pem", "PUBLIC KEY", p384Pub, "unsupported"},
+		{"cert.pem", "CERTIFICATE", []byte{0x30, 0x00}, "neither"},
+		{"enc-pub.pem", "PUBLIC KEY", encPub, "public half"},
+	}
+
+	for _, tc := range tests {
+		dir := t.TempDir()
+		writeKeyRingFile(t, dir, "enc.pem", "RSA PRIVATE KEY",
+			x509.MarshalPKCS1PrivateKey(encKey))
+		writeKeyRingFile(t, dir, tc.name, tc.pemType, tc.der)
+
+		_, err := ReadKeyRingDir(dir)
+		if err == nil || !strings.Contains(err.Error(), tc.errText) {
+			t.Fatalf("%s: wrong error: %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// AES key wrap (RFC 3394) and AES key wrap with padding (RFC 5649).
+
+package sec
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+
+	keywrap "github.com/NickBall/go-aes-key-wrap"
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+const kwBlockSize = 8
+
+// Default initial value defined by RFC 3394.
+var kwIv = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// Alternative initial value prefix defined by RFC 5649.  It is followed by
+// the 32-bit big-endian length of the unpadded key.
+var kwpAivPrefix = []byte{0xa6, 0x59, 0x59, 0xa6}
+
+// KeyWrapNeedsPadding indicates whether a key of the given length must be
+// wrapped with RFC 5649 rather than plain RFC 3394.
+func KeyWrapNeedsPadding(keyLen int) bool {
+	return keyLen < 2*kwBlockSize || keyLen%kwBlockSize != 0
+}
+
+// kwWrapBlocks performs the RFC 3394 wrapping process on a sequence of 64-bit
+// blocks using the supplied initial value.
+func kwWrapBlocks(c cipher.Block, iv []byte, plain []byte) []byte {
+	n := len(plain) / kwBlockSize
+
+	a := make([]byte, kwBlockSize)
+	copy(a, iv)
+
+	r := make([]byte, len(plain))
+	copy(r, plain)
+
+	b := make([]byte, 2*kwBlockSize)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			ri := r[i*kwBlockSize : (i+1)*kwBlockSize]
+
+			copy(b, a)
+			copy(b[kwBlockSize:], ri)
+			c.Encrypt(b, b)
+
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a,
+				binary.BigEndian.Uint64(b[:kwBlockSize])^t)
+			copy(ri, b[kwBlockSize:])
+		}
+	}
+
+	return append(a, r...)
+}
+
+// kwUnwrapBlocks performs the RFC 3394 unwrapping process.  It returns the
+// recovered initial value and the unwrapped data; the caller is responsible
+// for checking the initial value.
+func kwUnwrapBlocks(c cipher.Block, ciph []byte) ([]byte, []byte) {
+	n := len(ciph)/kwBlockSize - 1
+
+	a := make([]byte, kwBlockSize)
+	copy(a, ciph[:kwBlockSize])
+
+	r := make([]byte, len(ciph)-kwBlockSize)
+	copy(r, ciph[kwBlockSize:])
+
+	b := make([]byte, 2*kwBlockSize)
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			ri := r[i*kwBlockSize : (i+1)*kwBlockSize]
+
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^t)
+			copy(b[kwBlockSize:], ri)
+			c.Decrypt(b, b)
+
+			copy(a, b[:kwBlockSize])
+			copy(ri, b[kwBlockSize:])
+		}
+	}
+
+	return a, r
+}
+
+// WrapKeyPadded wraps a key of arbitrary length according to RFC 5649.
+func WrapKeyPadded(c cipher.Block, plain []byte) ([]byte, error) {
+	if c.BlockSize() != 2*kwBlockSize {
+		return nil, errors.Errorf(
+			"key wrap requires a 128-bit block cipher; have=%d bits",
+			c.BlockSize()*8)
+	}
+	if len(plain) == 0 {
+		return nil, errors.Errorf("cannot key-wrap an empty key")
+	}
+
+	aiv := make([]byte, kwBlockSize)
+	copy(aiv, kwpAivPrefix)
+	binary.BigEndian.PutUint32(aiv[4:], uint32(len(plain)))
+
+	padLen := (kwBlockSize - len(plain)%kwBlockSize) % kwBlockSize
+	padded := append(append([]byte(nil), plain...), make([]byte, padLen)...)
+
+	if len(padded) == kwBlockSize {
+		// A single block is encrypted directly in ECB mode.
+		out := append(aiv, padded...)
+		c.Encrypt(out, out)
+		return out, nil
+	}
+
+	return kwWrapBlocks(c, aiv, padded), nil
+}
+
+// WrapKey wraps a key with AES key wrap.  RFC 3394 is used when the key
+// length permits it; otherwise RFC 5649 padding is applied.
+func WrapKey(c cipher.Block, plain []byte) ([]byte, error) {
+	if KeyWrapNeedsPadding(len(plain)) {
+		return WrapKeyPadded(c, plain)
+	}
+
+	ciph, err := keywrap.Wrap(c, plain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error key-wrapping")
+	}
+
+	return ciph, nil
+}
+
+// UnwrapKey reverses WrapKey.  The wrapping variant (RFC 3394 or RFC 5649) is
+// detected from the wrapped length and the recovered initial value.
+func UnwrapKey(c cipher.Block, ciph []byte) ([]byte, error) {
+	if c.BlockSize() != 2*kwBlockSize {
+		return nil, errors.Errorf(
+			"key unwrap requires a 128-bit block cipher; have=%d bits",
+			c.BlockSize()*8)
+	}
+	if len(ciph) < 2*kwBlockSize || len(ciph)%kwBlockSize != 0 {
+		return nil, errors.Errorf(
+			"invalid wrapped key length: %d", len(ciph))
+	}
+
+	var aiv []byte
+	var plain []byte
+	if len(ciph) == 2*kwBlockSize {
+		// Only RFC 5649 can produce a single-block ciphertext.
+		out := make([]byte, len(ciph))
+		c.Decrypt(out, ciph)
+		aiv = out[:kwBlockSize]
+		plain = out[kwBlockSize:]
+	} else {
+		aiv, plain = kwUnwrapBlocks(c, ciph)
+	}
+
+	if subtle.ConstantTimeCompare(aiv, kwIv) == 1 {
+		if len(ciph) == 2*kwBlockSize {
+			return nil, errors.Errorf("key unwrap failed: integrity check")
+		}
+		return plain, nil
+	}
+
+	if !bytes.Equal(aiv[:4], kwpAivPrefix) {
+		return nil, errors.Errorf("key unwrap failed: integrity check")
+	}
+
+	mli := int(binary.BigEndian.Uint32(aiv[4:]))
+	if mli > len(plain) || mli <= len(plain)-kwBlockSize {
+		return nil, errors.Errorf(
+			"key unwrap failed: invalid message length indicator: %d", mli)
+	}
+	for _, b := range plain[mli:] {
+		if b != 0 {
+			return nil, errors.Errorf("key unwrap failed: nonzero padding")
+		}
+	}
+
+	return plain[:mli], nil
+}
@@ -0,0 +1,148 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestKeyWrapRfc5649Vectors(t *testing.T) {
+	type vector struct {
+		kek     string
+		key     string
+		wrapped string
+	}
+
+	vectors := []vector{
+		// RFC 5649 section 6, 20-octet key.
+		vector{
+			kek: "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8",
+			key: "c37b7e6492584340bed12207808941155068f738",
+			wrapped: "138bdeaa9b8fa7fc61f97742e72248ee" +
+				"5ae6ae5360d1ae6a5f54f373fa543b6a",
+		},
+		// RFC 5649 section 6, 7-octet key.
+		vector{
+			kek:     "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8",
+			key:     "466f7250617369",
+			wrapped: "afbeb0f07dfbf5419200f2ccb50bb24f",
+		},
+		// RFC 3394 section 4.1; no padding required.
+		vector{
+			kek:     "000102030405060708090a0b0c0d0e0f",
+			key:     "00112233445566778899aabbccddeeff",
+			wrapped: "1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5",
+		},
+	}
+
+	for i, v := range vectors {
+		c, err := aes.NewCipher(mustHex(v.kek))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wrapped, err := WrapKey(c, mustHex(v.key))
+		if err != nil {
+			t.Fatalf("vector %d: wrap failed: %s", i, err.Error())
+		}
+		if !bytes.Equal(wrapped, mustHex(v.wrapped)) {
+			t.Fatalf("vector %d: wrong ciphertext: have=%x want=%s",
+				i, wrapped, v.wrapped)
+		}
+
+		plain, err := UnwrapKey(c, wrapped)
+		if err != nil {
+			t.Fatalf("vector %d: unwrap failed: %s", i, err.Error())
+		}
+		if !bytes.Equal(plain, mustHex(v.key)) {
+			t.Fatalf("vector %d: wrong plaintext: have=%x want=%s",
+				i, plain, v.key)
+		}
+
+		// Corrupt the ciphertext; unwrapping must fail.
+		wrapped[len(wrapped)-1] ^= 0x01
+		if _, err := UnwrapKey(c, wrapped); err == nil {
+			t.Fatalf("vector %d: unwrap of corrupt ciphertext succeeded", i)
+		}
+	}
+}
+
+func TestKeyWrapGcm(t *testing.T) {
+	kek, err := aes.NewCipher(bytes.Repeat([]byte{0x42}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyLen := range []int{16, 24, 32} {
+		key := bytes.Repeat([]byte{0x5a}, keyLen)
+
+		wrapped, err := WrapKeyGcm(kek, key)
+		if err != nil {
+			t.Fatalf("len=%d: wrap failed: %s", keyLen, err.Error())
+		}
+		if len(wrapped) != GcmWrappedSize(keyLen) {
+			t.Fatalf("len=%d: wrong wrapped size: have=%d want=%d",
+				keyLen, len(wrapped), GcmWrappedSize(keyLen))
+		}
+
+		plain, err := UnwrapKeyGcm(kek, wrapped)
+		if err != nil {
+			t.Fatalf("len=%d: unwrap failed: %s", keyLen, err.Error())
+		}
+		if !bytes.Equal(plain, key) {
+			t.Fatalf("len=%d: wrong key: have=%x want=%x", keyLen, plain, key)
+		}
+	}
+
+	wrapped, err := WrapKeyGcm(kek, bytes.Repeat([]byte{0x5a}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated tag.
+	_, err = UnwrapKeyGcm(kek, wrapped[:len(wrapped)-4])
+	if err == nil {
+		t.Fatalf("truncated tag accepted")
+	}
+	if _, ok := errors.Cause(err).(*ErrGcmTag); ok {
+		t.Fatalf("truncated input reported as tag mismatch")
+	}
+
+	// Corrupted tag.
+	bad := append([]byte(nil), wrapped...)
+	bad[len(bad)-1] ^= 0x01
+	_, err = UnwrapKeyGcm(kek, bad)
+	if _, ok := errors.Cause(err).(*ErrGcmTag); !ok {
+		t.Fatalf("corrupted tag: wrong error: %v", err)
+	}
+}
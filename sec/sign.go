@@ -23,11 +23,14 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
+	"math/big"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"golang.org/x/crypto/ed25519"
@@ -44,11 +47,48 @@ type PubSignKey struct {
 	Rsa     *rsa.PublicKey
 	Ec      *ecdsa.PublicKey
 	Ed25519 ed25519.PublicKey
+
+	// Optional; nil means the key is always valid.
+	Validity *KeyValidity
+}
+
+// SignAlgo identifies the signature scheme of a signing key or signature.
+// Its values are the MCUboot image TLV types of the corresponding signatures.
+type SignAlgo uint8
+
+const (
+	SIGN_ALGO_UNKNOWN  SignAlgo = 0
+	SIGN_ALGO_RSA2048  SignAlgo = 0x20
+	SIGN_ALGO_ECDSA224 SignAlgo = 0x21
+	SIGN_ALGO_ECDSA256 SignAlgo = 0x22
+	SIGN_ALGO_RSA3072  SignAlgo = 0x23
+	SIGN_ALGO_ED25519  SignAlgo = 0x24
+)
+
+var signAlgoNameMap = map[SignAlgo]string{
+	SIGN_ALGO_RSA2048:  "RSA2048",
+	SIGN_ALGO_RSA3072:  "RSA3072",
+	SIGN_ALGO_ECDSA224: "ECDSA224",
+	SIGN_ALGO_ECDSA256: "ECDSA256",
+	SIGN_ALGO_ED25519:  "ED25519",
+}
+
+func (t SignAlgo) String() string {
+	name := signAlgoNameMap[t]
+	if name == "" {
+		name = "???"
+	}
+	return name
 }
 
 type Sig struct {
 	KeyHash []byte
 	Data    []byte
+
+	// The scheme that produced the signature, if known.  If set, the
+	// signature is only checked against keys of the same type (e.g., an
+	// RSA3072 signature is never checked against an RSA2048 key).
+	Type SignAlgo
 }
 
 var oidPrivateKeyEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
@@ -97,7 +137,7 @@ func parsePrivSignKeyItf(keyBytes []byte) (interface{}, error) {
 		 */
 		privKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Priv key parsing failed")
+			return nil, errors.WrapSensitive(err, "Priv key parsing failed")
 		}
 	}
 	if block != nil && block.Type == "EC PRIVATE KEY" {
@@ -106,16 +146,7 @@ func parsePrivSignKeyItf(keyBytes []byte) (interface{}, error) {
 		 */
 		privKey, err = x509.ParseECPrivateKey(block.Bytes)
 		if err != nil {
-			return nil, errors.Wrapf(err, "Priv key parsing failed")
-		}
-	}
-	if block != nil && block.Type == "PRIVATE KEY" {
-		// This indicates a PKCS#8 unencrypted private key.
-		// The particular type of key will be indicated within
-		// the key itself.
-		privKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Priv key parsing failed")
+			return nil, errors.WrapSensitive(err, "Priv key parsing failed")
 		}
 	}
 	if block != nil && block.Type == "PRIVATE KEY" {
@@ -127,7 +158,8 @@ func parsePrivSignKeyItf(keyBytes []byte) (interface{}, error) {
 			var _privKey interface{}
 			_privKey, err = ParseEd25519Pkcs8(block.Bytes)
 			if err != nil {
-				return nil, errors.Wrapf(err, "private key parsing failed")
+				return nil, errors.WrapSensitive(err,
+					"private key parsing failed")
 			}
 			privKey = _privKey
 		}
@@ -137,7 +169,7 @@ func parsePrivSignKeyItf(keyBytes []byte) (interface{}, error) {
 		// encryption.
 		privKey, err = parseEncryptedPrivateKey(block.Bytes)
 		if err != nil {
-			return nil, errors.Wrapf(
+			return nil, errors.WrapSensitive(
 				err, "Unable to decode encrypted private key")
 		}
 	}
@@ -158,6 +190,13 @@ func ParsePubSignKey(keyBytes []byte) (PubSignKey, error) {
 		return key, err
 	}
 
+	return pubSignKeyFromItf(itf)
+}
+
+// pubSignKeyFromItf wraps a public key decoded by the x509 package.
+func pubSignKeyFromItf(itf interface{}) (PubSignKey, error) {
+	key := PubSignKey{}
+
 	switch pub := itf.(type) {
 	case *rsa.PublicKey:
 		key.Rsa = pub
@@ -187,6 +226,9 @@ func ParsePrivSignKey(keyBytes []byte) (PrivSignKey, error) {
 		key.Ec = priv
 	case *ed25519.PrivateKey:
 		key.Ed25519 = priv
+	case ed25519.PrivateKey:
+		// Returned by the standard library's PKCS#8 parser.
+		key.Ed25519 = &priv
 	default:
 		return key, errors.Errorf("unknown private key type: %T", itf)
 	}
@@ -194,13 +236,261 @@ func ParsePrivSignKey(keyBytes []byte) (PrivSignKey, error) {
 	return key, nil
 }
 
+// Type indicates the signature scheme of a private signing key, as
+// determined from the decoded key.  It returns SIGN_ALGO_UNKNOWN if the
+// key size or curve is unsupported.
+func (key *PrivSignKey) Type() SignAlgo {
+	pub := key.Public()
+	return pub.Type()
+}
+
+// Type indicates the signature scheme of a public signing key.  It returns
+// SIGN_ALGO_UNKNOWN if the key size or curve is unsupported.
+func (key *PubSignKey) Type() SignAlgo {
+	key.AssertValid()
+
+	if key.Rsa != nil {
+		switch key.Rsa.Size() {
+		case 256:
+			return SIGN_ALGO_RSA2048
+		case 384:
+			return SIGN_ALGO_RSA3072
+		default:
+			return SIGN_ALGO_UNKNOWN
+		}
+	} else if key.Ec != nil {
+		switch key.Ec.Curve.Params().Name {
+		case "P-224":
+			return SIGN_ALGO_ECDSA224
+		case "P-256":
+			return SIGN_ALGO_ECDSA256
+		default:
+			return SIGN_ALGO_UNKNOWN
+		}
+	} else {
+		return SIGN_ALGO_ED25519
+	}
+}
+
+// ECDSASig is the ASN.1 structure of an ECDSA signature.
+type ECDSASig struct {
+	R *big.Int
+	S *big.Int
+}
+
+// digestMessage applies the specified hash function to a message.
+func digestMessage(data []byte, hash crypto.Hash) ([]byte, error) {
+	if !hash.Available() {
+		return nil, errors.Errorf("hash function unavailable: %d", hash)
+	}
+
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// EcdsaSigEncoding specifies how an ECDSA (r, s) pair is serialized.
+type EcdsaSigEncoding int
+
+const (
+	// ASN.1 DER-encoded SEQUENCE of two INTEGERs.
+	ECDSA_SIG_ENC_DER EcdsaSigEncoding = iota
+
+	// Fixed-width big-endian r followed by s, each the size of the curve
+	// order.
+	ECDSA_SIG_ENC_RAW
+)
+
+// EcdsaSignOpts controls how ECDSA signatures are produced.
+type EcdsaSignOpts struct {
+	Encoding EcdsaSigEncoding
+
+	// If true, signatures are normalized to "low-S" form: an s greater than
+	// half the curve order is replaced with its negation modulo the order.
+	// Both forms verify, but some strict verifiers only accept low-S.
+	LowS bool
+}
+
+// SigVerifyOpts controls how signatures are verified.
+type SigVerifyOpts struct {
+	// If true, an ECDSA signature whose s is greater than half the curve
+	// order ("high-S") is rejected even if it is otherwise valid.
+	RejectHighS bool
+}
+
+// ecdsaIsLowS indicates whether an ECDSA signature's s value is at most half
+// the curve order.
+func ecdsaIsLowS(curve elliptic.Curve, s *big.Int) bool {
+	halfN := new(big.Int).Rsh(curve.Params().N, 1)
+	return s.Cmp(halfN) <= 0
+}
+
+// ecdsaLowS returns the low-S form of an ECDSA signature's s value.  The
+// signatures (r, s) and (r, n-s) are equally valid.
+func ecdsaLowS(curve elliptic.Curve, s *big.Int) *big.Int {
+	if ecdsaIsLowS(curve, s) {
+		return s
+	}
+	return new(big.Int).Sub(curve.Params().N, s)
+}
+
+// ecdsaCoordLen returns the length, in bytes, of each half of a raw ECDSA
+// signature on the given curve.
+func ecdsaCoordLen(curve elliptic.Curve) int {
+	return (curve.Params().N.BitLen() + 7) / 8
+}
+
+// encodeEcdsaSigRaw serializes an ECDSA signature as fixed-width r||s.
+func encodeEcdsaSigRaw(curve elliptic.Curve, r *big.Int, s *big.Int) []byte {
+	n := ecdsaCoordLen(curve)
+	sig := make([]byte, 2*n)
+	rb := r.Bytes()
+	sb := s.Bytes()
+	copy(sig[n-len(rb):n], rb)
+	copy(sig[2*n-len(sb):], sb)
+	return sig
+}
+
+// decodeEcdsaSig parses an ECDSA signature in either encoding.  A signature
+// starting with a DER SEQUENCE tag (0x30) is parsed as DER, with any trailing
+// zero padding ignored; if that fails and the signature has the length of a
+// raw signature on the given curve, it is parsed as raw r||s.
+func decodeEcdsaSig(curve elliptic.Curve, sig []byte) (ECDSASig, error) {
+	var es ECDSASig
+
+	var derErr error
+	if len(sig) > 0 && sig[0] == 0x30 {
+		rest, err := asn1.Unmarshal(sig, &es)
+		if err == nil {
+			for _, b := range rest {
+				if b != 0 {
+					err = errors.Errorf("trailing data")
+					break
+				}
+			}
+		}
+		if err == nil && es.R != nil && es.S != nil {
+			return es, nil
+		}
+		derErr = err
+	}
+
+	n := ecdsaCoordLen(curve)
+	if len(sig) == 2*n {
+		return ECDSASig{
+			R: new(big.Int).SetBytes(sig[:n]),
+			S: new(big.Int).SetBytes(sig[n:]),
+		}, nil
+	}
+
+	if derErr != nil {
+		return es, errors.Wrapf(derErr, "invalid ECDSA signature")
+	}
+	return es, errors.Errorf(
+		"invalid ECDSA signature: neither DER nor %d-byte raw", 2*n)
+}
+
+// DecodeEcdsaSig parses an ECDSA signature on the given curve, in either DER
+// or raw r||s encoding, into its (r, s) pair.
+func DecodeEcdsaSig(curve elliptic.Curve, sig []byte) (ECDSASig, error) {
+	return decodeEcdsaSig(curve, sig)
+}
+
+// SignDigest signs a precomputed message digest produced by the specified
+// hash function.  The signature scheme depends on the key type:
+//   - RSA: RSASSA-PSS with a salt length equal to the digest length.
+//   - ECDSA: ASN.1 DER-encoded (r, s) pair.
+//   - Ed25519: pure Ed25519 over the digest bytes.
+func (key *PrivSignKey) SignDigest(digest []byte,
+	hash crypto.Hash) ([]byte, error) {
+
+	return key.SignDigestEnc(digest, hash, ECDSA_SIG_ENC_DER)
+}
+
+// SignDigestEnc is like SignDigest, but ECDSA signatures are serialized with
+// the specified encoding.  The encoding is ignored for other key types.
+func (key *PrivSignKey) SignDigestEnc(digest []byte, hash crypto.Hash,
+	enc EcdsaSigEncoding) ([]byte, error) {
+
+	return key.SignDigestOpts(digest, hash, EcdsaSignOpts{Encoding: enc})
+}
+
+// SignDigestOpts is like SignDigest, but ECDSA signatures are produced
+// according to the specified options.  The options are ignored for other key
+// types.
+func (key *PrivSignKey) SignDigestOpts(digest []byte, hash crypto.Hash,
+	opts EcdsaSignOpts) ([]byte, error) {
+
+	key.AssertValid()
+
+	if key.Rsa != nil {
+		opts := rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+		}
+		sig, err := rsa.SignPSS(rand.Reader, key.Rsa, hash, digest, &opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compute signature")
+		}
+		return sig, nil
+	} else if key.Ec != nil {
+		r, s, err := ecdsa.Sign(rand.Reader, key.Ec, digest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compute signature")
+		}
+
+		if opts.LowS {
+			s = ecdsaLowS(key.Ec.Curve, s)
+		}
+
+		enc := opts.Encoding
+		switch enc {
+		case ECDSA_SIG_ENC_DER:
+		case ECDSA_SIG_ENC_RAW:
+			return encodeEcdsaSigRaw(key.Ec.Curve, r, s), nil
+		default:
+			return nil, errors.Errorf("invalid ECDSA signature encoding: %d",
+				enc)
+		}
+
+		sig, err := asn1.Marshal(ECDSASig{R: r, S: s})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to construct signature")
+		}
+		return sig, nil
+	} else {
+		sig := ed25519.Sign(*key.Ed25519, digest)
+		if len(sig) != ed25519.SignatureSize {
+			return nil, errors.Errorf(
+				"ed25519 signature has wrong length: have=%d want=%d",
+				len(sig), ed25519.SignatureSize)
+		}
+		return sig, nil
+	}
+}
+
+// SignMessage hashes an arbitrary message with the specified hash function
+// and signs the resulting digest (see SignDigest).
+func (key *PrivSignKey) SignMessage(data []byte,
+	hash crypto.Hash) ([]byte, error) {
+
+	digest, err := digestMessage(data, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.SignDigest(digest, hash)
+}
+
 func (key *PrivSignKey) AssertValid() {
 	if key.Rsa == nil && key.Ec == nil && key.Ed25519 == nil {
 		panic("invalid key; neither RSA nor ECC nor ED25519")
 	}
 }
 
-func (key *PrivSignKey) PubKey() PubSignKey {
+// Public derives the public key corresponding to a private signing key.  The
+// result can be used to verify signatures produced by the private key (e.g.,
+// with Image.Verify) or serialized with PubSignKey.Bytes.
+func (key *PrivSignKey) Public() PubSignKey {
 	key.AssertValid()
 
 	if key.Rsa != nil {
@@ -213,8 +503,13 @@ func (key *PrivSignKey) PubKey() PubSignKey {
 	}
 }
 
+// PubKey is equivalent to Public.
+func (key *PrivSignKey) PubKey() PubSignKey {
+	return key.Public()
+}
+
 func (key *PrivSignKey) PubBytes() ([]byte, error) {
-	pk := key.PubKey()
+	pk := key.Public()
 	return pk.Bytes()
 }
 
@@ -238,6 +533,17 @@ func (key *PrivSignKey) SigLen() uint16 {
 	}
 }
 
+// SigLenOpts returns the length of the signatures the key produces with the
+// given ECDSA options.  DER-encoded ECDSA signatures are reported at their
+// padded image length (see SigLen).
+func (key *PrivSignKey) SigLenOpts(opts EcdsaSignOpts) uint16 {
+	if key.Ec != nil && opts.Encoding == ECDSA_SIG_ENC_RAW {
+		return uint16(2 * ecdsaCoordLen(key.Ec.Curve))
+	}
+
+	return key.SigLen()
+}
+
 func (key *PubSignKey) AssertValid() {
 	if key.Rsa == nil && key.Ec == nil && key.Ed25519 == nil {
 		panic("invalid public key; neither RSA nor ECC nor ED25519")
@@ -311,40 +617,116 @@ func (key *PubSignKey) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-func checkOneKeyOneSig(k PubSignKey, sig Sig, hash []byte) (bool, error) {
-	pubBytes, err := k.Bytes()
+// VerifyDigest checks a signature over a precomputed message digest produced
+// by the specified hash function.  It is the inverse of
+// PrivSignKey.SignDigest.  ECDSA signatures are accepted in either DER or raw
+// r||s encoding; trailing zero padding following a DER signature is ignored.
+// An error is returned if the signature is invalid.
+func (key *PubSignKey) VerifyDigest(digest []byte, hash crypto.Hash,
+	sig []byte) error {
+
+	return key.VerifyDigestOpts(digest, hash, sig, SigVerifyOpts{})
+}
+
+// VerifyDigestOpts is like VerifyDigest, but verification is controlled by
+// the specified options.
+func (key *PubSignKey) VerifyDigestOpts(digest []byte, hash crypto.Hash,
+	sig []byte, opts SigVerifyOpts) error {
+
+	key.AssertValid()
+
+	if key.Rsa != nil {
+		opts := rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+		}
+		if err := rsa.VerifyPSS(key.Rsa, hash, digest, sig, &opts); err != nil {
+			return errors.Wrapf(err, "invalid RSA signature")
+		}
+		return nil
+	} else if key.Ec != nil {
+		es, err := decodeEcdsaSig(key.Ec.Curve, sig)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(key.Ec, digest, es.R, es.S) {
+			return errors.Errorf("invalid ECDSA signature")
+		}
+		if opts.RejectHighS && !ecdsaIsLowS(key.Ec.Curve, es.S) {
+			return errors.Errorf("ECDSA signature not in low-S form")
+		}
+		return nil
+	} else {
+		if !ed25519.Verify(key.Ed25519, digest, sig) {
+			return errors.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+	}
+}
+
+// VerifyMessage checks a signature produced by PrivSignKey.SignMessage.  An
+// error is returned if the signature is invalid.
+func (key *PubSignKey) VerifyMessage(data []byte, hash crypto.Hash,
+	sig []byte) error {
+
+	digest, err := digestMessage(data, hash)
 	if err != nil {
-		return false, errors.WithStack(err)
+		return err
 	}
-	keyHash := RawKeyHash(pubBytes)
 
-	if !bytes.Equal(keyHash, sig.KeyHash) {
+	return key.VerifyDigest(digest, hash, sig)
+}
+
+// IdentifiesKey indicates whether a signature's metadata (its type and
+// keyhash) identify the specified key as the signer.  A signature without a
+// keyhash identifies every key of the right type.  The signature itself is
+// not checked.
+func (sig *Sig) IdentifiesKey(k PubSignKey) (bool, error) {
+	if sig.Type != SIGN_ALGO_UNKNOWN && sig.Type != k.Type() {
 		return false, nil
 	}
 
-	if k.Rsa != nil {
-		opts := rsa.PSSOptions{
-			SaltLength: rsa.PSSSaltLengthEqualsHash,
+	if sig.KeyHash != nil {
+		pubBytes, err := k.Bytes()
+		if err != nil {
+			return false, errors.WithStack(err)
 		}
-		err := rsa.VerifyPSS(k.Rsa, crypto.SHA256, hash, sig.Data, &opts)
-		return err == nil, nil
-	}
+		keyHash := RawKeyHash(pubBytes)
 
-	if k.Ec != nil {
-		return false, errors.Errorf(
-			"ecdsa signature verification not supported")
+		if !bytes.Equal(keyHash, sig.KeyHash) {
+			return false, nil
+		}
 	}
 
-	if k.Ed25519 != nil {
-		return ed25519.Verify(k.Ed25519, hash, sig.Data), nil
+	return true, nil
+}
+
+// checkOneKeyOneSig determines whether a signature was produced by a key.  If
+// the signature has a keyhash, the signature is only checked if the keyhash
+// matches the key.  A signature without a keyhash is checked directly.  A
+// signature of a known type is only checked against keys of that type.
+func checkOneKeyOneSig(k PubSignKey, sig Sig, hash []byte,
+	opts SigVerifyOpts) (bool, error) {
+
+	ok, err := sig.IdentifiesKey(k)
+	if err != nil || !ok {
+		return false, err
 	}
 
-	return false, nil
+	err = k.VerifyDigestOpts(hash, crypto.SHA256, sig.Data, opts)
+	return err == nil, nil
 }
 
 func VerifySigs(key PubSignKey, sigs []Sig, hash []byte) (int, error) {
+	return VerifySigsOpts(key, sigs, hash, SigVerifyOpts{})
+}
+
+// VerifySigsOpts is like VerifySigs, but verification is controlled by the
+// specified options.
+func VerifySigsOpts(key PubSignKey, sigs []Sig, hash []byte,
+	opts SigVerifyOpts) (int, error) {
+
 	for i, s := range sigs {
-		match, err := checkOneKeyOneSig(key, s, hash)
+		match, err := checkOneKeyOneSig(key, s, hash, opts)
 		if err != nil {
 			return -1, err
 		}
@@ -0,0 +1,328 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+func genTestKeys(t *testing.T) []PrivSignKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []PrivSignKey{
+		PrivSignKey{Rsa: rsaKey},
+		PrivSignKey{Ec: ecKey},
+		PrivSignKey{Ed25519: &edKey},
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	keys := genTestKeys(t)
+
+	msg := []byte("provisioning record")
+	for _, key := range keys {
+		sig, err := key.SignMessage(msg, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub := key.PubKey()
+		if err := pub.VerifyMessage(msg, crypto.SHA256, sig); err != nil {
+			t.Fatalf("%s: %s", key.Type(), err.Error())
+		}
+
+		if err := pub.VerifyMessage([]byte("tampered"), crypto.SHA256,
+			sig); err == nil {
+
+			t.Fatalf("%s: tampered message verified", key.Type())
+		}
+	}
+}
+
+func TestPublic(t *testing.T) {
+	for _, key := range genTestKeys(t) {
+		pub := key.Public()
+
+		switch {
+		case key.Rsa != nil:
+			if pub.Rsa == nil || pub.Rsa.N.Cmp(key.Rsa.N) != 0 {
+				t.Fatalf("%s: wrong public key", key.Type())
+			}
+		case key.Ec != nil:
+			if pub.Ec == nil || pub.Ec.X.Cmp(key.Ec.X) != 0 ||
+				pub.Ec.Y.Cmp(key.Ec.Y) != 0 {
+
+				t.Fatalf("%s: wrong public key", key.Type())
+			}
+		default:
+			want := key.Ed25519.Public().(ed25519.PublicKey)
+			if !bytes.Equal(pub.Ed25519, want) {
+				t.Fatalf("%s: wrong public key", key.Type())
+			}
+		}
+
+		if _, err := pub.Bytes(); err != nil {
+			t.Fatalf("%s: %s", key.Type(), err.Error())
+		}
+	}
+}
+
+func TestPubSignKeyFromCert(t *testing.T) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "release-signer"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(1<<31, 0),
+	}
+
+	for _, key := range genTestKeys(t) {
+		var priv, pub interface{}
+		switch {
+		case key.Rsa != nil:
+			priv, pub = key.Rsa, &key.Rsa.PublicKey
+		case key.Ec != nil:
+			priv, pub = key.Ec, &key.Ec.PublicKey
+		default:
+			priv, pub = *key.Ed25519, key.Ed25519.Public()
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPem := pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: der,
+		})
+
+		certKey, err := PubSignKeyFromCert(certPem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certKey.Type() != key.Type() {
+			t.Fatalf("wrong key type from cert: have=%s want=%s",
+				certKey.Type(), key.Type())
+		}
+		if certKey.Validity == nil ||
+			!certKey.Validity.NotAfter.Equal(tmpl.NotAfter) ||
+			!certKey.Validity.ValidAt(time.Unix(1<<30, 0)) ||
+			certKey.Validity.ValidAt(time.Unix(1<<32, 0)) {
+
+			t.Fatalf("wrong validity from cert: %+v", certKey.Validity)
+		}
+
+		msg := []byte("signed by cert")
+		sig, err := key.SignMessage(msg, crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := certKey.VerifyMessage(msg, crypto.SHA256, sig); err != nil {
+			t.Fatalf("cert key failed to verify: %s", err.Error())
+		}
+
+		subject, err := CertSubject(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject != "CN=release-signer" {
+			t.Fatalf("wrong subject: %s", subject)
+		}
+	}
+
+	if _, err := PubSignKeyFromCert([]byte("not a cert")); err == nil {
+		t.Fatalf("garbage accepted as certificate")
+	}
+}
+
+func TestEcdsaLowS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := PrivSignKey{Ec: ecKey}
+	pub := key.PubKey()
+	n := elliptic.P256().Params().N
+
+	digest, err := digestMessage([]byte("low-S test"), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := EcdsaSignOpts{Encoding: ECDSA_SIG_ENC_RAW, LowS: true}
+	strict := SigVerifyOpts{RejectHighS: true}
+
+	// ecdsa.Sign produces a high-S signature about half the time; sign
+	// repeatedly so that normalization is exercised.
+	for i := 0; i < 16; i++ {
+		low, err := key.SignDigestOpts(digest, crypto.SHA256, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := new(big.Int).SetBytes(low[32:])
+		if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			t.Fatalf("signature not normalized to low-S")
+		}
+
+		// The same signature with s negated is equally valid.
+		high := append([]byte(nil), low...)
+		hs := new(big.Int).Sub(n, s).Bytes()
+		copy(high[32:], make([]byte, 32))
+		copy(high[64-len(hs):], hs)
+
+		for _, sig := range [][]byte{low, high} {
+			if err := pub.VerifyDigest(digest, crypto.SHA256, sig); err != nil {
+				t.Fatalf("valid signature rejected: %s", err.Error())
+			}
+		}
+		err = pub.VerifyDigestOpts(digest, crypto.SHA256, low, strict)
+		if err != nil {
+			t.Fatalf("low-S signature rejected in strict mode: %s",
+				err.Error())
+		}
+		err = pub.VerifyDigestOpts(digest, crypto.SHA256, high, strict)
+		if err == nil {
+			t.Fatalf("high-S signature accepted in strict mode")
+		}
+	}
+}
+
+// A fixed P-256 public key and a signature of "low-S test vector" in both its
+// low-S and high-S forms (raw r||s encoding).
+const (
+	ecdsaVecX = "" +
+		"c4a78f80bfa7c892e01fbab67c6e699e4f62c513310c2c984cdb411add3050bd"
+	ecdsaVecY = "" +
+		"ccb1c80e091d2cd2f21e826b2d93b542036e4ce32e30239cdf624fbe93ed234e"
+	ecdsaVecR = "" +
+		"381f5e0071d0b0412e334e4dddd8214a8d90ccd6a358d0d8bc879351ff0d266d"
+	ecdsaVecLowS = "" +
+		"60727b02e862dc8a9df63d91581d5d5903d7b76caa6b1d1b4a198ae8b15219d0"
+	ecdsaVecHighS = "" +
+		"9f8d84fc179d23766209c26ea7e2a2a6b90f4340fcac8169a9a03fda4b110b81"
+)
+
+func TestEcdsaLowSVectors(t *testing.T) {
+	unhex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	pub := PubSignKey{Ec: &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(unhex(ecdsaVecX)),
+		Y:     new(big.Int).SetBytes(unhex(ecdsaVecY)),
+	}}
+
+	digest, err := digestMessage([]byte("low-S test vector"), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low := append(unhex(ecdsaVecR), unhex(ecdsaVecLowS)...)
+	high := append(unhex(ecdsaVecR), unhex(ecdsaVecHighS)...)
+	strict := SigVerifyOpts{RejectHighS: true}
+
+	for _, sig := range [][]byte{low, high} {
+		if err := pub.VerifyDigest(digest, crypto.SHA256, sig); err != nil {
+			t.Fatalf("valid signature rejected: %s", err.Error())
+		}
+	}
+	if err := pub.VerifyDigestOpts(digest, crypto.SHA256, low,
+		strict); err != nil {
+
+		t.Fatalf("low-S signature rejected in strict mode: %s", err.Error())
+	}
+	if err := pub.VerifyDigestOpts(digest, crypto.SHA256, high,
+		strict); err == nil {
+
+		t.Fatalf("high-S signature accepted in strict mode")
+	}
+
+	// Normalizing the high-S form yields the low-S form.
+	highS := new(big.Int).SetBytes(unhex(ecdsaVecHighS))
+	s := ecdsaLowS(elliptic.P256(), highS)
+	if have := hex.EncodeToString(s.Bytes()); have != ecdsaVecLowS {
+		t.Fatalf("wrong normalized s: have=%s want=%s", have, ecdsaVecLowS)
+	}
+
+	bad := append([]byte(nil), low...)
+	bad[0] ^= 0x01
+	if err := pub.VerifyDigest(digest, crypto.SHA256, bad); err == nil {
+		t.Fatalf("corrupted signature accepted")
+	}
+}
+
+func TestPrivKeyParseErrorRedacted(t *testing.T) {
+	// Truncated key material: the parser's error must not be reported.
+	for _, typ := range []string{
+		"RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY",
+	} {
+		data := pem.EncodeToMemory(&pem.Block{
+			Type:  typ,
+			Bytes: []byte{0x30, 0x82, 0x01, 0x0a, 0x02, 0x01},
+		})
+
+		_, signErr := ParsePrivSignKey(data)
+		_, encErr := ParsePrivEncKey(data)
+		for _, err := range []error{signErr, encErr} {
+			if err == nil {
+				t.Fatalf("%s: invalid key accepted", typ)
+			}
+			if !strings.HasSuffix(err.Error(), "<redacted>") {
+				t.Errorf("%s: error not redacted: %v", typ, err)
+			}
+			if !strings.HasSuffix(errors.Cause(err).Error(), "<redacted>") {
+				t.Errorf("%s: cause not redacted: %v", typ,
+					errors.Cause(err))
+			}
+		}
+	}
+}